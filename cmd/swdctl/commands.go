@@ -0,0 +1,965 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/flm"
+	"github.com/holoplot/go-swd/pkg/image"
+	"github.com/holoplot/go-swd/pkg/rtt"
+	"github.com/holoplot/go-swd/pkg/stm32"
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+const (
+	defaultReadLength = 64
+	dumpChunkSize     = 4096
+	eraseTimeout      = time.Minute
+
+	apIDRClassShift = 13
+	apIDRClassMask  = 0xf
+	apIDRTypeMask   = 0xf
+	apClassMemAP    = 0x8
+	maxAccessPorts  = 256
+)
+
+func parseUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+
+	return uint32(v), nil
+}
+
+// parseArgs parses the command flags and checks the number of positional arguments.
+// A negative max allows any number of arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		return &usageError{fs: fs}
+	}
+
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		return &usageError{fs: fs}
+	}
+
+	return nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	// Usage is printed by main
+	fs.Usage = func() {}
+
+	return fs
+}
+
+func hexDump(w io.Writer, addr uint32, data []byte) {
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+
+		ascii := make([]byte, len(line))
+
+		for j, b := range line {
+			ascii[j] = '.'
+
+			if b >= 0x20 && b < 0x7f {
+				ascii[j] = b
+			}
+		}
+
+		fmt.Fprintf(w, "%08x  %-47s  |%s|\n", addr+uint32(i), fmt.Sprintf("% x", line), ascii)
+	}
+}
+
+func runProbe(cfg *Config, args []string) error {
+	if err := parseArgs(newFlagSet("probe"), args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	fmt.Printf("IDCODE: 0x%08x (designer 0x%03x, part 0x%02x, version %d, revision %d)\n",
+		t.idCode, (t.idCode>>1)&0x7ff, (t.idCode>>20)&0xff, (t.idCode>>12)&0xf, t.idCode>>28)
+
+	for ap := 0; ap < maxAccessPorts; ap++ {
+		idr, err := t.swd.ReadAP(uint8(ap), swd.APRegIDR)
+		if err != nil {
+			return fmt.Errorf("read IDR of AP%d: %w", ap, err)
+		}
+
+		if idr == 0 {
+			break
+		}
+
+		desc := fmt.Sprintf("AP%d: IDR 0x%08x", ap, idr)
+
+		if (idr>>apIDRClassShift)&apIDRClassMask == apClassMemAP {
+			base, err := t.swd.ReadAP(uint8(ap), swd.APRegBase)
+			if err != nil {
+				return fmt.Errorf("read BASE of AP%d: %w", ap, err)
+			}
+
+			desc += fmt.Sprintf(", MEM-AP type %d, BASE 0x%08x", idr&apIDRTypeMask, base)
+		}
+
+		fmt.Println(desc)
+	}
+
+	id, err := scb.New(t.swd).Identify()
+	if err != nil {
+		return fmt.Errorf("identify core: %w", err)
+	}
+
+	fmt.Printf("Core: %s\n", id)
+
+	info, err := stm32.New(t.swd).Info()
+	if errors.Is(err, stm32.ErrUnknownDevice) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("identify device: %w", err)
+	}
+
+	fmt.Printf("Device: %s\n", info.Device)
+	fmt.Printf("Flash: %d KB\n", info.FlashSize/1024)
+	fmt.Printf("UID: %s\n", info.UIDString())
+
+	if info.HasPackage {
+		fmt.Printf("Package: 0x%02x\n", info.Package)
+	}
+
+	return nil
+}
+
+func runRead(cfg *Config, args []string) error {
+	fs := newFlagSet("read")
+
+	if err := parseArgs(fs, args, 1, 2); err != nil {
+		return err
+	}
+
+	addr, err := parseUint32(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	length := uint32(defaultReadLength)
+
+	if fs.NArg() > 1 {
+		if length, err = parseUint32(fs.Arg(1)); err != nil {
+			return err
+		}
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	buf := make([]byte, length)
+
+	if err := t.swd.ReadMemory(addr, buf); err != nil {
+		return err
+	}
+
+	hexDump(os.Stdout, addr, buf)
+
+	return nil
+}
+
+func runWrite(cfg *Config, args []string) error {
+	fs := newFlagSet("write")
+
+	if err := parseArgs(fs, args, 2, -1); err != nil {
+		return err
+	}
+
+	addr, err := parseUint32(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	words := make([]uint32, fs.NArg()-1)
+
+	for i := range words {
+		if words[i], err = parseUint32(fs.Arg(i + 1)); err != nil {
+			return err
+		}
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	return t.swd.WriteBlock(addr, words)
+}
+
+func runDump(cfg *Config, args []string) error {
+	fs := newFlagSet("dump")
+
+	if err := parseArgs(fs, args, 3, 3); err != nil {
+		return err
+	}
+
+	addr, err := parseUint32(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	length, err := parseUint32(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	f, err := os.Create(fs.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, dumpChunkSize)
+
+	for offset := uint32(0); offset < length; offset += dumpChunkSize {
+		n := length - offset
+		if n > dumpChunkSize {
+			n = dumpChunkSize
+		}
+
+		if err := t.swd.ReadMemory(addr+offset, buf[:n]); err != nil {
+			f.Close()
+
+			return fmt.Errorf("read 0x%08x: %w", addr+offset, err)
+		}
+
+		if _, err := f.Write(buf[:n]); err != nil {
+			f.Close()
+
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+func runErase(cfg *Config, args []string) error {
+	fs := newFlagSet("erase")
+	bankFlag := fs.Int("bank", 0, "mass erase a single bank, counted from 1")
+
+	if err := parseArgs(fs, args, 0, 2); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 1 || (*bankFlag != 0 && fs.NArg() != 0) {
+		return &usageError{fs: fs}
+	}
+
+	var offset, size uint32
+
+	if fs.NArg() == 2 {
+		var err error
+
+		if offset, err = parseUint32(fs.Arg(0)); err != nil {
+			return err
+		}
+
+		if size, err = parseUint32(fs.Arg(1)); err != nil {
+			return err
+		}
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	stm := stm32.New(t.swd)
+
+	if err := stm.Halt(); err != nil {
+		return fmt.Errorf("halt: %w", err)
+	}
+
+	if err := stm.Flash().Initialize(); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 2 {
+		return stm.Flash().EraseRange(offset, size)
+	}
+
+	if *bankFlag != 0 {
+		return stm.Flash().EraseBank(*bankFlag-1, eraseTimeout)
+	}
+
+	return stm.Flash().EraseAll(eraseTimeout)
+}
+
+// loadImage reads a firmware file. Raw binaries are placed at addr, all other
+// formats carry their own load addresses.
+func loadImage(path string, addr uint32) (*image.Image, error) {
+	if strings.ToLower(filepath.Ext(path)) != ".bin" {
+		return image.Load(path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return image.FromBinary(addr, content), nil
+}
+
+func runFlash(cfg *Config, args []string) error {
+	fs := newFlagSet("flash")
+	offsetFlag := fs.String("offset", "0", "offset into flash memory for .bin files")
+	verifyFlag := fs.Bool("verify", true, "read back and compare after programming")
+	resetFlag := fs.Bool("reset", true, "reset and run the target after programming")
+	loaderFlag := fs.String("loader", "0", "RAM size for the flash loader, 0 to program without it")
+	ramFlag := fs.String("ram", "0x20000000", "start of RAM used by the flash loader")
+	fastFlag := fs.Bool("fast", false, "use fast row programming on erased G0/G4/L4/WB parts")
+	updateFlag := fs.Bool("update", false, "only erase and program pages that differ from the image")
+	crcFlag := fs.Bool("crc", false, "verify with the CRC unit of the device instead of reading back")
+	algoFlag := fs.String("algo", "", "program through a CMSIS-Pack flash algorithm (.FLM)")
+	algoRAMFlag := fs.String("algo-ram", "0x4000", "RAM size for the flash algorithm")
+
+	if err := parseArgs(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	offset, err := parseUint32(*offsetFlag)
+	if err != nil {
+		return err
+	}
+
+	loaderSize, err := parseUint32(*loaderFlag)
+	if err != nil {
+		return err
+	}
+
+	ram, err := parseUint32(*ramFlag)
+	if err != nil {
+		return err
+	}
+
+	algoRAM, err := parseUint32(*algoRAMFlag)
+	if err != nil {
+		return err
+	}
+
+	var algo *flm.Algorithm
+
+	base := stm32.FlashBaseAddr
+
+	if *algoFlag != "" {
+		if algo, err = flm.Open(*algoFlag); err != nil {
+			return fmt.Errorf("load flash algorithm: %w", err)
+		}
+
+		base = algo.Device.Address
+	}
+
+	img, err := loadImage(fs.Arg(0), base+offset)
+	if err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	stm := stm32.New(t.swd)
+
+	var flash stm32.FlashDriver = stm.Flash()
+
+	if algo != nil {
+		fmt.Printf("Algorithm: %s\n", algo.Device.Name)
+		flash = flm.New(t.swd, algo, ram, algoRAM)
+	} else {
+		stm.Flash().SetLoaderRAM(ram, loaderSize)
+		stm.Flash().SetFastProgramming(*fastFlag)
+
+		if *crcFlag {
+			stm.Flash().SetVerifyMode(stm32.VerifyCRC)
+		}
+	}
+
+	if err := stm.Halt(); err != nil {
+		return fmt.Errorf("halt: %w", err)
+	}
+
+	if err := flash.Initialize(); err != nil {
+		return err
+	}
+
+	for _, seg := range img.Segments {
+		fmt.Printf("Segment %s\n", seg)
+	}
+
+	fmt.Printf("Writing flash (%d bytes)...\n", img.Size())
+
+	flash.SetProgressFunc(printProgress)
+
+	var summary stm32.Summary
+
+	if *updateFlag && algo == nil {
+		summary, err = stm.Flash().UpdateImage(img)
+	} else {
+		summary, err = flash.WriteImage(img)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if *verifyFlag {
+		verified, err := flash.VerifyImage(img)
+		if err != nil {
+			return err
+		}
+
+		summary.Verified = verified.Verified
+		summary.VerifyTime = verified.VerifyTime
+		summary.Retries += verified.Retries
+	}
+
+	fmt.Printf("Done: %s\n", summary)
+
+	if *resetFlag {
+		fmt.Println("Resetting...")
+
+		if err := stm.RunAfterReset(); err != nil {
+			return err
+		}
+
+		return stm.Reset()
+	}
+
+	return nil
+}
+
+func runOptions(cfg *Config, args []string) error {
+	if err := parseArgs(newFlagSet("options"), args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	ob, err := stm32.New(t.swd).Flash().ReadOptionBytes()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("OPTR: 0x%08x\n", ob.OPTR)
+	fmt.Printf("RDP: %s\n", ob.RDP)
+	fmt.Printf("BOR level: %d\n", ob.BORLevel)
+	fmt.Printf("nRST_STOP: %t, nRST_STDBY: %t, IWDG_SW: %t\n", ob.NRstStop, ob.NRstStdby, ob.IWDGSW)
+	fmt.Printf("nBOOT0: %t, nBOOT1: %t, nSWBOOT0: %t\n", ob.NBoot0, ob.NBoot1, ob.NSWBoot0)
+	fmt.Printf("dual bank: %t, bank swap: %t\n", ob.DualBank, ob.BankSwap)
+
+	for _, area := range ob.WRP {
+		fmt.Printf("WRP %s\n", area)
+	}
+
+	for _, area := range ob.PCROP {
+		fmt.Printf("PCROP bank %d: 0x%x-0x%x\n", area.Bank+1, area.Start, area.End)
+	}
+
+	fmt.Printf("PCROP_RDP: %t\n", ob.PCROPRDP)
+
+	return nil
+}
+
+func runDBGMCU(cfg *Config, args []string) error {
+	if err := parseArgs(newFlagSet("dbgmcu"), args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	dc, err := stm32.New(t.swd).DebugConfig()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("DBG_SLEEP: %t, DBG_STOP: %t, DBG_STANDBY: %t\n", dc.Sleep, dc.Stop, dc.Standby)
+	fmt.Printf("freeze IWDG: %t, WWDG: %t, timers: %t\n", dc.FreezeIWDG, dc.FreezeWWDG, dc.FreezeTimers)
+
+	return nil
+}
+
+func runECC(cfg *Config, args []string) error {
+	fs := newFlagSet("ecc")
+	clearFlag := fs.Bool("clear", false, "clear the latched errors")
+
+	if err := parseArgs(fs, args, 0, 2); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 1 {
+		return &usageError{fs: fs}
+	}
+
+	var offset, size uint32
+
+	if fs.NArg() == 2 {
+		var err error
+
+		if offset, err = parseUint32(fs.Arg(0)); err != nil {
+			return err
+		}
+
+		if size, err = parseUint32(fs.Arg(1)); err != nil {
+			return err
+		}
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	flash := stm32.New(t.swd).Flash()
+
+	var events []stm32.ECCEvent
+
+	if fs.NArg() == 2 {
+		flash.SetProgressFunc(printProgress)
+		events, err = flash.ScanECC(offset, size)
+	} else {
+		events, err = flash.ECCEvents()
+	}
+
+	for _, ev := range events {
+		fmt.Println(ev)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		fmt.Println("no ECC errors")
+	}
+
+	if *clearFlag {
+		return flash.ClearECC()
+	}
+
+	return nil
+}
+
+func runOTP(cfg *Config, args []string) error {
+	fs := newFlagSet("otp")
+	dryRunFlag := fs.Bool("dry-run", false, "only show what would be programmed")
+	lockFlag := fs.Int("lock", -1, "lock an OTP block, which can not be undone")
+
+	if err := parseArgs(fs, args, 0, 2); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 1 || (*lockFlag >= 0 && fs.NArg() != 0) {
+		return &usageError{fs: fs}
+	}
+
+	var offset uint32
+	var data []byte
+
+	if fs.NArg() == 2 {
+		var err error
+
+		if offset, err = parseUint32(fs.Arg(0)); err != nil {
+			return err
+		}
+
+		if data, err = os.ReadFile(fs.Arg(1)); err != nil {
+			return err
+		}
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	flash := stm32.New(t.swd).Flash()
+
+	switch {
+	case *lockFlag >= 0:
+		return flash.LockOTP(*lockFlag)
+
+	case data != nil:
+		writes, err := flash.ProgramOTP(offset, data, *dryRunFlag)
+
+		for _, w := range writes {
+			fmt.Println(w)
+		}
+
+		return err
+	}
+
+	size, blocks, err := flash.OTPSize()
+	if err != nil {
+		return err
+	}
+
+	content, err := flash.ReadOTP(0, size)
+	if err != nil {
+		return err
+	}
+
+	hexDump(os.Stdout, 0, content)
+
+	if blocks > 0 {
+		locked, err := flash.OTPLocked()
+		if err != nil {
+			return err
+		}
+
+		for i, l := range locked {
+			if l {
+				fmt.Printf("block %d locked\n", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+func runSwap(cfg *Config, args []string) error {
+	fs := newFlagSet("swap")
+
+	if err := parseArgs(fs, args, 0, 1); err != nil {
+		return err
+	}
+
+	var swap bool
+
+	switch fs.Arg(0) {
+	case "", "off":
+	case "on":
+		swap = true
+	default:
+		return &usageError{fs: fs}
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	flash := stm32.New(t.swd).Flash()
+
+	if fs.NArg() == 1 {
+		return flash.SetBankSwap(swap)
+	}
+
+	if swap, err = flash.BankSwap(); err != nil {
+		return err
+	}
+
+	fmt.Printf("bank swap: %t\n", swap)
+
+	return nil
+}
+
+func runRecover(cfg *Config, args []string) error {
+	if err := parseArgs(newFlagSet("recover"), args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	flash := stm32.New(t.swd).Flash()
+
+	level, err := flash.ReadProtection()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("RDP: %s\n", level)
+
+	if level == stm32.RDPLevel0 {
+		return nil
+	}
+
+	fmt.Println("Removing readout protection, this erases the flash...")
+
+	flash.SetProgressFunc(printProgress)
+
+	return flash.Recover(eraseTimeout)
+}
+
+// printProgress renders a status line for the current flash phase.
+func printProgress(p stm32.Progress) {
+	if p.Total == 0 {
+		fmt.Printf("\r%-6s %v", p.Phase, p.Elapsed.Round(time.Second))
+	} else {
+		fmt.Printf("\r%-6s %3d%% %d/%d bytes, %v remaining ", p.Phase,
+			uint64(p.Done)*100/uint64(p.Total), p.Done, p.Total, p.Remaining().Round(time.Second))
+	}
+
+	if p.Finished {
+		fmt.Println()
+	}
+}
+
+func runReset(cfg *Config, args []string) error {
+	fs := newFlagSet("reset")
+	haltFlag := fs.Bool("halt", false, "halt the core at the reset vector")
+
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	core := cd.New(t.swd)
+	sys := scb.New(t.swd)
+
+	if *haltFlag {
+		return sys.ResetAndHalt(core)
+	}
+
+	if err := core.ResetRegisters(); err != nil {
+		return err
+	}
+
+	return sys.ResetSystem()
+}
+
+func runHalt(cfg *Config, args []string) error {
+	if err := parseArgs(newFlagSet("halt"), args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	return cd.New(t.swd).Halt()
+}
+
+func runResume(cfg *Config, args []string) error {
+	if err := parseArgs(newFlagSet("resume"), args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	return cd.New(t.swd).Continue()
+}
+
+func runRegs(cfg *Config, args []string) error {
+	if err := parseArgs(newFlagSet("regs"), args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	core := cd.New(t.swd)
+
+	dhcsr, err := core.ReadDHCSR()
+	if err != nil {
+		return err
+	}
+
+	wasRunning := dhcsr&cd.DHCSRSHalt == 0
+
+	if err := core.Halt(); err != nil {
+		return fmt.Errorf("halt: %w", err)
+	}
+
+	regs := []cd.CoreRegister{}
+	for r := cd.CoreRegisterR0; r <= cd.CoreRegisterPSP; r++ {
+		regs = append(regs, r)
+	}
+
+	for i, r := range regs {
+		v, err := core.ReadCoreRegister(r)
+		if err != nil {
+			return err
+		}
+
+		sep := "  "
+		if i%4 == 3 || i == len(regs)-1 {
+			sep = "\n"
+		}
+
+		fmt.Printf("%-5s 0x%08x%s", r, v, sep)
+	}
+
+	special, err := core.ReadCoreRegister(cd.CoreRegisterSpecial)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("control 0x%02x  faultmask 0x%02x  basepri 0x%02x  primask 0x%02x\n",
+		special>>24, (special>>16)&0xff, (special>>8)&0xff, special&0xff)
+
+	if wasRunning {
+		return core.Continue()
+	}
+
+	return nil
+}
+
+func runRTT(cfg *Config, args []string) error {
+	fs := newFlagSet("rtt")
+	addrFlag := fs.String("addr", "", "address of the control block, scan RAM if empty")
+	ramFlag := fs.String("ram", "0x20000000", "start of RAM to scan")
+	sizeFlag := fs.String("size", "0x10000", "size of RAM to scan")
+	channelFlag := fs.Int("channel", 0, "channel to connect to")
+
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	t, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	var r *rtt.RTT
+
+	if *addrFlag != "" {
+		addr, err := parseUint32(*addrFlag)
+		if err != nil {
+			return err
+		}
+
+		if r, err = rtt.New(t.swd, addr); err != nil {
+			return err
+		}
+	} else {
+		ram, err := parseUint32(*ramFlag)
+		if err != nil {
+			return err
+		}
+
+		size, err := parseUint32(*sizeFlag)
+		if err != nil {
+			return err
+		}
+
+		if r, err = rtt.Find(t.swd, ram, size); err != nil {
+			return err
+		}
+	}
+
+	up := r.UpChannels()
+	if *channelFlag < 0 || *channelFlag >= len(up) {
+		return fmt.Errorf("up channel %d not available, target has %d", *channelFlag, len(up))
+	}
+
+	names := []string{}
+	for _, c := range up {
+		names = append(names, fmt.Sprintf("%d:%q", c.Index(), c.Name()))
+	}
+
+	fmt.Fprintf(os.Stderr, "RTT control block at 0x%08x, up channels %s\n", r.Address(), strings.Join(names, " "))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	r.Start()
+
+	errs := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(os.Stdout, up[*channelFlag])
+		errs <- err
+	}()
+
+	if down := r.DownChannels(); *channelFlag < len(down) {
+		go func() {
+			// Keep receiving when stdin is closed
+			if _, err := io.Copy(down[*channelFlag], os.Stdin); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	_ = r.Close()
+
+	return err
+}
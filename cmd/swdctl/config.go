@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/holoplot/go-swd/pkg/stm32"
+)
+
+const (
+	transportLinuxGPIO = "linux-gpio"
+	transportRPI       = "rpi"
+
+	configEnv = "SWDCTL_CONFIG"
+)
+
+// Config selects and configures the SWD transport. It can be loaded from a JSON
+// file, values given on the command line take precedence.
+type Config struct {
+	Transport string `json:"transport"`
+	Chip      string `json:"chip"`
+	SWDIO     int    `json:"swdio"`
+	SWCLK     int    `json:"swclk"`
+	Frequency int    `json:"frequency"`
+	// DBGMCU options applied on connect, a comma separated list of sleep, stop,
+	// standby, iwdg, wwdg and timers
+	DBGMCU string `json:"dbgmcu"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Transport: transportLinuxGPIO,
+		Chip:      "/dev/gpiochip0",
+		Frequency: 1000000,
+	}
+}
+
+func (c *Config) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+	switch c.Transport {
+	case transportLinuxGPIO, transportRPI:
+	default:
+		return fmt.Errorf("unknown transport %q", c.Transport)
+	}
+
+	if c.SWDIO == c.SWCLK {
+		return fmt.Errorf("SWDIO and SWCLK must use different GPIOs")
+	}
+
+	if c.Frequency <= 0 {
+		return fmt.Errorf("invalid frequency %d", c.Frequency)
+	}
+
+	if _, err := parseDebugConfig(c.DBGMCU); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parseGlobalFlags builds the configuration from defaults, the config file and the
+// global command line flags, in that order.
+func parseGlobalFlags(fs *flag.FlagSet, args []string) (*Config, error) {
+	flags := defaultConfig()
+
+	configPath := fs.String("config", os.Getenv(configEnv), "JSON config file, defaults to $"+configEnv)
+	fs.StringVar(&flags.Transport, "transport", flags.Transport, "transport: linux-gpio or rpi")
+	fs.StringVar(&flags.Chip, "chip", flags.Chip, "GPIO chip device")
+	fs.IntVar(&flags.SWDIO, "swdio", flags.SWDIO, "SWDIO GPIO number")
+	fs.IntVar(&flags.SWCLK, "swclk", flags.SWCLK, "SWCLK GPIO number")
+	fs.IntVar(&flags.Frequency, "frequency", flags.Frequency, "SWCLK frequency in Hz")
+	fs.StringVar(&flags.DBGMCU, "dbgmcu", flags.DBGMCU, "DBGMCU options to apply on connect: sleep,stop,standby,iwdg,wwdg,timers")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+
+	if *configPath != "" {
+		if err := cfg.load(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "transport":
+			cfg.Transport = flags.Transport
+		case "chip":
+			cfg.Chip = flags.Chip
+		case "swdio":
+			cfg.SWDIO = flags.SWDIO
+		case "swclk":
+			cfg.SWCLK = flags.SWCLK
+		case "frequency":
+			cfg.Frequency = flags.Frequency
+		case "dbgmcu":
+			cfg.DBGMCU = flags.DBGMCU
+		}
+	})
+
+	return &cfg, nil
+}
+
+// parseDebugConfig parses a comma separated list of DBGMCU options.
+func parseDebugConfig(s string) (stm32.DebugConfig, error) {
+	var dc stm32.DebugConfig
+
+	if s == "" {
+		return dc, nil
+	}
+
+	for _, opt := range strings.Split(s, ",") {
+		switch strings.TrimSpace(opt) {
+		case "sleep":
+			dc.Sleep = true
+		case "stop":
+			dc.Stop = true
+		case "standby":
+			dc.Standby = true
+		case "iwdg":
+			dc.FreezeIWDG = true
+		case "wwdg":
+			dc.FreezeWWDG = true
+		case "timers":
+			dc.FreezeTimers = true
+		default:
+			return dc, fmt.Errorf("unknown DBGMCU option %q", opt)
+		}
+	}
+
+	return dc, nil
+}
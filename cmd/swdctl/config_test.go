@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseGlobalFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swdctl.json")
+
+	if err := os.WriteFile(path, []byte(`{"chip": "gpiochip1", "swdio": 81, "swclk": 80, "frequency": 500000}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("swdctl", flag.ContinueOnError)
+
+	cfg, err := parseGlobalFlags(fs, []string{"-config", path, "-frequency", "2000000", "probe"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := Config{
+		Transport: transportLinuxGPIO,
+		Chip:      "gpiochip1",
+		SWDIO:     81,
+		SWCLK:     80,
+		Frequency: 2000000,
+	}
+
+	if *cfg != want {
+		t.Errorf("got %+v, want %+v", *cfg, want)
+	}
+
+	if err := cfg.validate(); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+
+	if fs.Arg(0) != "probe" {
+		t.Errorf("command: got %q", fs.Arg(0))
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := defaultConfig()
+
+	if err := cfg.validate(); err == nil {
+		t.Errorf("same GPIO for SWDIO and SWCLK accepted")
+	}
+
+	cfg.SWCLK = 1
+	cfg.Transport = "ftdi"
+
+	if err := cfg.validate(); err == nil {
+		t.Errorf("unknown transport accepted")
+	}
+}
+
+func TestParseDebugConfig(t *testing.T) {
+	dc, err := parseDebugConfig("stop, standby,iwdg")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if !dc.Stop || !dc.Standby || !dc.FreezeIWDG || dc.Sleep || dc.FreezeWWDG || dc.FreezeTimers {
+		t.Errorf("got %+v", dc)
+	}
+
+	if _, err := parseDebugConfig("stop,deepsleep"); err == nil {
+		t.Errorf("unknown option accepted")
+	}
+}
@@ -0,0 +1,104 @@
+// Command swdctl probes, debugs and programs targets over SWD.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	usage string
+	help  string
+	run   func(cfg *Config, args []string) error
+}
+
+var commands = map[string]command{
+	"probe":   {"", "show IDCODE, access ports and core identity", runProbe},
+	"read":    {"<addr> [length]", "hex dump target memory", runRead},
+	"write":   {"<addr> <word>...", "write 32-bit words to target memory", runWrite},
+	"dump":    {"<addr> <length> <file>", "save target memory to a file", runDump},
+	"erase":   {"[-bank n] [offset size]", "erase the pages of a flash range, a bank or the whole flash", runErase},
+	"flash":   {"[-offset n] [-verify] [-crc] [-reset] [-update] [-fast] [-loader size | -algo file.FLM] <file>", "program a .bin, .hex, .srec or .elf file into flash", runFlash},
+	"dbgmcu":  {"", "show the DBGMCU low-power and freeze options", runDBGMCU},
+	"ecc":     {"[-clear] [offset size]", "show latched flash ECC errors, or scan a flash range", runECC},
+	"options": {"", "show the option bytes", runOptions},
+	"recover": {"", "remove readout protection and mass erase a locked device", runRecover},
+	"otp":     {"[-dry-run] [offset file] | -lock block", "show, program or lock the OTP area", runOTP},
+	"swap":    {"[on|off]", "show or set the bank swap option of dual bank devices", runSwap},
+	"reset":   {"[-halt]", "reset the system", runReset},
+	"halt":    {"", "halt the core", runHalt},
+	"resume":  {"", "resume the halted core", runResume},
+	"regs":    {"", "halt the core and show its registers", runRegs},
+	"rtt":     {"[-addr a | -ram a -size n] [-channel n]", "connect stdin and stdout to RTT channels", runRTT},
+}
+
+// usageError is returned by commands invoked with invalid flags or arguments
+type usageError struct {
+	fs *flag.FlagSet
+}
+
+func (e *usageError) Error() string {
+	return "invalid arguments"
+}
+
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+
+	fmt.Fprintf(out, "Usage: swdctl [flags] <command> [arguments]\n\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		c := commands[name]
+		fmt.Fprintf(out, "  %-8s %-40s %s\n", name, c.usage, c.help)
+	}
+
+	fmt.Fprintf(out, "\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+func main() {
+	fs := flag.NewFlagSet("swdctl", flag.ExitOnError)
+	fs.Usage = func() { usage(fs) }
+
+	cfg, err := parseGlobalFlags(fs, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "swdctl: %v\n", err)
+		os.Exit(1)
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	name := fs.Arg(0)
+
+	c, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "swdctl: unknown command %q\n", name)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := c.run(cfg, fs.Args()[1:]); err != nil {
+		var ue *usageError
+
+		if errors.As(err, &ue) {
+			fmt.Fprintf(os.Stderr, "Usage: swdctl %s %s\n", name, c.usage)
+			ue.fs.PrintDefaults()
+			os.Exit(2)
+		}
+
+		fmt.Fprintf(os.Stderr, "swdctl %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/holoplot/go-swd/pkg/io"
+	"github.com/holoplot/go-swd/pkg/io/bitbang"
+	"github.com/holoplot/go-swd/pkg/stm32"
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+// target is an initialized connection to the device under test
+type target struct {
+	accessor io.Accessor
+	swd      *swd.SWD
+	idCode   uint32
+}
+
+func (t *target) Close() {
+	t.accessor.Close()
+}
+
+func openAccessor(cfg *Config) (io.Accessor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	var bb *bitbang.BitBang
+	var err error
+
+	switch cfg.Transport {
+	case transportRPI:
+		bb, err = bitbang.NewRPI(cfg.Chip, cfg.SWDIO, cfg.SWCLK, cfg.Frequency)
+	default:
+		bb, err = bitbang.NewLinuxGPIO(cfg.Chip, cfg.SWDIO, cfg.SWCLK, cfg.Frequency)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bb, nil
+}
+
+func connect(cfg *Config) (*target, error) {
+	accessor, err := openAccessor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("open %s transport: %w", cfg.Transport, err)
+	}
+
+	s := swd.New(accessor)
+
+	idCode, err := s.Initialize()
+	if err != nil {
+		accessor.Close()
+
+		return nil, fmt.Errorf("initialize SWD: %w", err)
+	}
+
+	if cfg.DBGMCU != "" {
+		// Validated with the rest of the config
+		dc, _ := parseDebugConfig(cfg.DBGMCU)
+
+		if err := stm32.New(s).ConfigureDebug(dc); err != nil {
+			accessor.Close()
+
+			return nil, fmt.Errorf("configure DBGMCU: %w", err)
+		}
+	}
+
+	return &target{
+		accessor: accessor,
+		swd:      s,
+		idCode:   idCode,
+	}, nil
+}
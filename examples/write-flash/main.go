@@ -8,6 +8,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/holoplot/go-swd/pkg/image"
 	"github.com/holoplot/go-swd/pkg/io/bitbang"
 	"github.com/holoplot/go-swd/pkg/stm32"
 	"github.com/holoplot/go-swd/pkg/swd"
@@ -45,7 +46,7 @@ func main() {
 		panic(err)
 	}
 
-	if err := s.Select(0, 0); err != nil {
+	if err := s.Select(0, 0, 0); err != nil {
 		panic(err)
 	}
 
@@ -73,16 +74,13 @@ func main() {
 
 	log.Printf("Verifying flash...")
 
-	buf = bytes.NewBuffer(nil)
+	// Compare the CRC computed on the target instead of reading back all data
+	flash.SetVerifyMode(stm32.VerifyCRC)
 
-	if err := flash.Read(0, uint32(len(content)), buf); err != nil {
+	if _, err := flash.VerifyImage(image.FromBinary(stm32.FlashBaseAddr, content)); err != nil {
 		panic(err)
 	}
 
-	if !bytes.Equal(buf.Bytes(), content) {
-		panic("verification failed")
-	}
-
 	log.Printf("Resetting...")
 
 	if err := stm.RunAfterReset(); err != nil {
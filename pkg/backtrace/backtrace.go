@@ -0,0 +1,288 @@
+package backtrace
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+const (
+	regSP = 13
+	regLR = 14
+	regPC = 15
+
+	numRegisters = 16
+
+	excReturnProcessStack = 1 << 2
+
+	defaultMaxFrames = 32
+)
+
+var ErrNotHalted = errors.New("core is not halted")
+
+type registers [numRegisters]uint32
+
+// Frame is a single entry of a backtrace
+type Frame struct {
+	PC uint32
+	SP uint32
+
+	// Symbol information, only available if an ELF file was loaded
+	Function string
+	File     string
+	Line     int
+
+	// Exception is set when this frame was interrupted by an exception, and holds
+	// the context the core stacked on exception entry.
+	Exception *scb.ExceptionFrame
+}
+
+func (f *Frame) String() string {
+	s := fmt.Sprintf("0x%08x", f.PC)
+
+	if f.Function != "" {
+		s += " in " + f.Function
+	}
+
+	if f.File != "" {
+		s += fmt.Sprintf(" at %s:%d", f.File, f.Line)
+	}
+
+	if f.Exception != nil {
+		s += " <exception>"
+	}
+
+	return s
+}
+
+type Unwinder struct {
+	swd       *swd.SWD
+	coreDebug *cd.CoreDebug
+	scb       *scb.SystemControlBlock
+
+	symbols    *symbolTable
+	lines      *lineTable
+	debugFrame *debugFrame
+	ehabi      *ehabi
+
+	maxFrames int
+}
+
+// LoadELF loads symbols, line information and unwind tables from the firmware image.
+// Without an ELF file, only exception frames and the link register of the innermost
+// frame are followed.
+func (u *Unwinder) LoadELF(f *elf.File) error {
+	if f.Machine != elf.EM_ARM || f.Class != elf.ELFCLASS32 {
+		return fmt.Errorf("not a 32-bit ARM ELF file")
+	}
+
+	symbols, err := newSymbolTable(f)
+	if err != nil {
+		return fmt.Errorf("read symbols: %w", err)
+	}
+
+	lines, err := newLineTable(f)
+	if err != nil {
+		return err
+	}
+
+	e, err := newEHABI(f)
+	if err != nil {
+		return err
+	}
+
+	var df *debugFrame
+
+	if s := f.Section(".debug_frame"); s != nil {
+		data, err := s.Data()
+		if err != nil {
+			return fmt.Errorf("read .debug_frame: %w", err)
+		}
+
+		if df, err = parseDebugFrame(data); err != nil {
+			return fmt.Errorf("parse .debug_frame: %w", err)
+		}
+	}
+
+	u.symbols = symbols
+	u.lines = lines
+	u.ehabi = e
+	u.debugFrame = df
+
+	return nil
+}
+
+// SetMaxFrames limits the depth of the backtrace.
+func (u *Unwinder) SetMaxFrames(n int) {
+	u.maxFrames = n
+}
+
+func (u *Unwinder) readWord(addr uint32) (uint32, error) {
+	return u.swd.ReadRegister(addr)
+}
+
+func (u *Unwinder) symbolize(frame *Frame, pc uint32) {
+	if u.symbols != nil {
+		frame.Function, _ = u.symbols.lookup(pc)
+	}
+
+	if u.lines != nil {
+		frame.File, frame.Line, _ = u.lines.lookup(pc)
+	}
+}
+
+// unwindFrame replaces the register set with the one of the caller.
+// leaf allows falling back to LR for frames without unwind information, which is
+// only correct if the function has not yet pushed LR.
+func (u *Unwinder) unwindFrame(regs *registers, pc uint32, leaf bool) error {
+	if u.debugFrame != nil {
+		if f := u.debugFrame.find(pc); f != nil {
+			return f.unwind(pc, regs, u.readWord)
+		}
+	}
+
+	if u.ehabi != nil {
+		instr, err := u.ehabi.instructions(pc)
+		if err == nil {
+			return executeEHABI(instr, regs, u.readWord)
+		}
+
+		if !errors.Is(err, errNoUnwindInfo) {
+			return err
+		}
+	}
+
+	if leaf {
+		regs[regPC] = regs[regLR]
+
+		return nil
+	}
+
+	return errNoUnwindInfo
+}
+
+// Backtrace unwinds the stack of the halted core, starting with the innermost frame.
+// Unwinding stops at the first frame that cannot be unwound, which is not reported
+// as an error.
+func (u *Unwinder) Backtrace() ([]Frame, error) {
+	dhcsr, err := u.coreDebug.ReadDHCSR()
+	if err != nil {
+		return nil, fmt.Errorf("read DHCSR: %w", err)
+	}
+
+	if dhcsr&cd.DHCSRSHalt == 0 {
+		return nil, ErrNotHalted
+	}
+
+	var regs registers
+
+	for r := range regs {
+		if regs[r], err = u.coreDebug.ReadCoreRegister(cd.CoreRegister(r)); err != nil {
+			return nil, fmt.Errorf("read register: %w", err)
+		}
+	}
+
+	psp, err := u.coreDebug.ReadCoreRegister(cd.CoreRegisterPSP)
+	if err != nil {
+		return nil, fmt.Errorf("read register: %w", err)
+	}
+
+	maxFrames := u.maxFrames
+	if maxFrames == 0 {
+		maxFrames = defaultMaxFrames
+	}
+
+	var (
+		frames    []Frame
+		exception *scb.ExceptionFrame
+	)
+
+	// The innermost frame and frames interrupted by an exception have a precise PC,
+	// all others hold a return address.
+	precise := true
+
+	for len(frames) < maxFrames {
+		pc := regs[regPC]
+
+		if pc == 0 || pc == 0xffffffff {
+			break
+		}
+
+		if scb.IsExcReturn(pc) {
+			// Exceptions taken from thread mode may have stacked to the process stack,
+			// nested exceptions always use the main stack.
+			sp := regs[regSP]
+			if pc&excReturnProcessStack != 0 {
+				sp = psp
+			}
+
+			ef, err := u.scb.ReadStackedFrame(sp, pc)
+			if err != nil {
+				return frames, err
+			}
+
+			regs[0], regs[1], regs[2], regs[3] = ef.R0, ef.R1, ef.R2, ef.R3
+			regs[12], regs[regLR], regs[regPC] = ef.R12, ef.LR, ef.PC
+			regs[regSP] = ef.CallerSP()
+
+			exception = ef
+			precise = true
+
+			continue
+		}
+
+		pc &^= 1
+
+		lookup := pc
+		if !precise {
+			// Return addresses point past the call instruction, which might be the
+			// last one of the function.
+			lookup--
+		}
+
+		frame := Frame{
+			PC:        pc,
+			SP:        regs[regSP],
+			Exception: exception,
+		}
+
+		u.symbolize(&frame, lookup)
+		frames = append(frames, frame)
+
+		caller := regs
+		if err := u.unwindFrame(&caller, lookup, precise); err != nil {
+			if errors.Is(err, errNoUnwindInfo) || errors.Is(err, ErrCantUnwind) {
+				break
+			}
+
+			return frames, err
+		}
+
+		if caller[regSP] < regs[regSP] || caller == regs {
+			// No progress or corrupted stack
+			break
+		}
+
+		if !scb.IsExcReturn(caller[regPC]) {
+			caller[regPC] &^= 1
+		}
+
+		regs = caller
+		exception = nil
+		precise = false
+	}
+
+	return frames, nil
+}
+
+func New(swd *swd.SWD) *Unwinder {
+	return &Unwinder{
+		swd:       swd,
+		coreDebug: cd.New(swd),
+		scb:       scb.New(swd),
+	}
+}
@@ -0,0 +1,572 @@
+package backtrace
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Call frame information from the DWARF .debug_frame section
+// https://dwarfstd.org/doc/DWARF5.pdf, section 6.4
+
+const (
+	cieID = 0xffffffff
+
+	cfaAdvanceLoc = 0x1 << 6
+	cfaOffset     = 0x2 << 6
+	cfaRestore    = 0x3 << 6
+
+	cfaNop              = 0x00
+	cfaSetLoc           = 0x01
+	cfaAdvanceLoc1      = 0x02
+	cfaAdvanceLoc2      = 0x03
+	cfaAdvanceLoc4      = 0x04
+	cfaOffsetExtended   = 0x05
+	cfaRestoreExtended  = 0x06
+	cfaUndefined        = 0x07
+	cfaSameValue        = 0x08
+	cfaRegister         = 0x09
+	cfaRememberState    = 0x0a
+	cfaRestoreState     = 0x0b
+	cfaDefCFA           = 0x0c
+	cfaDefCFARegister   = 0x0d
+	cfaDefCFAOffset     = 0x0e
+	cfaOffsetExtendedSf = 0x11
+	cfaDefCFASf         = 0x12
+	cfaDefCFAOffsetSf   = 0x13
+	cfaValOffset        = 0x14
+	cfaValOffsetSf      = 0x15
+	cfaGNUArgsSize      = 0x2e
+)
+
+var errTruncated = errors.New("truncated call frame information")
+
+type ruleKind int
+
+const (
+	ruleSameValue ruleKind = iota
+	ruleUndefined
+	ruleOffset
+	ruleValOffset
+	ruleRegister
+)
+
+type rule struct {
+	kind  ruleKind
+	value int64
+}
+
+type frameState struct {
+	cfaRegister uint64
+	cfaOffset   int64
+	rules       [numRegisters]rule
+}
+
+type cie struct {
+	codeAlign    uint64
+	dataAlign    int64
+	returnReg    uint64
+	instructions []byte
+}
+
+type fde struct {
+	cie          *cie
+	start, end   uint32
+	instructions []byte
+}
+
+type debugFrame struct {
+	fdes []*fde
+}
+
+type reader struct {
+	data []byte
+}
+
+func (r *reader) byte() (byte, error) {
+	if len(r.data) < 1 {
+		return 0, errTruncated
+	}
+
+	b := r.data[0]
+	r.data = r.data[1:]
+
+	return b, nil
+}
+
+func (r *reader) uint16() (uint16, error) {
+	if len(r.data) < 2 {
+		return 0, errTruncated
+	}
+
+	v := binary.LittleEndian.Uint16(r.data)
+	r.data = r.data[2:]
+
+	return v, nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errTruncated
+	}
+
+	v := binary.LittleEndian.Uint32(r.data)
+	r.data = r.data[4:]
+
+	return v, nil
+}
+
+func (r *reader) uleb() (uint64, error) {
+	var v uint64
+	var shift uint
+
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+
+		v |= uint64(b&0x7f) << shift
+		shift += 7
+
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+}
+
+func (r *reader) sleb() (int64, error) {
+	var v int64
+	var shift uint
+
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+
+		v |= int64(b&0x7f) << shift
+		shift += 7
+
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				v |= -1 << shift
+			}
+
+			return v, nil
+		}
+	}
+}
+
+func (r *reader) cstring() (string, error) {
+	for i, b := range r.data {
+		if b == 0 {
+			s := string(r.data[:i])
+			r.data = r.data[i+1:]
+
+			return s, nil
+		}
+	}
+
+	return "", errTruncated
+}
+
+func parseCIE(r *reader) (*cie, error) {
+	version, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	augmentation, err := r.cstring()
+	if err != nil {
+		return nil, err
+	}
+
+	if augmentation != "" {
+		return nil, fmt.Errorf("unsupported CIE augmentation %q", augmentation)
+	}
+
+	if version >= 4 {
+		// address_size and segment_selector_size
+		if _, err := r.uint16(); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &cie{}
+
+	if c.codeAlign, err = r.uleb(); err != nil {
+		return nil, err
+	}
+
+	if c.dataAlign, err = r.sleb(); err != nil {
+		return nil, err
+	}
+
+	if version == 1 {
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		c.returnReg = uint64(b)
+	} else if c.returnReg, err = r.uleb(); err != nil {
+		return nil, err
+	}
+
+	c.instructions = r.data
+
+	return c, nil
+}
+
+func parseDebugFrame(data []byte) (*debugFrame, error) {
+	df := &debugFrame{}
+	cies := map[uint32]*cie{}
+
+	type pending struct {
+		cieOffset uint32
+		fde       *fde
+	}
+
+	var fdes []pending
+
+	for offset := uint32(0); offset < uint32(len(data)); {
+		r := &reader{data: data[offset:]}
+
+		length, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+
+		if length == 0xffffffff {
+			return nil, fmt.Errorf("64-bit DWARF not supported")
+		}
+
+		if uint32(len(r.data)) < length {
+			return nil, errTruncated
+		}
+
+		entry := &reader{data: r.data[:length]}
+		start := offset
+		offset += 4 + length
+
+		id, err := entry.uint32()
+		if err != nil {
+			return nil, err
+		}
+
+		if id == cieID {
+			c, err := parseCIE(entry)
+			if err != nil {
+				// Skip CIEs we do not understand along with their FDEs
+				continue
+			}
+
+			cies[start] = c
+
+			continue
+		}
+
+		f := &fde{}
+
+		if f.start, err = entry.uint32(); err != nil {
+			return nil, err
+		}
+
+		size, err := entry.uint32()
+		if err != nil {
+			return nil, err
+		}
+
+		f.start &^= 1
+		f.end = f.start + size
+		f.instructions = entry.data
+
+		fdes = append(fdes, pending{id, f})
+	}
+
+	for _, p := range fdes {
+		if c, ok := cies[p.cieOffset]; ok {
+			p.fde.cie = c
+			df.fdes = append(df.fdes, p.fde)
+		}
+	}
+
+	sort.Slice(df.fdes, func(i, j int) bool {
+		return df.fdes[i].start < df.fdes[j].start
+	})
+
+	return df, nil
+}
+
+func (df *debugFrame) find(pc uint32) *fde {
+	i := sort.Search(len(df.fdes), func(i int) bool {
+		return df.fdes[i].start > pc
+	})
+
+	if i == 0 || pc >= df.fdes[i-1].end {
+		return nil
+	}
+
+	return df.fdes[i-1]
+}
+
+// execute runs the call frame instructions until the location exceeds pc.
+func (f *fde) execute(instructions []byte, state *frameState, initial *frameState, loc *uint32, pc uint32) error {
+	r := &reader{data: instructions}
+
+	var stack []frameState
+
+	setRule := func(reg uint64, ru rule) {
+		if reg < numRegisters {
+			state.rules[reg] = ru
+		}
+	}
+
+	restore := func(reg uint64) {
+		if reg < numRegisters && initial != nil {
+			state.rules[reg] = initial.rules[reg]
+		}
+	}
+
+	advance := func(delta uint64) bool {
+		*loc += uint32(delta * f.cie.codeAlign)
+
+		return *loc > pc
+	}
+
+	for len(r.data) > 0 {
+		op, _ := r.byte()
+
+		switch op & 0xc0 {
+		case cfaAdvanceLoc:
+			if advance(uint64(op & 0x3f)) {
+				return nil
+			}
+
+			continue
+
+		case cfaOffset:
+			off, err := r.uleb()
+			if err != nil {
+				return err
+			}
+
+			setRule(uint64(op&0x3f), rule{ruleOffset, int64(off) * f.cie.dataAlign})
+
+			continue
+
+		case cfaRestore:
+			restore(uint64(op & 0x3f))
+
+			continue
+		}
+
+		var err error
+
+		switch op {
+		case cfaNop:
+
+		case cfaSetLoc:
+			var v uint32
+
+			if v, err = r.uint32(); err == nil {
+				*loc = v
+
+				if *loc > pc {
+					return nil
+				}
+			}
+
+		case cfaAdvanceLoc1:
+			var v byte
+
+			if v, err = r.byte(); err == nil && advance(uint64(v)) {
+				return nil
+			}
+
+		case cfaAdvanceLoc2:
+			var v uint16
+
+			if v, err = r.uint16(); err == nil && advance(uint64(v)) {
+				return nil
+			}
+
+		case cfaAdvanceLoc4:
+			var v uint32
+
+			if v, err = r.uint32(); err == nil && advance(uint64(v)) {
+				return nil
+			}
+
+		case cfaOffsetExtended, cfaValOffset:
+			var reg, off uint64
+
+			if reg, err = r.uleb(); err == nil {
+				if off, err = r.uleb(); err == nil {
+					kind := ruleOffset
+					if op == cfaValOffset {
+						kind = ruleValOffset
+					}
+
+					setRule(reg, rule{kind, int64(off) * f.cie.dataAlign})
+				}
+			}
+
+		case cfaOffsetExtendedSf, cfaValOffsetSf:
+			var reg uint64
+			var off int64
+
+			if reg, err = r.uleb(); err == nil {
+				if off, err = r.sleb(); err == nil {
+					kind := ruleOffset
+					if op == cfaValOffsetSf {
+						kind = ruleValOffset
+					}
+
+					setRule(reg, rule{kind, off * f.cie.dataAlign})
+				}
+			}
+
+		case cfaRestoreExtended:
+			var reg uint64
+
+			if reg, err = r.uleb(); err == nil {
+				restore(reg)
+			}
+
+		case cfaUndefined, cfaSameValue:
+			var reg uint64
+
+			if reg, err = r.uleb(); err == nil {
+				kind := ruleUndefined
+				if op == cfaSameValue {
+					kind = ruleSameValue
+				}
+
+				setRule(reg, rule{kind: kind})
+			}
+
+		case cfaRegister:
+			var reg, reg2 uint64
+
+			if reg, err = r.uleb(); err == nil {
+				if reg2, err = r.uleb(); err == nil {
+					setRule(reg, rule{ruleRegister, int64(reg2)})
+				}
+			}
+
+		case cfaRememberState:
+			stack = append(stack, *state)
+
+		case cfaRestoreState:
+			if len(stack) == 0 {
+				return fmt.Errorf("restore state without remember state")
+			}
+
+			cfaRegister, cfaOffset := state.cfaRegister, state.cfaOffset
+			*state = stack[len(stack)-1]
+			state.cfaRegister, state.cfaOffset = cfaRegister, cfaOffset
+			stack = stack[:len(stack)-1]
+
+		case cfaDefCFA:
+			if state.cfaRegister, err = r.uleb(); err == nil {
+				var off uint64
+
+				off, err = r.uleb()
+				state.cfaOffset = int64(off)
+			}
+
+		case cfaDefCFASf:
+			if state.cfaRegister, err = r.uleb(); err == nil {
+				var off int64
+
+				off, err = r.sleb()
+				state.cfaOffset = off * f.cie.dataAlign
+			}
+
+		case cfaDefCFARegister:
+			state.cfaRegister, err = r.uleb()
+
+		case cfaDefCFAOffset:
+			var off uint64
+
+			off, err = r.uleb()
+			state.cfaOffset = int64(off)
+
+		case cfaDefCFAOffsetSf:
+			var off int64
+
+			off, err = r.sleb()
+			state.cfaOffset = off * f.cie.dataAlign
+
+		case cfaGNUArgsSize:
+			_, err = r.uleb()
+
+		default:
+			return fmt.Errorf("unsupported call frame instruction 0x%02x", op)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unwind computes the register set of the caller.
+func (f *fde) unwind(pc uint32, regs *registers, read func(uint32) (uint32, error)) error {
+	var initial frameState
+
+	loc := f.start
+
+	if err := f.execute(f.cie.instructions, &initial, nil, &loc, ^uint32(0)); err != nil {
+		return fmt.Errorf("CIE instructions: %w", err)
+	}
+
+	state := initial
+	loc = f.start
+
+	if err := f.execute(f.instructions, &state, &initial, &loc, pc); err != nil {
+		return fmt.Errorf("FDE instructions: %w", err)
+	}
+
+	if state.cfaRegister >= numRegisters {
+		return fmt.Errorf("unsupported CFA register %d", state.cfaRegister)
+	}
+
+	cfa := uint32(int64(regs[state.cfaRegister]) + state.cfaOffset)
+	caller := *regs
+
+	for reg, ru := range state.rules {
+		switch ru.kind {
+		case ruleOffset:
+			v, err := read(uint32(int64(cfa) + ru.value))
+			if err != nil {
+				return err
+			}
+
+			caller[reg] = v
+
+		case ruleValOffset:
+			caller[reg] = uint32(int64(cfa) + ru.value)
+
+		case ruleRegister:
+			if ru.value < numRegisters {
+				caller[reg] = regs[ru.value]
+			}
+		}
+	}
+
+	caller[regSP] = cfa
+
+	if f.cie.returnReg < numRegisters {
+		caller[regPC] = caller[f.cie.returnReg]
+	}
+
+	*regs = caller
+
+	return nil
+}
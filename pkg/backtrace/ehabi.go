@@ -0,0 +1,349 @@
+package backtrace
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ARM exception handling ABI (EHABI) unwind tables from the .ARM.exidx and .ARM.extab sections
+// https://github.com/ARM-software/abi-aa/blob/main/ehabi32/ehabi32.rst
+
+const (
+	exidxCantUnwind = 0x1
+	exidxCompact    = 1 << 31
+)
+
+var (
+	ErrCantUnwind   = errors.New("function marked as not unwindable")
+	errNoUnwindInfo = errors.New("no unwind information")
+)
+
+type section struct {
+	addr uint32
+	data []byte
+}
+
+func loadSection(f *elf.File, name string) (*section, error) {
+	s := f.Section(name)
+	if s == nil {
+		return nil, nil
+	}
+
+	data, err := s.Data()
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+
+	return &section{
+		addr: uint32(s.Addr),
+		data: data,
+	}, nil
+}
+
+func (s *section) word(addr uint32) (uint32, bool) {
+	if s == nil || addr < s.addr || addr+4 > s.addr+uint32(len(s.data)) {
+		return 0, false
+	}
+
+	o := addr - s.addr
+
+	return uint32(s.data[o]) | uint32(s.data[o+1])<<8 | uint32(s.data[o+2])<<16 | uint32(s.data[o+3])<<24, true
+}
+
+// prel31 resolves a place-relative 31-bit signed offset
+func prel31(place, v uint32) uint32 {
+	offset := v & 0x7fffffff
+
+	if offset&0x40000000 != 0 {
+		offset |= 0x80000000
+	}
+
+	return place + offset
+}
+
+type exidxEntry struct {
+	function uint32
+	place    uint32
+	data     uint32
+}
+
+type ehabi struct {
+	extab   *section
+	entries []exidxEntry
+}
+
+func newEHABI(f *elf.File) (*ehabi, error) {
+	exidx, err := loadSection(f, ".ARM.exidx")
+	if err != nil || exidx == nil {
+		return nil, err
+	}
+
+	extab, err := loadSection(f, ".ARM.extab")
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ehabi{
+		extab: extab,
+	}
+
+	for o := uint32(0); o+8 <= uint32(len(exidx.data)); o += 8 {
+		place := exidx.addr + o
+		fn, _ := exidx.word(place)
+		data, _ := exidx.word(place + 4)
+
+		e.entries = append(e.entries, exidxEntry{
+			function: prel31(place, fn),
+			place:    place + 4,
+			data:     data,
+		})
+	}
+
+	sort.Slice(e.entries, func(i, j int) bool {
+		return e.entries[i].function < e.entries[j].function
+	})
+
+	return e, nil
+}
+
+// instructions returns the unwind instruction bytes for the function containing pc.
+func (e *ehabi) instructions(pc uint32) ([]byte, error) {
+	i := sort.Search(len(e.entries), func(i int) bool {
+		return e.entries[i].function > pc
+	})
+
+	if i == 0 {
+		return nil, errNoUnwindInfo
+	}
+
+	entry := e.entries[i-1]
+
+	if entry.data == exidxCantUnwind {
+		return nil, ErrCantUnwind
+	}
+
+	if entry.data&exidxCompact != 0 {
+		instr, _, err := compactInstructions(entry.data)
+		return instr, err
+	}
+
+	addr := prel31(entry.place, entry.data)
+
+	w, ok := e.extab.word(addr)
+	if !ok {
+		return nil, fmt.Errorf("extab entry at 0x%08x out of range", addr)
+	}
+
+	var (
+		instr []byte
+		more  int
+		err   error
+	)
+
+	if w&exidxCompact == 0 {
+		// Generic personality routine, the unwind data follows in the next word
+		addr += 4
+
+		if w, ok = e.extab.word(addr); !ok {
+			return nil, fmt.Errorf("extab entry at 0x%08x out of range", addr)
+		}
+
+		more = int(w >> 24)
+		instr = []byte{byte(w >> 16), byte(w >> 8), byte(w)}
+	} else if instr, more, err = compactInstructions(w); err != nil {
+		return nil, err
+	}
+
+	for n := 0; n < more; n++ {
+		addr += 4
+
+		v, ok := e.extab.word(addr)
+		if !ok {
+			return nil, fmt.Errorf("extab entry at 0x%08x out of range", addr)
+		}
+
+		instr = append(instr, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+
+	return instr, nil
+}
+
+// compactInstructions decodes the first word of a compact model entry and returns
+// its instruction bytes and the number of additional words that follow.
+func compactInstructions(w uint32) ([]byte, int, error) {
+	switch index := (w >> 24) & 0xf; index {
+	case 0:
+		return []byte{byte(w >> 16), byte(w >> 8), byte(w)}, 0, nil
+	case 1, 2:
+		return []byte{byte(w >> 8), byte(w)}, int((w >> 16) & 0xff), nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported personality routine %d", index)
+	}
+}
+
+// executeEHABI applies the unwind instructions to the register set.
+func executeEHABI(instr []byte, regs *registers, read func(uint32) (uint32, error)) error {
+	vsp := regs[regSP]
+	pcSet := false
+
+	pop := func(mask uint16, base int) error {
+		spSet := false
+
+		for n := 0; n < 16; n++ {
+			if mask&(1<<n) == 0 {
+				continue
+			}
+
+			v, err := read(vsp)
+			if err != nil {
+				return err
+			}
+
+			r := base + n
+			regs[r] = v
+			vsp += 4
+
+			switch r {
+			case regPC:
+				pcSet = true
+			case regSP:
+				spSet = true
+			}
+		}
+
+		if spSet {
+			vsp = regs[regSP]
+		}
+
+		return nil
+	}
+
+	next := func(i *int) (byte, error) {
+		*i++
+
+		if *i >= len(instr) {
+			return 0, fmt.Errorf("truncated unwind instruction")
+		}
+
+		return instr[*i], nil
+	}
+
+	for i := 0; i < len(instr); i++ {
+		b := instr[i]
+
+		switch {
+		case b&0xc0 == 0x00:
+			vsp += uint32(b&0x3f)<<2 + 4
+
+		case b&0xc0 == 0x40:
+			vsp -= uint32(b&0x3f)<<2 + 4
+
+		case b&0xf0 == 0x80:
+			b2, err := next(&i)
+			if err != nil {
+				return err
+			}
+
+			mask := uint16(b&0xf)<<8 | uint16(b2)
+			if mask == 0 {
+				return ErrCantUnwind
+			}
+
+			if err := pop(mask, 4); err != nil {
+				return err
+			}
+
+		case b&0xf0 == 0x90:
+			r := int(b & 0xf)
+			if r == regSP || r == regPC {
+				return fmt.Errorf("reserved unwind instruction 0x%02x", b)
+			}
+
+			vsp = regs[r]
+
+		case b&0xf8 == 0xa0, b&0xf8 == 0xa8:
+			mask := uint16(1)<<((b&0x7)+1) - 1
+
+			if b&0x08 != 0 {
+				mask |= 1 << (regLR - 4)
+			}
+
+			if err := pop(mask, 4); err != nil {
+				return err
+			}
+
+		case b == 0xb0:
+			i = len(instr)
+
+		case b == 0xb1:
+			b2, err := next(&i)
+			if err != nil {
+				return err
+			}
+
+			if b2 == 0 || b2&0xf0 != 0 {
+				return fmt.Errorf("spare unwind instruction 0xb1 0x%02x", b2)
+			}
+
+			if err := pop(uint16(b2), 0); err != nil {
+				return err
+			}
+
+		case b == 0xb2:
+			var v, shift uint32
+
+			for {
+				b2, err := next(&i)
+				if err != nil {
+					return err
+				}
+
+				v |= uint32(b2&0x7f) << shift
+				shift += 7
+
+				if b2&0x80 == 0 {
+					break
+				}
+			}
+
+			vsp += 0x204 + v<<2
+
+		case b == 0xb3:
+			b2, err := next(&i)
+			if err != nil {
+				return err
+			}
+
+			// VFP registers saved by FSTMFDX
+			vsp += 8*uint32(b2&0xf+1) + 4
+
+		case b&0xf8 == 0xb8:
+			vsp += 8*uint32(b&0x7+1) + 4
+
+		case b == 0xc8, b == 0xc9:
+			b2, err := next(&i)
+			if err != nil {
+				return err
+			}
+
+			// VFP registers saved by VPUSH
+			vsp += 8 * uint32(b2&0xf+1)
+
+		case b&0xf8 == 0xd0:
+			vsp += 8 * uint32(b&0x7+1)
+
+		default:
+			return fmt.Errorf("unsupported unwind instruction 0x%02x", b)
+		}
+	}
+
+	regs[regSP] = vsp
+
+	if !pcSet {
+		regs[regPC] = regs[regLR]
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package backtrace
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+type function struct {
+	name       string
+	start, end uint32
+}
+
+type symbolTable struct {
+	functions []function
+}
+
+func newSymbolTable(f *elf.File) (*symbolTable, error) {
+	symbols, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, err
+	}
+
+	st := &symbolTable{}
+
+	for _, s := range symbols {
+		if elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Name == "" {
+			continue
+		}
+
+		// Thumb functions have bit 0 set
+		start := uint32(s.Value) &^ 1
+
+		st.functions = append(st.functions, function{
+			name:  s.Name,
+			start: start,
+			end:   start + uint32(s.Size),
+		})
+	}
+
+	sort.Slice(st.functions, func(i, j int) bool {
+		return st.functions[i].start < st.functions[j].start
+	})
+
+	return st, nil
+}
+
+func (st *symbolTable) lookup(pc uint32) (string, bool) {
+	i := sort.Search(len(st.functions), func(i int) bool {
+		return st.functions[i].start > pc
+	})
+
+	if i == 0 {
+		return "", false
+	}
+
+	fn := st.functions[i-1]
+
+	if fn.end != fn.start && pc >= fn.end {
+		return "", false
+	}
+
+	return fn.name, true
+}
+
+type lineRow struct {
+	address     uint32
+	file        string
+	line        int
+	endSequence bool
+}
+
+type lineTable struct {
+	rows []lineRow
+}
+
+func newLineTable(f *elf.File) (*lineTable, error) {
+	d, err := f.DWARF()
+	if err != nil {
+		// No debug information, which is not an error for our purposes
+		return nil, nil
+	}
+
+	lt := &lineTable{}
+	r := d.Reader()
+
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return nil, fmt.Errorf("read DWARF: %w", err)
+		}
+
+		if entry == nil {
+			break
+		}
+
+		if entry.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+
+		lr, err := d.LineReader(entry)
+		if err != nil {
+			return nil, fmt.Errorf("read line table: %w", err)
+		}
+
+		r.SkipChildren()
+
+		if lr == nil {
+			continue
+		}
+
+		var le dwarf.LineEntry
+
+		for {
+			if err := lr.Next(&le); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				return nil, fmt.Errorf("read line entry: %w", err)
+			}
+
+			row := lineRow{
+				address:     uint32(le.Address),
+				line:        le.Line,
+				endSequence: le.EndSequence,
+			}
+
+			if le.File != nil {
+				row.file = le.File.Name
+			}
+
+			lt.rows = append(lt.rows, row)
+		}
+	}
+
+	// Sequence ends sort before rows starting at the same address
+	sort.SliceStable(lt.rows, func(i, j int) bool {
+		if lt.rows[i].address == lt.rows[j].address {
+			return lt.rows[i].endSequence && !lt.rows[j].endSequence
+		}
+
+		return lt.rows[i].address < lt.rows[j].address
+	})
+
+	return lt, nil
+}
+
+func (lt *lineTable) lookup(pc uint32) (string, int, bool) {
+	i := sort.Search(len(lt.rows), func(i int) bool {
+		return lt.rows[i].address > pc
+	})
+
+	if i == 0 || lt.rows[i-1].endSequence {
+		return "", 0, false
+	}
+
+	row := lt.rows[i-1]
+
+	return row.file, row.line, true
+}
@@ -0,0 +1,139 @@
+package backtrace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+type memory map[uint32]uint32
+
+func (m memory) read(addr uint32) (uint32, error) {
+	v, ok := m[addr]
+	if !ok {
+		return 0, fmt.Errorf("unmapped address 0x%08x", addr)
+	}
+
+	return v, nil
+}
+
+func TestExecuteEHABI(t *testing.T) {
+	mem := memory{
+		0x20000ff0: 0x44444444, // r4
+		0x20000ff4: 0x77777777, // r7
+		0x20000ff8: 0x08000235, // lr
+	}
+
+	tests := []struct {
+		name   string
+		instr  []byte
+		wantSP uint32
+		wantPC uint32
+	}{
+		{
+			name: "leaf",
+			// finish
+			instr:  []byte{0xb0, 0xb0, 0xb0},
+			wantSP: 0x20000fe8,
+			wantPC: 0x08000101,
+		},
+		{
+			name: "pop r4-r7, lr after sub sp",
+			// vsp += 8; pop {r4, r7, lr}; finish
+			instr:  []byte{0x01, 0x84, 0x09, 0xb0},
+			wantSP: 0x20000ffc,
+			wantPC: 0x08000235,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var regs registers
+
+			regs[regSP] = 0x20000fe8
+			regs[regLR] = 0x08000101
+
+			if err := executeEHABI(tt.instr, &regs, mem.read); err != nil {
+				t.Fatalf("executeEHABI() error = %v", err)
+			}
+
+			if regs[regSP] != tt.wantSP {
+				t.Errorf("sp = 0x%08x, want 0x%08x", regs[regSP], tt.wantSP)
+			}
+
+			if regs[regPC] != tt.wantPC {
+				t.Errorf("pc = 0x%08x, want 0x%08x", regs[regPC], tt.wantPC)
+			}
+		})
+	}
+}
+
+func TestDebugFrameUnwind(t *testing.T) {
+	entry := func(body []byte) []byte {
+		b := binary.LittleEndian.AppendUint32(nil, uint32(len(body)))
+		return append(b, body...)
+	}
+
+	// CIE: version 1, no augmentation, code alignment 2, data alignment -4, return address in r14,
+	// DW_CFA_def_cfa r13+0
+	cie := entry([]byte{
+		0xff, 0xff, 0xff, 0xff,
+		0x01, 0x00,
+		0x02, 0x7c, 0x0e,
+		0x0c, 0x0d, 0x00,
+		0x00,
+	})
+
+	// FDE for push {r7, lr}; sub sp, #8
+	fdeBody := binary.LittleEndian.AppendUint32(nil, 0)
+	fdeBody = binary.LittleEndian.AppendUint32(fdeBody, 0x08000101)
+	fdeBody = binary.LittleEndian.AppendUint32(fdeBody, 0x20)
+	fdeBody = append(fdeBody,
+		0x41,       // advance_loc 2
+		0x0e, 0x08, // def_cfa_offset 8
+		0x87, 0x02, // offset r7, cfa-8
+		0x8e, 0x01, // offset r14, cfa-4
+		0x41,       // advance_loc 2
+		0x0e, 0x10, // def_cfa_offset 16
+	)
+
+	df, err := parseDebugFrame(append(cie, entry(fdeBody)...))
+	if err != nil {
+		t.Fatalf("parseDebugFrame() error = %v", err)
+	}
+
+	if df.find(0x08000120) != nil {
+		t.Errorf("find() returned FDE for address outside of range")
+	}
+
+	f := df.find(0x08000106)
+	if f == nil {
+		t.Fatalf("find() returned no FDE")
+	}
+
+	mem := memory{
+		0x20000ff8: 0x77777777,
+		0x20000ffc: 0x08000235,
+	}
+
+	var regs registers
+
+	regs[regSP] = 0x20000ff0
+	regs[regLR] = 0x08000301
+
+	if err := f.unwind(0x08000106, &regs, mem.read); err != nil {
+		t.Fatalf("unwind() error = %v", err)
+	}
+
+	if regs[regSP] != 0x20001000 {
+		t.Errorf("sp = 0x%08x, want 0x20001000", regs[regSP])
+	}
+
+	if regs[regPC] != 0x08000235 {
+		t.Errorf("pc = 0x%08x, want 0x08000235", regs[regPC])
+	}
+
+	if regs[7] != 0x77777777 {
+		t.Errorf("r7 = 0x%08x, want 0x77777777", regs[7])
+	}
+}
@@ -128,20 +128,49 @@ func (cd *CoreDebug) Continue() error {
 	return ErrTimeout
 }
 
+// Step executes a single instruction with interrupts masked and waits for the core to
+// halt again. The core must be halted.
+func (cd *CoreDebug) Step() error {
+	if err := cd.WriteDHCSR(DHCSRDebugKey | DHCSRCDebugEn | DHCSRCHalt | DHCSRCMaskInts); err != nil {
+		return err
+	}
+
+	if err := cd.WriteDHCSR(DHCSRDebugKey | DHCSRCDebugEn | DHCSRCStep | DHCSRCMaskInts); err != nil {
+		return err
+	}
+
+	for n := 0; n < retries; n++ {
+		dhcsr, err := cd.ReadDHCSR()
+		if err != nil {
+			return fmt.Errorf("error reading DHCSR: %w", err)
+		}
+
+		if dhcsr&DHCSRSHalt != 0 {
+			return cd.WriteDHCSR(DHCSRDebugKey | DHCSRCDebugEn | DHCSRCHalt)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return ErrTimeout
+}
+
 func (cd *CoreDebug) RunAfterReset() error {
 	if err := cd.WriteDHCSR(DHCSRDebugKey); err != nil {
 		return err
 	}
 
 	return nil
+}
 
+func (cd *CoreDebug) waitForRegisterReady() error {
 	for n := 0; n < retries; n++ {
 		dhcsr, err := cd.ReadDHCSR()
 		if err != nil {
 			return fmt.Errorf("error reading DHCSR: %w", err)
 		}
 
-		if dhcsr&DHCSRSHalt == 0 {
+		if dhcsr&DHCSRSRegReady != 0 {
 			return nil
 		}
 
@@ -151,6 +180,67 @@ func (cd *CoreDebug) RunAfterReset() error {
 	return ErrTimeout
 }
 
+// ReadCoreRegister reads a core register through DCRSR/DCRDR.
+// The core must be halted.
+func (cd *CoreDebug) ReadCoreRegister(reg CoreRegister) (uint32, error) {
+	if err := cd.WriteDCRSR(DCRSR(reg) & RegSelMask); err != nil {
+		return 0, err
+	}
+
+	if err := cd.waitForRegisterReady(); err != nil {
+		return 0, fmt.Errorf("read %s: %w", reg, err)
+	}
+
+	dcrdr, err := cd.ReadDCRDR()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(dcrdr), nil
+}
+
+// WriteCoreRegister writes a core register through DCRSR/DCRDR.
+// The core must be halted.
+func (cd *CoreDebug) WriteCoreRegister(reg CoreRegister, value uint32) error {
+	if err := cd.WriteDCRDR(DCRDR(value)); err != nil {
+		return err
+	}
+
+	if err := cd.WriteDCRSR((DCRSR(reg) & RegSelMask) | RegWnR); err != nil {
+		return err
+	}
+
+	if err := cd.waitForRegisterReady(); err != nil {
+		return fmt.Errorf("write %s: %w", reg, err)
+	}
+
+	return nil
+}
+
+// ReadVectorCatch returns the vector catch bits currently set in DEMCR.
+func (cd *CoreDebug) ReadVectorCatch() (DEMCR, error) {
+	demcr, err := cd.ReadDEMCR()
+	if err != nil {
+		return 0, err
+	}
+
+	return demcr & DEMCRVcMask, nil
+}
+
+// VectorCatch configures which exceptions halt the core on entry.
+// Only the vector catch bits of DEMCR are modified, pass 0 to disable all catches.
+func (cd *CoreDebug) VectorCatch(vc DEMCR) error {
+	demcr, err := cd.ReadDEMCR()
+	if err != nil {
+		return err
+	}
+
+	demcr &= ^DEMCRVcMask
+	demcr |= vc & DEMCRVcMask
+
+	return cd.WriteDEMCR(demcr)
+}
+
 func New(swd *swd.SWD) *CoreDebug {
 	return &CoreDebug{
 		swd: swd,
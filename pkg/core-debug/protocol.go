@@ -1,5 +1,7 @@
 package coredebug
 
+import "fmt"
+
 // https://developer.arm.com/documentation/ddi0337/e/core-debug/core-debug-registers
 
 // Debug Halting Control and Status Register
@@ -27,7 +29,7 @@ const (
 type DCRSR uint32
 
 const (
-	RegSelMask DCRSR = 0x1f
+	RegSelMask DCRSR = 0x7f
 	RegWnR     DCRSR = 1 << 16
 )
 
@@ -51,8 +53,83 @@ const (
 	DEMCRMonitoringStep    DEMCR = 1 << 18
 	DEMCRMonitoringReq     DEMCR = 1 << 19
 	DEMCREnableTrace       DEMCR = 1 << 24
+
+	DEMCRVcMask = DEMCRVcCoreReset |
+		DEMCRVcMmErr |
+		DEMCRVcNoCoproessorErr |
+		DEMCRVcCheckErr |
+		DEMCRVcStateErr |
+		DEMCRVcBusErr |
+		DEMCRVcIntErr |
+		DEMCRVcHardFaultErr
+
+	// All fault vector catches, without halting on core reset
+	DEMCRVcFaults = DEMCRVcMask & ^DEMCRVcCoreReset
+)
+
+// Core register numbers as used in the REGSEL field of DCRSR
+type CoreRegister uint8
+
+const (
+	CoreRegisterR0      CoreRegister = 0
+	CoreRegisterR1      CoreRegister = 1
+	CoreRegisterR2      CoreRegister = 2
+	CoreRegisterR3      CoreRegister = 3
+	CoreRegisterR4      CoreRegister = 4
+	CoreRegisterR5      CoreRegister = 5
+	CoreRegisterR6      CoreRegister = 6
+	CoreRegisterR7      CoreRegister = 7
+	CoreRegisterR8      CoreRegister = 8
+	CoreRegisterR9      CoreRegister = 9
+	CoreRegisterR10     CoreRegister = 10
+	CoreRegisterR11     CoreRegister = 11
+	CoreRegisterR12     CoreRegister = 12
+	CoreRegisterSP      CoreRegister = 13
+	CoreRegisterLR      CoreRegister = 14
+	CoreRegisterPC      CoreRegister = 15 // DebugReturnAddress
+	CoreRegisterXPSR    CoreRegister = 16
+	CoreRegisterMSP     CoreRegister = 17
+	CoreRegisterPSP     CoreRegister = 18
+	CoreRegisterSpecial CoreRegister = 20 // CONTROL, FAULTMASK, BASEPRI and PRIMASK
+
+	// Only available on cores with FPU
+	CoreRegisterFPSCR CoreRegister = 33
+	CoreRegisterS0    CoreRegister = 64
+	CoreRegisterS31   CoreRegister = 95
 )
 
+// CoreRegisterS returns the register number of the single precision FP register s<n>.
+func CoreRegisterS(n int) CoreRegister {
+	return CoreRegisterS0 + CoreRegister(n)
+}
+
+func (r CoreRegister) String() string {
+	switch {
+	case r <= CoreRegisterR12:
+		return fmt.Sprintf("r%d", r)
+	case r == CoreRegisterSP:
+		return "sp"
+	case r == CoreRegisterLR:
+		return "lr"
+	case r == CoreRegisterPC:
+		return "pc"
+	case r == CoreRegisterXPSR:
+		return "xpsr"
+	case r == CoreRegisterMSP:
+		return "msp"
+	case r == CoreRegisterPSP:
+		return "psp"
+	case r == CoreRegisterSpecial:
+		return "special"
+	case r == CoreRegisterFPSCR:
+		return "fpscr"
+	case r >= CoreRegisterS0 && r <= CoreRegisterS31:
+		return fmt.Sprintf("s%d", r-CoreRegisterS0)
+	default:
+		return fmt.Sprintf("reg%d", uint8(r))
+	}
+}
+
 const (
 	baseAddress = 0xe000edf0
 
@@ -0,0 +1,39 @@
+package dwt
+
+import "github.com/holoplot/go-swd/pkg/swd"
+
+type DWT struct {
+	swd *swd.SWD
+
+	// DWTv2 as found on ARMv8-M
+	v2 bool
+	// Comparator assignments, nil until probed
+	watchpoints []*Watchpoint
+}
+
+func (d *DWT) ReadCtrl() (Ctrl, error) {
+	reg, err := d.swd.ReadRegister(regCTRL)
+	if err != nil {
+		return 0, err
+	}
+
+	return Ctrl(reg), nil
+}
+
+func (d *DWT) WriteCtrl(ctrl Ctrl) error {
+	return d.swd.WriteRegister(regCTRL, uint32(ctrl))
+}
+
+func (d *DWT) ReadCycleCount() (uint32, error) {
+	return d.swd.ReadRegister(regCYCCNT)
+}
+
+func (d *DWT) WriteCycleCount(v uint32) error {
+	return d.swd.WriteRegister(regCYCCNT, v)
+}
+
+func New(swd *swd.SWD) *DWT {
+	return &DWT{
+		swd: swd,
+	}
+}
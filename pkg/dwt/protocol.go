@@ -0,0 +1,87 @@
+package dwt
+
+// https://developer.arm.com/documentation/ddi0403/ed/ Chapter C1.8, The Data Watchpoint and Trace unit
+
+// Control Register
+type Ctrl uint32
+
+const (
+	CtrlCycCntEnable       Ctrl = 1 << 0
+	CtrlPostPresetShift         = 1
+	CtrlPostPresetMask     Ctrl = 0xf << CtrlPostPresetShift
+	CtrlPostInitShift           = 5
+	CtrlPostInitMask       Ctrl = 0xf << CtrlPostInitShift
+	CtrlCycTap             Ctrl = 1 << 9
+	CtrlSyncTapShift            = 10
+	CtrlSyncTapMask        Ctrl = 0x3 << CtrlSyncTapShift
+	CtrlPCSampleEnable     Ctrl = 1 << 12
+	CtrlExcTraceEnable     Ctrl = 1 << 16
+	CtrlCPIEventEnable     Ctrl = 1 << 17
+	CtrlExcEventEnable     Ctrl = 1 << 18
+	CtrlSleepEventEnable   Ctrl = 1 << 19
+	CtrlLSUEventEnable     Ctrl = 1 << 20
+	CtrlFoldEventEnable    Ctrl = 1 << 21
+	CtrlCycEventEnable     Ctrl = 1 << 22
+	CtrlNoProfileCounters  Ctrl = 1 << 24
+	CtrlNoCycleCounter     Ctrl = 1 << 25
+	CtrlNoExternalTrigger  Ctrl = 1 << 26
+	CtrlNoTracePackets     Ctrl = 1 << 27
+	CtrlNumComparatorShift      = 28
+	CtrlNumComparatorMask  Ctrl = 0xf << CtrlNumComparatorShift
+)
+
+// NumComparators returns the number of implemented comparators.
+func (ctrl Ctrl) NumComparators() int {
+	return int((ctrl & CtrlNumComparatorMask) >> CtrlNumComparatorShift)
+}
+
+func (ctrl *Ctrl) SetPostPreset(v uint8) {
+	*ctrl &= ^CtrlPostPresetMask
+	*ctrl |= (Ctrl(v) << CtrlPostPresetShift) & CtrlPostPresetMask
+}
+
+func (ctrl *Ctrl) SetSyncTap(v uint8) {
+	*ctrl &= ^CtrlSyncTapMask
+	*ctrl |= (Ctrl(v) << CtrlSyncTapShift) & CtrlSyncTapMask
+}
+
+const (
+	baseAddress = 0xe0001000
+
+	regCTRL   = baseAddress + 0x0
+	regCYCCNT = baseAddress + 0x4
+)
+
+// Comparator Function Register
+type Function uint32
+
+const (
+	// ARMv6-M and ARMv7-M
+	FunctionDisabled       Function = 0x0
+	FunctionWatchRead      Function = 0x5
+	FunctionWatchWrite     Function = 0x6
+	FunctionWatchReadWrite Function = 0x7
+
+	// ARMv8-M
+	FunctionMatchReadWrite Function = 0x4
+	FunctionMatchWrite     Function = 0x5
+	FunctionMatchRead      Function = 0x6
+	FunctionActionDebug    Function = 0x1 << 4
+	FunctionDataSizeShift           = 10
+
+	FunctionMatched Function = 1 << 24
+)
+
+const (
+	devArchIDMask = 0xffff
+	devArchDWTv2  = 0x1a03
+)
+
+const (
+	regCOMP0     = baseAddress + 0x20
+	regMASK0     = baseAddress + 0x24
+	regFUNCTION0 = baseAddress + 0x28
+	regDEVARCH   = baseAddress + 0xfbc
+
+	comparatorStride = 0x10
+)
@@ -0,0 +1,220 @@
+package dwt
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+var (
+	ErrNoComparator          = errors.New("no free watchpoint comparator")
+	ErrUnsupportedWatchpoint = errors.New("watchpoint not supported")
+	ErrNotFound              = errors.New("watchpoint not found")
+)
+
+// Access selects which data accesses trigger a watchpoint
+type Access uint8
+
+const (
+	AccessRead      Access = 1 << 0
+	AccessWrite     Access = 1 << 1
+	AccessReadWrite        = AccessRead | AccessWrite
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	case AccessReadWrite:
+		return "access"
+	default:
+		return fmt.Sprintf("unknown:%d", uint8(a))
+	}
+}
+
+// Watchpoint halts the core on data accesses to Size bytes at Address.
+type Watchpoint struct {
+	Address uint32
+	Size    uint32
+	Access  Access
+}
+
+func (d *DWT) probe() error {
+	if d.watchpoints != nil {
+		return nil
+	}
+
+	ctrl, err := d.ReadCtrl()
+	if err != nil {
+		return fmt.Errorf("read DWT control: %w", err)
+	}
+
+	devArch, err := d.swd.ReadRegister(regDEVARCH)
+	if err != nil {
+		return fmt.Errorf("read DEVARCH: %w", err)
+	}
+
+	d.v2 = devArch&devArchIDMask == devArchDWTv2
+	d.watchpoints = make([]*Watchpoint, ctrl.NumComparators())
+
+	return nil
+}
+
+func (d *DWT) function(w Watchpoint) (Function, uint32, error) {
+	if w.Size == 0 || bits.OnesCount32(w.Size) != 1 || w.Address&(w.Size-1) != 0 {
+		return 0, 0, fmt.Errorf("%w: %d bytes at 0x%08x", ErrUnsupportedWatchpoint, w.Size, w.Address)
+	}
+
+	mask := uint32(bits.TrailingZeros32(w.Size))
+
+	if !d.v2 {
+		switch w.Access {
+		case AccessRead:
+			return FunctionWatchRead, mask, nil
+		case AccessWrite:
+			return FunctionWatchWrite, mask, nil
+		default:
+			return FunctionWatchReadWrite, mask, nil
+		}
+	}
+
+	// DWTv2 matches single accesses of up to a word
+	if w.Size > 4 {
+		return 0, 0, fmt.Errorf("%w: %d bytes at 0x%08x", ErrUnsupportedWatchpoint, w.Size, w.Address)
+	}
+
+	f := FunctionActionDebug | Function(mask)<<FunctionDataSizeShift
+
+	switch w.Access {
+	case AccessRead:
+		f |= FunctionMatchRead
+	case AccessWrite:
+		f |= FunctionMatchWrite
+	default:
+		f |= FunctionMatchReadWrite
+	}
+
+	return f, 0, nil
+}
+
+func (d *DWT) writeComparator(n int, comp, mask uint32, f Function) error {
+	offset := uint32(n) * comparatorStride
+
+	if err := d.swd.WriteRegister(regFUNCTION0+offset, uint32(FunctionDisabled)); err != nil {
+		return err
+	}
+
+	if f == FunctionDisabled {
+		return nil
+	}
+
+	if err := d.swd.WriteRegister(regCOMP0+offset, comp); err != nil {
+		return err
+	}
+
+	if !d.v2 {
+		if err := d.swd.WriteRegister(regMASK0+offset, mask); err != nil {
+			return err
+		}
+	}
+
+	return d.swd.WriteRegister(regFUNCTION0+offset, uint32(f))
+}
+
+// SetWatchpoint programs a free comparator. The trace enable bit in DEMCR must be set
+// for the DWT to be operational.
+func (d *DWT) SetWatchpoint(w Watchpoint) error {
+	if err := d.probe(); err != nil {
+		return err
+	}
+
+	f, mask, err := d.function(w)
+	if err != nil {
+		return err
+	}
+
+	for n, c := range d.watchpoints {
+		if c != nil {
+			continue
+		}
+
+		if err := d.writeComparator(n, w.Address, mask, f); err != nil {
+			return fmt.Errorf("write comparator %d: %w", n, err)
+		}
+
+		d.watchpoints[n] = &w
+
+		return nil
+	}
+
+	return ErrNoComparator
+}
+
+// ClearWatchpoint removes a watchpoint previously set with SetWatchpoint.
+func (d *DWT) ClearWatchpoint(w Watchpoint) error {
+	if err := d.probe(); err != nil {
+		return err
+	}
+
+	for n, c := range d.watchpoints {
+		if c == nil || *c != w {
+			continue
+		}
+
+		if err := d.writeComparator(n, 0, 0, FunctionDisabled); err != nil {
+			return fmt.Errorf("write comparator %d: %w", n, err)
+		}
+
+		d.watchpoints[n] = nil
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d bytes at 0x%08x", ErrNotFound, w.Size, w.Address)
+}
+
+// ClearAllWatchpoints disables all comparators.
+func (d *DWT) ClearAllWatchpoints() error {
+	if err := d.probe(); err != nil {
+		return err
+	}
+
+	for n := range d.watchpoints {
+		if err := d.writeComparator(n, 0, 0, FunctionDisabled); err != nil {
+			return fmt.Errorf("write comparator %d: %w", n, err)
+		}
+
+		d.watchpoints[n] = nil
+	}
+
+	return nil
+}
+
+// Matched returns the watchpoint that triggered since the last call, or nil.
+// Reading the function register clears its MATCHED flag.
+func (d *DWT) Matched() (*Watchpoint, error) {
+	if err := d.probe(); err != nil {
+		return nil, err
+	}
+
+	var matched *Watchpoint
+
+	for n, c := range d.watchpoints {
+		if c == nil {
+			continue
+		}
+
+		f, err := d.swd.ReadRegister(regFUNCTION0 + uint32(n)*comparatorStride)
+		if err != nil {
+			return nil, err
+		}
+
+		if Function(f)&FunctionMatched != 0 && matched == nil {
+			matched = c
+		}
+	}
+
+	return matched, nil
+}
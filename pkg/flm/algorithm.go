@@ -0,0 +1,273 @@
+package flm
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// http://www.keil.com/pack/doc/CMSIS/Pack/html/flashAlgorithm.html
+
+const (
+	sectionCode   = "PrgCode"
+	sectionData   = "PrgData"
+	sectionDevice = "DevDscr"
+
+	symbolDevice = "FlashDevice"
+
+	// Offsets within the FlashDevice structure
+	devVersion   = 0
+	devName      = 2
+	devNameSize  = 128
+	devType      = 130
+	devAddress   = 132
+	devSize      = 136
+	devPageSize  = 140
+	devEmpty     = 148
+	devProgTime  = 152
+	devEraseTime = 156
+	devSectors   = 160
+
+	sectorEnd = 0xffffffff
+)
+
+var ErrInvalidAlgorithm = errors.New("invalid flash algorithm")
+
+// Sector describes a run of sectors of equal size, starting at an offset from
+// the device address.
+type Sector struct {
+	Size   uint32
+	Offset uint32
+}
+
+// Device is the FlashDevice structure of an algorithm.
+type Device struct {
+	Version uint16
+	Name    string
+	Type    uint16
+	Address uint32
+	Size    uint32
+	// Programming page size, the maximum size passed to ProgramPage
+	PageSize   uint32
+	EmptyValue uint8
+	// Timeouts for programming a page and erasing a sector in milliseconds
+	ProgramTimeout uint32
+	EraseTimeout   uint32
+	Sectors        []Sector
+}
+
+// Algorithm is a position-independent flash algorithm. Entry points are offsets
+// into Code, which holds the code and data sections as loaded into RAM.
+type Algorithm struct {
+	Device Device
+	Code   []byte
+	// Offset of the data section, which the algorithm addresses through r9
+	StaticBase uint32
+
+	Init         uint32
+	UnInit       uint32
+	EraseChip    uint32
+	EraseSector  uint32
+	ProgramPage  uint32
+	HasUnInit    bool
+	HasEraseChip bool
+}
+
+// Open reads a .FLM file.
+func Open(path string) (*Algorithm, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse reads a flash algorithm from an ELF file.
+func Parse(r io.ReaderAt) (*Algorithm, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_ARM {
+		return nil, fmt.Errorf("%w: not a 32-bit ARM ELF file", ErrInvalidAlgorithm)
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("read symbols: %w", err)
+	}
+
+	addrs := map[string]uint32{}
+	for _, s := range symbols {
+		addrs[s.Name] = uint32(s.Value)
+	}
+
+	algo := &Algorithm{}
+
+	if err := algo.load(f); err != nil {
+		return nil, err
+	}
+
+	if err := algo.parseDevice(f, addrs); err != nil {
+		return nil, err
+	}
+
+	for _, fn := range []struct {
+		name     string
+		dst      *uint32
+		required bool
+		found    *bool
+	}{
+		{"Init", &algo.Init, true, nil},
+		{"UnInit", &algo.UnInit, false, &algo.HasUnInit},
+		{"EraseChip", &algo.EraseChip, false, &algo.HasEraseChip},
+		{"EraseSector", &algo.EraseSector, true, nil},
+		{"ProgramPage", &algo.ProgramPage, true, nil},
+	} {
+		addr, ok := addrs[fn.name]
+		if !ok && fn.required {
+			return nil, fmt.Errorf("%w: missing function %s", ErrInvalidAlgorithm, fn.name)
+		}
+
+		if ok && addr&^1 >= uint32(len(algo.Code)) {
+			return nil, fmt.Errorf("%w: function %s outside of code", ErrInvalidAlgorithm, fn.name)
+		}
+
+		*fn.dst = addr &^ 1
+
+		if fn.found != nil {
+			*fn.found = ok
+		}
+	}
+
+	return algo, nil
+}
+
+// load copies the code and data sections into a single blob. Both are linked
+// starting at address 0, zero-initialized data follows the initialized data.
+func (a *Algorithm) load(f *elf.File) error {
+	code := f.Section(sectionCode)
+	if code == nil {
+		return fmt.Errorf("%w: missing section %s", ErrInvalidAlgorithm, sectionCode)
+	}
+
+	end := uint32(0)
+
+	for _, s := range f.Sections {
+		if s.Name != sectionCode && s.Name != sectionData {
+			continue
+		}
+
+		if e := uint32(s.Addr + s.Size); e > end {
+			end = e
+		}
+	}
+
+	a.Code = make([]byte, end)
+
+	for _, s := range f.Sections {
+		if s.Name != sectionCode && s.Name != sectionData {
+			continue
+		}
+
+		if s.Name == sectionData && a.StaticBase == 0 {
+			a.StaticBase = uint32(s.Addr)
+		}
+
+		if s.Type == elf.SHT_NOBITS {
+			continue
+		}
+
+		data, err := s.Data()
+		if err != nil {
+			return fmt.Errorf("read section %s: %w", s.Name, err)
+		}
+
+		copy(a.Code[s.Addr:], data)
+	}
+
+	return nil
+}
+
+func (a *Algorithm) parseDevice(f *elf.File, addrs map[string]uint32) error {
+	sec := f.Section(sectionDevice)
+	addr, ok := addrs[symbolDevice]
+
+	if sec == nil || !ok || uint64(addr) < sec.Addr {
+		return fmt.Errorf("%w: missing %s", ErrInvalidAlgorithm, symbolDevice)
+	}
+
+	data, err := sec.Data()
+	if err != nil {
+		return fmt.Errorf("read section %s: %w", sectionDevice, err)
+	}
+
+	data = data[uint64(addr)-sec.Addr:]
+	if len(data) < devSectors {
+		return fmt.Errorf("%w: %s truncated", ErrInvalidAlgorithm, symbolDevice)
+	}
+
+	le := binary.LittleEndian
+	name := data[devName : devName+devNameSize]
+
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+
+	a.Device = Device{
+		Version:        le.Uint16(data[devVersion:]),
+		Name:           string(name),
+		Type:           le.Uint16(data[devType:]),
+		Address:        le.Uint32(data[devAddress:]),
+		Size:           le.Uint32(data[devSize:]),
+		PageSize:       le.Uint32(data[devPageSize:]),
+		EmptyValue:     data[devEmpty],
+		ProgramTimeout: le.Uint32(data[devProgTime:]),
+		EraseTimeout:   le.Uint32(data[devEraseTime:]),
+	}
+
+	for p := data[devSectors:]; len(p) >= 8; p = p[8:] {
+		size, offset := le.Uint32(p), le.Uint32(p[4:])
+		if size == sectorEnd && offset == sectorEnd {
+			break
+		}
+
+		a.Device.Sectors = append(a.Device.Sectors, Sector{Size: size, Offset: offset})
+	}
+
+	if len(a.Device.Sectors) == 0 || a.Device.PageSize == 0 {
+		return fmt.Errorf("%w: no sectors", ErrInvalidAlgorithm)
+	}
+
+	return nil
+}
+
+// sectorSizes expands the sector runs to the size of each sector.
+func (d Device) sectorSizes() []uint32 {
+	var sizes []uint32
+
+	for i, s := range d.Sectors {
+		end := d.Size
+		if i+1 < len(d.Sectors) {
+			end = d.Sectors[i+1].Offset
+		}
+
+		if s.Size == 0 {
+			break
+		}
+
+		for offset := s.Offset; offset < end; offset += s.Size {
+			sizes = append(sizes, s.Size)
+		}
+	}
+
+	return sizes
+}
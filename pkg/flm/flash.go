@@ -0,0 +1,527 @@
+package flm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/image"
+	"github.com/holoplot/go-swd/pkg/stm32"
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+const (
+	// RAM reserved in front of the algorithm for the BKPT the functions return to
+	trampolineSize = 0x20
+	// BKPT #0, twice
+	trampoline   = 0xbe00be00
+	minStackSize = 0x200
+
+	// Function codes passed to Init and UnInit
+	fnErase   = 1
+	fnProgram = 2
+	fnVerify  = 3
+
+	// Added to the timeouts of the algorithm to cover debugger latencies
+	timeoutMargin = time.Second
+	initTimeout   = time.Second
+
+	xpsrThumb = 1 << 24
+	// PRIMASK in the special purpose register
+	specialPrimask = 1 << 0
+)
+
+// Flash programs flash memory through a flash algorithm running on the target.
+// It implements the same interface as stm32.Flash, addresses are offsets from
+// the device address of the algorithm.
+type Flash struct {
+	swd  *swd.SWD
+	core *cd.CoreDebug
+	algo *Algorithm
+
+	ramAddr  uint32
+	ramSize  uint32
+	loadAddr uint32
+	buffer   uint32
+	stack    uint32
+
+	loaded   bool
+	geometry stm32.Geometry
+	progress stm32.ProgressFunc
+}
+
+var _ stm32.FlashDriver = (*Flash)(nil)
+
+// New returns a driver that loads algo into ramSize bytes of target RAM at
+// ramAddr. The core is halted and its registers are clobbered while the
+// algorithm runs.
+func New(swd *swd.SWD, algo *Algorithm, ramAddr, ramSize uint32) *Flash {
+	f := &Flash{
+		swd:     swd,
+		core:    cd.New(swd),
+		algo:    algo,
+		ramAddr: ramAddr,
+		ramSize: ramSize,
+	}
+
+	f.geometry = geometry(algo.Device)
+
+	return f
+}
+
+func geometry(d Device) stm32.Geometry {
+	g := stm32.Geometry{Size: d.Size, Banks: 1}
+	sizes := d.sectorSizes()
+
+	for _, s := range sizes {
+		if s != sizes[0] {
+			g.Sectors = sizes
+			return g
+		}
+	}
+
+	if len(sizes) > 0 {
+		g.PageSize = sizes[0]
+	}
+
+	return g
+}
+
+// Initialize halts the core and downloads the algorithm.
+func (f *Flash) Initialize() error {
+	f.loadAddr = f.ramAddr + trampolineSize
+	f.buffer = f.loadAddr + (uint32(len(f.algo.Code))+7)&^7
+	f.stack = (f.ramAddr + f.ramSize) &^ 7
+
+	if f.buffer+f.algo.Device.PageSize+minStackSize > f.stack {
+		return fmt.Errorf("algorithm needs more than %d bytes of RAM", f.ramSize)
+	}
+
+	if err := f.core.Halt(); err != nil {
+		return fmt.Errorf("halt: %w", err)
+	}
+
+	head := make([]byte, trampolineSize)
+	for i := 0; i < len(head); i += 4 {
+		binary.LittleEndian.PutUint32(head[i:], trampoline)
+	}
+
+	if err := f.swd.WriteMemory(f.ramAddr, head); err != nil {
+		return fmt.Errorf("download trampoline: %w", err)
+	}
+
+	if err := f.swd.WriteMemory(f.loadAddr, f.algo.Code); err != nil {
+		return fmt.Errorf("download algorithm: %w", err)
+	}
+
+	f.loaded = true
+
+	return nil
+}
+
+func (f *Flash) ensureLoaded() error {
+	if f.loaded {
+		return nil
+	}
+
+	return f.Initialize()
+}
+
+// Algorithm returns the flash algorithm used by the driver.
+func (f *Flash) Algorithm() *Algorithm {
+	return f.algo
+}
+
+func (f *Flash) Geometry() stm32.Geometry {
+	return f.geometry
+}
+
+func (f *Flash) SetProgressFunc(fn stm32.ProgressFunc) {
+	f.progress = fn
+}
+
+type registerValue struct {
+	reg cd.CoreRegister
+	val uint32
+}
+
+// call runs the function at offset fn of the algorithm and returns its result.
+// Interrupts are masked, as the firmware's handlers and vector table may be
+// erased while the algorithm runs.
+func (f *Flash) call(fn uint32, timeout time.Duration, args ...uint32) (uint32, error) {
+	special, err := f.core.ReadCoreRegister(cd.CoreRegisterSpecial)
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %w", cd.CoreRegisterSpecial, err)
+	}
+
+	regs := []registerValue{
+		{cd.CoreRegisterR9, f.loadAddr + f.algo.StaticBase},
+		{cd.CoreRegisterSP, f.stack},
+		{cd.CoreRegisterLR, f.ramAddr | 1},
+		{cd.CoreRegisterPC, f.loadAddr + fn},
+		{cd.CoreRegisterXPSR, xpsrThumb},
+		{cd.CoreRegisterSpecial, special | specialPrimask},
+	}
+
+	for i, arg := range args {
+		regs = append(regs, registerValue{cd.CoreRegisterR0 + cd.CoreRegister(i), arg})
+	}
+
+	for _, r := range regs {
+		if err := f.core.WriteCoreRegister(r.reg, r.val); err != nil {
+			return 0, fmt.Errorf("write %s: %w", r.reg, err)
+		}
+	}
+
+	if err := f.core.Continue(); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	for {
+		dhcsr, err := f.core.ReadDHCSR()
+		if err != nil {
+			return 0, err
+		}
+
+		if dhcsr&cd.DHCSRSHalt != 0 {
+			break
+		}
+
+		if time.Since(start) > timeout {
+			_ = f.core.Halt()
+
+			return 0, stm32.ErrTimeout
+		}
+	}
+
+	pc, err := f.core.ReadCoreRegister(cd.CoreRegisterPC)
+	if err != nil {
+		return 0, err
+	}
+
+	if pc < f.ramAddr || pc >= f.loadAddr {
+		return 0, fmt.Errorf("algorithm halted at 0x%08x", pc)
+	}
+
+	return f.core.ReadCoreRegister(cd.CoreRegisterR0)
+}
+
+// check calls a function and fails if it does not return 0.
+func (f *Flash) check(name string, fn uint32, timeout time.Duration, args ...uint32) error {
+	ret, err := f.call(fn, timeout, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	if ret != 0 {
+		return fmt.Errorf("%s failed with %d", name, ret)
+	}
+
+	return nil
+}
+
+// run wraps op in calls to Init and UnInit with the function code fnc.
+func (f *Flash) run(fnc uint32, op func() error) error {
+	if err := f.ensureLoaded(); err != nil {
+		return err
+	}
+
+	if err := f.check("Init", f.algo.Init, initTimeout, f.algo.Device.Address, 0, fnc); err != nil {
+		return err
+	}
+
+	err := op()
+
+	if f.algo.HasUnInit {
+		if uerr := f.check("UnInit", f.algo.UnInit, initTimeout, fnc); err == nil {
+			err = uerr
+		}
+	}
+
+	return err
+}
+
+func (f *Flash) programTimeout() time.Duration {
+	return time.Duration(f.algo.Device.ProgramTimeout)*time.Millisecond + timeoutMargin
+}
+
+func (f *Flash) eraseTimeout() time.Duration {
+	return time.Duration(f.algo.Device.EraseTimeout)*time.Millisecond + timeoutMargin
+}
+
+func (f *Flash) Read(addr, size uint32, writer io.Writer) error {
+	buf := make([]byte, size)
+
+	if err := f.swd.ReadMemory(f.algo.Device.Address+addr, buf); err != nil {
+		return err
+	}
+
+	_, err := writer.Write(buf)
+
+	return err
+}
+
+// Write programs the data read from reader at offset addr. The data is padded
+// to whole pages with the erased value, so the pages must have been erased.
+func (f *Flash) Write(addr uint32, reader io.Reader) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.writeSegments(image.FromBinary(f.algo.Device.Address+addr, data))
+
+	return err
+}
+
+func (f *Flash) ErasePage(page uint32) error {
+	if page >= f.geometry.Pages() {
+		return fmt.Errorf("page %d out of range, flash has %d pages", page, f.geometry.Pages())
+	}
+
+	return f.run(fnErase, func() error {
+		return f.erasePage(page)
+	})
+}
+
+func (f *Flash) erasePage(page uint32) error {
+	start := uint32(0)
+
+	if f.geometry.Sectors == nil {
+		start = page * f.geometry.PageSize
+	} else {
+		for _, s := range f.geometry.Sectors[:page] {
+			start += s
+		}
+	}
+
+	return f.check("EraseSector", f.algo.EraseSector, f.eraseTimeout(), f.algo.Device.Address+start)
+}
+
+func (f *Flash) EraseRange(addr, size uint32) error {
+	if size == 0 {
+		return nil
+	}
+
+	return f.run(fnErase, func() error {
+		for offset := addr; offset < addr+size; {
+			page, start, pageSize, err := f.geometry.Page(offset)
+			if err != nil {
+				return err
+			}
+
+			if err := f.erasePage(page); err != nil {
+				return err
+			}
+
+			offset = start + pageSize
+		}
+
+		return nil
+	})
+}
+
+// EraseAll uses EraseChip if the algorithm provides it and erases every sector
+// otherwise.
+func (f *Flash) EraseAll(timeout time.Duration) error {
+	tr := f.newTracker(stm32.PhaseErase, 0)
+
+	err := f.run(fnErase, func() error {
+		if f.algo.HasEraseChip {
+			return f.check("EraseChip", f.algo.EraseChip, timeout)
+		}
+
+		for page := uint32(0); page < f.geometry.Pages(); page++ {
+			if err := f.erasePage(page); err != nil {
+				return err
+			}
+
+			tr.Report()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	tr.Finish()
+
+	return nil
+}
+
+// erasePages erases every page touched by the image once and returns the number
+// of bytes erased.
+func (f *Flash) erasePages(img *image.Image) (uint32, error) {
+	base := f.algo.Device.Address
+	pages := map[uint32]uint32{}
+	var order []uint32
+
+	for _, seg := range img.Segments {
+		if seg.Address < base || uint64(seg.End()) > uint64(base)+uint64(f.geometry.Size) {
+			return 0, fmt.Errorf("segment %s outside of flash", seg)
+		}
+
+		for offset := seg.Address - base; offset < seg.End()-base; {
+			page, start, size, err := f.geometry.Page(offset)
+			if err != nil {
+				return 0, err
+			}
+
+			if _, ok := pages[page]; !ok {
+				pages[page] = size
+				order = append(order, page)
+			}
+
+			offset = start + size
+		}
+	}
+
+	total := uint32(0)
+	for _, size := range pages {
+		total += size
+	}
+
+	tr := f.newTracker(stm32.PhaseErase, total)
+
+	err := f.run(fnErase, func() error {
+		for _, page := range order {
+			if err := f.erasePage(page); err != nil {
+				return fmt.Errorf("erase page %d: %w", page, err)
+			}
+
+			tr.Add(pages[page])
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return tr.Done(), err
+	}
+
+	tr.Finish()
+
+	return tr.Done(), nil
+}
+
+// writeSegments programs the image page by page through the buffer in RAM and
+// returns the number of bytes written.
+func (f *Flash) writeSegments(img *image.Image) (uint32, error) {
+	base := f.algo.Device.Address
+	pageSize := f.algo.Device.PageSize
+	segments := img.Aligned(pageSize, f.algo.Device.EmptyValue)
+
+	total := uint32(0)
+	for _, seg := range segments {
+		total += uint32(len(seg.Data))
+	}
+
+	tr := f.newTracker(stm32.PhaseWrite, total)
+
+	err := f.run(fnProgram, func() error {
+		for _, seg := range segments {
+			if seg.Address < base || uint64(seg.End()) > uint64(base)+uint64(f.geometry.Size) {
+				return fmt.Errorf("segment %s outside of flash", seg)
+			}
+
+			for i := uint32(0); i < uint32(len(seg.Data)); i += pageSize {
+				page := seg.Data[i : i+pageSize]
+				addr := seg.Address + i
+
+				if err := f.swd.WriteMemory(f.buffer, page); err != nil {
+					return err
+				}
+
+				if err := f.check("ProgramPage", f.algo.ProgramPage, f.programTimeout(),
+					addr, pageSize, f.buffer); err != nil {
+					return fmt.Errorf("write 0x%08x: %w", addr, err)
+				}
+
+				tr.Add(pageSize)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return tr.Done(), err
+	}
+
+	tr.Finish()
+
+	return tr.Done(), nil
+}
+
+// WriteImage erases the pages covered by the image and programs all of its
+// segments.
+func (f *Flash) WriteImage(img *image.Image) (summary stm32.Summary, err error) {
+	retries := f.swd.WaitRetries()
+
+	defer func() {
+		summary.Retries = f.swd.WaitRetries() - retries
+	}()
+
+	start := time.Now()
+
+	if summary.Erased, err = f.erasePages(img); err != nil {
+		return summary, err
+	}
+
+	summary.EraseTime = time.Since(start)
+	start = time.Now()
+
+	if summary.Written, err = f.writeSegments(img); err != nil {
+		return summary, err
+	}
+
+	summary.WriteTime = time.Since(start)
+
+	return summary, nil
+}
+
+// VerifyImage reads back the flash and compares it with the image.
+func (f *Flash) VerifyImage(img *image.Image) (summary stm32.Summary, err error) {
+	retries := f.swd.WaitRetries()
+
+	defer func() {
+		summary.Retries = f.swd.WaitRetries() - retries
+	}()
+
+	tr := f.newTracker(stm32.PhaseVerify, uint32(img.Size()))
+
+	for _, seg := range img.Segments {
+		got := make([]byte, len(seg.Data))
+
+		if err := f.swd.ReadMemory(seg.Address, got); err != nil {
+			return summary, fmt.Errorf("read %s: %w", seg, err)
+		}
+
+		if !bytes.Equal(got, seg.Data) {
+			for i := range got {
+				if got[i] != seg.Data[i] {
+					return summary, fmt.Errorf("%w at 0x%08x: read 0x%02x, expected 0x%02x",
+						stm32.ErrVerify, seg.Address+uint32(i), got[i], seg.Data[i])
+				}
+			}
+		}
+
+		tr.Add(uint32(len(got)))
+	}
+
+	summary.Verified = tr.Done()
+	summary.VerifyTime = tr.Finish()
+
+	return summary, nil
+}
+
+func (f *Flash) newTracker(phase stm32.Phase, total uint32) *stm32.Tracker {
+	return stm32.NewTracker(f.progress, phase, total)
+}
@@ -0,0 +1,244 @@
+package flm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/image"
+	"github.com/holoplot/go-swd/pkg/io/sim"
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+const (
+	testInit        = 0x01
+	testUnInit      = 0x05
+	testEraseSector = 0x09
+	testProgramPage = 0x0d
+	testStaticBase  = 0x40
+	testDeviceAddr  = 0x1000
+)
+
+// buildFLM returns a minimal flash algorithm with a 1 KB page size and four 1 KB
+// sectors followed by a 4 KB sector.
+func buildFLM() []byte {
+	le := binary.LittleEndian
+
+	code := make([]byte, testStaticBase)
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	dev := make([]byte, devSectors)
+	le.PutUint16(dev[devVersion:], 0x101)
+	copy(dev[devName:], "Test 8KB Flash")
+	le.PutUint16(dev[devType:], 1)
+	le.PutUint32(dev[devAddress:], 0x08000000)
+	le.PutUint32(dev[devSize:], 0x2000)
+	le.PutUint32(dev[devPageSize:], 0x400)
+	dev[devEmpty] = 0xff
+	le.PutUint32(dev[devProgTime:], 100)
+	le.PutUint32(dev[devEraseTime:], 500)
+
+	for _, v := range []uint32{0x400, 0, 0x1000, 0x1000, sectorEnd, sectorEnd} {
+		dev = le.AppendUint32(dev, v)
+	}
+
+	strtab := []byte("\x00Init\x00UnInit\x00EraseSector\x00ProgramPage\x00FlashDevice\x00")
+	shstrtab := []byte("\x00PrgCode\x00PrgData\x00DevDscr\x00.symtab\x00.strtab\x00.shstrtab\x00")
+
+	symtab := make([]byte, 16)
+	for _, s := range []struct {
+		name, value uint32
+		shndx       uint16
+	}{
+		{1, testInit, 1},
+		{6, testUnInit, 1},
+		{13, testEraseSector, 1},
+		{25, testProgramPage, 1},
+		{37, testDeviceAddr, 3},
+	} {
+		symtab = le.AppendUint32(symtab, s.name)
+		symtab = le.AppendUint32(symtab, s.value)
+		symtab = le.AppendUint32(symtab, 0)
+		symtab = append(symtab, 0x12, 0)
+		symtab = le.AppendUint16(symtab, s.shndx)
+	}
+
+	type section struct {
+		name, typ, flags, addr uint32
+		data                   []byte
+		link, entsize          uint32
+	}
+
+	sections := []section{
+		{},
+		{1, 1, 6, 0, code, 0, 0},
+		{9, 1, 3, testStaticBase, data, 0, 0},
+		{17, 1, 2, testDeviceAddr, dev, 0, 0},
+		{25, 2, 0, 0, symtab, 5, 16},
+		{33, 3, 0, 0, strtab, 0, 0},
+		{41, 3, 0, 0, shstrtab, 0, 0},
+	}
+
+	const ehdrSize, shdrSize = 52, 40
+
+	body := &bytes.Buffer{}
+	offsets := make([]uint32, len(sections))
+
+	for i, s := range sections {
+		offsets[i] = uint32(ehdrSize + body.Len())
+		body.Write(s.data)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	_ = binary.Write(buf, le, []uint16{2, 40})
+	_ = binary.Write(buf, le, []uint32{1, 0, 0, uint32(ehdrSize + body.Len()), 0x05000000})
+	_ = binary.Write(buf, le, []uint16{ehdrSize, 0, 0, shdrSize, uint16(len(sections)), 6})
+	buf.Write(body.Bytes())
+
+	for i, s := range sections {
+		if i == 0 {
+			buf.Write(make([]byte, shdrSize))
+			continue
+		}
+
+		info := uint32(0)
+		if s.typ == 2 {
+			info = 1
+		}
+
+		_ = binary.Write(buf, le, []uint32{s.name, s.typ, s.flags, s.addr, offsets[i],
+			uint32(len(s.data)), s.link, info, 4, s.entsize})
+	}
+
+	return buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	algo, err := Parse(bytes.NewReader(buildFLM()))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	d := algo.Device
+	if d.Name != "Test 8KB Flash" || d.Address != 0x08000000 || d.Size != 0x2000 || d.PageSize != 0x400 {
+		t.Errorf("device: got %+v", d)
+	}
+
+	if algo.Init != testInit&^1 || algo.ProgramPage != testProgramPage&^1 || !algo.HasUnInit || algo.HasEraseChip {
+		t.Errorf("functions: got %+v", algo)
+	}
+
+	if algo.StaticBase != testStaticBase || len(algo.Code) != testStaticBase+8 {
+		t.Errorf("code: static base 0x%x, %d bytes", algo.StaticBase, len(algo.Code))
+	}
+
+	g := geometry(d)
+	if g.Pages() != 5 || g.Sectors[4] != 0x1000 {
+		t.Errorf("geometry: got %s", g)
+	}
+}
+
+// runAlgorithm emulates the algorithm functions whenever the core is started.
+func runAlgorithm(target *sim.Target, loadAddr uint32, calls chan<- string, done <-chan struct{}) {
+	core := target.Core()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if core.Halted() {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		r0, r1, r2 := core.Register(cd.CoreRegisterR0), core.Register(cd.CoreRegisterR1), core.Register(cd.CoreRegisterR2)
+
+		switch core.Register(cd.CoreRegisterPC) - loadAddr {
+		case testInit &^ 1:
+			calls <- "Init"
+		case testUnInit &^ 1:
+			calls <- "UnInit"
+		case testEraseSector &^ 1:
+			target.Load(r0, bytes.Repeat([]byte{0xff}, 0x400))
+			calls <- "EraseSector"
+		case testProgramPage &^ 1:
+			target.Load(r0, target.Dump(r2, int(r1)))
+			calls <- "ProgramPage"
+		}
+
+		if core.Register(cd.CoreRegisterR9) != loadAddr+testStaticBase {
+			calls <- "bad static base"
+		}
+
+		if core.Register(cd.CoreRegisterSpecial)&specialPrimask == 0 {
+			calls <- "interrupts enabled"
+		}
+
+		core.SetRegister(cd.CoreRegisterR0, 0)
+		core.Break(core.Register(cd.CoreRegisterLR)&^1, scb.DFSRBkpt)
+	}
+}
+
+func TestWriteImage(t *testing.T) {
+	const ramAddr = 0x20000000
+
+	algo, err := Parse(bytes.NewReader(buildFLM()))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	target := sim.New()
+	flash := New(swd.New(target), algo, ramAddr, 0x1000)
+
+	calls := make(chan string, 100)
+	done := make(chan struct{})
+	defer close(done)
+
+	go runAlgorithm(target, ramAddr+trampolineSize, calls, done)
+
+	data := bytes.Repeat([]byte{0x5a}, 0x500)
+	img := image.FromBinary(0x08000300, data)
+
+	if _, err := flash.WriteImage(img); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	close(calls)
+
+	var got []string
+	for c := range calls {
+		got = append(got, c)
+	}
+
+	want := []string{"Init", "EraseSector", "EraseSector", "UnInit", "Init", "ProgramPage", "ProgramPage", "UnInit"}
+	if len(got) != len(want) {
+		t.Fatalf("calls: got %v, want %v", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("calls: got %v, want %v", got, want)
+			break
+		}
+	}
+
+	flashData := target.Dump(0x08000000, 0x800)
+	if !bytes.Equal(flashData[0x300:], data) || flashData[0] != 0xff {
+		t.Errorf("flash content differs")
+	}
+
+	if _, err := flash.VerifyImage(img); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	if got := target.Dump(ramAddr+trampolineSize, len(algo.Code)); !bytes.Equal(got, algo.Code) {
+		t.Errorf("algorithm not downloaded")
+	}
+}
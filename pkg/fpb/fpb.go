@@ -0,0 +1,189 @@
+package fpb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+var (
+	ErrNoComparator       = errors.New("no free breakpoint comparator")
+	ErrUnsupportedAddress = errors.New("address not supported by breakpoint unit")
+	ErrNotFound           = errors.New("breakpoint not found")
+)
+
+// FPB manages hardware breakpoints with the Flash Patch and Breakpoint unit.
+type FPB struct {
+	swd *swd.SWD
+
+	revision int
+	// Shadow copies of the comparator registers, nil until probed
+	comparators []uint32
+}
+
+func (f *FPB) ReadCtrl() (Ctrl, error) {
+	reg, err := f.swd.ReadRegister(regCTRL)
+	if err != nil {
+		return 0, err
+	}
+
+	return Ctrl(reg), nil
+}
+
+func (f *FPB) WriteCtrl(ctrl Ctrl) error {
+	return f.swd.WriteRegister(regCTRL, uint32(ctrl|CtrlKey))
+}
+
+func (f *FPB) probe() error {
+	if f.comparators != nil {
+		return nil
+	}
+
+	ctrl, err := f.ReadCtrl()
+	if err != nil {
+		return fmt.Errorf("read FP_CTRL: %w", err)
+	}
+
+	f.revision = ctrl.Revision()
+	f.comparators = make([]uint32, ctrl.NumCode())
+
+	return nil
+}
+
+// NumBreakpoints returns the number of hardware breakpoints.
+func (f *FPB) NumBreakpoints() (int, error) {
+	if err := f.probe(); err != nil {
+		return 0, err
+	}
+
+	return len(f.comparators), nil
+}
+
+// Enable turns on the unit and clears all comparators.
+func (f *FPB) Enable() error {
+	if err := f.probe(); err != nil {
+		return err
+	}
+
+	if err := f.ClearAll(); err != nil {
+		return err
+	}
+
+	return f.WriteCtrl(CtrlEnable)
+}
+
+func (f *FPB) Disable() error {
+	return f.WriteCtrl(0)
+}
+
+// encode returns the comparator value matching the instruction at addr, together
+// with the mask of bits that identify the matched address.
+func (f *FPB) encode(addr uint32) (uint32, uint32, error) {
+	if f.revision >= revisionFPBv2 {
+		return addr&^1 | compEnable, ^uint32(1), nil
+	}
+
+	if addr >= codeRegionEnd {
+		return 0, 0, fmt.Errorf("%w: 0x%08x", ErrUnsupportedAddress, addr)
+	}
+
+	replace := uint32(compReplaceLower)
+	if addr&2 != 0 {
+		replace = compReplaceUpper
+	}
+
+	return addr&compAddressMask | replace | compEnable, compAddressMask, nil
+}
+
+func (f *FPB) writeComparator(n int, v uint32) error {
+	if err := f.swd.WriteRegister(regCOMP0+uint32(n)*4, v); err != nil {
+		return fmt.Errorf("write FP_COMP%d: %w", n, err)
+	}
+
+	f.comparators[n] = v
+
+	return nil
+}
+
+// SetBreakpoint halts the core when the instruction at addr is executed.
+func (f *FPB) SetBreakpoint(addr uint32) error {
+	if err := f.probe(); err != nil {
+		return err
+	}
+
+	v, mask, err := f.encode(addr)
+	if err != nil {
+		return err
+	}
+
+	free := -1
+
+	for n, c := range f.comparators {
+		switch {
+		case c&compEnable == 0:
+			if free < 0 {
+				free = n
+			}
+
+		case c&mask == v&mask:
+			// FPBv1 can match both halfwords of a word with one comparator
+			return f.writeComparator(n, c|v)
+		}
+	}
+
+	if free < 0 {
+		return ErrNoComparator
+	}
+
+	return f.writeComparator(free, v)
+}
+
+// ClearBreakpoint removes the breakpoint at addr.
+func (f *FPB) ClearBreakpoint(addr uint32) error {
+	if err := f.probe(); err != nil {
+		return err
+	}
+
+	v, mask, err := f.encode(addr)
+	if err != nil {
+		return err
+	}
+
+	for n, c := range f.comparators {
+		if c&compEnable == 0 || c&mask != v&mask {
+			continue
+		}
+
+		if f.revision < revisionFPBv2 {
+			if c &^= v & compReplaceMask; c&compReplaceMask != 0 {
+				return f.writeComparator(n, c)
+			}
+		}
+
+		return f.writeComparator(n, 0)
+	}
+
+	return fmt.Errorf("%w: 0x%08x", ErrNotFound, addr)
+}
+
+// ClearAll disables all comparators.
+func (f *FPB) ClearAll() error {
+	if err := f.probe(); err != nil {
+		return err
+	}
+
+	for n := range f.comparators {
+		if err := f.writeComparator(n, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func New(swd *swd.SWD) *FPB {
+	return &FPB{
+		swd: swd,
+	}
+}
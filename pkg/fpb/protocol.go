@@ -0,0 +1,57 @@
+package fpb
+
+// https://developer.arm.com/documentation/ddi0403/ed/ Chapter C1.11, Flash Patch and Breakpoint unit
+
+// Flash Patch Control Register
+type Ctrl uint32
+
+const (
+	CtrlEnable           Ctrl = 1 << 0
+	CtrlKey              Ctrl = 1 << 1
+	CtrlNumCodeLowShift       = 4
+	CtrlNumCodeLowMask   Ctrl = 0xf << CtrlNumCodeLowShift
+	CtrlNumLitShift           = 8
+	CtrlNumLitMask       Ctrl = 0xf << CtrlNumLitShift
+	CtrlNumCodeHighShift      = 12
+	CtrlNumCodeHighMask  Ctrl = 0x7 << CtrlNumCodeHighShift
+	CtrlRevisionShift         = 28
+	CtrlRevisionMask     Ctrl = 0xf << CtrlRevisionShift
+)
+
+// NumCode returns the number of instruction address comparators.
+func (ctrl Ctrl) NumCode() int {
+	return int((ctrl&CtrlNumCodeLowMask)>>CtrlNumCodeLowShift) |
+		int((ctrl&CtrlNumCodeHighMask)>>CtrlNumCodeHighShift)<<4
+}
+
+// NumLit returns the number of literal address comparators.
+func (ctrl Ctrl) NumLit() int {
+	return int((ctrl & CtrlNumLitMask) >> CtrlNumLitShift)
+}
+
+// Revision returns 0 for the original FPB and 1 for FPBv2, which can set breakpoints
+// on any address.
+func (ctrl Ctrl) Revision() int {
+	return int((ctrl & CtrlRevisionMask) >> CtrlRevisionShift)
+}
+
+const (
+	compEnable = 1 << 0
+
+	// FPBv1 only
+	compAddressMask  = 0x1ffffffc
+	compReplaceShift = 30
+	compReplaceLower = 1 << compReplaceShift
+	compReplaceUpper = 2 << compReplaceShift
+	compReplaceMask  = 3 << compReplaceShift
+	codeRegionEnd    = 0x20000000
+	revisionFPBv2    = 1
+)
+
+const (
+	baseAddress = 0xe0002000
+
+	regCTRL  = baseAddress + 0x0
+	regREMAP = baseAddress + 0x4
+	regCOMP0 = baseAddress + 0x8
+)
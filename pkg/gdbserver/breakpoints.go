@@ -0,0 +1,115 @@
+package gdbserver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holoplot/go-swd/pkg/dwt"
+	"github.com/holoplot/go-swd/pkg/fpb"
+)
+
+const (
+	breakpointSoftware = '0'
+	breakpointHardware = '1'
+	watchpointWrite    = '2'
+	watchpointRead     = '3'
+	watchpointAccess   = '4'
+)
+
+// Thumb BKPT #0 instruction in little endian byte order
+var bkptInstruction = []byte{0x00, 0xbe}
+
+// breakpoint handles the Z and z packets.
+func (s *session) breakpoint(insert bool, args string) (string, error) {
+	if len(args) < 2 || args[1] != ',' {
+		return "", fmt.Errorf("malformed breakpoint %q", args)
+	}
+
+	addr, kind, err := parseAddressLength(args[2:])
+	if err != nil {
+		return "", err
+	}
+
+	switch args[0] {
+	case breakpointSoftware:
+		err = s.softwareBreakpoint(insert, addr)
+
+	case breakpointHardware:
+		if insert {
+			err = s.server.fpb.SetBreakpoint(addr)
+		} else {
+			err = s.server.fpb.ClearBreakpoint(addr)
+		}
+
+	case watchpointWrite, watchpointRead, watchpointAccess:
+		w := dwt.Watchpoint{
+			Address: addr,
+			Size:    kind,
+			Access: map[byte]dwt.Access{
+				watchpointWrite:  dwt.AccessWrite,
+				watchpointRead:   dwt.AccessRead,
+				watchpointAccess: dwt.AccessReadWrite,
+			}[args[0]],
+		}
+
+		if insert {
+			err = s.server.dwt.SetWatchpoint(w)
+		} else {
+			err = s.server.dwt.ClearWatchpoint(w)
+		}
+
+	default:
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return replyOK, nil
+}
+
+// softwareBreakpoint prefers the FPB, which also works for code in flash, and
+// patches a BKPT instruction into memory when no comparator can be used.
+func (s *session) softwareBreakpoint(insert bool, addr uint32) error {
+	if !insert {
+		if _, ok := s.swBreakpoints[addr]; ok {
+			return s.removeSoftwareBreakpoint(addr)
+		}
+
+		return s.server.fpb.ClearBreakpoint(addr)
+	}
+
+	err := s.server.fpb.SetBreakpoint(addr)
+	if !errors.Is(err, fpb.ErrNoComparator) && !errors.Is(err, fpb.ErrUnsupportedAddress) {
+		return err
+	}
+
+	if _, ok := s.swBreakpoints[addr]; ok {
+		return nil
+	}
+
+	orig := make([]byte, len(bkptInstruction))
+
+	if err := s.server.swd.ReadMemory(addr, orig); err != nil {
+		return err
+	}
+
+	if err := s.server.swd.WriteMemory(addr, bkptInstruction); err != nil {
+		return err
+	}
+
+	s.swBreakpoints[addr] = orig
+
+	return nil
+}
+
+func (s *session) removeSoftwareBreakpoint(addr uint32) error {
+	if err := s.server.swd.WriteMemory(addr, s.swBreakpoints[addr]); err != nil {
+		return err
+	}
+
+	delete(s.swBreakpoints, addr)
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package gdbserver
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/holoplot/go-swd/pkg/image"
+	"github.com/holoplot/go-swd/pkg/stm32"
+)
+
+const (
+	// Flash is programmed in double words
+	flashWriteAlignment = 8
+	flashErasedValue    = 0xff
+)
+
+// flashGeometry returns the flash layout, identifying the device on first use.
+func (s *session) flashGeometry() (stm32.Geometry, error) {
+	if g := s.server.flash.Geometry(); g.Size != 0 {
+		return g, nil
+	}
+
+	if err := s.server.flash.Initialize(); err != nil {
+		return stm32.Geometry{}, err
+	}
+
+	return s.server.flash.Geometry(), nil
+}
+
+func (s *session) memoryMap() (string, error) {
+	g, err := s.flashGeometry()
+	if err != nil {
+		return "", err
+	}
+
+	flashEnd := uint64(stm32.FlashBaseAddr) + uint64(g.Size)
+
+	var sb strings.Builder
+
+	sb.WriteString(`<?xml version="1.0"?>` + "\n")
+	sb.WriteString(`<!DOCTYPE memory-map PUBLIC "+//IDN gnu.org//DTD GDB Memory Map V1.0//EN" "http://sourceware.org/gdb/gdb-memory-map.dtd">` + "\n")
+	sb.WriteString("<memory-map>\n")
+	fmt.Fprintf(&sb, "  <memory type=\"ram\" start=\"0x0\" length=\"0x%x\"/>\n", stm32.FlashBaseAddr)
+
+	// One flash region per run of equally sized pages
+	for offset := uint32(0); offset < g.Size; {
+		_, _, size, err := g.Page(offset)
+		if err != nil {
+			return "", err
+		}
+
+		start := offset
+
+		for offset < g.Size {
+			_, _, n, err := g.Page(offset)
+			if err != nil || n != size {
+				break
+			}
+
+			offset += n
+		}
+
+		fmt.Fprintf(&sb, "  <memory type=\"flash\" start=\"0x%x\" length=\"0x%x\">\n", stm32.FlashBaseAddr+start, offset-start)
+		fmt.Fprintf(&sb, "    <property name=\"blocksize\">0x%x</property>\n", size)
+		sb.WriteString("  </memory>\n")
+	}
+
+	fmt.Fprintf(&sb, "  <memory type=\"ram\" start=\"0x%x\" length=\"0x%x\"/>\n", flashEnd, uint64(1)<<32-flashEnd)
+	sb.WriteString("</memory-map>\n")
+
+	return sb.String(), nil
+}
+
+func (s *session) inFlash(addr, length uint32) bool {
+	return addr >= stm32.FlashBaseAddr &&
+		uint64(addr)+uint64(length) <= uint64(stm32.FlashBaseAddr)+uint64(s.server.flash.Geometry().Size)
+}
+
+// flashErase handles vFlashErase and erases the pages of the requested range.
+func (s *session) flashErase(args string) (string, error) {
+	if s.server.flash == nil {
+		return replyError, nil
+	}
+
+	addr, length, err := parseAddressLength(args)
+	if err != nil {
+		return "", err
+	}
+
+	if !s.inFlash(addr, length) {
+		return "", fmt.Errorf("erase 0x%08x+0x%x outside of flash", addr, length)
+	}
+
+	if !s.flashStarted {
+		if err := s.server.flash.Initialize(); err != nil {
+			return "", err
+		}
+
+		s.flashStarted = true
+	}
+
+	if err := s.server.flash.EraseRange(addr-stm32.FlashBaseAddr, length); err != nil {
+		return "", err
+	}
+
+	return replyOK, nil
+}
+
+// flashWrite handles vFlashWrite. Data is collected until vFlashDone, as gdb does
+// not align the chunks to the programming granularity.
+func (s *session) flashWrite(p []byte) (string, error) {
+	if s.server.flash == nil {
+		return replyError, nil
+	}
+
+	i := bytes.IndexByte(p, ':')
+	if i < 0 {
+		return "", fmt.Errorf("malformed flash write")
+	}
+
+	addr, err := parseHex(string(p[:i]))
+	if err != nil {
+		return "", err
+	}
+
+	data := p[i+1:]
+
+	if !s.inFlash(addr, uint32(len(data))) {
+		return "", fmt.Errorf("write 0x%08x+0x%x outside of flash", addr, len(data))
+	}
+
+	if s.flashImage == nil {
+		s.flashImage = &image.Image{}
+	}
+
+	if err := s.flashImage.Add(addr, data); err != nil {
+		return "", err
+	}
+
+	return replyOK, nil
+}
+
+// flashDone handles vFlashDone and programs all collected data.
+func (s *session) flashDone() (string, error) {
+	if s.server.flash == nil {
+		return replyError, nil
+	}
+
+	img := s.flashImage
+
+	s.flashImage = nil
+	s.flashStarted = false
+
+	if img == nil {
+		return replyOK, nil
+	}
+
+	for _, seg := range img.Aligned(flashWriteAlignment, flashErasedValue) {
+		if err := s.server.flash.Write(seg.Address-stm32.FlashBaseAddr, bytes.NewReader(seg.Data)); err != nil {
+			return "", fmt.Errorf("write flash at 0x%08x: %w", seg.Address, err)
+		}
+	}
+
+	return replyOK, nil
+}
@@ -0,0 +1,741 @@
+package gdbserver
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/dwt"
+	"github.com/holoplot/go-swd/pkg/fpb"
+	"github.com/holoplot/go-swd/pkg/image"
+	"github.com/holoplot/go-swd/pkg/stm32"
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+const (
+	defaultPollInterval = 10 * time.Millisecond
+	maxPacketSize       = 0x4000
+
+	signalInterrupt = 2
+	signalTrap      = 5
+
+	replyOK    = "OK"
+	replyError = "E01"
+)
+
+// Server implements the GDB remote serial protocol for a Cortex-M target.
+type Server struct {
+	swd       *swd.SWD
+	coreDebug *cd.CoreDebug
+	scb       *scb.SystemControlBlock
+	dwt       *dwt.DWT
+	fpb       *fpb.FPB
+
+	flash stm32.FlashDriver
+
+	pollInterval time.Duration
+}
+
+// SetFlash routes gdb's flash commands to a flash driver for the memory mapped
+// at stm32.FlashBaseAddr. The memory map reported to gdb follows its geometry.
+func (s *Server) SetFlash(flash stm32.FlashDriver) {
+	s.flash = flash
+}
+
+// SetPollInterval sets how often the core state is checked while it is running.
+// Values of zero or less select the default interval.
+func (s *Server) SetPollInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultPollInterval
+	}
+
+	s.pollInterval = d
+}
+
+// ListenAndServe listens on the TCP address addr and serves gdb connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer l.Close()
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves them one at a time. It returns when
+// the listener fails or a session ends with an error other than a disconnect.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		if err := s.ServeConn(c); err != nil {
+			return err
+		}
+	}
+}
+
+// ServeConn runs a single debug session on rw and closes it when done.
+func (s *Server) ServeConn(rw io.ReadWriteCloser) error {
+	defer rw.Close()
+
+	sess := &session{
+		server:        s,
+		conn:          newConn(rw),
+		events:        make(chan event),
+		errs:          make(chan error, 1),
+		done:          make(chan struct{}),
+		swBreakpoints: make(map[uint32][]byte),
+	}
+
+	defer close(sess.done)
+
+	go sess.readLoop()
+
+	return sess.run()
+}
+
+type session struct {
+	server *Server
+	conn   *conn
+
+	events chan event
+	errs   chan error
+	done   chan struct{}
+
+	registers []register
+	targetXML string
+	lastStop  string
+	detached  bool
+
+	swBreakpoints map[uint32][]byte
+
+	flashStarted bool
+	flashImage   *image.Image
+}
+
+func (s *session) readLoop() {
+	for {
+		ev, err := s.conn.read()
+		if err != nil {
+			s.errs <- err
+			return
+		}
+
+		select {
+		case s.events <- ev:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// attach halts the core and brings the debug units into a known state.
+func (s *session) attach() error {
+	if err := s.server.coreDebug.Halt(); err != nil {
+		return fmt.Errorf("halt: %w", err)
+	}
+
+	id, err := s.server.scb.Identify()
+	if err != nil {
+		return fmt.Errorf("identify core: %w", err)
+	}
+
+	s.registers = registerSet(id)
+	s.targetXML = targetDescription(s.registers)
+
+	// The DWT comparators only work with trace enabled
+	demcr, err := s.server.coreDebug.ReadDEMCR()
+	if err != nil {
+		return err
+	}
+
+	if err := s.server.coreDebug.WriteDEMCR(demcr | cd.DEMCREnableTrace); err != nil {
+		return err
+	}
+
+	if err := s.server.fpb.Enable(); err != nil {
+		return fmt.Errorf("enable FPB: %w", err)
+	}
+
+	if err := s.server.dwt.ClearAllWatchpoints(); err != nil {
+		return fmt.Errorf("clear watchpoints: %w", err)
+	}
+
+	s.lastStop = fmt.Sprintf("T%02x", signalTrap)
+
+	return s.server.scb.ClearDFSR()
+}
+
+// detach removes all breakpoints and watchpoints set during the session.
+func (s *session) detach() error {
+	for addr := range s.swBreakpoints {
+		if err := s.removeSoftwareBreakpoint(addr); err != nil {
+			return err
+		}
+	}
+
+	if err := s.server.fpb.ClearAll(); err != nil {
+		return err
+	}
+
+	return s.server.dwt.ClearAllWatchpoints()
+}
+
+func (s *session) run() error {
+	if err := s.attach(); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = s.detach()
+	}()
+
+	for !s.detached {
+		select {
+		case err := <-s.errs:
+			if isDisconnect(err) {
+				return nil
+			}
+
+			return err
+
+		case ev := <-s.events:
+			// Interrupts are only meaningful while the core is running
+			if ev.interrupt {
+				continue
+			}
+
+			reply, err := s.handle(ev.packet)
+			if err != nil {
+				reply = replyError
+			}
+
+			if err := s.conn.sendString(reply); err != nil {
+				if isDisconnect(err) {
+					return nil
+				}
+
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *session) handle(p []byte) (string, error) {
+	if len(p) == 0 {
+		return "", nil
+	}
+
+	cmd, args := p[0], string(p[1:])
+
+	switch cmd {
+	case '?':
+		return s.lastStop, nil
+
+	case 'g':
+		return s.readRegisters()
+
+	case 'G':
+		return s.writeRegisters(args)
+
+	case 'p':
+		return s.readRegisterPacket(args)
+
+	case 'P':
+		return s.writeRegisterPacket(args)
+
+	case 'm':
+		return s.readMemory(args)
+
+	case 'M':
+		return s.writeMemoryHex(args)
+
+	case 'X':
+		return s.writeMemoryBinary(p[1:])
+
+	case 'Z', 'z':
+		return s.breakpoint(cmd == 'Z', args)
+
+	case 'c', 'C':
+		return s.resume(cmd == 'c', args)
+
+	case 's', 'S':
+		return s.step(cmd == 's', args)
+
+	case 'H', 'T':
+		return replyOK, nil
+
+	case 'D':
+		s.detached = true
+
+		if err := s.detach(); err != nil {
+			return "", err
+		}
+
+		if err := s.server.coreDebug.Continue(); err != nil {
+			return "", err
+		}
+
+		return replyOK, nil
+
+	case 'k':
+		s.detached = true
+
+		return replyOK, nil
+
+	case 'q':
+		return s.query(args)
+
+	case 'Q':
+		if args == "StartNoAckMode" {
+			// The reply is still acknowledged by the client
+			defer s.conn.setNoAck()
+
+			return replyOK, nil
+		}
+
+	case 'v':
+		return s.vPacket(p[1:])
+	}
+
+	return "", nil
+}
+
+func (s *session) query(args string) (string, error) {
+	name, params, _ := strings.Cut(args, ":")
+
+	switch {
+	case name == "Supported":
+		features := []string{
+			fmt.Sprintf("PacketSize=%x", maxPacketSize),
+			"qXfer:features:read+",
+			"QStartNoAckMode+",
+			"vContSupported+",
+		}
+
+		if s.server.flash != nil {
+			features = append(features, "qXfer:memory-map:read+")
+		}
+
+		return strings.Join(features, ";"), nil
+
+	case name == "Attached":
+		return "1", nil
+
+	case name == "C":
+		return "QC1", nil
+
+	case name == "fThreadInfo":
+		return "m1", nil
+
+	case name == "sThreadInfo":
+		return "l", nil
+
+	case name == "Symbol":
+		return replyOK, nil
+
+	case name == "Xfer":
+		return s.transfer(params)
+
+	case strings.HasPrefix(name, "Rcmd,"):
+		cmd, err := hex.DecodeString(strings.TrimPrefix(name, "Rcmd,"))
+		if err != nil {
+			return "", err
+		}
+
+		return s.monitor(string(cmd))
+	}
+
+	return "", nil
+}
+
+// transfer handles qXfer reads of the target description and memory map.
+func (s *session) transfer(params string) (string, error) {
+	parts := strings.Split(params, ":")
+	if len(parts) != 4 || parts[1] != "read" {
+		return "", nil
+	}
+
+	var (
+		doc string
+		err error
+	)
+
+	switch {
+	case parts[0] == "features" && parts[2] == "target.xml":
+		doc = s.targetXML
+	case parts[0] == "memory-map" && s.server.flash != nil:
+		if doc, err = s.memoryMap(); err != nil {
+			return "", err
+		}
+	default:
+		return "", nil
+	}
+
+	offset, length, err := parseAddressLength(parts[3])
+	if err != nil {
+		return "", err
+	}
+
+	if int(offset) >= len(doc) {
+		return "l", nil
+	}
+
+	chunk := doc[offset:]
+	prefix := "l"
+
+	if uint32(len(chunk)) > length {
+		chunk = chunk[:length]
+		prefix = "m"
+	}
+
+	return prefix + string(escape([]byte(chunk))), nil
+}
+
+func (s *session) vPacket(p []byte) (string, error) {
+	name, args, _ := strings.Cut(string(p), ";")
+
+	switch {
+	case name == "Cont?":
+		return "vCont;c;C;s;S", nil
+
+	case name == "Cont":
+		// Without threads, only the first action is relevant
+		action, _, _ := strings.Cut(args, ";")
+		action, _, _ = strings.Cut(action, ":")
+
+		if action == "" {
+			return replyError, nil
+		}
+
+		switch action[0] {
+		case 'c', 'C':
+			return s.resume(false, "")
+		case 's', 'S':
+			return s.step(false, "")
+		}
+
+		return replyError, nil
+
+	case strings.HasPrefix(name, "FlashErase:"):
+		return s.flashErase(strings.TrimPrefix(name, "FlashErase:"))
+
+	case strings.HasPrefix(string(p), "FlashWrite:"):
+		return s.flashWrite(p[len("FlashWrite:"):])
+
+	case name == "FlashDone":
+		return s.flashDone()
+
+	case name == "MustReplyEmpty":
+		return "", nil
+	}
+
+	return "", nil
+}
+
+func (s *session) readRegisters() (string, error) {
+	var sb strings.Builder
+
+	for _, r := range s.registers {
+		buf, err := s.readRegister(r)
+		if err != nil {
+			return "", err
+		}
+
+		sb.WriteString(hex.EncodeToString(buf))
+	}
+
+	return sb.String(), nil
+}
+
+func (s *session) writeRegisters(args string) (string, error) {
+	data, err := hex.DecodeString(args)
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range s.registers {
+		size := r.bits / 8
+
+		if len(data) < size {
+			break
+		}
+
+		if err := s.writeRegister(r, data[:size]); err != nil {
+			return "", err
+		}
+
+		data = data[size:]
+	}
+
+	return replyOK, nil
+}
+
+func (s *session) lookupRegister(arg string) (register, error) {
+	n, err := parseHex(arg)
+	if err != nil {
+		return register{}, err
+	}
+
+	if int(n) >= len(s.registers) {
+		return register{}, fmt.Errorf("unknown register %d", n)
+	}
+
+	return s.registers[n], nil
+}
+
+func (s *session) readRegisterPacket(args string) (string, error) {
+	r, err := s.lookupRegister(args)
+	if err != nil {
+		return "", err
+	}
+
+	buf, err := s.readRegister(r)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *session) writeRegisterPacket(args string) (string, error) {
+	n, v, ok := strings.Cut(args, "=")
+	if !ok {
+		return "", fmt.Errorf("malformed register write %q", args)
+	}
+
+	r, err := s.lookupRegister(n)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := hex.DecodeString(v)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.writeRegister(r, data); err != nil {
+		return "", err
+	}
+
+	return replyOK, nil
+}
+
+func (s *session) readMemory(args string) (string, error) {
+	addr, length, err := parseAddressLength(args)
+	if err != nil {
+		return "", err
+	}
+
+	if length > maxPacketSize/2 {
+		length = maxPacketSize / 2
+	}
+
+	buf := make([]byte, length)
+
+	if err := s.server.swd.ReadMemory(addr, buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *session) writeMemoryHex(args string) (string, error) {
+	al, v, ok := strings.Cut(args, ":")
+	if !ok {
+		return "", fmt.Errorf("malformed memory write %q", args)
+	}
+
+	addr, length, err := parseAddressLength(al)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := hex.DecodeString(v)
+	if err != nil {
+		return "", err
+	}
+
+	if uint32(len(data)) != length {
+		return "", fmt.Errorf("memory write: got %d bytes, want %d", len(data), length)
+	}
+
+	if err := s.server.swd.WriteMemory(addr, data); err != nil {
+		return "", err
+	}
+
+	return replyOK, nil
+}
+
+func (s *session) writeMemoryBinary(p []byte) (string, error) {
+	i := strings.IndexByte(string(p), ':')
+	if i < 0 {
+		return "", fmt.Errorf("malformed memory write")
+	}
+
+	addr, length, err := parseAddressLength(string(p[:i]))
+	if err != nil {
+		return "", err
+	}
+
+	data := p[i+1:]
+
+	if uint32(len(data)) != length {
+		return "", fmt.Errorf("memory write: got %d bytes, want %d", len(data), length)
+	}
+
+	if len(data) > 0 {
+		if err := s.server.swd.WriteMemory(addr, data); err != nil {
+			return "", err
+		}
+	}
+
+	return replyOK, nil
+}
+
+// setPC handles the optional resume address of the c and s packets.
+func (s *session) setPC(args string) error {
+	if args == "" {
+		return nil
+	}
+
+	addr, err := parseHex(args)
+	if err != nil {
+		return err
+	}
+
+	return s.server.coreDebug.WriteCoreRegister(cd.CoreRegisterPC, addr)
+}
+
+func (s *session) step(withAddress bool, args string) (string, error) {
+	if withAddress {
+		if err := s.setPC(args); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.server.coreDebug.Step(); err != nil {
+		return "", err
+	}
+
+	return s.stopReply(signalTrap)
+}
+
+// resume lets the core run until it halts or gdb sends an interrupt.
+func (s *session) resume(withAddress bool, args string) (string, error) {
+	if withAddress {
+		if err := s.setPC(args); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.server.scb.ClearDFSR(); err != nil {
+		return "", err
+	}
+
+	if err := s.server.coreDebug.WriteDHCSR(cd.DHCSRDebugKey | cd.DHCSRCDebugEn); err != nil {
+		return "", err
+	}
+
+	ticker := time.NewTicker(s.server.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-s.errs:
+			// Leave the core running, the session ends with the connection
+			s.errs <- err
+
+			return "", err
+
+		case ev := <-s.events:
+			if !ev.interrupt {
+				continue
+			}
+
+			if err := s.server.coreDebug.Halt(); err != nil {
+				return "", err
+			}
+
+			return s.stopReply(signalInterrupt)
+
+		case <-ticker.C:
+			dhcsr, err := s.server.coreDebug.ReadDHCSR()
+			if err != nil {
+				return "", err
+			}
+
+			if dhcsr&cd.DHCSRSHalt != 0 {
+				return s.stopReply(signalTrap)
+			}
+		}
+	}
+}
+
+func watchKind(a dwt.Access) string {
+	switch a {
+	case dwt.AccessRead:
+		return "rwatch"
+	case dwt.AccessWrite:
+		return "watch"
+	default:
+		return "awatch"
+	}
+}
+
+// stopReply builds the T packet for a halted core and clears the debug event flags.
+func (s *session) stopReply(signal int) (string, error) {
+	dfsr, err := s.server.scb.ReadDFSR()
+	if err != nil {
+		return "", err
+	}
+
+	reply := fmt.Sprintf("T%02x", signal)
+
+	if dfsr&scb.DFSRDWTTrap != 0 {
+		w, err := s.server.dwt.Matched()
+		if err != nil {
+			return "", err
+		}
+
+		if w != nil {
+			reply += fmt.Sprintf("%s:%x;", watchKind(w.Access), w.Address)
+		}
+	}
+
+	if err := s.server.scb.ClearDFSR(); err != nil {
+		return "", err
+	}
+
+	s.lastStop = reply
+
+	return reply, nil
+}
+
+func New(swd *swd.SWD) *Server {
+	return &Server{
+		swd:          swd,
+		coreDebug:    cd.New(swd),
+		scb:          scb.New(swd),
+		dwt:          dwt.New(swd),
+		fpb:          fpb.New(swd),
+		pollInterval: defaultPollInterval,
+	}
+}
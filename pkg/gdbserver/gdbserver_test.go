@@ -0,0 +1,311 @@
+package gdbserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/io/sim"
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+// client is a scripted RSP client
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *client) sendRaw(data string) {
+	c.t.Helper()
+
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *client) send(packet string) {
+	c.t.Helper()
+
+	c.sendRaw(fmt.Sprintf("$%s#%02x", packet, checksum([]byte(packet))))
+
+	if b, err := c.r.ReadByte(); err != nil || b != ackOk {
+		c.t.Fatalf("ack: got %q, %v", b, err)
+	}
+}
+
+func (c *client) receive() string {
+	c.t.Helper()
+
+	if _, err := c.r.ReadString(packetStart); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+
+	data, err := c.r.ReadString(packetEnd)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+
+	var sum [2]byte
+	if _, err := c.r.Read(sum[:]); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+
+	c.sendRaw("+")
+
+	return data[:len(data)-1]
+}
+
+func (c *client) request(packet string) string {
+	c.t.Helper()
+
+	c.send(packet)
+
+	return c.receive()
+}
+
+func (c *client) expect(packet, want string) {
+	c.t.Helper()
+
+	if got := c.request(packet); got != want {
+		c.t.Errorf("%s: got %q, want %q", packet, got, want)
+	}
+}
+
+func setup(t *testing.T) (*client, *sim.Target) {
+	target := sim.New()
+	server := New(swd.New(target))
+	server.SetPollInterval(time.Millisecond)
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		done <- server.ServeConn(serverConn)
+	}()
+
+	t.Cleanup(func() {
+		clientConn.Close()
+
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	})
+
+	_ = clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return &client{t: t, conn: clientConn, r: bufio.NewReader(clientConn)}, target
+}
+
+func TestQueries(t *testing.T) {
+	c, _ := setup(t)
+
+	if got := c.request("qSupported:multiprocess+;swbreak+"); !strings.Contains(got, "qXfer:features:read+") {
+		t.Errorf("qSupported: got %q", got)
+	}
+
+	c.expect("?", "T05")
+	c.expect("vMustReplyEmpty", "")
+
+	xml := c.request("qXfer:features:read:target.xml:0,fff")
+	if !strings.HasPrefix(xml, "l") || !strings.Contains(xml, featureMProfile) || !strings.Contains(xml, featureVFP) {
+		t.Errorf("target.xml: got %q", xml)
+	}
+
+	if got := c.request("qXfer:features:read:target.xml:0,10"); got != "m"+xml[1:17] {
+		t.Errorf("partial target.xml: got %q", got)
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	c, target := setup(t)
+	core := target.Core()
+
+	core.SetRegister(cd.CoreRegisterPC, 0x08000124)
+	core.SetRegister(cd.CoreRegisterSpecial, 0x02000001)
+
+	c.expect("pf", "24010008")
+	// primask and control
+	c.expect("p13", "01")
+	c.expect("p16", "02")
+
+	c.expect("P1=78563412", "OK")
+
+	if got := core.Register(cd.CoreRegisterR1); got != 0x12345678 {
+		t.Errorf("r1: got 0x%08x", got)
+	}
+
+	// d0 is made of s0 and s1
+	c.expect("P17=0100000002000000", "OK")
+
+	if core.Register(cd.CoreRegisterS(0)) != 1 || core.Register(cd.CoreRegisterS(1)) != 2 {
+		t.Errorf("d0 not written to s0 and s1")
+	}
+
+	// 19 word registers, 4 special registers, d0-d15 and fpscr
+	if got := c.request("g"); len(got) != (19*4+4+16*8+4)*2 || !strings.HasPrefix(got[8:], "78563412") {
+		t.Errorf("g: got %q", got)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	c, target := setup(t)
+
+	c.expect("M20000001,3:aabbcc", "OK")
+	c.expect("m20000000,5", "00aabbcc00")
+
+	// '}' escapes '#', '$', '}' and '*'
+	c.expect("X20000010,4:}\x03}\x04}]*", "OK")
+
+	if got := target.Dump(0x20000010, 4); !bytes.Equal(got, []byte("#$}*")) {
+		t.Errorf("X: got %q", got)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	c, target := setup(t)
+
+	c.expect("Z1,8000124,2", "OK")
+
+	if got := target.ReadWord(0xe0002008); got != 0x48000125 {
+		t.Errorf("FP_COMP0: got 0x%08x", got)
+	}
+
+	// Upper halfword of the same word shares the comparator
+	c.expect("Z0,8000126,2", "OK")
+
+	if got := target.ReadWord(0xe0002008); got != 0xc8000125 {
+		t.Errorf("FP_COMP0: got 0x%08x", got)
+	}
+
+	c.expect("z1,8000124,2", "OK")
+
+	if got := target.ReadWord(0xe0002008); got != 0x88000125 {
+		t.Errorf("FP_COMP0: got 0x%08x", got)
+	}
+
+	// FPBv1 can not break on RAM, a BKPT instruction is patched in
+	target.Load(0x20000100, []byte{0x70, 0x47})
+
+	c.expect("Z0,20000100,2", "OK")
+
+	if got := target.Dump(0x20000100, 2); !bytes.Equal(got, bkptInstruction) {
+		t.Errorf("software breakpoint: got %x", got)
+	}
+
+	c.expect("z0,20000100,2", "OK")
+
+	if got := target.Dump(0x20000100, 2); !bytes.Equal(got, []byte{0x70, 0x47}) {
+		t.Errorf("restored instruction: got %x", got)
+	}
+
+	c.expect("Z2,20000200,4", "OK")
+
+	if comp, mask, function := target.ReadWord(0xe0001020), target.ReadWord(0xe0001024), target.ReadWord(0xe0001028); comp != 0x20000200 || mask != 2 || function != 6 {
+		t.Errorf("DWT comparator 0: got 0x%08x 0x%x 0x%x", comp, mask, function)
+	}
+
+	c.expect("Z2,20000201,4", "E01")
+}
+
+func TestRunControl(t *testing.T) {
+	c, target := setup(t)
+	core := target.Core()
+
+	core.SetRegister(cd.CoreRegisterPC, 0x08000100)
+
+	c.expect("s", "T05")
+
+	if got := core.Register(cd.CoreRegisterPC); got != 0x08000102 {
+		t.Errorf("pc after step: got 0x%08x", got)
+	}
+
+	// Continue and hit a breakpoint
+	c.send("c")
+
+	for core.Halted() {
+		time.Sleep(time.Millisecond)
+	}
+
+	core.Break(0x08000200, scb.DFSRBkpt)
+
+	if got := c.receive(); got != "T05" {
+		t.Errorf("breakpoint: got %q", got)
+	}
+
+	// Continue and hit a watchpoint
+	c.expect("Z2,20000200,4", "OK")
+	c.send("vCont;c")
+
+	for core.Halted() {
+		time.Sleep(time.Millisecond)
+	}
+
+	target.WriteWord(0xe0001028, 0x01000006)
+	core.Break(0x08000300, scb.DFSRDWTTrap)
+
+	if got := c.receive(); got != "T05watch:20000200;" {
+		t.Errorf("watchpoint: got %q", got)
+	}
+
+	// Continue and interrupt
+	c.send("c")
+
+	for core.Halted() {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.sendRaw("\x03")
+
+	if got := c.receive(); got != "T02" {
+		t.Errorf("interrupt: got %q", got)
+	}
+
+	if !core.Halted() {
+		t.Errorf("core not halted after interrupt")
+	}
+
+	c.expect("?", "T02")
+}
+
+func TestMonitorReset(t *testing.T) {
+	c, target := setup(t)
+	core := target.Core()
+
+	core.SetVectorTable(0x08000000)
+	target.WriteWord(0x08000000, 0x20001000)
+	target.WriteWord(0x08000004, 0x08000195)
+
+	c.expect("qRcmd,"+hexString("reset halt"), "OK")
+
+	if core.Resets() != 1 || !core.Halted() {
+		t.Errorf("core not reset and halted")
+	}
+
+	c.expect("pf", "94010008")
+	c.expect("pd", "00100020")
+
+	if got := c.request("qRcmd," + hexString("bogus")); !strings.HasPrefix(got, "O") {
+		t.Errorf("unknown command: got %q", got)
+	}
+
+	if got := c.receive(); got != "OK" {
+		t.Errorf("unknown command: got %q", got)
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	server := New(swd.New(sim.New()))
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		if server.SetPollInterval(d); server.pollInterval != defaultPollInterval {
+			t.Errorf("%v: got %v", d, server.pollInterval)
+		}
+	}
+}
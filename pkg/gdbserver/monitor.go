@@ -0,0 +1,59 @@
+package gdbserver
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	monitorHelp = `Supported monitor commands:
+  reset [halt|run]  reset the system, optionally halting at the reset vector
+  halt              halt the core
+  fault             show the fault status
+`
+)
+
+// output sends text to the gdb console.
+func (s *session) output(text string) error {
+	return s.conn.sendString("O" + hexString(text))
+}
+
+// monitor handles the commands passed with "monitor" on the gdb command line.
+func (s *session) monitor(cmd string) (string, error) {
+	var err error
+
+	switch strings.Join(strings.Fields(cmd), " ") {
+	case "reset", "reset run":
+		err = s.server.scb.ResetSystem()
+
+	case "reset halt":
+		err = s.server.scb.ResetAndHalt(s.server.coreDebug)
+
+	case "halt":
+		err = s.server.coreDebug.Halt()
+
+	case "fault":
+		err = s.showFault()
+
+	case "help":
+		err = s.output(monitorHelp)
+
+	default:
+		err = s.output(fmt.Sprintf("unknown command %q\n%s", cmd, monitorHelp))
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return replyOK, nil
+}
+
+func (s *session) showFault() error {
+	f, err := s.server.scb.AnalyzeFault(s.server.coreDebug)
+	if err != nil {
+		return err
+	}
+
+	return s.output(f.String() + "\n")
+}
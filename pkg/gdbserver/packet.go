@@ -0,0 +1,204 @@
+package gdbserver
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// https://sourceware.org/gdb/current/onlinedocs/gdb.html/Overview.html
+
+const (
+	packetStart     = '$'
+	packetEnd       = '#'
+	packetEscape    = '}'
+	packetRunLength = '*'
+	escapeXor       = 0x20
+	ackOk           = '+'
+	ackRetransmit   = '-'
+	interrupt       = 0x03
+)
+
+// event is either a received packet or an out-of-band interrupt request
+type event struct {
+	packet    []byte
+	interrupt bool
+}
+
+// conn handles packet framing and acknowledgements on a remote connection.
+type conn struct {
+	rw io.ReadWriter
+	r  *bufio.Reader
+
+	mu    sync.Mutex
+	noAck bool
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	return &conn{
+		rw: rw,
+		r:  bufio.NewReader(rw),
+	}
+}
+
+func checksum(data []byte) byte {
+	var sum byte
+
+	for _, b := range data {
+		sum += b
+	}
+
+	return sum
+}
+
+func unescape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+
+	for i := 0; i < len(data); i++ {
+		if data[i] == packetEscape && i+1 < len(data) {
+			i++
+			out = append(out, data[i]^escapeXor)
+
+			continue
+		}
+
+		out = append(out, data[i])
+	}
+
+	return out
+}
+
+func escape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+
+	for _, b := range data {
+		switch b {
+		case packetStart, packetEnd, packetEscape, packetRunLength:
+			out = append(out, packetEscape, b^escapeXor)
+		default:
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+func (c *conn) setNoAck() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.noAck = true
+}
+
+func (c *conn) ackMode() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.noAck
+}
+
+func (c *conn) writeRaw(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.rw.Write(data)
+
+	return err
+}
+
+// send writes a packet. Binary payloads must already be escaped.
+func (c *conn) send(data []byte) error {
+	buf := make([]byte, 0, len(data)+4)
+	buf = append(buf, packetStart)
+	buf = append(buf, data...)
+	buf = append(buf, packetEnd)
+	buf = append(buf, fmt.Sprintf("%02x", checksum(data))...)
+
+	return c.writeRaw(buf)
+}
+
+func (c *conn) sendString(s string) error {
+	return c.send([]byte(s))
+}
+
+// read returns the next packet or interrupt request. Acknowledgements from the
+// client are consumed silently.
+func (c *conn) read() (event, error) {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return event{}, err
+		}
+
+		switch b {
+		case interrupt:
+			return event{interrupt: true}, nil
+
+		case packetStart:
+			data, err := c.r.ReadBytes(packetEnd)
+			if err != nil {
+				return event{}, err
+			}
+
+			data = data[:len(data)-1]
+
+			var sum [2]byte
+			if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+				return event{}, err
+			}
+
+			if !c.ackMode() {
+				return event{packet: unescape(data)}, nil
+			}
+
+			if v, err := strconv.ParseUint(string(sum[:]), 16, 8); err != nil || byte(v) != checksum(data) {
+				if err := c.writeRaw([]byte{ackRetransmit}); err != nil {
+					return event{}, err
+				}
+
+				continue
+			}
+
+			if err := c.writeRaw([]byte{ackOk}); err != nil {
+				return event{}, err
+			}
+
+			return event{packet: unescape(data)}, nil
+		}
+	}
+}
+
+// parseHex parses a hexadecimal number as used in addresses and lengths.
+func parseHex(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 16, 32)
+
+	return uint32(v), err
+}
+
+// parseAddressLength parses the "addr,length" argument of memory packets.
+func parseAddressLength(s string) (uint32, uint32, error) {
+	a, l, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed address and length %q", s)
+	}
+
+	addr, err := parseHex(a)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	length, err := parseHex(l)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return addr, length, nil
+}
+
+func hexString(s string) string {
+	return hex.EncodeToString([]byte(s))
+}
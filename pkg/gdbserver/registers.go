@@ -0,0 +1,191 @@
+package gdbserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+type registerKind int
+
+const (
+	registerCore registerKind = iota
+	// 8-bit field of the combined CONTROL/FAULTMASK/BASEPRI/PRIMASK register
+	registerSpecial
+	// Double precision register made of two single precision registers
+	registerDouble
+)
+
+const (
+	featureMProfile = "org.gnu.gdb.arm.m-profile"
+	featureMSystem  = "org.gnu.gdb.arm.m-system"
+	featureVFP      = "org.gnu.gdb.arm.vfp"
+
+	specialPrimaskShift   = 0
+	specialBasepriShift   = 8
+	specialFaultmaskShift = 16
+	specialControlShift   = 24
+)
+
+type register struct {
+	name    string
+	bits    int
+	typ     string
+	feature string
+	kind    registerKind
+	core    cd.CoreRegister
+	shift   uint
+}
+
+// registerSet returns the registers presented to gdb for the given core, in
+// register number order.
+func registerSet(id *scb.Identity) []register {
+	var regs []register
+
+	for n := cd.CoreRegisterR0; n <= cd.CoreRegisterR12; n++ {
+		regs = append(regs, register{name: n.String(), bits: 32, typ: "uint32", feature: featureMProfile, core: n})
+	}
+
+	regs = append(regs,
+		register{name: "sp", bits: 32, typ: "data_ptr", feature: featureMProfile, core: cd.CoreRegisterSP},
+		register{name: "lr", bits: 32, typ: "int", feature: featureMProfile, core: cd.CoreRegisterLR},
+		register{name: "pc", bits: 32, typ: "code_ptr", feature: featureMProfile, core: cd.CoreRegisterPC},
+		register{name: "xpsr", bits: 32, typ: "int", feature: featureMProfile, core: cd.CoreRegisterXPSR},
+		register{name: "msp", bits: 32, typ: "data_ptr", feature: featureMSystem, core: cd.CoreRegisterMSP},
+		register{name: "psp", bits: 32, typ: "data_ptr", feature: featureMSystem, core: cd.CoreRegisterPSP},
+		register{name: "primask", bits: 8, typ: "int", feature: featureMSystem, kind: registerSpecial, shift: specialPrimaskShift},
+	)
+
+	if !id.Architecture.Baseline() {
+		regs = append(regs,
+			register{name: "basepri", bits: 8, typ: "int", feature: featureMSystem, kind: registerSpecial, shift: specialBasepriShift},
+			register{name: "faultmask", bits: 8, typ: "int", feature: featureMSystem, kind: registerSpecial, shift: specialFaultmaskShift},
+		)
+	}
+
+	regs = append(regs,
+		register{name: "control", bits: 8, typ: "int", feature: featureMSystem, kind: registerSpecial, shift: specialControlShift},
+	)
+
+	if id.FPU {
+		for n := 0; n < 16; n++ {
+			regs = append(regs, register{
+				name:    fmt.Sprintf("d%d", n),
+				bits:    64,
+				typ:     "ieee_double",
+				feature: featureVFP,
+				kind:    registerDouble,
+				core:    cd.CoreRegisterS(2 * n),
+			})
+		}
+
+		regs = append(regs,
+			register{name: "fpscr", bits: 32, typ: "int", feature: featureVFP, core: cd.CoreRegisterFPSCR},
+		)
+	}
+
+	return regs
+}
+
+// targetDescription returns the target.xml document for the register set.
+func targetDescription(regs []register) string {
+	var sb strings.Builder
+
+	sb.WriteString(`<?xml version="1.0"?>` + "\n")
+	sb.WriteString(`<!DOCTYPE target SYSTEM "gdb-target.dtd">` + "\n")
+	sb.WriteString("<target>\n")
+	sb.WriteString("  <architecture>arm</architecture>\n")
+
+	feature := ""
+
+	for n, r := range regs {
+		if r.feature != feature {
+			if feature != "" {
+				sb.WriteString("  </feature>\n")
+			}
+
+			feature = r.feature
+			fmt.Fprintf(&sb, "  <feature name=%q>\n", feature)
+		}
+
+		fmt.Fprintf(&sb, "    <reg name=%q bitsize=\"%d\" regnum=\"%d\" type=%q/>\n", r.name, r.bits, n, r.typ)
+	}
+
+	if feature != "" {
+		sb.WriteString("  </feature>\n")
+	}
+
+	sb.WriteString("</target>\n")
+
+	return sb.String()
+}
+
+func (s *session) readRegister(r register) ([]byte, error) {
+	buf := make([]byte, r.bits/8)
+
+	switch r.kind {
+	case registerSpecial:
+		v, err := s.server.coreDebug.ReadCoreRegister(cd.CoreRegisterSpecial)
+		if err != nil {
+			return nil, err
+		}
+
+		buf[0] = byte(v >> r.shift)
+
+	case registerDouble:
+		for i := 0; i < 2; i++ {
+			v, err := s.server.coreDebug.ReadCoreRegister(r.core + cd.CoreRegister(i))
+			if err != nil {
+				return nil, err
+			}
+
+			binary.LittleEndian.PutUint32(buf[i*4:], v)
+		}
+
+	default:
+		v, err := s.server.coreDebug.ReadCoreRegister(r.core)
+		if err != nil {
+			return nil, err
+		}
+
+		binary.LittleEndian.PutUint32(buf, v)
+	}
+
+	return buf, nil
+}
+
+func (s *session) writeRegister(r register, buf []byte) error {
+	if len(buf) != r.bits/8 {
+		return fmt.Errorf("register %s: got %d bytes, want %d", r.name, len(buf), r.bits/8)
+	}
+
+	switch r.kind {
+	case registerSpecial:
+		v, err := s.server.coreDebug.ReadCoreRegister(cd.CoreRegisterSpecial)
+		if err != nil {
+			return err
+		}
+
+		v &= ^(uint32(0xff) << r.shift)
+		v |= uint32(buf[0]) << r.shift
+
+		return s.server.coreDebug.WriteCoreRegister(cd.CoreRegisterSpecial, v)
+
+	case registerDouble:
+		for i := 0; i < 2; i++ {
+			v := binary.LittleEndian.Uint32(buf[i*4:])
+
+			if err := s.server.coreDebug.WriteCoreRegister(r.core+cd.CoreRegister(i), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	default:
+		return s.server.coreDebug.WriteCoreRegister(r.core, binary.LittleEndian.Uint32(buf))
+	}
+}
@@ -0,0 +1,49 @@
+package image
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+)
+
+// ParseELF reads an ELF file and returns the file contents of its loadable segments
+// at their load (physical) addresses.
+func ParseELF(r io.ReaderAt) (*Image, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromELF(f)
+}
+
+// FromELF returns the loadable segments of an opened ELF file. Segments without
+// file contents, such as .bss, are skipped.
+func FromELF(f *elf.File) (*Image, error) {
+	if f.Class != elf.ELFCLASS32 {
+		return nil, fmt.Errorf("unsupported ELF class %s", f.Class)
+	}
+
+	img := &Image{
+		Entry:    uint32(f.Entry),
+		HasEntry: true,
+	}
+
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Filesz == 0 {
+			continue
+		}
+
+		data := make([]byte, p.Filesz)
+
+		if _, err := p.ReadAt(data, 0); err != nil {
+			return nil, fmt.Errorf("read segment at 0x%08x: %w", p.Paddr, err)
+		}
+
+		if err := img.Add(uint32(p.Paddr), data); err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
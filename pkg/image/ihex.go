@@ -0,0 +1,113 @@
+package image
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// https://en.wikipedia.org/wiki/Intel_HEX
+
+const (
+	ihexData                   = 0x00
+	ihexEndOfFile              = 0x01
+	ihexExtendedSegmentAddress = 0x02
+	ihexStartSegmentAddress    = 0x03
+	ihexExtendedLinearAddress  = 0x04
+	ihexStartLinearAddress     = 0x05
+
+	// Byte count, address and record type
+	ihexHeaderSize = 4
+)
+
+// ParseIntelHex parses an Intel HEX file.
+func ParseIntelHex(r io.Reader) (*Image, error) {
+	img := &Image{}
+	scanner := bufio.NewScanner(r)
+
+	var base uint32
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if text[0] != ':' {
+			return nil, fmt.Errorf("line %d: missing start code", line)
+		}
+
+		rec, err := hex.DecodeString(text[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if len(rec) < ihexHeaderSize+1 || len(rec) != int(rec[0])+ihexHeaderSize+1 {
+			return nil, fmt.Errorf("line %d: invalid record length", line)
+		}
+
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+
+		if sum != 0 {
+			return nil, fmt.Errorf("line %d: %w", line, ErrChecksum)
+		}
+
+		offset := uint32(rec[1])<<8 | uint32(rec[2])
+		data := rec[ihexHeaderSize : len(rec)-1]
+
+		switch rec[3] {
+		case ihexData:
+			if err := img.Add(base+offset, data); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+
+		case ihexEndOfFile:
+			return img, nil
+
+		case ihexExtendedSegmentAddress, ihexExtendedLinearAddress:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("line %d: invalid address record", line)
+			}
+
+			base = uint32(data[0])<<8 | uint32(data[1])
+
+			if rec[3] == ihexExtendedSegmentAddress {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+
+		case ihexStartSegmentAddress, ihexStartLinearAddress:
+			if len(data) != 4 {
+				return nil, fmt.Errorf("line %d: invalid start address record", line)
+			}
+
+			v := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+
+			if rec[3] == ihexStartSegmentAddress {
+				// CS:IP
+				v = (v>>16)<<4 + v&0xffff
+			}
+
+			img.Entry = v
+			img.HasEntry = true
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown record type 0x%02x", line, rec[3])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("missing end of file record")
+}
@@ -0,0 +1,184 @@
+// Package image loads firmware images into a sparse list of memory segments.
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrOverlap       = errors.New("overlapping segments")
+	ErrUnknownFormat = errors.New("unknown image format")
+	ErrChecksum      = errors.New("checksum mismatch")
+)
+
+// Segment is a contiguous block of data at a load address.
+type Segment struct {
+	Address uint32
+	Data    []byte
+}
+
+// End returns the address following the last byte of the segment.
+func (s Segment) End() uint32 {
+	return s.Address + uint32(len(s.Data))
+}
+
+func (s Segment) String() string {
+	return fmt.Sprintf("0x%08x-0x%08x (%d bytes)", s.Address, s.End(), len(s.Data))
+}
+
+// Image is a set of non-overlapping segments, sorted by address.
+type Image struct {
+	Segments []Segment
+
+	// Entry point, if the file format carries one
+	Entry    uint32
+	HasEntry bool
+}
+
+// Add inserts data at addr, merging it with adjacent segments.
+func (img *Image) Add(addr uint32, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	end := uint64(addr) + uint64(len(data))
+
+	i := sort.Search(len(img.Segments), func(i int) bool {
+		return img.Segments[i].Address >= addr
+	})
+
+	if i > 0 && img.Segments[i-1].End() > addr {
+		return fmt.Errorf("%w: 0x%08x and %s", ErrOverlap, addr, img.Segments[i-1])
+	}
+
+	if i < len(img.Segments) && uint64(img.Segments[i].Address) < end {
+		return fmt.Errorf("%w: 0x%08x and %s", ErrOverlap, addr, img.Segments[i])
+	}
+
+	if i > 0 && img.Segments[i-1].End() == addr {
+		prev := &img.Segments[i-1]
+		prev.Data = append(prev.Data, data...)
+
+		if i < len(img.Segments) && prev.End() == img.Segments[i].Address {
+			prev.Data = append(prev.Data, img.Segments[i].Data...)
+			img.Segments = append(img.Segments[:i], img.Segments[i+1:]...)
+		}
+
+		return nil
+	}
+
+	if i < len(img.Segments) && uint64(img.Segments[i].Address) == end {
+		next := &img.Segments[i]
+		next.Data = append(append([]byte(nil), data...), next.Data...)
+		next.Address = addr
+
+		return nil
+	}
+
+	img.Segments = append(img.Segments, Segment{})
+	copy(img.Segments[i+1:], img.Segments[i:])
+	img.Segments[i] = Segment{Address: addr, Data: append([]byte(nil), data...)}
+
+	return nil
+}
+
+// Size returns the number of data bytes in the image.
+func (img *Image) Size() int {
+	n := 0
+
+	for _, s := range img.Segments {
+		n += len(s.Data)
+	}
+
+	return n
+}
+
+// Aligned returns the segments extended to multiples of alignment, which must be a
+// power of two. Segments sharing an aligned block are merged and all padding is
+// set to fill.
+func (img *Image) Aligned(alignment uint32, fill byte) []Segment {
+	var out []Segment
+
+	pad := func(s *Segment) {
+		for uint32(len(s.Data))%alignment != 0 {
+			s.Data = append(s.Data, fill)
+		}
+	}
+
+	for _, s := range img.Segments {
+		start := s.Address &^ (alignment - 1)
+
+		if n := len(out); n > 0 && start < out[n-1].End() {
+			last := &out[n-1]
+
+			for last.End() < s.End() {
+				last.Data = append(last.Data, fill)
+			}
+
+			copy(last.Data[s.Address-last.Address:], s.Data)
+			pad(last)
+
+			continue
+		}
+
+		data := bytes.Repeat([]byte{fill}, int(s.Address-start))
+		data = append(data, s.Data...)
+
+		seg := Segment{Address: start, Data: data}
+		pad(&seg)
+
+		out = append(out, seg)
+	}
+
+	return out
+}
+
+// FromBinary returns an image holding the raw data at addr.
+func FromBinary(addr uint32, data []byte) *Image {
+	img := &Image{}
+	_ = img.Add(addr, data)
+
+	return img
+}
+
+// Load reads an Intel HEX, Motorola S-record or ELF file. The format is derived
+// from the file extension, or from the content if the extension is unknown.
+func Load(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".hex", ".ihex", ".ihx":
+		return ParseIntelHex(f)
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return ParseSREC(f)
+	case ".elf", ".axf", ".out":
+		return ParseELF(f)
+	}
+
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, path)
+	}
+
+	switch {
+	case bytes.Equal(magic, []byte("\x7fELF")):
+		return ParseELF(f)
+	case magic[0] == ':':
+		return ParseIntelHex(f)
+	case magic[0] == 'S' && magic[1] >= '0' && magic[1] <= '9':
+		return ParseSREC(f)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, path)
+}
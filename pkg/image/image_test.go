@@ -0,0 +1,181 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	img := &Image{}
+
+	for _, s := range []Segment{
+		{0x1004, []byte{5, 6}},
+		{0x1000, []byte{1, 2, 3, 4}},
+		{0x2000, []byte{9}},
+		{0x1006, []byte{7}},
+	} {
+		if err := img.Add(s.Address, s.Data); err != nil {
+			t.Fatalf("add %s: %v", s, err)
+		}
+	}
+
+	want := []Segment{
+		{0x1000, []byte{1, 2, 3, 4, 5, 6, 7}},
+		{0x2000, []byte{9}},
+	}
+
+	if fmt.Sprint(img.Segments) != fmt.Sprint(want) || fmt.Sprintf("%v", img.Segments[0].Data) != fmt.Sprintf("%v", want[0].Data) {
+		t.Errorf("got %v, want %v", img.Segments, want)
+	}
+
+	if img.Size() != 8 {
+		t.Errorf("size: got %d, want 8", img.Size())
+	}
+
+	if err := img.Add(0x1ffe, []byte{1, 2, 3}); !errors.Is(err, ErrOverlap) {
+		t.Errorf("overlap: got %v", err)
+	}
+}
+
+func TestAligned(t *testing.T) {
+	img := &Image{}
+	_ = img.Add(0x08000002, []byte{4, 5})
+	_ = img.Add(0x08000010, []byte{1, 2, 3})
+	_ = img.Add(0x08000014, []byte{6})
+	_ = img.Add(0x08000100, []byte{7})
+
+	got := img.Aligned(8, 0xff)
+
+	want := []Segment{
+		{0x08000000, []byte{0xff, 0xff, 4, 5, 0xff, 0xff, 0xff, 0xff}},
+		{0x08000010, []byte{1, 2, 3, 0xff, 6, 0xff, 0xff, 0xff}},
+		{0x08000100, []byte{7, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for i := range want {
+		if got[i].Address != want[i].Address || !bytes.Equal(got[i].Data, want[i].Data) {
+			t.Errorf("segment %d: got 0x%08x %x, want 0x%08x %x", i, got[i].Address, got[i].Data, want[i].Address, want[i].Data)
+		}
+	}
+}
+
+func TestParseIntelHex(t *testing.T) {
+	const hex = `:020000040800F2
+:10000000000100200D0100080F0100081101000887
+:0400100001020304E2
+:0200000400FFFB
+:02FFFE00AABB9C
+:0400000508000101ED
+:00000001FF
+`
+
+	img, err := ParseIntelHex(strings.NewReader(hex))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if len(img.Segments) != 2 || img.Segments[1].Address != 0x08000000 || len(img.Segments[1].Data) != 0x14 {
+		t.Fatalf("segments: got %v", img.Segments)
+	}
+
+	if img.Segments[0].Address != 0x00fffffe || !bytes.Equal(img.Segments[0].Data, []byte{0xaa, 0xbb}) {
+		t.Errorf("segment 0: got %s %x", img.Segments[0], img.Segments[0].Data)
+	}
+
+	if !img.HasEntry || img.Entry != 0x08000101 {
+		t.Errorf("entry: got 0x%08x", img.Entry)
+	}
+
+	if _, err := ParseIntelHex(strings.NewReader(":0400100001020304E3\n")); !errors.Is(err, ErrChecksum) {
+		t.Errorf("bad checksum: got %v", err)
+	}
+}
+
+func TestParseSREC(t *testing.T) {
+	const srec = `S00600004844521B
+S3090800000001020304E4
+S30708000004AABB87
+S5030002FA
+S70508000101F0
+`
+
+	img, err := ParseSREC(strings.NewReader(srec))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if len(img.Segments) != 1 || img.Segments[0].Address != 0x08000000 ||
+		!bytes.Equal(img.Segments[0].Data, []byte{1, 2, 3, 4, 0xaa, 0xbb}) {
+		t.Errorf("segments: got %v", img.Segments)
+	}
+
+	if !img.HasEntry || img.Entry != 0x08000101 {
+		t.Errorf("entry: got 0x%08x", img.Entry)
+	}
+}
+
+// buildELF returns a minimal 32-bit little endian ELF file with the given segments
+func buildELF(entry uint32, progs []struct {
+	typ, vaddr, paddr uint32
+	data              []byte
+	memsz             uint32
+}) []byte {
+	const ehdrSize, phdrSize = 52, 32
+
+	buf := &bytes.Buffer{}
+	le := binary.LittleEndian
+
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	_ = binary.Write(buf, le, []uint16{2, 40})
+	_ = binary.Write(buf, le, []uint32{1, entry, ehdrSize, 0, 0x05000200})
+	_ = binary.Write(buf, le, []uint16{ehdrSize, phdrSize, uint16(len(progs)), 40, 0, 0})
+
+	offset := uint32(ehdrSize + phdrSize*len(progs))
+
+	for _, p := range progs {
+		_ = binary.Write(buf, le, []uint32{p.typ, offset, p.vaddr, p.paddr, uint32(len(p.data)), p.memsz, 5, 4})
+		offset += uint32(len(p.data))
+	}
+
+	for _, p := range progs {
+		buf.Write(p.data)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParseELF(t *testing.T) {
+	data := buildELF(0x08000101, []struct {
+		typ, vaddr, paddr uint32
+		data              []byte
+		memsz             uint32
+	}{
+		{1, 0x08000000, 0x08000000, []byte{1, 2, 3, 4}, 4},
+		// .data is linked to RAM and loaded from flash
+		{1, 0x20000000, 0x08000004, []byte{5, 6}, 2},
+		// .bss has no file contents
+		{1, 0x20000002, 0x20000002, nil, 0x100},
+	})
+
+	img, err := ParseELF(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if len(img.Segments) != 1 || img.Segments[0].Address != 0x08000000 ||
+		!bytes.Equal(img.Segments[0].Data, []byte{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("segments: got %v", img.Segments)
+	}
+
+	if img.Entry != 0x08000101 {
+		t.Errorf("entry: got 0x%08x", img.Entry)
+	}
+}
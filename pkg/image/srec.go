@@ -0,0 +1,93 @@
+package image
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// https://en.wikipedia.org/wiki/SREC_(file_format)
+
+// ParseSREC parses a Motorola S-record file.
+func ParseSREC(r io.Reader) (*Image, error) {
+	img := &Image{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if len(text) < 2 || text[0] != 'S' {
+			return nil, fmt.Errorf("line %d: missing start code", line)
+		}
+
+		rec, err := hex.DecodeString(text[2:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if len(rec) < 1 || len(rec) != int(rec[0])+1 {
+			return nil, fmt.Errorf("line %d: invalid record length", line)
+		}
+
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+
+		if sum != 0xff {
+			return nil, fmt.Errorf("line %d: %w", line, ErrChecksum)
+		}
+
+		var addrSize int
+
+		switch text[1] {
+		case '0', '5':
+			// Header and record count
+			continue
+		case '1', '9':
+			addrSize = 2
+		case '2', '8':
+			addrSize = 3
+		case '3', '7':
+			addrSize = 4
+		case '6':
+			continue
+		default:
+			return nil, fmt.Errorf("line %d: unknown record type S%c", line, text[1])
+		}
+
+		if len(rec) < addrSize+2 {
+			return nil, fmt.Errorf("line %d: record too short", line)
+		}
+
+		var addr uint32
+		for _, b := range rec[1 : 1+addrSize] {
+			addr = addr<<8 | uint32(b)
+		}
+
+		switch text[1] {
+		case '1', '2', '3':
+			if err := img.Add(addr, rec[1+addrSize:len(rec)-1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+
+		default:
+			img.Entry = addr
+			img.HasEntry = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
@@ -0,0 +1,201 @@
+package sim
+
+import (
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+const (
+	regCPUID   = 0xe000ed00
+	regAIRCR   = 0xe000ed0c
+	regDFSR    = 0xe000ed30
+	regMPU     = 0xe000ed90
+	regMVFR0   = 0xe000ef40
+	regDHCSR   = 0xe000edf0
+	regDCRSR   = 0xe000edf4
+	regDCRDR   = 0xe000edf8
+	regDEMCR   = 0xe000edfc
+	regFPCtrl  = 0xe0002000
+	regDWTCtrl = 0xe0001000
+
+	cpuidCortexM4 = 0x410fc241
+	// Eight MPU regions and a single precision FPU
+	mpuTypeDefault = 0x800
+	mvfr0Default   = 0x10110021
+	aircrReadValue = 0xfa050000
+	dhcsrKeyShift  = 16
+	dhcsrKey       = 0xa05f
+	dhcsrCtrlMask  = 0xffff
+	xpsrThumb      = 1 << 24
+
+	// Six code and two literal comparators
+	fpCtrlDefault = 0x260
+	// Four comparators
+	dwtCtrlDefault = 0x40000000
+)
+
+// Core models the debug interface of a Cortex-M core. It does not execute code:
+// while running, it only halts on debug requests or when Break is called.
+type Core struct {
+	t *Target
+
+	dhcsr  uint32
+	halted bool
+	dfsr   uint32
+	demcr  uint32
+	dcrsr  uint32
+	dcrdr  uint32
+	resets int
+
+	vectorTable uint32
+	registers   map[cd.CoreRegister]uint32
+}
+
+func newCore(t *Target) *Core {
+	c := &Core{
+		t:         t,
+		halted:    true,
+		registers: make(map[cd.CoreRegister]uint32),
+	}
+
+	t.registers[regDHCSR] = register{read: c.readDHCSR, write: c.writeDHCSR}
+	t.registers[regDCRSR] = register{read: func() uint32 { return c.dcrsr }, write: c.writeDCRSR}
+	t.registers[regDCRDR] = register{read: func() uint32 { return c.dcrdr }, write: func(v uint32) { c.dcrdr = v }}
+	t.registers[regDEMCR] = register{read: func() uint32 { return c.demcr }, write: func(v uint32) { c.demcr = v }}
+	t.registers[regDFSR] = register{read: func() uint32 { return c.dfsr }, write: func(v uint32) { c.dfsr &= ^v }}
+	t.registers[regAIRCR] = register{read: func() uint32 { return aircrReadValue }, write: c.writeAIRCR}
+
+	t.memory[regCPUID] = cpuidCortexM4
+	t.memory[regMPU] = mpuTypeDefault
+	t.memory[regMVFR0] = mvfr0Default
+	t.memory[regFPCtrl] = fpCtrlDefault
+	t.memory[regDWTCtrl] = dwtCtrlDefault
+
+	return c
+}
+
+func (c *Core) readDHCSR() uint32 {
+	v := c.dhcsr&dhcsrCtrlMask | uint32(cd.DHCSRSRegReady)
+
+	if c.halted {
+		v |= uint32(cd.DHCSRSHalt)
+	}
+
+	return v
+}
+
+func (c *Core) writeDHCSR(v uint32) {
+	if v>>dhcsrKeyShift != dhcsrKey {
+		return
+	}
+
+	c.dhcsr = v & dhcsrCtrlMask
+	ctrl := cd.DHCSR(c.dhcsr)
+
+	switch {
+	case ctrl&cd.DHCSRCDebugEn == 0:
+		c.halted = false
+
+	case ctrl&cd.DHCSRCHalt != 0:
+		if !c.halted {
+			c.halted = true
+			c.dfsr |= uint32(scb.DFSRHalted)
+		}
+
+	case c.halted && ctrl&cd.DHCSRCStep != 0:
+		// Pretend every instruction is a 16-bit Thumb instruction
+		c.registers[cd.CoreRegisterPC] += 2
+		c.dfsr |= uint32(scb.DFSRHalted)
+
+	default:
+		c.halted = false
+	}
+}
+
+func (c *Core) writeDCRSR(v uint32) {
+	c.dcrsr = v
+	reg := cd.CoreRegister(cd.DCRSR(v) & cd.RegSelMask)
+
+	if cd.DCRSR(v)&cd.RegWnR != 0 {
+		c.registers[reg] = c.dcrdr
+	} else {
+		c.dcrdr = c.registers[reg]
+	}
+}
+
+func (c *Core) writeAIRCR(v uint32) {
+	aircr := scb.AIRCR(v)
+
+	if aircr&^0xffff != scb.AIRCRVectKeyStat || aircr&scb.AIRCRSysResetReq == 0 {
+		return
+	}
+
+	c.reset()
+}
+
+func (c *Core) reset() {
+	c.resets++
+	c.registers = map[cd.CoreRegister]uint32{
+		cd.CoreRegisterSP:   c.t.memory[c.vectorTable],
+		cd.CoreRegisterMSP:  c.t.memory[c.vectorTable],
+		cd.CoreRegisterPC:   c.t.memory[c.vectorTable+4] &^ 1,
+		cd.CoreRegisterXPSR: xpsrThumb,
+		cd.CoreRegisterLR:   0xffffffff,
+	}
+
+	if cd.DHCSR(c.dhcsr)&cd.DHCSRCDebugEn != 0 && cd.DEMCR(c.demcr)&cd.DEMCRVcCoreReset != 0 {
+		c.halted = true
+		c.dfsr |= uint32(scb.DFSRVCatch)
+	} else {
+		c.halted = false
+	}
+}
+
+// SetVectorTable sets the address the initial SP and PC are loaded from on reset.
+func (c *Core) SetVectorTable(addr uint32) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	c.vectorTable = addr
+}
+
+// Halted reports whether the core is in debug state.
+func (c *Core) Halted() bool {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	return c.halted
+}
+
+// Break simulates a debug event at pc while the core is running, for example a
+// breakpoint hit or a watchpoint trigger.
+func (c *Core) Break(pc uint32, reason scb.DFSR) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	c.registers[cd.CoreRegisterPC] = pc
+	c.dfsr |= uint32(reason)
+	c.halted = true
+}
+
+// Resets returns the number of system resets requested through AIRCR.
+func (c *Core) Resets() int {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	return c.resets
+}
+
+func (c *Core) Register(reg cd.CoreRegister) uint32 {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	return c.registers[reg]
+}
+
+func (c *Core) SetRegister(reg cd.CoreRegister, v uint32) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+
+	c.registers[reg] = v
+}
@@ -0,0 +1,289 @@
+// Package sim implements a simulated SWD target for tests. It models a debug port
+// with a single MEM-AP on top of sparse memory, and a Cortex-M core that only
+// reacts to debug requests.
+package sim
+
+import (
+	"sync"
+
+	"github.com/holoplot/go-swd/pkg/io"
+)
+
+const (
+	dpIDCode   = 0x0
+	dpAbort    = 0x0
+	dpCtrlStat = 0x4
+	dpSelect   = 0x8
+	dpRdBuff   = 0xc
+
+	apCSW  = 0x00
+	apTAR  = 0x04
+	apDRW  = 0x0c
+	apBase = 0xf8
+	apIDR  = 0xfc
+
+	apSelShift = 24
+
+	ctrlStatStickyErr    = 1 << 5
+	ctrlStatPowerUpReq   = 1<<28 | 1<<30
+	ctrlStatPowerUpShift = 1
+
+	cswSizeMask          = 0x7
+	cswAutoIncrementMask = 0x3 << 4
+	cswAutoIncrement     = 0x1 << 4
+	cswDefault           = 0x23000002
+
+	// TAR auto-increment wraps within 1KB, like on most MEM-AP implementations
+	autoIncrementWrap = 0x3ff
+
+	defaultIDCode = 0x2ba01477
+	defaultAPIDR  = 0x24770011
+	defaultBase   = 0xe00ff003
+)
+
+// ReadFunc returns the value of a memory mapped register.
+type ReadFunc func() uint32
+
+// WriteFunc is called for writes to a memory mapped register.
+type WriteFunc func(uint32)
+
+type register struct {
+	read  ReadFunc
+	write WriteFunc
+}
+
+// Target is a simulated SWD target implementing io.Accessor.
+type Target struct {
+	mu sync.Mutex
+
+	idCode   uint32
+	ctrlStat uint32
+	sel      uint32
+	rdBuff   uint32
+	csw      uint32
+	tar      uint32
+
+	memory    map[uint32]uint32
+	registers map[uint32]register
+
+	core *Core
+}
+
+func (t *Target) LineReset() error {
+	return nil
+}
+
+func (t *Target) Close() {}
+
+func (t *Target) Tx(tx *io.Transaction) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx.Ack = io.AckOk
+
+	if tx.PortType == io.DebugPort {
+		t.debugPort(tx)
+	} else {
+		t.accessPort(tx)
+	}
+
+	return nil
+}
+
+func (t *Target) debugPort(tx *io.Transaction) {
+	if tx.Direction == io.DirectionRead {
+		switch tx.Address {
+		case dpIDCode:
+			tx.Data = t.idCode
+		case dpCtrlStat:
+			// Power-up acknowledge bits follow the request bits
+			tx.Data = t.ctrlStat | (t.ctrlStat&ctrlStatPowerUpReq)<<ctrlStatPowerUpShift
+		case dpRdBuff:
+			tx.Data = t.rdBuff
+		}
+
+		return
+	}
+
+	switch tx.Address {
+	case dpAbort:
+		t.ctrlStat &= ^uint32(ctrlStatStickyErr)
+	case dpCtrlStat:
+		t.ctrlStat = tx.Data & ctrlStatPowerUpReq
+	case dpSelect:
+		t.sel = tx.Data
+	}
+}
+
+func (t *Target) accessPort(tx *io.Transaction) {
+	reg := (t.sel&0xf0 | uint32(tx.Address)) & 0xff
+
+	// Only access port 0 is implemented
+	if t.sel>>apSelShift != 0 {
+		if tx.Direction == io.DirectionRead {
+			tx.Data = t.rdBuff
+			t.rdBuff = 0
+		}
+
+		return
+	}
+
+	if tx.Direction == io.DirectionRead {
+		var v uint32
+
+		switch reg {
+		case apCSW:
+			v = t.csw
+		case apTAR:
+			v = t.tar
+		case apDRW:
+			v = t.read(t.tar &^ 3)
+			t.increment()
+		case apBase:
+			v = defaultBase
+		case apIDR:
+			v = defaultAPIDR
+		}
+
+		// AP reads are posted, the result is returned by the next read
+		tx.Data = t.rdBuff
+		t.rdBuff = v
+
+		return
+	}
+
+	switch reg {
+	case apCSW:
+		t.csw = tx.Data
+	case apTAR:
+		t.tar = tx.Data
+	case apDRW:
+		t.writeLanes(t.tar, tx.Data)
+		t.increment()
+	}
+}
+
+func (t *Target) accessSize() uint32 {
+	return 1 << (t.csw & cswSizeMask)
+}
+
+func (t *Target) increment() {
+	if t.csw&cswAutoIncrementMask != cswAutoIncrement {
+		return
+	}
+
+	t.tar = t.tar&^autoIncrementWrap | (t.tar+t.accessSize())&autoIncrementWrap
+}
+
+func (t *Target) writeLanes(addr, data uint32) {
+	size := t.accessSize()
+	if size >= 4 {
+		t.write(addr&^3, data)
+		return
+	}
+
+	shift := (addr & 3) * 8
+	mask := (uint32(1)<<(size*8) - 1) << shift
+
+	t.write(addr&^3, t.read(addr&^3)&^mask|data&mask)
+}
+
+func (t *Target) read(addr uint32) uint32 {
+	if r, ok := t.registers[addr]; ok && r.read != nil {
+		return r.read()
+	}
+
+	return t.memory[addr]
+}
+
+func (t *Target) write(addr, v uint32) {
+	if r, ok := t.registers[addr]; ok {
+		if r.write != nil {
+			r.write(v)
+		}
+
+		return
+	}
+
+	t.memory[addr] = v
+}
+
+// Map installs handlers for the word at addr. A nil read function returns the last
+// value stored with WriteWord, a nil write function ignores writes.
+func (t *Target) Map(addr uint32, read ReadFunc, write WriteFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.registers[addr&^3] = register{read: read, write: write}
+}
+
+// ReadWord returns the word at addr as seen by the debugger.
+func (t *Target) ReadWord(addr uint32) uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.read(addr &^ 3)
+}
+
+// WriteWord stores a word in memory, bypassing any register handlers.
+func (t *Target) WriteWord(addr, v uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.memory[addr&^3] = v
+}
+
+// Load copies data into memory at addr.
+func (t *Target) Load(addr uint32, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, b := range data {
+		a := addr + uint32(i)
+		shift := (a & 3) * 8
+
+		t.memory[a&^3] = t.memory[a&^3]&^(0xff<<shift) | uint32(b)<<shift
+	}
+}
+
+// Dump returns size bytes of memory starting at addr.
+func (t *Target) Dump(addr uint32, size int) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	buf := make([]byte, size)
+
+	for i := range buf {
+		a := addr + uint32(i)
+		buf[i] = byte(t.memory[a&^3] >> ((a & 3) * 8))
+	}
+
+	return buf
+}
+
+// SetStickyError flags a sticky error in CTRL/STAT, as after a faulting access.
+func (t *Target) SetStickyError() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ctrlStat |= ctrlStatStickyErr
+}
+
+// Core returns the simulated processor.
+func (t *Target) Core() *Core {
+	return t.core
+}
+
+// New returns a simulated target with a halted Cortex-M4F core.
+func New() *Target {
+	t := &Target{
+		idCode:    defaultIDCode,
+		csw:       cswDefault,
+		memory:    make(map[uint32]uint32),
+		registers: make(map[uint32]register),
+	}
+
+	t.core = newCore(t)
+
+	return t
+}
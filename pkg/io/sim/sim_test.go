@@ -0,0 +1,78 @@
+package sim
+
+import (
+	"bytes"
+	"testing"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+func TestMemory(t *testing.T) {
+	target := New()
+	s := swd.New(target)
+
+	if _, err := s.Initialize(); err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+
+	// Crosses the 1KB auto-increment boundary with unaligned head and tail
+	addr := uint32(0x200003f1)
+	data := make([]byte, 0x31)
+
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+
+	if err := s.WriteMemory(addr, data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if got := target.Dump(addr, len(data)); !bytes.Equal(got, data) {
+		t.Errorf("memory: got %x, want %x", got, data)
+	}
+
+	buf := make([]byte, len(data))
+
+	if err := s.ReadMemory(addr, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if !bytes.Equal(buf, data) {
+		t.Errorf("read: got %x, want %x", buf, data)
+	}
+}
+
+func TestCoreRegisters(t *testing.T) {
+	target := New()
+	core := cd.New(swd.New(target))
+
+	if err := core.Halt(); err != nil {
+		t.Fatalf("halt: %v", err)
+	}
+
+	if err := core.WriteCoreRegister(cd.CoreRegisterPC, 0x08000100); err != nil {
+		t.Fatalf("write pc: %v", err)
+	}
+
+	if err := core.Step(); err != nil {
+		t.Fatalf("step: %v", err)
+	}
+
+	pc, err := core.ReadCoreRegister(cd.CoreRegisterPC)
+	if err != nil {
+		t.Fatalf("read pc: %v", err)
+	}
+
+	if pc != 0x08000102 {
+		t.Errorf("pc: got 0x%08x, want 0x08000102", pc)
+	}
+
+	if err := core.Continue(); err != nil {
+		t.Fatalf("continue: %v", err)
+	}
+
+	if target.Core().Halted() {
+		t.Errorf("core still halted")
+	}
+}
@@ -0,0 +1,262 @@
+package itm
+
+import (
+	"bufio"
+	"io"
+)
+
+// https://developer.arm.com/documentation/ddi0403/ed/ Appendix D4, Debug ITM and DWT Packet Protocol
+
+const (
+	headerSizeMask      = 0x03
+	headerHardware      = 0x04
+	headerExtension     = 0x08
+	headerContinuation  = 0x80
+	headerOverflow      = 0x70
+	headerGTS1          = 0x94
+	headerGTS2          = 0xb4
+	headerSyncEnd       = 0x80
+	headerAddressShift  = 3
+	headerTimestampMask = 0x0f
+
+	syncZeroBytes = 5
+
+	gts1Bits        = 26
+	gts1ClockChange = 0x20
+	gts1Wrap        = 0x40
+
+	discriminatorEventCounter = 0
+	discriminatorException    = 1
+	discriminatorPCSample     = 2
+)
+
+// Decoder parses a raw SWO byte stream into packets.
+type Decoder struct {
+	r *bufio.Reader
+
+	gtsHigh uint64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+// continuation reads up to max payload bytes with 7 data bits each, the last byte
+// has the continuation bit cleared.
+func (d *Decoder) continuation(max int) (uint64, []byte, error) {
+	var v uint64
+	var raw []byte
+
+	for i := 0; i < max; i++ {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+
+		raw = append(raw, b)
+		v |= uint64(b&0x7f) << (7 * i)
+
+		if b&headerContinuation == 0 {
+			break
+		}
+	}
+
+	return v, raw, nil
+}
+
+func (d *Decoder) payload(size int) ([]byte, uint32, error) {
+	buf := make([]byte, size)
+
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+
+	var v uint32
+
+	for i, b := range buf {
+		v |= uint32(b) << (8 * i)
+	}
+
+	return buf, v, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (d *Decoder) sync() (Packet, bool, error) {
+	zeros := 1
+
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch {
+		case b == 0:
+			zeros++
+		case b == headerSyncEnd && zeros >= syncZeroBytes:
+			return Sync{}, true, nil
+		default:
+			// Idle zero bytes, continue with the next header
+			_ = d.r.UnreadByte()
+
+			return nil, false, nil
+		}
+	}
+}
+
+func (d *Decoder) hardware(header byte, size int) (Packet, error) {
+	raw, v, err := d.payload(size)
+	if err != nil {
+		return nil, err
+	}
+
+	id := header >> headerAddressShift
+
+	switch {
+	case id == discriminatorEventCounter:
+		return EventCounter{Flags: EventCounterFlags(v)}, nil
+
+	case id == discriminatorException && size == 2:
+		return ExceptionTrace{
+			Exception: uint16(v & 0x1ff),
+			Action:    ExceptionAction((v >> 12) & 0x3),
+		}, nil
+
+	case id == discriminatorPCSample:
+		if size == 1 {
+			return PCSample{Sleep: true}, nil
+		}
+
+		return PCSample{PC: v}, nil
+
+	case id >= 8 && id <= 15:
+		comparator := (id >> 1) & 0x3
+
+		if id&1 == 0 {
+			return DataTracePC{Comparator: comparator, PC: v}, nil
+		}
+
+		return DataTraceAddress{Comparator: comparator, Offset: uint16(v)}, nil
+
+	case id >= 16 && id <= 23:
+		return DataTraceValue{
+			Comparator: (id >> 1) & 0x3,
+			Write:      id&1 != 0,
+			Size:       size,
+			Value:      v,
+		}, nil
+	}
+
+	return Unknown{Header: header, Payload: raw}, nil
+}
+
+// Next returns the next packet from the stream, or io.EOF at the end.
+func (d *Decoder) Next() (Packet, error) {
+	for {
+		header, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case header == 0:
+			p, ok, err := d.sync()
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				return p, nil
+			}
+
+		case header == headerOverflow:
+			return Overflow{}, nil
+
+		case header&headerSizeMask != 0:
+			size := 1 << (header&headerSizeMask - 1)
+
+			if header&headerHardware != 0 {
+				return d.hardware(header, size)
+			}
+
+			_, v, err := d.payload(size)
+			if err != nil {
+				return nil, err
+			}
+
+			return Instrumentation{
+				Port: header >> headerAddressShift,
+				Size: size,
+				Data: v,
+			}, nil
+
+		case header == headerGTS1:
+			v, raw, err := d.continuation(4)
+			if err != nil {
+				return nil, err
+			}
+
+			p := GlobalTimestamp{Value: v & (1<<gts1Bits - 1)}
+
+			if len(raw) == 4 {
+				p.ClockChange = raw[3]&gts1ClockChange != 0
+				p.Wrap = raw[3]&gts1Wrap != 0
+			}
+
+			p.Value |= d.gtsHigh << gts1Bits
+
+			return p, nil
+
+		case header == headerGTS2:
+			v, _, err := d.continuation(5)
+			if err != nil {
+				return nil, err
+			}
+
+			d.gtsHigh = v
+
+		case header&headerTimestampMask == 0:
+			if header&headerContinuation == 0 {
+				// LTS2, the timestamp is encoded in the header
+				return LocalTimestamp{Delta: uint32(header >> 4)}, nil
+			}
+
+			v, _, err := d.continuation(4)
+			if err != nil {
+				return nil, err
+			}
+
+			return LocalTimestamp{
+				Delta:    uint32(v),
+				Relation: TimestampRelation((header >> 4) & 0x3),
+			}, nil
+
+		case header&headerExtension != 0 && header&0x3 == 0:
+			// Bits 6:4 of the header hold the low bits of the value
+			value := uint32(header>>4) & 0x7
+
+			if header&headerContinuation != 0 {
+				v, _, err := d.continuation(4)
+				if err != nil {
+					return nil, err
+				}
+
+				value |= uint32(v) << 3
+			}
+
+			return Extension{Hardware: header&headerHardware != 0, Value: value}, nil
+
+		default:
+			return Unknown{Header: header}, nil
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package itm
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []Packet
+	}{
+		{
+			name: "sync",
+			data: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x80},
+			want: []Packet{Sync{}},
+		},
+		{
+			name: "overflow",
+			data: []byte{0x70},
+			want: []Packet{Overflow{}},
+		},
+		{
+			name: "instrumentation",
+			data: []byte{0x01, 'A', 0x0a, 0x34, 0x12, 0x0b, 0x78, 0x56, 0x34, 0x12},
+			want: []Packet{
+				Instrumentation{Port: 0, Size: 1, Data: 'A'},
+				Instrumentation{Port: 1, Size: 2, Data: 0x1234},
+				Instrumentation{Port: 1, Size: 4, Data: 0x12345678},
+			},
+		},
+		{
+			name: "pc sample",
+			data: []byte{0x17, 0x01, 0x02, 0x00, 0x08, 0x15, 0x00},
+			want: []Packet{
+				PCSample{PC: 0x08000201},
+				PCSample{Sleep: true},
+			},
+		},
+		{
+			name: "exception trace",
+			data: []byte{0x0e, 0x0f, 0x20},
+			want: []Packet{ExceptionTrace{Exception: 15, Action: ExceptionExited}},
+		},
+		{
+			name: "local timestamps",
+			data: []byte{0x30, 0xc0, 0x81, 0x01},
+			want: []Packet{
+				LocalTimestamp{Delta: 3},
+				LocalTimestamp{Delta: 0x81, Relation: TimestampSync},
+			},
+		},
+		{
+			name: "global timestamp",
+			data: []byte{0xb4, 0x01, 0x94, 0x85, 0x80, 0x80, 0x20},
+			want: []Packet{
+				GlobalTimestamp{Value: 1<<26 | 5, ClockChange: true},
+			},
+		},
+		{
+			name: "data trace",
+			data: []byte{0x47, 0x00, 0x10, 0x00, 0x20, 0x8e, 0xff, 0x00},
+			want: []Packet{
+				DataTracePC{Comparator: 0, PC: 0x20001000},
+				DataTraceValue{Comparator: 0, Write: true, Size: 2, Value: 0xff},
+			},
+		},
+		{
+			name: "extension",
+			data: []byte{0x18},
+			want: []Packet{Extension{Value: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(bytes.NewReader(tt.data))
+
+			var got []Packet
+
+			for {
+				p, err := d.Next()
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				got = append(got, p)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	d := NewDecoder(bytes.NewReader([]byte{0x03, 0x01}))
+
+	if _, err := d.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestPCSampling(t *testing.T) {
+	tests := []struct {
+		interval uint32
+		tap      bool
+		preset   uint8
+	}{
+		{64, false, 0},
+		{640, false, 9},
+		{1024, false, 15},
+		{4096, true, 3},
+		{1 << 20, true, 15},
+	}
+
+	for _, tt := range tests {
+		ctrl, preset := pcSampling(tt.interval)
+
+		if (ctrl != 0) != tt.tap || preset != tt.preset {
+			t.Errorf("interval %d: got tap %v preset %d, want %v %d", tt.interval, ctrl != 0, preset, tt.tap, tt.preset)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package itm
+
+import (
+	"errors"
+	"fmt"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/dwt"
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+var ErrInvalidConfig = errors.New("invalid trace configuration")
+
+// Config describes the SWO trace output. Routing the SWO signal to its pin is
+// device specific and not covered here.
+type Config struct {
+	// Frequency of the trace clock, usually the core clock
+	TraceClock uint32
+	BaudRate   uint32
+
+	// Use Manchester encoding instead of NRZ (UART)
+	Manchester bool
+
+	// Bit mask of the stimulus ports to enable
+	StimulusPorts uint32
+
+	// ATB ID of the ITM, must be non-zero
+	TraceBusID uint8
+
+	LocalTimestamps bool
+	// Local timestamp prescaler, 0 to 3 for division by 1, 4, 16 or 64
+	TimestampPrescaler uint8
+
+	// Emit synchronization packets periodically
+	Sync bool
+
+	// Sample the PC roughly every PCSampleInterval cycles, 0 disables sampling
+	PCSampleInterval uint32
+
+	ExceptionTrace bool
+}
+
+type ITM struct {
+	swd       *swd.SWD
+	coreDebug *cd.CoreDebug
+	dwt       *dwt.DWT
+}
+
+func (itm *ITM) ReadTCR() (TCR, error) {
+	reg, err := itm.swd.ReadRegister(regITMTCR)
+	if err != nil {
+		return 0, err
+	}
+
+	return TCR(reg), nil
+}
+
+func (itm *ITM) WriteTCR(tcr TCR) error {
+	return itm.swd.WriteRegister(regITMTCR, uint32(tcr))
+}
+
+// pcSampling computes CYCTAP and POSTPRESET for the requested sample interval.
+func pcSampling(interval uint32) (dwt.Ctrl, uint8) {
+	tap, ctrl := uint32(64), dwt.Ctrl(0)
+
+	if interval > 64*16 {
+		tap, ctrl = 1024, dwt.CtrlCycTap
+	}
+
+	preset := interval / tap
+	if preset > 0 {
+		preset--
+	}
+
+	if preset > 15 {
+		preset = 15
+	}
+
+	return ctrl, uint8(preset)
+}
+
+// Configure enables tracing and sets up TPIU, ITM and DWT for SWO output.
+func (itm *ITM) Configure(cfg Config) error {
+	if cfg.BaudRate == 0 || cfg.TraceClock < cfg.BaudRate {
+		return fmt.Errorf("%w: trace clock %d, baud rate %d", ErrInvalidConfig, cfg.TraceClock, cfg.BaudRate)
+	}
+
+	if cfg.TraceBusID == 0 || cfg.TraceBusID > 0x7f {
+		return fmt.Errorf("%w: trace bus ID %d", ErrInvalidConfig, cfg.TraceBusID)
+	}
+
+	demcr, err := itm.coreDebug.ReadDEMCR()
+	if err != nil {
+		return fmt.Errorf("read DEMCR: %w", err)
+	}
+
+	if err := itm.coreDebug.WriteDEMCR(demcr | cd.DEMCREnableTrace); err != nil {
+		return fmt.Errorf("write DEMCR: %w", err)
+	}
+
+	// TPIU: single pin asynchronous output without formatter
+	if err := itm.swd.WriteRegister(regTPIUCSPSR, 1); err != nil {
+		return err
+	}
+
+	if err := itm.swd.WriteRegister(regTPIUACPR, cfg.TraceClock/cfg.BaudRate-1); err != nil {
+		return err
+	}
+
+	protocol := uint32(tpiuProtocolNRZ)
+	if cfg.Manchester {
+		protocol = tpiuProtocolManchester
+	}
+
+	if err := itm.swd.WriteRegister(regTPIUSPPR, protocol); err != nil {
+		return err
+	}
+
+	if err := itm.swd.WriteRegister(regTPIUFFCR, tpiuFormatterTrigIn); err != nil {
+		return err
+	}
+
+	// ITM
+	if err := itm.swd.WriteRegister(regITMLAR, itmLockAccessKey); err != nil {
+		return err
+	}
+
+	tcr := TCRITMEnable | TCRDWTEnable | TCRSWOEnable |
+		TCR(cfg.TraceBusID)<<TCRTraceBusIDShift
+
+	if cfg.LocalTimestamps {
+		tcr |= TCRTimestampEnable | (TCR(cfg.TimestampPrescaler)<<TCRTSPrescaleShift)&TCRTSPrescaleMask
+	}
+
+	if cfg.Sync {
+		tcr |= TCRSyncEnable
+	}
+
+	if err := itm.WriteTCR(tcr); err != nil {
+		return fmt.Errorf("write TCR: %w", err)
+	}
+
+	// Allow unprivileged access to all stimulus ports
+	if err := itm.swd.WriteRegister(regITMTPR, 0); err != nil {
+		return err
+	}
+
+	if err := itm.swd.WriteRegister(regITMTER, cfg.StimulusPorts); err != nil {
+		return err
+	}
+
+	// DWT
+	ctrl, err := itm.dwt.ReadCtrl()
+	if err != nil {
+		return fmt.Errorf("read DWT control: %w", err)
+	}
+
+	ctrl &= ^(dwt.CtrlPCSampleEnable | dwt.CtrlExcTraceEnable | dwt.CtrlCycTap | dwt.CtrlSyncTapMask)
+
+	// Synchronization packets are timed by the cycle counter
+	if cfg.Sync {
+		ctrl.SetSyncTap(1)
+		ctrl |= dwt.CtrlCycCntEnable
+	}
+
+	if cfg.PCSampleInterval > 0 {
+		tap, preset := pcSampling(cfg.PCSampleInterval)
+
+		ctrl |= tap | dwt.CtrlPCSampleEnable | dwt.CtrlCycCntEnable
+		ctrl.SetPostPreset(preset)
+	}
+
+	if cfg.ExceptionTrace {
+		ctrl |= dwt.CtrlExcTraceEnable
+	}
+
+	if err := itm.dwt.WriteCtrl(ctrl); err != nil {
+		return fmt.Errorf("write DWT control: %w", err)
+	}
+
+	return nil
+}
+
+// Disable stops all ITM and DWT trace output.
+func (itm *ITM) Disable() error {
+	ctrl, err := itm.dwt.ReadCtrl()
+	if err != nil {
+		return err
+	}
+
+	ctrl &= ^(dwt.CtrlPCSampleEnable | dwt.CtrlExcTraceEnable)
+
+	if err := itm.dwt.WriteCtrl(ctrl); err != nil {
+		return err
+	}
+
+	if err := itm.swd.WriteRegister(regITMTER, 0); err != nil {
+		return err
+	}
+
+	return itm.WriteTCR(0)
+}
+
+// WriteStimulus writes a word to a stimulus port from the debugger side, which is
+// useful to test the trace path.
+func (itm *ITM) WriteStimulus(port uint8, data uint32) error {
+	if port > 31 {
+		return fmt.Errorf("invalid stimulus port %d", port)
+	}
+
+	return itm.swd.WriteRegister(regITMStim+uint32(port)*4, data)
+}
+
+func New(swd *swd.SWD) *ITM {
+	return &ITM{
+		swd:       swd,
+		coreDebug: cd.New(swd),
+		dwt:       dwt.New(swd),
+	}
+}
@@ -0,0 +1,38 @@
+package itm
+
+import (
+	"testing"
+
+	"github.com/holoplot/go-swd/pkg/dwt"
+	"github.com/holoplot/go-swd/pkg/io/sim"
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+func TestConfigureSync(t *testing.T) {
+	s := swd.New(sim.New())
+	itm := New(s)
+
+	cfg := Config{TraceClock: 72000000, BaudRate: 2000000, TraceBusID: 1, Sync: true}
+
+	if err := itm.Configure(cfg); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+
+	ctrl, err := dwt.New(s).ReadCtrl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctrl&dwt.CtrlCycCntEnable == 0 || ctrl&dwt.CtrlSyncTapMask == 0 {
+		t.Errorf("DWT control: got 0x%08x", uint32(ctrl))
+	}
+
+	tcr, err := itm.ReadTCR()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tcr&TCRSyncEnable == 0 {
+		t.Errorf("TCR: got 0x%08x", uint32(tcr))
+	}
+}
@@ -0,0 +1,192 @@
+package itm
+
+import "fmt"
+
+// Packet is a decoded ITM or DWT trace packet
+type Packet interface {
+	fmt.Stringer
+}
+
+// Sync is a synchronization packet
+type Sync struct{}
+
+func (Sync) String() string {
+	return "sync"
+}
+
+// Overflow signals that packets were lost
+type Overflow struct{}
+
+func (Overflow) String() string {
+	return "overflow"
+}
+
+// Instrumentation is a software source packet written to a stimulus port
+type Instrumentation struct {
+	Port uint8
+	Size int
+	Data uint32
+}
+
+func (p Instrumentation) String() string {
+	return fmt.Sprintf("stimulus port %d: 0x%0*x", p.Port, p.Size*2, p.Data)
+}
+
+type TimestampRelation uint8
+
+const (
+	// Timestamp is synchronous to the corresponding packet
+	TimestampSync TimestampRelation = 0
+	// Timestamp is delayed relative to the packet
+	TimestampDelayed TimestampRelation = 1
+	// Packet is delayed relative to the timestamp
+	PacketDelayed TimestampRelation = 2
+	// Both packet and timestamp are delayed
+	BothDelayed TimestampRelation = 3
+)
+
+// LocalTimestamp carries the time since the previous local timestamp
+type LocalTimestamp struct {
+	Delta    uint32
+	Relation TimestampRelation
+}
+
+func (p LocalTimestamp) String() string {
+	return fmt.Sprintf("local timestamp +%d (relation %d)", p.Delta, p.Relation)
+}
+
+// GlobalTimestamp carries an absolute timestamp. The upper bits are taken from
+// the most recent GTS2 packet.
+type GlobalTimestamp struct {
+	Value       uint64
+	ClockChange bool
+	Wrap        bool
+}
+
+func (p GlobalTimestamp) String() string {
+	return fmt.Sprintf("global timestamp %d", p.Value)
+}
+
+// Extension carries the stimulus port page or other source specific information
+type Extension struct {
+	Hardware bool
+	Value    uint32
+}
+
+func (p Extension) String() string {
+	return fmt.Sprintf("extension 0x%x", p.Value)
+}
+
+type EventCounterFlags uint8
+
+const (
+	EventCPI   EventCounterFlags = 1 << 0
+	EventExc   EventCounterFlags = 1 << 1
+	EventSleep EventCounterFlags = 1 << 2
+	EventLSU   EventCounterFlags = 1 << 3
+	EventFold  EventCounterFlags = 1 << 4
+	EventCyc   EventCounterFlags = 1 << 5
+)
+
+// EventCounter reports wrapping DWT profiling counters
+type EventCounter struct {
+	Flags EventCounterFlags
+}
+
+func (p EventCounter) String() string {
+	return fmt.Sprintf("event counter 0x%02x", uint8(p.Flags))
+}
+
+type ExceptionAction uint8
+
+const (
+	ExceptionEntered  ExceptionAction = 1
+	ExceptionExited   ExceptionAction = 2
+	ExceptionReturned ExceptionAction = 3
+)
+
+func (a ExceptionAction) String() string {
+	switch a {
+	case ExceptionEntered:
+		return "entered"
+	case ExceptionExited:
+		return "exited"
+	case ExceptionReturned:
+		return "returned"
+	default:
+		return fmt.Sprintf("unknown:%d", uint8(a))
+	}
+}
+
+// ExceptionTrace reports entry to, exit from or return to an exception
+type ExceptionTrace struct {
+	Exception uint16
+	Action    ExceptionAction
+}
+
+func (p ExceptionTrace) String() string {
+	return fmt.Sprintf("exception %d %s", p.Exception, p.Action)
+}
+
+// PCSample is a periodic program counter sample
+type PCSample struct {
+	PC uint32
+
+	// Core was sleeping, PC is not valid
+	Sleep bool
+}
+
+func (p PCSample) String() string {
+	if p.Sleep {
+		return "pc sample: sleeping"
+	}
+
+	return fmt.Sprintf("pc sample 0x%08x", p.PC)
+}
+
+// DataTracePC reports the PC of an instruction that matched a DWT comparator
+type DataTracePC struct {
+	Comparator uint8
+	PC         uint32
+}
+
+func (p DataTracePC) String() string {
+	return fmt.Sprintf("comparator %d: pc 0x%08x", p.Comparator, p.PC)
+}
+
+// DataTraceAddress reports the lower address bits of an access that matched a DWT comparator
+type DataTraceAddress struct {
+	Comparator uint8
+	Offset     uint16
+}
+
+func (p DataTraceAddress) String() string {
+	return fmt.Sprintf("comparator %d: address offset 0x%04x", p.Comparator, p.Offset)
+}
+
+// DataTraceValue reports the data of an access that matched a DWT comparator
+type DataTraceValue struct {
+	Comparator uint8
+	Write      bool
+	Size       int
+	Value      uint32
+}
+
+func (p DataTraceValue) String() string {
+	dir := "read"
+	if p.Write {
+		dir = "write"
+	}
+
+	return fmt.Sprintf("comparator %d: %s 0x%0*x", p.Comparator, dir, p.Size*2, p.Value)
+}
+
+// Unknown is a packet with a reserved header or hardware source discriminator
+type Unknown struct {
+	Header  byte
+	Payload []byte
+}
+
+func (p Unknown) String() string {
+	return fmt.Sprintf("unknown packet 0x%02x %x", p.Header, p.Payload)
+}
@@ -0,0 +1,40 @@
+package itm
+
+// Trace Control Register
+type TCR uint32
+
+const (
+	TCRITMEnable           TCR = 1 << 0
+	TCRTimestampEnable     TCR = 1 << 1
+	TCRSyncEnable          TCR = 1 << 2
+	TCRDWTEnable           TCR = 1 << 3
+	TCRSWOEnable           TCR = 1 << 4
+	TCRTSPrescaleShift         = 8
+	TCRTSPrescaleMask      TCR = 0x3 << TCRTSPrescaleShift
+	TCRGTSFreqShift            = 10
+	TCRGTSFreqMask         TCR = 0x3 << TCRGTSFreqShift
+	TCRTraceBusIDShift         = 16
+	TCRTraceBusIDMask      TCR = 0x7f << TCRTraceBusIDShift
+	TCRBusy                TCR = 1 << 23
+	itmLockAccessKey           = 0xc5acce55
+	tpiuProtocolManchester     = 1
+	tpiuProtocolNRZ            = 2
+	tpiuFormatterTrigIn        = 1 << 8
+)
+
+const (
+	itmBaseAddress = 0xe0000000
+
+	regITMStim = itmBaseAddress + 0x000
+	regITMTER  = itmBaseAddress + 0xe00
+	regITMTPR  = itmBaseAddress + 0xe40
+	regITMTCR  = itmBaseAddress + 0xe80
+	regITMLAR  = itmBaseAddress + 0xfb0
+
+	tpiuBaseAddress = 0xe0040000
+
+	regTPIUCSPSR = tpiuBaseAddress + 0x004
+	regTPIUACPR  = tpiuBaseAddress + 0x010
+	regTPIUSPPR  = tpiuBaseAddress + 0x0f0
+	regTPIUFFCR  = tpiuBaseAddress + 0x304
+)
@@ -0,0 +1,574 @@
+package rtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+// https://wiki.segger.com/RTT
+
+const (
+	controlBlockID = "SEGGER RTT"
+
+	idSize         = 16
+	headerSize     = idSize + 8
+	descriptorSize = 24
+
+	// Offsets within a buffer descriptor
+	descName   = 0
+	descBuffer = 4
+	descSize   = 8
+	descWrOff  = 12
+	descRdOff  = 16
+	descFlags  = 20
+
+	maxChannels   = 32
+	maxNameLength = 64
+	scanChunkSize = 1024
+
+	defaultPollInterval = 10 * time.Millisecond
+)
+
+var (
+	ErrNotFound = errors.New("RTT control block not found")
+	ErrClosed   = errors.New("RTT closed")
+)
+
+// RTT gives access to the channels of a SEGGER RTT control block in target memory.
+// Target memory is accessed while the core is running.
+type RTT struct {
+	swd  *swd.SWD
+	addr uint32
+
+	// Serializes accesses to the SWD connection, see SetLocker
+	locker sync.Locker
+
+	up   []*UpChannel
+	down []*DownChannel
+
+	pollInterval time.Duration
+	stop         chan struct{}
+	done         chan struct{}
+	closed       bool
+	mu           sync.Mutex
+}
+
+type channel struct {
+	rtt *RTT
+
+	index      int
+	name       string
+	descriptor uint32
+	buffer     uint32
+	size       uint32
+}
+
+func (c *channel) Index() int {
+	return c.index
+}
+
+func (c *channel) Name() string {
+	return c.name
+}
+
+// Size returns the size of the ring buffer in target memory.
+func (c *channel) Size() int {
+	return int(c.size)
+}
+
+// UpChannel transfers data from the target to the host.
+type UpChannel struct {
+	channel
+
+	cond    *sync.Cond
+	pending bytes.Buffer
+	err     error
+}
+
+// DownChannel transfers data from the host to the target.
+type DownChannel struct {
+	channel
+}
+
+// SetLocker sets the lock that is held around every access to the SWD connection.
+// Other users of the same connection must hold it while the background poller runs.
+func (r *RTT) SetLocker(l sync.Locker) {
+	r.locker = l
+}
+
+// SetPollInterval sets how often ring buffers are polled. Values of zero or
+// less select the default interval.
+func (r *RTT) SetPollInterval(d time.Duration) {
+	r.pollInterval = d
+}
+
+func (r *RTT) UpChannels() []*UpChannel {
+	return r.up
+}
+
+func (r *RTT) DownChannels() []*DownChannel {
+	return r.down
+}
+
+// Address returns the location of the control block in target memory.
+func (r *RTT) Address() uint32 {
+	return r.addr
+}
+
+func (r *RTT) readWords(addr uint32, n int) ([]uint32, error) {
+	words := make([]uint32, n)
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if err := r.swd.ReadBlock(addr, words); err != nil {
+		return nil, err
+	}
+
+	return words, nil
+}
+
+func (r *RTT) readString(addr uint32) (string, error) {
+	if addr == 0 {
+		return "", nil
+	}
+
+	buf := make([]byte, maxNameLength)
+
+	r.locker.Lock()
+	err := r.swd.ReadMemory(addr, buf)
+	r.locker.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+
+	return string(buf), nil
+}
+
+func (r *RTT) parse() error {
+	header := make([]byte, headerSize)
+
+	r.locker.Lock()
+	err := r.swd.ReadMemory(r.addr, header)
+	r.locker.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("read control block: %w", err)
+	}
+
+	if !bytes.HasPrefix(header, []byte(controlBlockID)) {
+		return ErrNotFound
+	}
+
+	numUp := binary.LittleEndian.Uint32(header[idSize:])
+	numDown := binary.LittleEndian.Uint32(header[idSize+4:])
+
+	if numUp > maxChannels || numDown > maxChannels {
+		return fmt.Errorf("implausible channel count %d/%d", numUp, numDown)
+	}
+
+	descriptors, err := r.readWords(r.addr+headerSize, int(numUp+numDown)*descriptorSize/4)
+	if err != nil {
+		return fmt.Errorf("read buffer descriptors: %w", err)
+	}
+
+	for i := 0; i < int(numUp+numDown); i++ {
+		d := descriptors[i*descriptorSize/4:]
+
+		name, err := r.readString(d[descName/4])
+		if err != nil {
+			return fmt.Errorf("read channel name: %w", err)
+		}
+
+		c := channel{
+			rtt:        r,
+			name:       name,
+			descriptor: r.addr + headerSize + uint32(i)*descriptorSize,
+			buffer:     d[descBuffer/4],
+			size:       d[descSize/4],
+		}
+
+		if i < int(numUp) {
+			c.index = i
+			up := &UpChannel{channel: c}
+			up.cond = sync.NewCond(&r.mu)
+			r.up = append(r.up, up)
+		} else {
+			c.index = i - int(numUp)
+			r.down = append(r.down, &DownChannel{channel: c})
+		}
+	}
+
+	return nil
+}
+
+// offsets returns the write and read offsets of the ring buffer. Channels
+// without a buffer are reported as empty.
+func (c *channel) offsets() (uint32, uint32, error) {
+	if c.size == 0 {
+		return 0, 0, nil
+	}
+
+	words, err := c.rtt.readWords(c.descriptor+descWrOff, 2)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	wr, rd := words[0], words[1]
+
+	if wr >= c.size || rd >= c.size {
+		return 0, 0, fmt.Errorf("channel %d: offsets %d/%d out of range", c.index, wr, rd)
+	}
+
+	return wr, rd, nil
+}
+
+func (c *channel) readBuffer(offset uint32, buf []byte) error {
+	c.rtt.locker.Lock()
+	defer c.rtt.locker.Unlock()
+
+	return c.rtt.swd.ReadMemory(c.buffer+offset, buf)
+}
+
+func (c *channel) writeBuffer(offset uint32, buf []byte) error {
+	c.rtt.locker.Lock()
+	defer c.rtt.locker.Unlock()
+
+	return c.rtt.swd.WriteMemory(c.buffer+offset, buf)
+}
+
+func (c *channel) writeOffset(field, v uint32) error {
+	c.rtt.locker.Lock()
+	defer c.rtt.locker.Unlock()
+
+	return c.rtt.swd.WriteRegister(c.descriptor+field, v)
+}
+
+// Poll reads all data currently available in the ring buffer without blocking.
+func (c *UpChannel) Poll() ([]byte, error) {
+	wr, rd, err := c.offsets()
+	if err != nil {
+		return nil, err
+	}
+
+	if wr == rd {
+		return nil, nil
+	}
+
+	var data []byte
+
+	if wr < rd {
+		// Wrapped, read up to the end of the buffer first
+		tail := make([]byte, c.size-rd)
+
+		if err := c.readBuffer(rd, tail); err != nil {
+			return nil, err
+		}
+
+		data = tail
+		rd = 0
+	}
+
+	head := make([]byte, wr-rd)
+
+	if err := c.readBuffer(rd, head); err != nil {
+		return nil, err
+	}
+
+	data = append(data, head...)
+
+	if err := c.writeOffset(descRdOff, wr); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// fill polls the target and queues the data for Read.
+func (c *UpChannel) fill() error {
+	data, err := c.Poll()
+
+	c.rtt.mu.Lock()
+	defer c.rtt.mu.Unlock()
+
+	if err != nil {
+		c.err = err
+	}
+
+	c.pending.Write(data)
+	c.cond.Broadcast()
+
+	return err
+}
+
+// Read blocks until data is available on the channel. If the background poller
+// is not running, the target is polled directly.
+func (c *UpChannel) Read(p []byte) (int, error) {
+	r := c.rtt
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		if c.pending.Len() > 0 {
+			return c.pending.Read(p)
+		}
+
+		if c.err != nil {
+			err := c.err
+			c.err = nil
+
+			return 0, err
+		}
+
+		if r.closed {
+			return 0, io.EOF
+		}
+
+		if r.stop != nil {
+			c.cond.Wait()
+			continue
+		}
+
+		r.mu.Unlock()
+
+		err := c.fill()
+		if err == nil && c.available() == 0 {
+			time.Sleep(r.interval())
+		}
+
+		r.mu.Lock()
+	}
+}
+
+func (c *UpChannel) available() int {
+	c.rtt.mu.Lock()
+	defer c.rtt.mu.Unlock()
+
+	return c.pending.Len()
+}
+
+// TryWrite copies as much of p into the ring buffer as fits without blocking and
+// returns the number of bytes written.
+func (c *DownChannel) TryWrite(p []byte) (int, error) {
+	if c.size == 0 {
+		return 0, fmt.Errorf("channel %d has no buffer", c.index)
+	}
+
+	wr, rd, err := c.offsets()
+	if err != nil {
+		return 0, err
+	}
+
+	// One byte is kept free to distinguish a full from an empty buffer
+	free := (rd + c.size - wr - 1) % c.size
+	if uint32(len(p)) < free {
+		free = uint32(len(p))
+	}
+
+	written := uint32(0)
+
+	for written < free {
+		n := free - written
+		if wr+n > c.size {
+			n = c.size - wr
+		}
+
+		if err := c.writeBuffer(wr, p[written:written+n]); err != nil {
+			return int(written), err
+		}
+
+		written += n
+		wr = (wr + n) % c.size
+	}
+
+	if written > 0 {
+		if err := c.writeOffset(descWrOff, wr); err != nil {
+			return 0, err
+		}
+	}
+
+	return int(written), nil
+}
+
+// Write blocks until all of p has been copied into the ring buffer.
+func (c *DownChannel) Write(p []byte) (int, error) {
+	total := 0
+
+	for len(p) > 0 {
+		c.rtt.mu.Lock()
+		closed := c.rtt.closed
+		c.rtt.mu.Unlock()
+
+		if closed {
+			return total, ErrClosed
+		}
+
+		n, err := c.TryWrite(p)
+		total += n
+
+		if err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+
+		if n == 0 {
+			time.Sleep(c.rtt.interval())
+		}
+	}
+
+	return total, nil
+}
+
+func (r *RTT) interval() time.Duration {
+	if r.pollInterval <= 0 {
+		return defaultPollInterval
+	}
+
+	return r.pollInterval
+}
+
+// Start launches a background poller that transfers data of all up channels to
+// host memory, so that target logs are not lost while nobody reads.
+func (r *RTT) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stop != nil || r.closed {
+		return
+	}
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go r.poll(r.stop, r.done)
+}
+
+func (r *RTT) poll(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+
+	for {
+		for _, c := range r.up {
+			if c.size != 0 {
+				_ = c.fill()
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop terminates the background poller.
+func (r *RTT) Stop() {
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop = nil
+	r.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+
+	// Wake up readers so they fall back to polling directly
+	r.mu.Lock()
+	for _, c := range r.up {
+		c.cond.Broadcast()
+	}
+	r.mu.Unlock()
+}
+
+// Close stops the poller and makes all pending and future reads return io.EOF.
+func (r *RTT) Close() error {
+	r.Stop()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+
+	for _, c := range r.up {
+		c.cond.Broadcast()
+	}
+
+	return nil
+}
+
+func newRTT(swd *swd.SWD, addr uint32) *RTT {
+	return &RTT{
+		swd:    swd,
+		addr:   addr,
+		locker: &sync.Mutex{},
+	}
+}
+
+// New opens the control block at a known address.
+func New(swd *swd.SWD, addr uint32) (*RTT, error) {
+	r := newRTT(swd, addr)
+
+	if err := r.parse(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Find scans target RAM for the control block and opens it.
+func Find(swd *swd.SWD, ramStart, ramSize uint32) (*RTT, error) {
+	id := []byte(controlBlockID)
+	buf := make([]byte, scanChunkSize+idSize)
+
+	for offset := uint32(0); offset < ramSize; offset += scanChunkSize {
+		n := uint32(len(buf))
+		if offset+n > ramSize {
+			n = ramSize - offset
+		}
+
+		if err := swd.ReadMemory(ramStart+offset, buf[:n]); err != nil {
+			return nil, fmt.Errorf("read 0x%08x: %w", ramStart+offset, err)
+		}
+
+		// The control block is word aligned
+		for i := uint32(0); i+uint32(len(id)) <= n && i < scanChunkSize; i += 4 {
+			if !bytes.Equal(buf[i:i+uint32(len(id))], id) {
+				continue
+			}
+
+			r := newRTT(swd, ramStart+offset+i)
+
+			if err := r.parse(); err != nil {
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+
+				return nil, err
+			}
+
+			return r, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
@@ -0,0 +1,155 @@
+package rtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/holoplot/go-swd/pkg/io/sim"
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+const (
+	testRAM     = 0x20000000
+	testRAMSize = 0x2000
+	// Not aligned to the scan chunk, so the ID may straddle two reads
+	testCB   = testRAM + 0x3f8
+	testName = testRAM + 0x100
+	testUp   = testRAM + 0x1000
+	testDown = testRAM + 0x1100
+	testSize = 16
+)
+
+func descriptor(name, buffer, size uint32) []byte {
+	d := make([]byte, descriptorSize)
+	binary.LittleEndian.PutUint32(d[descName:], name)
+	binary.LittleEndian.PutUint32(d[descBuffer:], buffer)
+	binary.LittleEndian.PutUint32(d[descSize:], size)
+
+	return d
+}
+
+// newTarget places a control block with two up channels, the second one
+// unused, and one down channel in target RAM.
+func newTarget() *sim.Target {
+	target := sim.New()
+
+	cb := make([]byte, headerSize)
+	copy(cb, controlBlockID)
+	binary.LittleEndian.PutUint32(cb[idSize:], 2)
+	binary.LittleEndian.PutUint32(cb[idSize+4:], 1)
+
+	cb = append(cb, descriptor(testName, testUp, testSize)...)
+	cb = append(cb, descriptor(0, 0, 0)...)
+	cb = append(cb, descriptor(testName, testDown, testSize)...)
+
+	target.Load(testCB, cb)
+	target.Load(testName, []byte("Terminal\x00"))
+
+	return target
+}
+
+func find(t *testing.T, target *sim.Target) *RTT {
+	t.Helper()
+
+	r, err := Find(swd.New(target), testRAM, testRAMSize)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+
+	return r
+}
+
+func TestFind(t *testing.T) {
+	r := find(t, newTarget())
+
+	if r.Address() != testCB {
+		t.Errorf("address: got 0x%08x", r.Address())
+	}
+
+	if len(r.UpChannels()) != 2 || len(r.DownChannels()) != 1 {
+		t.Fatalf("got %d up and %d down channels", len(r.UpChannels()), len(r.DownChannels()))
+	}
+
+	if up := r.UpChannels()[0]; up.Name() != "Terminal" || up.Size() != testSize {
+		t.Errorf("up channel: got %q, %d bytes", up.Name(), up.Size())
+	}
+
+	if _, err := Find(swd.New(sim.New()), testRAM, testRAMSize); !errors.Is(err, ErrNotFound) {
+		t.Errorf("empty RAM: got %v", err)
+	}
+}
+
+func TestUpChannel(t *testing.T) {
+	target := newTarget()
+	r := find(t, target)
+	up := r.UpChannels()[0]
+
+	target.Load(testUp, []byte("o worldxxxxxhell"))
+
+	// Wrapped: the data starts at offset 12 and ends before offset 7
+	target.WriteWord(up.descriptor+descWrOff, 7)
+	target.WriteWord(up.descriptor+descRdOff, 12)
+
+	data, err := up.Poll()
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("poll: got %q, %v", data, err)
+	}
+
+	if rd := target.ReadWord(up.descriptor + descRdOff); rd != 7 {
+		t.Errorf("read offset: got %d", rd)
+	}
+
+	if data, err := up.Poll(); err != nil || len(data) != 0 {
+		t.Errorf("empty poll: got %q, %v", data, err)
+	}
+
+	// The unused channel neither fails nor returns data
+	unused := r.UpChannels()[1]
+
+	if err := unused.fill(); err != nil || unused.err != nil || unused.available() != 0 {
+		t.Errorf("unused channel: %v", err)
+	}
+}
+
+func TestDownChannel(t *testing.T) {
+	target := newTarget()
+	r := find(t, target)
+	down := r.DownChannels()[0]
+
+	target.WriteWord(down.descriptor+descWrOff, 14)
+	target.WriteWord(down.descriptor+descRdOff, 14)
+
+	if n, err := down.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("write: got %d, %v", n, err)
+	}
+
+	if wr := target.ReadWord(down.descriptor + descWrOff); wr != 3 {
+		t.Errorf("write offset: got %d", wr)
+	}
+
+	if got := target.Dump(testDown, testSize); !bytes.Equal(got[14:], []byte("he")) || !bytes.Equal(got[:3], []byte("llo")) {
+		t.Errorf("buffer: got %q", got)
+	}
+
+	// One byte is kept free
+	if n, err := down.TryWrite(make([]byte, testSize)); n != testSize-5-1 || err != nil {
+		t.Errorf("try write: got %d, %v", n, err)
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	r := find(t, newTarget())
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		if r.SetPollInterval(d); r.interval() != defaultPollInterval {
+			t.Errorf("%v: got %v", d, r.interval())
+		}
+	}
+
+	// Must not panic
+	r.Start()
+	r.Stop()
+}
@@ -0,0 +1,630 @@
+package semihosting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+// https://github.com/ARM-software/abi-aa/blob/main/semihosting/semihosting.rst
+
+type Operation uint32
+
+const (
+	SysOpen         Operation = 0x01
+	SysClose        Operation = 0x02
+	SysWriteC       Operation = 0x03
+	SysWrite0       Operation = 0x04
+	SysWrite        Operation = 0x05
+	SysRead         Operation = 0x06
+	SysIsTTY        Operation = 0x09
+	SysClock        Operation = 0x10
+	SysTime         Operation = 0x11
+	SysErrno        Operation = 0x13
+	SysExit         Operation = 0x18
+	SysExitExtended Operation = 0x20
+)
+
+const (
+	// BKPT 0xAB in Thumb encoding
+	bkptSemihosting = 0xbeab
+
+	adpStoppedApplicationExit = 0x20026
+
+	maxStringLength = 4096
+	// Bytes moved at once by SYS_READ and SYS_WRITE, whose length is chosen
+	// by the target
+	transferChunk = 4096
+	ttyName       = ":tt"
+
+	handleStdin  = 1
+	handleStdout = 2
+	handleStderr = 3
+	handleFirst  = 4
+
+	defaultPollInterval = 10 * time.Millisecond
+)
+
+var (
+	ErrUnexpectedHalt = errors.New("core halted outside of a semihosting call")
+
+	// fopen() modes in the order of the SYS_OPEN mode parameter
+	openModes = []int{
+		os.O_RDONLY,
+		os.O_RDONLY,
+		os.O_RDWR,
+		os.O_RDWR,
+		os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+		os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+		os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+		os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+		os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+		os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+		os.O_RDWR | os.O_CREATE | os.O_APPEND,
+		os.O_RDWR | os.O_CREATE | os.O_APPEND,
+	}
+)
+
+// ExitError is returned by Run when the target exits with a non-zero status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("target exited with status %d", e.Code)
+}
+
+type Host struct {
+	swd       *swd.SWD
+	coreDebug *cd.CoreDebug
+
+	root   string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	files      map[uint32]*os.File
+	nextHandle uint32
+	errno      uint32
+
+	exited   bool
+	exitCode int
+
+	pollInterval time.Duration
+	start        time.Time
+}
+
+// SetStdio sets the streams the :tt special file is connected to.
+func (h *Host) SetStdio(stdin io.Reader, stdout, stderr io.Writer) {
+	h.stdin = stdin
+	h.stdout = stdout
+	h.stderr = stderr
+}
+
+// SetPollInterval sets how often the core is checked for a halt while running.
+// Values of zero or less select the default interval.
+func (h *Host) SetPollInterval(d time.Duration) {
+	h.pollInterval = d
+}
+
+func (h *Host) readWord(addr uint32) (uint32, error) {
+	return h.swd.ReadRegister(addr)
+}
+
+func (h *Host) readArgs(addr uint32, n int) ([]uint32, error) {
+	args := make([]uint32, n)
+
+	for i := range args {
+		v, err := h.readWord(addr + uint32(i)*4)
+		if err != nil {
+			return nil, fmt.Errorf("read parameter block: %w", err)
+		}
+
+		args[i] = v
+	}
+
+	return args, nil
+}
+
+func (h *Host) readString(addr uint32) (string, error) {
+	var s []byte
+
+	for len(s) < maxStringLength {
+		buf := make([]byte, 4-addr&3)
+
+		if err := h.swd.ReadMemory(addr, buf); err != nil {
+			return "", err
+		}
+
+		for _, b := range buf {
+			if b == 0 {
+				return string(s), nil
+			}
+
+			s = append(s, b)
+		}
+
+		addr += uint32(len(buf))
+	}
+
+	return "", fmt.Errorf("string at 0x%08x exceeds %d bytes", addr, maxStringLength)
+}
+
+func (h *Host) fail(err error) uint32 {
+	var errno uint32 = 5 // EIO
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		errno = 2 // ENOENT
+	case errors.Is(err, os.ErrPermission):
+		errno = 13 // EACCES
+	case errors.Is(err, os.ErrExist):
+		errno = 17 // EEXIST
+	}
+
+	h.errno = errno
+
+	return 0xffffffff
+}
+
+// sandboxPath maps a target file name to a path inside the root directory.
+// Symbolic links are resolved, so a link can not lead out of the root either.
+func (h *Host) sandboxPath(name string) (string, error) {
+	root, err := filepath.EvalSymlinks(h.root)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(root, filepath.Clean("/"+name))
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// A dangling link would be followed when the file is created
+		if _, err := os.Lstat(path); err == nil {
+			return "", fmt.Errorf("%s: %w", name, os.ErrPermission)
+		}
+
+		// The file does not exist yet, only its directory has to
+		dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return "", err
+		}
+
+		resolved = filepath.Join(dir, filepath.Base(path))
+	} else if err != nil {
+		return "", err
+	}
+
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: %w", name, os.ErrPermission)
+	}
+
+	return resolved, nil
+}
+
+func (h *Host) open(args []uint32) (uint32, error) {
+	name, err := h.readString(args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	mode := args[1]
+
+	if name == ttyName {
+		switch {
+		case mode < 4:
+			return handleStdin, nil
+		case mode < 8:
+			return handleStdout, nil
+		default:
+			return handleStderr, nil
+		}
+	}
+
+	if int(mode) >= len(openModes) || h.root == "" {
+		return h.fail(os.ErrPermission), nil
+	}
+
+	path, err := h.sandboxPath(name)
+	if err != nil {
+		return h.fail(err), nil
+	}
+
+	f, err := os.OpenFile(path, openModes[mode], 0o644)
+	if err != nil {
+		return h.fail(err), nil
+	}
+
+	handle := h.nextHandle
+	h.nextHandle++
+	h.files[handle] = f
+
+	return handle, nil
+}
+
+func (h *Host) close(args []uint32) uint32 {
+	handle := args[0]
+
+	if handle < handleFirst {
+		return 0
+	}
+
+	f, ok := h.files[handle]
+	if !ok {
+		h.errno = 9 // EBADF
+		return 0xffffffff
+	}
+
+	delete(h.files, handle)
+
+	if err := f.Close(); err != nil {
+		return h.fail(err)
+	}
+
+	return 0
+}
+
+func (h *Host) writer(handle uint32) io.Writer {
+	switch handle {
+	case handleStdout:
+		return h.stdout
+	case handleStderr:
+		return h.stderr
+	}
+
+	if f, ok := h.files[handle]; ok {
+		return f
+	}
+
+	return nil
+}
+
+func (h *Host) reader(handle uint32) io.Reader {
+	if handle == handleStdin {
+		return h.stdin
+	}
+
+	if f, ok := h.files[handle]; ok {
+		return f
+	}
+
+	return nil
+}
+
+// write returns the number of bytes not written
+func (h *Host) write(args []uint32) (uint32, error) {
+	handle, addr, length := args[0], args[1], args[2]
+
+	w := h.writer(handle)
+	if w == nil {
+		h.errno = 9 // EBADF
+		return length, nil
+	}
+
+	buf := make([]byte, transferChunk)
+	left := length
+
+	for left > 0 {
+		chunk := buf
+		if left < uint32(len(chunk)) {
+			chunk = chunk[:left]
+		}
+
+		if err := h.swd.ReadMemory(addr, chunk); err != nil {
+			return 0, err
+		}
+
+		n, err := w.Write(chunk)
+		left -= uint32(n)
+		addr += uint32(n)
+
+		if err != nil {
+			h.fail(err)
+			break
+		}
+	}
+
+	return left, nil
+}
+
+// read returns the number of bytes not read
+func (h *Host) read(args []uint32) (uint32, error) {
+	handle, addr, length := args[0], args[1], args[2]
+
+	r := h.reader(handle)
+	if r == nil {
+		h.errno = 9 // EBADF
+		return length, nil
+	}
+
+	buf := make([]byte, transferChunk)
+	left := length
+
+	// A short read ends the call, so the console does not block for more
+	// input than is available
+	for left > 0 {
+		chunk := buf
+		if left < uint32(len(chunk)) {
+			chunk = chunk[:left]
+		}
+
+		n, err := r.Read(chunk)
+		if err != nil && !errors.Is(err, io.EOF) {
+			h.fail(err)
+		}
+
+		if err := h.swd.WriteMemory(addr, chunk[:n]); err != nil {
+			return 0, err
+		}
+
+		left -= uint32(n)
+		addr += uint32(n)
+
+		if err != nil || n < len(chunk) {
+			break
+		}
+	}
+
+	return left, nil
+}
+
+// call executes a semihosting operation and returns the value for R0.
+// exit is set when the target requested to terminate.
+func (h *Host) call(op Operation, param uint32) (result uint32, exit *int, err error) {
+	switch op {
+	case SysOpen:
+		args, err := h.readArgs(param, 3)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		result, err = h.open(args)
+
+		return result, nil, err
+
+	case SysClose:
+		args, err := h.readArgs(param, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return h.close(args), nil, nil
+
+	case SysWriteC:
+		buf := make([]byte, 1)
+
+		if err := h.swd.ReadMemory(param, buf); err != nil {
+			return 0, nil, err
+		}
+
+		_, _ = h.stdout.Write(buf)
+
+		return 0, nil, nil
+
+	case SysWrite0:
+		s, err := h.readString(param)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		_, _ = io.WriteString(h.stdout, s)
+
+		return 0, nil, nil
+
+	case SysWrite:
+		args, err := h.readArgs(param, 3)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		result, err = h.write(args)
+
+		return result, nil, err
+
+	case SysRead:
+		args, err := h.readArgs(param, 3)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		result, err = h.read(args)
+
+		return result, nil, err
+
+	case SysIsTTY:
+		args, err := h.readArgs(param, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if args[0] < handleFirst {
+			return 1, nil, nil
+		}
+
+		return 0, nil, nil
+
+	case SysClock:
+		// Centiseconds since the host started
+		return uint32(time.Since(h.start) / (10 * time.Millisecond)), nil, nil
+
+	case SysTime:
+		return uint32(time.Now().Unix()), nil, nil
+
+	case SysErrno:
+		return h.errno, nil, nil
+
+	case SysExit:
+		// On 32-bit targets the parameter is the reason code itself
+		code := 0
+		if param != adpStoppedApplicationExit {
+			code = 1
+		}
+
+		return 0, &code, nil
+
+	case SysExitExtended:
+		args, err := h.readArgs(param, 2)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		code := int(int32(args[1]))
+		if args[0] != adpStoppedApplicationExit && code == 0 {
+			code = 1
+		}
+
+		return 0, &code, nil
+
+	default:
+		h.errno = 38 // ENOSYS
+		return 0xffffffff, nil, nil
+	}
+}
+
+func (h *Host) halted() (bool, error) {
+	dhcsr, err := h.coreDebug.ReadDHCSR()
+	if err != nil {
+		return false, err
+	}
+
+	return dhcsr&cd.DHCSRSHalt != 0, nil
+}
+
+// ExitCode returns the status the target passed to SYS_EXIT, and whether it exited at all.
+func (h *Host) ExitCode() (int, bool) {
+	return h.exitCode, h.exited
+}
+
+// Handle services a pending semihosting call if the core is halted on one.
+// It returns false if the core is running, and ErrUnexpectedHalt if it halted for
+// any other reason. If the target requested to exit, the core is left halted.
+func (h *Host) Handle() (bool, error) {
+	if halted, err := h.halted(); err != nil {
+		return false, err
+	} else if !halted {
+		return false, nil
+	}
+
+	pc, err := h.coreDebug.ReadCoreRegister(cd.CoreRegisterPC)
+	if err != nil {
+		return false, err
+	}
+
+	word, err := h.readWord(pc &^ 3)
+	if err != nil {
+		return false, fmt.Errorf("read instruction: %w", err)
+	}
+
+	if pc&2 != 0 {
+		word >>= 16
+	}
+
+	if word&0xffff != bkptSemihosting {
+		return false, fmt.Errorf("%w: pc 0x%08x", ErrUnexpectedHalt, pc)
+	}
+
+	op, err := h.coreDebug.ReadCoreRegister(cd.CoreRegisterR0)
+	if err != nil {
+		return false, err
+	}
+
+	param, err := h.coreDebug.ReadCoreRegister(cd.CoreRegisterR1)
+	if err != nil {
+		return false, err
+	}
+
+	result, exit, err := h.call(Operation(op), param)
+	if err != nil {
+		return false, fmt.Errorf("operation 0x%02x: %w", op, err)
+	}
+
+	if exit != nil {
+		h.exited = true
+		h.exitCode = *exit
+
+		return true, nil
+	}
+
+	if err := h.coreDebug.WriteCoreRegister(cd.CoreRegisterR0, result); err != nil {
+		return false, err
+	}
+
+	// Skip the BKPT instruction
+	if err := h.coreDebug.WriteCoreRegister(cd.CoreRegisterPC, pc+2); err != nil {
+		return false, err
+	}
+
+	if err := h.coreDebug.Continue(); err != nil {
+		return false, fmt.Errorf("resume: %w", err)
+	}
+
+	return true, nil
+}
+
+// Run services semihosting calls until the target exits or the context is cancelled.
+// A non-zero exit status is reported as *ExitError. Halting debug must be enabled on the
+// core, otherwise BKPT instructions escalate to a HardFault.
+func (h *Host) Run(ctx context.Context) error {
+	interval := h.pollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	defer h.closeFiles()
+
+	for {
+		handled, err := h.Handle()
+		if err != nil {
+			return err
+		}
+
+		if h.exited {
+			if h.exitCode != 0 {
+				return &ExitError{Code: h.exitCode}
+			}
+
+			return nil
+		}
+
+		if handled {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (h *Host) closeFiles() {
+	for handle, f := range h.files {
+		_ = f.Close()
+		delete(h.files, handle)
+	}
+}
+
+// New creates a semihosting host. Files opened by the target are confined to the
+// root directory; an empty root denies all file access except the console.
+func New(swd *swd.SWD, root string) *Host {
+	return &Host{
+		swd:        swd,
+		coreDebug:  cd.New(swd),
+		root:       root,
+		stdin:      os.Stdin,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		files:      map[uint32]*os.File{},
+		nextHandle: handleFirst,
+		start:      time.Now(),
+	}
+}
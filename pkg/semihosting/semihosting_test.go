@@ -0,0 +1,186 @@
+package semihosting
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/io/sim"
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+const (
+	testPC     = 0x08000100
+	testParams = 0x20000000
+	testName   = 0x20000100
+	testBuffer = 0x20001000
+)
+
+// call makes the target halt on a semihosting call and services it. It returns
+// the result in R0.
+func call(t *testing.T, target *sim.Target, h *Host, op Operation, args ...uint32) uint32 {
+	t.Helper()
+
+	params := make([]byte, len(args)*4)
+	for i, arg := range args {
+		binary.LittleEndian.PutUint32(params[i*4:], arg)
+	}
+
+	target.Load(testParams, params)
+	target.WriteWord(testPC, bkptSemihosting)
+
+	core := target.Core()
+	core.SetRegister(cd.CoreRegisterR0, uint32(op))
+	core.SetRegister(cd.CoreRegisterR1, testParams)
+	core.Break(testPC, scb.DFSRBkpt)
+
+	if handled, err := h.Handle(); err != nil || !handled {
+		t.Fatalf("operation 0x%02x: handled %v, %v", op, handled, err)
+	}
+
+	if core.Register(cd.CoreRegisterPC) != testPC+2 {
+		t.Errorf("BKPT not skipped")
+	}
+
+	return core.Register(cd.CoreRegisterR0)
+}
+
+func open(t *testing.T, target *sim.Target, h *Host, name string, mode uint32) uint32 {
+	t.Helper()
+
+	target.Load(testName, append([]byte(name), 0))
+
+	return call(t, target, h, SysOpen, testName, mode, uint32(len(name)))
+}
+
+func TestFiles(t *testing.T) {
+	root := t.TempDir()
+	target := sim.New()
+	h := New(swd.New(target), root)
+
+	// Larger than a transfer chunk
+	data := make([]byte, transferChunk*2+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	handle := open(t, target, h, "dir/../out.bin", 4)
+	if handle == 0xffffffff {
+		t.Fatalf("open for writing failed, errno %d", h.errno)
+	}
+
+	target.Load(testBuffer, data)
+
+	if left := call(t, target, h, SysWrite, handle, testBuffer, uint32(len(data))); left != 0 {
+		t.Errorf("write: %d bytes left", left)
+	}
+
+	if got := call(t, target, h, SysClose, handle); got != 0 {
+		t.Errorf("close: got %d", got)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(root, "out.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("file content differs: %v", err)
+	}
+
+	handle = open(t, target, h, "/out.bin", 0)
+	if handle == 0xffffffff {
+		t.Fatalf("open for reading failed, errno %d", h.errno)
+	}
+
+	target.Load(testBuffer, make([]byte, len(data)+16))
+
+	// Ask for more than the file holds
+	if left := call(t, target, h, SysRead, handle, testBuffer, uint32(len(data)+16)); left != 16 {
+		t.Errorf("read: %d bytes left", left)
+	}
+
+	if got := target.Dump(testBuffer, len(data)); !bytes.Equal(got, data) {
+		t.Errorf("read data differs")
+	}
+
+	if left := call(t, target, h, SysRead, handle, testBuffer, 16); left != 16 {
+		t.Errorf("read at EOF: %d bytes left", left)
+	}
+}
+
+func TestConsole(t *testing.T) {
+	target := sim.New()
+	h := New(swd.New(target), "")
+
+	var stdout bytes.Buffer
+	h.SetStdio(bytes.NewReader([]byte("input")), &stdout, &stdout)
+
+	handle := open(t, target, h, ttyName, 4)
+	target.Load(testBuffer, []byte("hello"))
+
+	if left := call(t, target, h, SysWrite, handle, testBuffer, 5); left != 0 || stdout.String() != "hello" {
+		t.Errorf("write: %d left, %q", left, stdout.String())
+	}
+
+	handle = open(t, target, h, ttyName, 0)
+
+	if left := call(t, target, h, SysRead, handle, testBuffer, 16); left != 11 {
+		t.Errorf("read: %d left", left)
+	}
+
+	if got := target.Dump(testBuffer, 5); string(got) != "input" {
+		t.Errorf("read: got %q", got)
+	}
+
+	// Without a root, files can not be opened
+	if got := open(t, target, h, "file", 0); got != 0xffffffff || h.errno != 13 {
+		t.Errorf("open: got 0x%x, errno %d", got, h.errno)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	outside := t.TempDir()
+	root := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(outside, "new"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	target := sim.New()
+	h := New(swd.New(target), root)
+
+	for _, tc := range []struct {
+		name string
+		mode uint32
+	}{
+		{"link/secret", 0},
+		{"link/created", 4},
+		{"dangling", 4},
+	} {
+		if got := open(t, target, h, tc.name, tc.mode); got != 0xffffffff || h.errno != 13 {
+			t.Errorf("%s: got 0x%x, errno %d", tc.name, got, h.errno)
+		}
+	}
+
+	// Lexical escapes stay inside the root
+	if handle := open(t, target, h, "../../secret", 4); handle == 0xffffffff {
+		t.Errorf("open: errno %d", h.errno)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "secret")); err != nil {
+		t.Errorf("file not created in root: %v", err)
+	}
+
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 1 {
+		t.Errorf("files created outside of the root: %v", entries)
+	}
+}
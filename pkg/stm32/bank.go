@@ -0,0 +1,96 @@
+package stm32
+
+import (
+	"fmt"
+	"time"
+)
+
+// bankEraser is implemented by controllers that can mass erase a single bank.
+type bankEraser interface {
+	eraseBank(bank int, timeout time.Duration, tr *Tracker) error
+}
+
+// bankSwapper is implemented by controllers of dual bank parts that can map
+// bank 2 at the flash base address.
+type bankSwapper interface {
+	bankSwap() (bool, error)
+	// setBankSwap programs the swap option, which takes effect after a reset
+	setBankSwap(swap bool) error
+}
+
+// EraseBank mass erases one bank, counted from 0, and leaves the other bank
+// untouched.
+func (f *Flash) EraseBank(bank int, timeout time.Duration) error {
+	ctrl, err := f.controller()
+	if err != nil {
+		return err
+	}
+
+	be, ok := ctrl.(bankEraser)
+	if !ok {
+		return fmt.Errorf("%w: bank erase not supported on %s", ErrUnsupportedDevice, f.device)
+	}
+
+	if err := f.geometry.checkBank(bank); err != nil {
+		return err
+	}
+
+	bankSize := f.geometry.Size / uint32(f.geometry.Banks)
+
+	if err := f.checkEraseProtection(uint32(bank)*bankSize, bankSize); err != nil {
+		return err
+	}
+
+	tr := f.newTracker(PhaseErase, 0)
+
+	if err := be.eraseBank(bank, timeout, tr); err != nil {
+		return err
+	}
+
+	tr.Finish()
+
+	return nil
+}
+
+func (f *Flash) bankSwapper() (bankSwapper, error) {
+	ctrl, err := f.controller()
+	if err != nil {
+		return nil, err
+	}
+
+	bs, ok := ctrl.(bankSwapper)
+	if !ok || f.geometry.Banks < 2 {
+		return nil, fmt.Errorf("%w: bank swap not supported on %s", ErrUnsupportedDevice, f.device)
+	}
+
+	return bs, nil
+}
+
+// BankSwap reports whether the device is configured to boot from bank 2, with
+// the banks swapped in the memory map.
+func (f *Flash) BankSwap() (bool, error) {
+	bs, err := f.bankSwapper()
+	if err != nil {
+		return false, err
+	}
+
+	return bs.bankSwap()
+}
+
+// SetBankSwap selects the bank the device boots from, for A/B update schemes
+// that program the inactive bank and then switch over. On G0/G4/L4 parts the
+// option bytes are reloaded, which resets the device. On H7 parts the change
+// takes effect with the next reset.
+func (f *Flash) SetBankSwap(swap bool) error {
+	bs, err := f.bankSwapper()
+	if err != nil {
+		return err
+	}
+
+	err = bs.setBankSwap(swap)
+
+	// The bank mapping changes, so the device needs to be identified again
+	f.ctrl = nil
+
+	return err
+}
@@ -0,0 +1,106 @@
+package stm32
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	regH7OPTKEYR  uint32 = regH7Base + 0x08
+	regH7OPTCR    uint32 = regH7Base + 0x18
+	regH7OPTSRCur uint32 = regH7Base + 0x1c
+	regH7OPTSRPrg uint32 = regH7Base + 0x20
+	regH7OPTCCR   uint32 = regH7Base + 0x24
+
+	// OPTCR
+	h7OptLock  = 1 << 0
+	h7OptStart = 1 << 1
+
+	// OPTSR_CUR and OPTSR_PRG
+	h7OptBusy      = 1 << 0
+	h7OptChangeErr = 1 << 30
+	h7SwapBank     = 1 << 31
+
+	h7OptionTimeout = time.Second
+)
+
+func (f *flashH7) bankSwap() (bool, error) {
+	sr, err := f.swd.ReadRegister(regH7OPTSRCur)
+	if err != nil {
+		return false, fmt.Errorf("read OPTSR_CUR: %w", err)
+	}
+
+	return sr&h7SwapBank != 0, nil
+}
+
+func (f *flashH7) setBankSwap(swap bool) error {
+	cur, err := f.swd.ReadRegister(regH7OPTSRCur)
+	if err != nil {
+		return fmt.Errorf("read OPTSR_CUR: %w", err)
+	}
+
+	prg := cur &^ (h7OptBusy | h7OptChangeErr)
+	if swap {
+		prg |= h7SwapBank
+	} else {
+		prg &^= h7SwapBank
+	}
+
+	if err := f.unlockOptions(); err != nil {
+		return fmt.Errorf("unlock option bytes: %w", err)
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(regH7OPTCR, h7OptLock)
+	}()
+
+	if err := f.swd.WriteRegister(regH7OPTSRPrg, prg); err != nil {
+		return err
+	}
+
+	if err := f.swd.WriteRegister(regH7OPTCR, h7OptStart); err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	for {
+		sr, err := f.swd.ReadRegister(regH7OPTSRCur)
+		if err != nil {
+			return err
+		}
+
+		if sr&h7OptBusy == 0 {
+			if sr&h7OptChangeErr != 0 {
+				_ = f.swd.WriteRegister(regH7OPTCCR, h7OptChangeErr)
+				return fmt.Errorf("option byte change error")
+			}
+
+			return nil
+		}
+
+		if time.Since(start) > h7OptionTimeout {
+			return ErrTimeout
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// unlockOptions clears the OPTLOCK bit of OPTCR.
+func (f *flashH7) unlockOptions() error {
+	cr, err := f.swd.ReadRegister(regH7OPTCR)
+	if err != nil {
+		return err
+	}
+
+	if cr&h7OptLock == 0 {
+		return nil
+	}
+
+	if err := f.swd.WriteRegister(regH7OPTKEYR, optionKey1); err != nil {
+		return err
+	}
+
+	return f.swd.WriteRegister(regH7OPTKEYR, optionKey2)
+}
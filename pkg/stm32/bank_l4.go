@@ -0,0 +1,35 @@
+package stm32
+
+import "fmt"
+
+func (f *flashL4) bankSwap() (bool, error) {
+	if f.layout.bankSwapOption == 0 {
+		return false, fmt.Errorf("%w: no bank swap option on %s", ErrUnsupportedDevice, f.family)
+	}
+
+	ob, err := f.readOptionBytes()
+	if err != nil {
+		return false, err
+	}
+
+	return ob.BankSwap, nil
+}
+
+func (f *flashL4) setBankSwap(swap bool) error {
+	if f.layout.bankSwapOption == 0 {
+		return fmt.Errorf("%w: no bank swap option on %s", ErrUnsupportedDevice, f.family)
+	}
+
+	ob, err := f.readOptionBytes()
+	if err != nil {
+		return err
+	}
+
+	ob.BankSwap = swap
+
+	if err := f.programOptionBytes(ob); err != nil {
+		return err
+	}
+
+	return f.launchOptionBytes()
+}
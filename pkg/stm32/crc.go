@@ -0,0 +1,229 @@
+package stm32
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/image"
+)
+
+const (
+	crcRegDR   = 0x00
+	crcRegCR   = 0x08
+	crcRegINIT = 0x10
+	crcRegPOL  = 0x14
+
+	crcReset      = 1 << 0
+	crcPolynomial = 0x04c11db7
+	crcInitial    = 0xffffffff
+
+	// RAM used by the CRC stub if no loader RAM is configured
+	defaultStubAddr = 0x20000000
+	crcTimeout      = 5 * time.Second
+)
+
+type VerifyMode int
+
+const (
+	// Read back the flash and compare it with the image
+	VerifyReadback VerifyMode = iota
+	// Compare the CRC computed by the CRC unit of the device with the image
+	VerifyCRC
+)
+
+// crcUnit describes the CRC peripheral of a family and its clock enable bit.
+type crcUnit struct {
+	addr     uint32
+	clockReg uint32
+	clockBit uint32
+	// The initial value and polynomial are programmable
+	programmable bool
+}
+
+var crcUnits = map[Family]crcUnit{
+	FamilyF0: {0x40023000, 0x40021014, 1 << 6, true},
+	FamilyF1: {0x40023000, 0x40021014, 1 << 6, false},
+	FamilyF2: {0x40023000, 0x40023830, 1 << 12, false},
+	FamilyF3: {0x40023000, 0x40021014, 1 << 6, true},
+	FamilyF4: {0x40023000, 0x40023830, 1 << 12, false},
+	FamilyF7: {0x40023000, 0x40023830, 1 << 12, true},
+	FamilyG0: {0x40023000, 0x40021038, 1 << 12, true},
+	FamilyG4: {0x40023000, 0x40021048, 1 << 12, true},
+	FamilyH7: {0x58024c00, 0x580244e0, 1 << 19, true},
+	FamilyL0: {0x40023000, 0x40021030, 1 << 12, true},
+	FamilyL1: {0x40023000, 0x4002381c, 1 << 12, false},
+	FamilyL4: {0x40023000, 0x40021048, 1 << 12, true},
+	FamilyWB: {0x40023000, 0x58000048, 1 << 12, true},
+}
+
+// SetVerifyMode selects how VerifyImage checks the flash. VerifyCRC runs a small
+// routine on the core that feeds the flash contents into the CRC unit; it uses
+// the loader RAM, or the first bytes of SRAM if none is configured. The RAM and
+// the core registers are restored afterwards. Devices without a CRC unit are
+// verified by reading back.
+func (f *Flash) SetVerifyMode(mode VerifyMode) {
+	f.verifyMode = mode
+}
+
+// stm32CRC computes the CRC of the CRC unit in its reset configuration: CRC-32
+// with the bits of each little-endian word processed most significant first.
+func stm32CRC(crc uint32, data []byte) uint32 {
+	for i := 0; i+4 <= len(data); i += 4 {
+		crc ^= binary.LittleEndian.Uint32(data[i:])
+
+		for b := 0; b < 32; b++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ crcPolynomial
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// setupCRC enables the clock of the CRC unit and resets it to the standard
+// polynomial and initial value.
+func (f *Flash) setupCRC(unit crcUnit) error {
+	if err := f.swd.UpdateRegisterBits(unit.clockReg, unit.clockBit, unit.clockBit); err != nil {
+		return fmt.Errorf("enable CRC clock: %w", err)
+	}
+
+	if unit.programmable {
+		if err := f.swd.WriteRegister(unit.addr+crcRegINIT, crcInitial); err != nil {
+			return err
+		}
+
+		if err := f.swd.WriteRegister(unit.addr+crcRegPOL, crcPolynomial); err != nil {
+			return err
+		}
+	}
+
+	// Also clears the input and output reversal of programmable units
+	return f.swd.WriteRegister(unit.addr+crcRegCR, crcReset)
+}
+
+// targetCRC computes the CRC of words 32-bit words at addr on the target.
+func (f *Flash) targetCRC(unit crcUnit, addr, words uint32) (crc uint32, rerr error) {
+	if err := f.setupCRC(unit); err != nil {
+		return 0, err
+	}
+
+	core := cd.New(f.swd)
+
+	if err := core.Halt(); err != nil {
+		return 0, fmt.Errorf("halt: %w", err)
+	}
+
+	// Leave the core where it was halted, so it can be resumed
+	regs, err := saveRegisters(core)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err := restoreRegisters(core, regs); err != nil && rerr == nil {
+			rerr = fmt.Errorf("restore registers: %w", err)
+		}
+	}()
+
+	stubAddr, stubEnd := f.loaderAddr, f.loaderAddr+f.loaderSize
+	if f.loaderSize == 0 {
+		stubAddr, stubEnd = defaultStubAddr, defaultStubAddr+uint32(len(crcStub))+0x10
+
+		// The firmware owns this RAM, so put back what the stub and its
+		// stack overwrite
+		saved := make([]byte, stubEnd-stubAddr)
+
+		if err := f.swd.ReadMemory(stubAddr, saved); err != nil {
+			return 0, fmt.Errorf("save stub RAM: %w", err)
+		}
+
+		defer func() {
+			if err := f.swd.WriteMemory(stubAddr, saved); err != nil && rerr == nil {
+				rerr = fmt.Errorf("restore stub RAM: %w", err)
+			}
+		}()
+	}
+
+	if err := f.swd.WriteMemory(stubAddr, crcStub); err != nil {
+		return 0, fmt.Errorf("download stub: %w", err)
+	}
+
+	if err := startStub(core, stubAddr, stubEnd&^7, addr, words, unit.addr+crcRegDR); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	for {
+		dhcsr, err := core.ReadDHCSR()
+		if err != nil {
+			return 0, err
+		}
+
+		if dhcsr&cd.DHCSRSHalt != 0 {
+			break
+		}
+
+		if time.Since(start) > crcTimeout {
+			_ = core.Halt()
+
+			return 0, fmt.Errorf("CRC: %w", ErrTimeout)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if left, err := core.ReadCoreRegister(cd.CoreRegisterR1); err != nil {
+		return 0, err
+	} else if left != 0 {
+		return 0, fmt.Errorf("CRC stub stopped with %d words left", left)
+	}
+
+	return f.swd.ReadRegister(unit.addr + crcRegDR)
+}
+
+// verifyCRC checks the word aligned part of each segment with the CRC unit and
+// the rest by reading back. Segments with a CRC mismatch are read back to find
+// the first differing byte.
+func (f *Flash) verifyCRC(unit crcUnit, img *image.Image, tr *Tracker) error {
+	for _, seg := range img.Segments {
+		start := (seg.Address + 3) &^ 3
+		end := seg.End() &^ 3
+
+		if start >= end {
+			if err := f.verifyReadback(seg, tr); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		head := image.Segment{Address: seg.Address, Data: seg.Data[:start-seg.Address]}
+		body := seg.Data[start-seg.Address : end-seg.Address]
+		tail := image.Segment{Address: end, Data: seg.Data[end-seg.Address:]}
+
+		crc, err := f.targetCRC(unit, start, uint32(len(body))/4)
+		if err != nil {
+			return err
+		}
+
+		if crc != stm32CRC(crcInitial, body) {
+			return f.verifyReadback(seg, tr)
+		}
+
+		tr.Add(uint32(len(body)))
+
+		for _, s := range []image.Segment{head, tail} {
+			if err := f.verifyReadback(s, tr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
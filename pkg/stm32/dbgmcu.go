@@ -0,0 +1,248 @@
+package stm32
+
+import "fmt"
+
+// DebugConfig selects the debug behavior configured in the DBGMCU. Options a
+// family does not implement can not be enabled.
+type DebugConfig struct {
+	// Keep the debug connection alive in Sleep, Stop and Standby mode
+	Sleep   bool
+	Stop    bool
+	Standby bool
+
+	// Freeze the watchdogs and timers while the core is halted
+	FreezeIWDG   bool
+	FreezeWWDG   bool
+	FreezeTimers bool
+}
+
+// freezeBits are bits of a DBGMCU register.
+type freezeBits struct {
+	reg  uint32
+	mask uint32
+}
+
+// dbgmcuLayout describes the DBGMCU registers of a family.
+type dbgmcuLayout struct {
+	cr                   uint32
+	sleep, stop, standby uint32
+	// CR bits keeping the debug clocks running in low-power modes
+	clocks uint32
+
+	iwdg, wwdg freezeBits
+	timers     []freezeBits
+
+	// Peripheral clock of the DBGMCU, 0 if always enabled
+	clockReg uint32
+	clockBit uint32
+}
+
+var dbgmcuLayouts = map[Family]dbgmcuLayout{
+	FamilyF0: {
+		cr: regIDCodeM0 + 0x04, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCodeM0 + 0x08, 1 << 12}, wwdg: freezeBits{regIDCodeM0 + 0x08, 1 << 11},
+		timers:   []freezeBits{{regIDCodeM0 + 0x08, 0x133}, {regIDCodeM0 + 0x0c, 1<<11 | 7<<16}},
+		clockReg: 0x40021018, clockBit: 1 << 22,
+	},
+	FamilyF1: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x04, 1 << 8}, wwdg: freezeBits{regIDCode + 0x04, 1 << 9},
+		timers: []freezeBits{{regIDCode + 0x04, 0xf<<10 | 1<<17 | 7<<18 | 0x1ff<<22}},
+	},
+	FamilyF2: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x08, 1 << 12}, wwdg: freezeBits{regIDCode + 0x08, 1 << 11},
+		timers: []freezeBits{{regIDCode + 0x08, 0x1ff}, {regIDCode + 0x0c, 3 | 7<<16}},
+	},
+	FamilyF3: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x08, 1 << 12}, wwdg: freezeBits{regIDCode + 0x08, 1 << 11},
+		timers: []freezeBits{{regIDCode + 0x08, 0x3f}, {regIDCode + 0x0c, 0x3f}},
+	},
+	FamilyF4: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x08, 1 << 12}, wwdg: freezeBits{regIDCode + 0x08, 1 << 11},
+		timers: []freezeBits{{regIDCode + 0x08, 0x1ff}, {regIDCode + 0x0c, 3 | 7<<16}},
+	},
+	FamilyF7: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x08, 1 << 12}, wwdg: freezeBits{regIDCode + 0x08, 1 << 11},
+		timers: []freezeBits{{regIDCode + 0x08, 0x3ff}, {regIDCode + 0x0c, 3 | 7<<16}},
+	},
+	FamilyG0: {
+		cr: regIDCodeM0 + 0x04, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCodeM0 + 0x08, 1 << 12}, wwdg: freezeBits{regIDCodeM0 + 0x08, 1 << 11},
+		timers:   []freezeBits{{regIDCodeM0 + 0x08, 0x37}, {regIDCodeM0 + 0x0c, 1<<11 | 1<<15 | 7<<16}},
+		clockReg: 0x4002103c, clockBit: 1 << 27,
+	},
+	FamilyG4: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x08, 1 << 12}, wwdg: freezeBits{regIDCode + 0x08, 1 << 11},
+		timers: []freezeBits{{regIDCode + 0x08, 0x3f}, {regIDCode + 0x10, 1<<11 | 1<<13 | 7<<16 | 1<<20}},
+	},
+	FamilyH7: {
+		cr: regIDCodeH7 + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		clocks: 1<<21 | 1<<22,
+		iwdg:   freezeBits{regIDCodeH7 + 0x54, 1 << 18}, wwdg: freezeBits{regIDCodeH7 + 0x34, 1 << 6},
+		timers: []freezeBits{{regIDCodeH7 + 0x3c, 0x3ff}, {regIDCodeH7 + 0x4c, 3 | 7<<16 | 1<<29}},
+	},
+	FamilyL0: {
+		cr: regIDCodeM0 + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCodeM0 + 0x08, 1 << 12}, wwdg: freezeBits{regIDCodeM0 + 0x08, 1 << 11},
+		timers:   []freezeBits{{regIDCodeM0 + 0x08, 0x33}, {regIDCodeM0 + 0x0c, 1<<2 | 1<<5}},
+		clockReg: 0x40021034, clockBit: 1 << 22,
+	},
+	FamilyL1: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x08, 1 << 12}, wwdg: freezeBits{regIDCode + 0x08, 1 << 11},
+		timers: []freezeBits{{regIDCode + 0x08, 0x3f}, {regIDCode + 0x0c, 7 << 2}},
+	},
+	FamilyL4: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x08, 1 << 12}, wwdg: freezeBits{regIDCode + 0x08, 1 << 11},
+		timers: []freezeBits{{regIDCode + 0x08, 0x3f}, {regIDCode + 0x10, 1<<11 | 1<<13 | 7<<16}},
+	},
+	FamilyWB: {
+		cr: regIDCode + 0x04, sleep: 1 << 0, stop: 1 << 1, standby: 1 << 2,
+		iwdg: freezeBits{regIDCode + 0x3c, 1 << 12}, wwdg: freezeBits{regIDCode + 0x3c, 1 << 11},
+		timers: []freezeBits{{regIDCode + 0x3c, 1 << 0}, {regIDCode + 0x4c, 1<<11 | 3<<17}},
+	},
+}
+
+// debugOption is a single DebugConfig field and the register bits it controls.
+type debugOption struct {
+	name    string
+	bits    []freezeBits
+	enabled *bool
+}
+
+func (l dbgmcuLayout) options(cfg *DebugConfig) []debugOption {
+	return []debugOption{
+		{"DBG_SLEEP", []freezeBits{{l.cr, l.sleep}}, &cfg.Sleep},
+		{"DBG_STOP", []freezeBits{{l.cr, l.stop}}, &cfg.Stop},
+		{"DBG_STANDBY", []freezeBits{{l.cr, l.standby}}, &cfg.Standby},
+		{"IWDG freeze", []freezeBits{l.iwdg}, &cfg.FreezeIWDG},
+		{"WWDG freeze", []freezeBits{l.wwdg}, &cfg.FreezeWWDG},
+		{"timer freeze", l.timers, &cfg.FreezeTimers},
+	}
+}
+
+func (stm *STM32) dbgmcuLayout() (*Device, dbgmcuLayout, error) {
+	dev, err := identify(stm.swd)
+	if err != nil {
+		return nil, dbgmcuLayout{}, err
+	}
+
+	layout, ok := dbgmcuLayouts[dev.Family]
+	if !ok {
+		return nil, dbgmcuLayout{}, fmt.Errorf("%w: no DBGMCU layout for %s", ErrUnsupportedDevice, dev)
+	}
+
+	if layout.clockReg != 0 {
+		if err := stm.swd.UpdateRegisterBits(layout.clockReg, layout.clockBit, layout.clockBit); err != nil {
+			return nil, dbgmcuLayout{}, fmt.Errorf("enable DBGMCU clock: %w", err)
+		}
+	}
+
+	return dev, layout, nil
+}
+
+// DebugConfig reads the DBGMCU configuration. An option is reported as enabled
+// if all of its bits are set.
+func (stm *STM32) DebugConfig() (DebugConfig, error) {
+	var cfg DebugConfig
+
+	_, layout, err := stm.dbgmcuLayout()
+	if err != nil {
+		return cfg, err
+	}
+
+	for _, opt := range layout.options(&cfg) {
+		enabled := false
+
+		for _, b := range opt.bits {
+			if b.mask == 0 {
+				continue
+			}
+
+			v, err := stm.swd.ReadRegister(b.reg)
+			if err != nil {
+				return cfg, fmt.Errorf("read DBGMCU: %w", err)
+			}
+
+			if v&b.mask != b.mask {
+				enabled = false
+				break
+			}
+
+			enabled = true
+		}
+
+		*opt.enabled = enabled
+	}
+
+	return cfg, nil
+}
+
+// ConfigureDebug writes the DBGMCU configuration. Bits of options that are not
+// selected are cleared. The DBGMCU is only reset by a power-on reset, so the
+// configuration survives system resets.
+func (stm *STM32) ConfigureDebug(cfg DebugConfig) error {
+	dev, layout, err := stm.dbgmcuLayout()
+	if err != nil {
+		return err
+	}
+
+	type update struct {
+		reg, mask, value uint32
+	}
+
+	var updates []update
+
+	set := func(b freezeBits, enabled bool) {
+		value := uint32(0)
+		if enabled {
+			value = b.mask
+		}
+
+		for i := range updates {
+			if updates[i].reg == b.reg {
+				updates[i].mask |= b.mask
+				updates[i].value |= value
+
+				return
+			}
+		}
+
+		updates = append(updates, update{b.reg, b.mask, value})
+	}
+
+	for _, opt := range layout.options(&cfg) {
+		supported := false
+
+		for _, b := range opt.bits {
+			if b.mask != 0 {
+				set(b, *opt.enabled)
+				supported = true
+			}
+		}
+
+		if *opt.enabled && !supported {
+			return fmt.Errorf("%w: %s not available on %s", ErrUnsupportedDevice, opt.name, dev.Family)
+		}
+	}
+
+	set(freezeBits{layout.cr, layout.clocks}, cfg.Sleep || cfg.Stop || cfg.Standby)
+
+	for _, u := range updates {
+		if u.mask == 0 {
+			continue
+		}
+
+		if err := stm.swd.UpdateRegisterBits(u.reg, u.mask, u.value); err != nil {
+			return fmt.Errorf("write DBGMCU: %w", err)
+		}
+	}
+
+	return nil
+}
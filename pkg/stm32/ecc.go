@@ -0,0 +1,205 @@
+package stm32
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+// Bytes read at once by ScanECC before narrowing down an event
+const eccScanChunk = 1024
+
+var ErrECC = errors.New("flash ECC error")
+
+// ECCEvent is an error detected by the ECC of the flash memory and latched by
+// the controller.
+type ECCEvent struct {
+	// Double-bit error that could not be corrected, a single-bit error
+	// otherwise
+	DoubleBit bool
+	// Absolute address of the failing double word or flash word. For errors
+	// in system flash, this is the offset reported by the controller.
+	Addr uint32
+	Bank int
+	// The error occurred in system flash or the OTP area
+	SystemFlash bool
+}
+
+func (e ECCEvent) String() string {
+	s := "corrected single-bit error"
+	if e.DoubleBit {
+		s = "double-bit error"
+	}
+
+	if e.SystemFlash {
+		return fmt.Sprintf("%s in system flash at offset 0x%x", s, e.Addr)
+	}
+
+	return fmt.Sprintf("%s at 0x%08x (bank %d)", s, e.Addr, e.Bank+1)
+}
+
+// eccController is implemented by controllers that report ECC errors.
+type eccController interface {
+	// readECC returns the latched ECC events, none if no flag is set
+	readECC() ([]ECCEvent, error)
+	clearECC() error
+}
+
+func (f *Flash) eccController() (eccController, error) {
+	ctrl, err := f.controller()
+	if err != nil {
+		return nil, err
+	}
+
+	ec, ok := ctrl.(eccController)
+	if !ok {
+		return nil, fmt.Errorf("%w: ECC status not supported on %s", ErrUnsupportedDevice, f.device)
+	}
+
+	return ec, nil
+}
+
+// ECCEvents returns the ECC events latched by the controller. The controller
+// keeps the first event until it is cleared with ClearECC, later events are
+// not recorded.
+func (f *Flash) ECCEvents() ([]ECCEvent, error) {
+	ec, err := f.eccController()
+	if err != nil {
+		return nil, err
+	}
+
+	return ec.readECC()
+}
+
+// ClearECC clears the latched ECC events.
+func (f *Flash) ClearECC() error {
+	ec, err := f.eccController()
+	if err != nil {
+		return err
+	}
+
+	return ec.clearECC()
+}
+
+// ScanECC reads size bytes at offset addr into flash and returns every ECC
+// event the reads trigger. Events latched before the scan are returned first,
+// as they would hide the events of the scan, and all flags are cleared.
+func (f *Flash) ScanECC(addr, size uint32) ([]ECCEvent, error) {
+	ec, err := f.eccController()
+	if err != nil {
+		return nil, err
+	}
+
+	unit := f.ctrl.writeSize()
+
+	if addr%unit != 0 || size%unit != 0 {
+		return nil, fmt.Errorf("scan range must be aligned to %d bytes", unit)
+	}
+
+	if addr > f.geometry.Size || size > f.geometry.Size-addr {
+		return nil, fmt.Errorf("0x%x bytes at offset 0x%x outside of flash", size, addr)
+	}
+
+	events, err := ec.readECC()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ec.clearECC(); err != nil {
+		return nil, err
+	}
+
+	tr := f.newTracker(PhaseScan, size)
+	buf := make([]byte, eccScanChunk)
+
+	for offset := addr; offset < addr+size; {
+		n := addr + size - offset
+		if n > eccScanChunk {
+			n = eccScanChunk
+		}
+
+		found, err := f.readECC(ec, offset, buf[:n])
+		if err != nil {
+			return events, err
+		}
+
+		// Only the first event of the chunk is latched, so read it again
+		// one unit at a time to find all of them
+		if len(found) > 0 {
+			var narrowed []ECCEvent
+
+			for i := uint32(0); i < n; i += unit {
+				ev, err := f.readECC(ec, offset+i, buf[i:i+unit])
+				if err != nil {
+					return events, err
+				}
+
+				narrowed = append(narrowed, ev...)
+			}
+
+			if len(narrowed) > 0 {
+				found = narrowed
+			}
+		}
+
+		events = append(events, found...)
+		offset += n
+		tr.Add(n)
+	}
+
+	tr.Finish()
+
+	return events, nil
+}
+
+// readECC reads flash at offset and returns the ECC events latched by the
+// read, which are cleared.
+func (f *Flash) readECC(ec eccController, offset uint32, buf []byte) ([]ECCEvent, error) {
+	readErr := f.swd.ReadMemory(FlashBaseAddr+offset, buf)
+	if readErr != nil {
+		// A double-bit error may fail the access and leave sticky flags
+		_ = f.swd.Abort(swd.AbortAllFlags())
+	}
+
+	events, err := ec.readECC()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) == 0 {
+		if readErr != nil {
+			return nil, f.readProtected(readErr)
+		}
+
+		return nil, nil
+	}
+
+	return events, ec.clearECC()
+}
+
+// readError adds the readout protection level or the latched ECC events to a
+// failed flash read.
+func (f *Flash) readError(err error) error {
+	err = f.readProtected(err)
+	if errors.Is(err, ErrReadProtected) {
+		return err
+	}
+
+	if events, eerr := f.ECCEvents(); eerr == nil && len(events) > 0 {
+		return fmt.Errorf("%w: %s: %v", ErrECC, events[0], err)
+	}
+
+	return err
+}
+
+// doubleBitError returns an error for the first double-bit event, if any.
+func doubleBitError(events []ECCEvent) error {
+	for _, ev := range events {
+		if ev.DoubleBit {
+			return fmt.Errorf("%w: %s", ErrECC, ev)
+		}
+	}
+
+	return nil
+}
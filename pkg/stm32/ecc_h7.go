@@ -0,0 +1,49 @@
+package stm32
+
+const (
+	// ECC fail address, in flash words from the start of the bank
+	regH7ECCFA uint32 = regH7Base + 0x5c
+
+	h7StatusSingleECCError h7Status = 1 << 25
+	h7StatusDoubleECCError h7Status = 1 << 26
+
+	h7ECCAddrMask = 0xffff
+)
+
+func (f *flashH7) readECC() ([]ECCEvent, error) {
+	var events []ECCEvent
+
+	for bank := 0; bank < f.banks; bank++ {
+		sr, err := f.status(bank)
+		if err != nil {
+			return nil, err
+		}
+
+		if sr&(h7StatusSingleECCError|h7StatusDoubleECCError) == 0 {
+			continue
+		}
+
+		fa, err := f.swd.ReadRegister(f.reg(regH7ECCFA, bank))
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, ECCEvent{
+			DoubleBit: sr&h7StatusDoubleECCError != 0,
+			Addr:      FlashBaseAddr + uint32(bank)*h7Bank2Start + (fa&h7ECCAddrMask)*f.layout.wordSize,
+			Bank:      bank,
+		})
+	}
+
+	return events, nil
+}
+
+func (f *flashH7) clearECC() error {
+	for bank := 0; bank < f.banks; bank++ {
+		if err := f.swd.WriteRegister(f.reg(regH7CCR, bank), uint32(h7StatusSingleECCError|h7StatusDoubleECCError)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
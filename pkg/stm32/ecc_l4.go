@@ -0,0 +1,82 @@
+package stm32
+
+type eccRegister uint32
+
+const (
+	eccRegisterCorrection eccRegister = 1 << 30
+	eccRegisterDetection  eccRegister = 1 << 31
+)
+
+// l4ECCLayout describes the ECCR fields of a device line.
+type l4ECCLayout struct {
+	addrMask eccRegister
+	// ADDR_ECC counts double words instead of bytes
+	doubleWords bool
+	// BK_ECC, 0 if the register does not report the bank
+	bank   eccRegister
+	system eccRegister
+}
+
+var l4ECCLayouts = map[Family]l4ECCLayout{
+	FamilyG0: {addrMask: 0x3fff, doubleWords: true, system: 1 << 20},
+	FamilyG4: {addrMask: 0x1fffff, bank: 1 << 21, system: 1 << 22},
+	FamilyL4: {addrMask: 0x7ffff, bank: 1 << 19, system: 1 << 20},
+	FamilyWB: {addrMask: 0x1ffff, system: 1 << 20},
+}
+
+// The L4+ lines have a larger address field
+var l4ECCDeviceLayouts = map[uint16]l4ECCLayout{
+	0x470: {addrMask: 0x1fffff, bank: 1 << 21, system: 1 << 22},
+	0x471: {addrMask: 0x1fffff, bank: 1 << 21, system: 1 << 22},
+}
+
+func (f *flashL4) readECC() ([]ECCEvent, error) {
+	v, err := f.swd.ReadRegister(regECCR)
+	if err != nil {
+		return nil, err
+	}
+
+	eccr := eccRegister(v)
+
+	if eccr&(eccRegisterCorrection|eccRegisterDetection) == 0 {
+		return nil, nil
+	}
+
+	layout, ok := l4ECCDeviceLayouts[f.devID]
+	if !ok {
+		layout = l4ECCLayouts[f.family]
+	}
+
+	addr := uint32(eccr & layout.addrMask)
+	if layout.doubleWords {
+		addr *= l4WriteSize
+	}
+
+	ev := ECCEvent{
+		DoubleBit:   eccr&eccRegisterDetection != 0,
+		SystemFlash: eccr&layout.system != 0,
+	}
+
+	if layout.bank != 0 && eccr&layout.bank != 0 {
+		ev.Bank = 1
+	}
+
+	// The address is relative to the start of the bank
+	if !ev.SystemFlash {
+		addr += FlashBaseAddr + uint32(ev.Bank)*(f.geometry.Size/uint32(f.geometry.Banks))
+	}
+
+	ev.Addr = addr
+
+	return []ECCEvent{ev}, nil
+}
+
+func (f *flashL4) clearECC() error {
+	v, err := f.swd.ReadRegister(regECCR)
+	if err != nil {
+		return err
+	}
+
+	// The flags are cleared by writing 1, the interrupt enable bit is kept
+	return f.swd.WriteRegister(regECCR, v)
+}
@@ -0,0 +1,115 @@
+package stm32
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+)
+
+// Fast programming writes a row of 32 double words in a single operation
+const l4RowSize = 256
+
+func (f *flashL4) setFastProgramming(enable bool) {
+	f.fast = enable
+}
+
+// programFast programs full, erased rows in fast programming mode and everything
+// else one double word at a time.
+func (f *flashL4) programFast(offset uint32, data []byte, tr *Tracker) error {
+	for i := uint32(0); i < uint32(len(data)); {
+		addr := offset + i
+
+		if addr%l4RowSize == 0 && uint32(len(data))-i >= l4RowSize {
+			row := data[i : i+l4RowSize]
+
+			erased, err := f.rowErased(addr)
+			if err != nil {
+				return err
+			}
+
+			if erased {
+				if err := f.programRow(addr, row); err != nil {
+					return fmt.Errorf("fast program row at 0x%08x: %w", FlashBaseAddr+addr, err)
+				}
+
+				tr.Add(l4RowSize)
+				i += l4RowSize
+
+				continue
+			}
+		}
+
+		// Up to the next row boundary
+		n := l4RowSize - addr%l4RowSize
+		if n > uint32(len(data))-i {
+			n = uint32(len(data)) - i
+		}
+
+		if err := f.programDoubleWords(addr, data[i:i+n], tr); err != nil {
+			return err
+		}
+
+		i += n
+	}
+
+	return f.clearEmpty()
+}
+
+// rowErased reads back a row and reports whether all of it is erased.
+func (f *flashL4) rowErased(offset uint32) (bool, error) {
+	words := make([]uint32, l4RowSize/4)
+
+	if err := f.swd.ReadBlock(FlashBaseAddr+offset, words); err != nil {
+		return false, err
+	}
+
+	for _, w := range words {
+		if w != 0xffffffff {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// programRow streams a row with auto-increment writes. The controller expects
+// the double words without gaps, so a running core is halted first, as any of
+// its bus accesses would abort the operation.
+func (f *flashL4) programRow(offset uint32, row []byte) error {
+	core := cd.New(f.swd)
+
+	dhcsr, err := core.ReadDHCSR()
+	if err != nil {
+		return fmt.Errorf("read DHCSR: %w", err)
+	}
+
+	if dhcsr&cd.DHCSRSHalt == 0 {
+		if err := core.Halt(); err != nil {
+			return fmt.Errorf("halt: %w", err)
+		}
+	}
+
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	words := make([]uint32, len(row)/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(row[i*4:])
+	}
+
+	if err := f.swd.WriteRegister(regCR, uint32(controlRegisterOptionFastProgramming|controlRegisterEndOfOperation)); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(regCR, 0)
+	}()
+
+	if err := f.swd.WriteBlock(FlashBaseAddr+offset, words); err != nil {
+		return err
+	}
+
+	return f.waitForCompletion()
+}
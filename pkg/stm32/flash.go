@@ -1,297 +1,557 @@
 package stm32
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"time"
 
+	"github.com/holoplot/go-swd/pkg/image"
 	"github.com/holoplot/go-swd/pkg/swd"
 )
 
 const (
-	flashBaseAddr uint32 = 0x08000000
-
-	regBase    uint32 = 0x40022000
-	regACR     uint32 = regBase + 0x00
-	regKEYR    uint32 = regBase + 0x08
-	regOPTKEYR uint32 = regBase + 0x0c
-	regSR      uint32 = regBase + 0x10
-	regCR      uint32 = regBase + 0x14
-	regECCR    uint32 = regBase + 0x18
-	regOPTR    uint32 = regBase + 0x20
-
-	flashKey1 = 0x45670123
-	flashKey2 = 0xcdef89ab
-)
+	// Address the main flash memory is mapped at
+	FlashBaseAddr uint32 = 0x08000000
 
-type acrRegister uint32
+	flashErasedValue = 0xff
+)
 
-const (
-	acrRegisterLatencyMask       acrRegister = 0x7
-	acrRegisterCPUPrefetchEnable acrRegister = 1 << 8
-	acrRegisterInstructionCache  acrRegister = 1 << 9
-	acrRegisterDataCache         acrRegister = 1 << 11
-	acrEmpty                     acrRegister = 1 << 16
-	acrDebugEnable               acrRegister = 1 << 18
+var (
+	ErrTimeout           = errors.New("timeout")
+	ErrVerify            = errors.New("verification failed")
+	ErrUnsupportedDevice = errors.New("unsupported device")
 )
 
-type statusRegister uint32
+// FlashDriver is the interface of a flash programmer. Addresses are offsets
+// into the main flash memory unless noted otherwise.
+type FlashDriver interface {
+	Initialize() error
+	Geometry() Geometry
 
-const (
-	statusRegisterEndOfOperation            statusRegister = 1 << 0
-	statusRegisterOperationError            statusRegister = 1 << 1
-	statusRegisterProgrammingError          statusRegister = 1 << 3
-	statusRegisterWriteProtectionError      statusRegister = 1 << 4
-	statusRegisterProgrammingAlignmentError statusRegister = 1 << 5
-	statusRegisterSizeError                 statusRegister = 1 << 6
-	statusRegisterProgrammingSequenceError  statusRegister = 1 << 7
-	statusRegisterStatusMissError           statusRegister = 1 << 8
-	statusRegisterFastProgrammingError      statusRegister = 1 << 9
-	statusRegisterBusy1                     statusRegister = 1 << 16
-	statusRegisterBusy2                     statusRegister = 1 << 17
-)
+	Read(addr, size uint32, writer io.Writer) error
+	Write(addr uint32, reader io.Reader) error
+	ErasePage(page uint32) error
+	EraseRange(addr, size uint32) error
+	EraseAll(timeout time.Duration) error
 
-type controlRegister uint32
+	// WriteImage and VerifyImage take absolute addresses from the image
+	WriteImage(img *image.Image) (Summary, error)
+	VerifyImage(img *image.Image) (Summary, error)
 
-const (
-	controlRegisterPg                    controlRegister = 1 << 0
-	controlRegisterPer                   controlRegister = 1 << 1
-	controlRegisterMer1                  controlRegister = 1 << 2
-	controlRegisterMer2                  controlRegister = 1 << 15
-	controlRegisterStart                 controlRegister = 1 << 16
-	controlRegisterOptionStart           controlRegister = 1 << 17
-	controlRegisterOptionFastProgramming controlRegister = 1 << 18
-	controlRegisterEndOfOperation        controlRegister = 1 << 24
-	controlRegisterOptLock               controlRegister = 1 << 30
-	controlRegisterLock                  controlRegister = 1 << 31
-)
+	SetProgressFunc(fn ProgressFunc)
+}
+
+// controller implements the register interface of a family's flash controller.
+type controller interface {
+	// initialize checks the controller state and returns the flash layout
+	initialize(dev *Device, size uint32) (Geometry, error)
+	// writeSize returns the programming granularity in bytes
+	writeSize() uint32
+	// program writes data, a multiple of writeSize, at offset into flash
+	program(offset uint32, data []byte, tr *Tracker) error
+	erasePage(page uint32) error
+	eraseAll(timeout time.Duration, tr *Tracker) error
+}
+
+func newController(s *swd.SWD, family Family) (controller, error) {
+	switch family {
+	case FamilyF0, FamilyF1, FamilyF3:
+		return &flashF1{swd: s}, nil
+	case FamilyF2, FamilyF4, FamilyF7:
+		return &flashF4{swd: s}, nil
+	case FamilyG0, FamilyG4, FamilyL4, FamilyWB:
+		return &flashL4{swd: s}, nil
+	case FamilyH7:
+		return &flashH7{swd: s}, nil
+	}
+
+	return nil, fmt.Errorf("%w: no flash driver for %s", ErrUnsupportedDevice, family)
+}
 
+// Flash programs the main flash memory of STM32 devices. Initialize identifies
+// the device and selects the driver for its family; it is called implicitly by
+// the first operation otherwise.
 type Flash struct {
-	swd        *swd.SWD
-	isWritable bool
-	pllEnabled bool
+	swd             *swd.SWD
+	device          *Device
+	ctrl            controller
+	geometry        Geometry
+	progress        ProgressFunc
+	eraseOnWrite    bool
+	fastProgramming bool
+	verifyMode      VerifyMode
+
+	// RAM used by the flash loader, disabled if loaderSize is 0
+	loaderAddr uint32
+	loaderSize uint32
 }
 
-func (f *Flash) Read(addr, size uint32, writer io.Writer) error {
-	for i := uint32(0); i < size; i += 4 {
-		data, err := f.swd.ReadRegister(flashBaseAddr + addr + i)
-		if err != nil {
-			return err
-		}
+var _ FlashDriver = (*Flash)(nil)
 
-		if err := binary.Write(writer, binary.LittleEndian, data); err != nil {
-			return err
-		}
+func (f *Flash) Initialize() error {
+	dev, err := identify(f.swd)
+	if err != nil {
+		return err
 	}
 
+	ctrl, err := newController(f.swd, dev.Family)
+	if err != nil {
+		return err
+	}
+
+	size, err := readFlashSize(f.swd, dev)
+	if err != nil {
+		return fmt.Errorf("read flash size: %w", err)
+	}
+
+	geometry, err := ctrl.initialize(dev, size)
+	if err != nil {
+		return err
+	}
+
+	if fp, ok := ctrl.(fastProgrammer); ok {
+		fp.setFastProgramming(f.fastProgramming)
+	}
+
+	f.device = dev
+	f.ctrl = ctrl
+	f.geometry = geometry
+
 	return nil
 }
 
-func (f *Flash) makeWriteable() error {
-	if !f.isWritable {
-		if err := f.swd.WriteRegister(regKEYR, flashKey1); err != nil {
-			return err
+func (f *Flash) controller() (controller, error) {
+	if f.ctrl == nil {
+		if err := f.Initialize(); err != nil {
+			return nil, err
 		}
+	}
 
-		if err := f.swd.WriteRegister(regKEYR, flashKey2); err != nil {
-			return err
-		}
+	return f.ctrl, nil
+}
 
-		f.isWritable = true
-	}
+// Device returns the device identified by Initialize.
+func (f *Flash) Device() *Device {
+	return f.device
+}
 
-	return nil
+// Geometry returns the flash layout detected by Initialize.
+func (f *Flash) Geometry() Geometry {
+	return f.geometry
 }
 
-func (f *Flash) clearErrors() error {
-	clr := statusRegisterOperationError |
-		statusRegisterProgrammingError |
-		statusRegisterWriteProtectionError |
-		statusRegisterProgrammingAlignmentError |
-		statusRegisterSizeError |
-		statusRegisterProgrammingSequenceError |
-		statusRegisterStatusMissError |
-		statusRegisterFastProgrammingError
-
-	return f.swd.WriteRegister(regSR, uint32(clr))
+// SetEraseOnWrite makes Write erase the pages it touches before programming.
+func (f *Flash) SetEraseOnWrite(enable bool) {
+	f.eraseOnWrite = enable
 }
 
-func (f *Flash) waitForCompletion() error {
-	var sr statusRegister
+// fastProgrammer is implemented by controllers with a fast programming mode.
+type fastProgrammer interface {
+	setFastProgramming(enable bool)
+}
 
-	defer func() {
-		_ = f.swd.WriteRegister(regSR, uint32(sr))
-	}()
+// SetFastProgramming enables fast programming on G0/G4/L4/WB parts, which writes
+// full 256-byte rows at once. It is meant for mass-erased parts: rows that are
+// not erased, and devices without the mode, are programmed as usual. The SWD
+// clock must be fast enough to stream a row without gaps.
+func (f *Flash) SetFastProgramming(enable bool) {
+	f.fastProgramming = enable
 
-	for {
-		val, err := f.swd.ReadRegister(regSR)
-		if err != nil {
-			return err
-		}
+	if fp, ok := f.ctrl.(fastProgrammer); ok {
+		fp.setFastProgramming(enable)
+	}
+}
 
-		sr = statusRegister(val)
+// SetProgressFunc installs a callback that is periodically invoked during erase,
+// write and verify operations. Pass nil to disable reporting.
+func (f *Flash) SetProgressFunc(fn ProgressFunc) {
+	f.progress = fn
+}
 
-		if sr&statusRegisterProgrammingAlignmentError != 0 {
-			return fmt.Errorf("programming alignment error")
+// Read reads size bytes at offset addr into flash. Errors name the readout
+// protection level or the latched ECC event if they are the likely cause, and
+// a double-bit ECC error detected during the read fails it.
+func (f *Flash) Read(addr, size uint32, writer io.Writer) error {
+	// ECC is checked on a best effort basis. Latched events hide those of the
+	// read, so it is only checked if no event is pending.
+	ec, _ := f.eccController()
+	if ec != nil {
+		if latched, err := ec.readECC(); err != nil || len(latched) > 0 {
+			ec = nil
 		}
+	}
 
-		if sr&statusRegisterProgrammingError != 0 {
-			return fmt.Errorf("programming error")
+	for i := uint32(0); i < size; i += 4 {
+		data, err := f.swd.ReadRegister(FlashBaseAddr + addr + i)
+		if err != nil {
+			return f.readError(err)
 		}
 
-		if sr&statusRegisterOperationError != 0 {
-			return fmt.Errorf("operation error")
+		if err := binary.Write(writer, binary.LittleEndian, data); err != nil {
+			return err
 		}
+	}
 
-		if sr&(statusRegisterBusy1|statusRegisterEndOfOperation) == statusRegisterEndOfOperation {
-			return nil
-		}
+	if ec == nil {
+		return nil
+	}
 
-		time.Sleep(time.Millisecond)
+	events, err := ec.readECC()
+	if err != nil {
+		return err
 	}
+
+	return doubleBitError(events)
 }
 
+// Write programs the data read from reader at offset addr, which must be aligned
+// to the programming granularity. The data is padded with the erased value.
 func (f *Flash) Write(addr uint32, reader io.Reader) error {
-	if err := f.makeWriteable(); err != nil {
-		return fmt.Errorf("make writable: %w", err)
+	ctrl, err := f.controller()
+	if err != nil {
+		return err
+	}
+
+	if addr%ctrl.writeSize() != 0 {
+		return fmt.Errorf("address 0x%x not aligned to %d bytes", addr, ctrl.writeSize())
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
 	}
 
-	if err := f.swd.UpdateCSW(swd.CSWAutoIncrementOff|swd.CSWSize32bit,
-		swd.CSWAutoIncrementMask|swd.CSWSizeMask); err != nil {
+	img := image.FromBinary(FlashBaseAddr+addr, data)
+
+	if err := f.checkWriteProtection(img); err != nil {
 		return err
 	}
 
-	for {
-		if busy, err := f.busy(); err != nil {
+	if f.eraseOnWrite {
+		if _, err := f.erasePages(img); err != nil {
 			return err
-		} else if !busy {
-			break
 		}
 	}
 
-	if err := f.clearErrors(); err != nil {
+	_, err = f.writeSegments(img)
+
+	return err
+}
+
+// ErasePage erases a single page or sector. Pages are numbered from the start of
+// flash across all banks.
+func (f *Flash) ErasePage(page uint32) error {
+	ctrl, err := f.controller()
+	if err != nil {
 		return err
 	}
 
-	if err := f.swd.WriteRegister(regCR, uint32(controlRegisterPg|controlRegisterEndOfOperation)); err != nil {
+	if page >= f.geometry.Pages() {
+		return fmt.Errorf("page %d out of range, flash has %d pages", page, f.geometry.Pages())
+	}
+
+	if err := f.checkEraseProtection(f.geometry.pageBounds(page)); err != nil {
 		return err
 	}
 
-	defer func() {
-		_ = f.swd.WriteRegister(regCR, 0)
-	}()
+	return ctrl.erasePage(page)
+}
 
-	for {
-		var data1, data2 uint32
+// EraseRange erases all pages overlapping size bytes at offset addr into flash.
+func (f *Flash) EraseRange(addr, size uint32) error {
+	if size == 0 {
+		return nil
+	}
 
-		if err := binary.Read(reader, binary.LittleEndian, &data1); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
+	ctrl, err := f.controller()
+	if err != nil {
+		return err
+	}
 
-			return err
-		}
+	if addr > f.geometry.Size || size > f.geometry.Size-addr {
+		return fmt.Errorf("0x%x bytes at offset 0x%x outside of flash", size, addr)
+	}
 
-		// Write the second word as 0 in case of errors
-		_ = binary.Read(reader, binary.LittleEndian, &data2)
+	// Check the whole range before erasing anything
+	first, _, _, err := f.geometry.Page(addr)
+	if err != nil {
+		return err
+	}
 
-		if err := f.swd.WriteTAR(flashBaseAddr + addr); err != nil {
-			return err
-		}
+	last, lastStart, lastSize, err := f.geometry.Page(addr + size - 1)
+	if err != nil {
+		return err
+	}
 
-		if err := f.swd.WriteDRW(data1); err != nil {
-			return err
+	firstStart, _ := f.geometry.pageBounds(first)
+
+	if err := f.checkEraseProtection(firstStart, lastStart+lastSize-firstStart); err != nil {
+		return err
+	}
+
+	for page := first; page <= last; page++ {
+		if err := ctrl.erasePage(page); err != nil {
+			return fmt.Errorf("erase page %d: %w", page, err)
 		}
+	}
+
+	return nil
+}
+
+func (f *Flash) EraseAll(timeout time.Duration) error {
+	ctrl, err := f.controller()
+	if err != nil {
+		return err
+	}
+
+	if err := f.checkEraseProtection(0, f.geometry.Size); err != nil {
+		return err
+	}
+
+	tr := f.newTracker(PhaseErase, 0)
+
+	if err := ctrl.eraseAll(timeout, tr); err != nil {
+		return err
+	}
 
-		addr += 4
+	tr.Finish()
+
+	return nil
+}
+
+// waitIdle polls busy until it reports false, for operations such as a mass erase
+// that take too long to poll at full speed.
+func waitIdle(busy func() (bool, error), timeout time.Duration, tr *Tracker) error {
+	for time.Since(tr.start) < timeout {
+		time.Sleep(time.Millisecond * 100)
 
-		if err := f.swd.WriteTAR(flashBaseAddr + addr); err != nil {
+		if busy, err := busy(); err != nil {
 			return err
+		} else if !busy {
+			return nil
 		}
 
-		if err := f.swd.WriteDRW(uint32(data2)); err != nil {
-			return err
+		tr.report(false)
+	}
+
+	return ErrTimeout
+}
+
+type pageRange struct {
+	page, start, size uint32
+}
+
+// imagePages returns every page touched by the image once, in address order.
+func (f *Flash) imagePages(img *image.Image) ([]pageRange, error) {
+	var pages []pageRange
+
+	for _, seg := range img.Segments {
+		if seg.Address < FlashBaseAddr || uint64(seg.End()) > uint64(FlashBaseAddr)+uint64(f.geometry.Size) {
+			return nil, fmt.Errorf("segment %s outside of flash", seg)
 		}
 
-		addr += 4
+		for offset := seg.Address - FlashBaseAddr; offset < seg.End()-FlashBaseAddr; {
+			page, start, size, err := f.geometry.Page(offset)
+			if err != nil {
+				return nil, err
+			}
 
-		if err := f.waitForCompletion(); err != nil {
-			return err
+			if n := len(pages); n == 0 || pages[n-1].page < page {
+				pages = append(pages, pageRange{page, start, size})
+			}
+
+			offset = start + size
 		}
 	}
 
-	// Clear EMPTY bit
-	if err := f.swd.WriteRegister(regACR, uint32(2|acrRegisterInstructionCache|acrDebugEnable)); err != nil {
-		return err
+	return pages, nil
+}
+
+// erasePages erases every page touched by the image once and returns the number
+// of bytes erased.
+func (f *Flash) erasePages(img *image.Image) (uint32, error) {
+	pages, err := f.imagePages(img)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	total := uint32(0)
+	for _, p := range pages {
+		total += p.size
+	}
+
+	tr := f.newTracker(PhaseErase, total)
+
+	for _, p := range pages {
+		if err := f.ctrl.erasePage(p.page); err != nil {
+			return tr.done, fmt.Errorf("erase page %d: %w", p.page, err)
+		}
+
+		tr.Add(p.size)
+	}
+
+	tr.Finish()
+
+	return tr.done, nil
 }
 
-var ErrTimeout = errors.New("timeout")
+// writeSegments programs the segments of the image, padded to the programming
+// granularity, and returns the number of bytes written.
+func (f *Flash) writeSegments(img *image.Image) (uint32, error) {
+	segments := img.Aligned(f.ctrl.writeSize(), flashErasedValue)
 
-func (f *Flash) EraseAll(timeout time.Duration) error {
-	if err := f.makeWriteable(); err != nil {
-		return fmt.Errorf("failed to make writable: %w", err)
+	total := uint32(0)
+	for _, seg := range segments {
+		total += uint32(len(seg.Data))
 	}
 
-	for {
-		if busy, err := f.busy(); err != nil {
-			return err
-		} else if !busy {
-			break
+	tr := f.newTracker(PhaseWrite, total)
+
+	var err error
+
+	for _, seg := range segments {
+		if seg.Address < FlashBaseAddr || uint64(seg.End()) > uint64(FlashBaseAddr)+uint64(f.geometry.Size) {
+			return tr.done, fmt.Errorf("segment %s outside of flash", seg)
+		}
+
+		offset := seg.Address - FlashBaseAddr
+
+		if lc, ok := f.loader(); ok {
+			err = f.programWithLoader(lc, offset, seg.Data, tr)
+		} else {
+			err = f.ctrl.program(offset, seg.Data, tr)
+		}
+
+		if err != nil {
+			return tr.done, fmt.Errorf("write %s: %w", seg, err)
 		}
 	}
 
-	if err := f.clearErrors(); err != nil {
-		return err
+	tr.Finish()
+
+	return tr.done, nil
+}
+
+// WriteImage erases the pages covered by the image and programs all of its
+// segments. Other pages are left untouched.
+func (f *Flash) WriteImage(img *image.Image) (summary Summary, err error) {
+	retries := f.swd.WaitRetries()
+
+	defer func() {
+		summary.Retries = f.swd.WaitRetries() - retries
+	}()
+
+	if _, err := f.controller(); err != nil {
+		return summary, err
 	}
 
-	if err := f.swd.WriteRegister(regCR, uint32(controlRegisterMer1|controlRegisterStart)); err != nil {
-		return err
+	if err := f.checkWriteProtection(img); err != nil {
+		return summary, err
 	}
 
 	start := time.Now()
 
-	for time.Since(start) < timeout {
-		time.Sleep(time.Millisecond * 100)
+	if summary.Erased, err = f.erasePages(img); err != nil {
+		return summary, err
+	}
 
-		if busy, err := f.busy(); err != nil {
-			return err
-		} else if !busy {
-			return nil
-		}
+	summary.EraseTime = time.Since(start)
+	start = time.Now()
+
+	if summary.Written, err = f.writeSegments(img); err != nil {
+		return summary, err
 	}
 
-	return ErrTimeout
+	summary.WriteTime = time.Since(start)
+
+	return summary, nil
 }
 
-func (f *Flash) Initialize() error {
-	if busy, err := f.busy(); err != nil {
-		return err
-	} else if busy {
-		return fmt.Errorf("flash is busy")
+// VerifyImage compares the flash with the image, by reading it back or with the
+// CRC unit of the device, see SetVerifyMode.
+func (f *Flash) VerifyImage(img *image.Image) (summary Summary, err error) {
+	retries := f.swd.WaitRetries()
+
+	defer func() {
+		summary.Retries = f.swd.WaitRetries() - retries
+	}()
+
+	unit, useCRC := crcUnit{}, false
+
+	if f.verifyMode == VerifyCRC {
+		if _, err := f.controller(); err != nil {
+			return summary, err
+		}
+
+		unit, useCRC = crcUnits[f.device.Family]
+	}
+
+	tr := f.newTracker(PhaseVerify, uint32(img.Size()))
+
+	if useCRC {
+		err = f.verifyCRC(unit, img, tr)
+	} else {
+		for _, seg := range img.Segments {
+			if err = f.verifyReadback(seg, tr); err != nil {
+				break
+			}
+		}
 	}
 
-	cr, err := f.swd.ReadRegister(regCR)
 	if err != nil {
-		return err
+		return summary, err
 	}
 
-	f.isWritable = (cr & uint32(controlRegisterLock)) == 0
+	summary.Verified = tr.done
+	summary.VerifyTime = tr.Finish()
+
+	return summary, nil
+}
+
+// verifyReadback reads back the flash and compares it with the segment.
+func (f *Flash) verifyReadback(seg image.Segment, tr *Tracker) error {
+	buf := make([]byte, progressInterval)
+
+	for offset := 0; offset < len(seg.Data); offset += len(buf) {
+		want := seg.Data[offset:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+		}
+
+		addr := seg.Address + uint32(offset)
+		got := buf[:len(want)]
+
+		if err := f.swd.ReadMemory(addr, got); err != nil {
+			return fmt.Errorf("read 0x%08x: %w", addr, err)
+		}
+
+		if i := mismatch(got, want); i >= 0 {
+			return fmt.Errorf("%w at 0x%08x: read 0x%02x, expected 0x%02x",
+				ErrVerify, addr+uint32(i), got[i], want[i])
+		}
+
+		tr.Add(uint32(len(want)))
+	}
 
 	return nil
 }
 
-func (f *Flash) busy() (bool, error) {
-	sr, err := f.swd.ReadRegister(regSR)
-	if err != nil {
-		return false, err
+// mismatch returns the index of the first differing byte, or -1.
+func mismatch(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
 	}
 
-	return (statusRegister(sr) & statusRegisterBusy1) != 0, nil
+	return len(a)
 }
 
 func newFlash(swd *swd.SWD) *Flash {
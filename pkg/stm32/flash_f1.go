@@ -0,0 +1,298 @@
+package stm32
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+// Flash controller of the F0, F1 and F3 series, programmed in half words
+
+const (
+	regF1Base uint32 = 0x40022000
+	regF1KEYR uint32 = regF1Base + 0x04
+	regF1SR   uint32 = regF1Base + 0x0c
+	regF1CR   uint32 = regF1Base + 0x10
+	regF1AR   uint32 = regF1Base + 0x14
+
+	// Offset of the bank 2 registers on XL-density F1 devices
+	f1Bank2Offset = 0x40
+	f1Bank2Start  = 512 * 1024
+	f1DevIDXL     = 0x430
+
+	f1WriteSize = 2
+
+	// Longest single program or page erase operation, with a large margin
+	f1OperationTimeout = time.Second
+)
+
+type f1Status uint32
+
+const (
+	f1StatusBusy                 f1Status = 1 << 0
+	f1StatusProgrammingError     f1Status = 1 << 2
+	f1StatusWriteProtectionError f1Status = 1 << 4
+	f1StatusEndOfOperation       f1Status = 1 << 5
+)
+
+type f1Control uint32
+
+const (
+	f1ControlPg    f1Control = 1 << 0
+	f1ControlPer   f1Control = 1 << 1
+	f1ControlMer   f1Control = 1 << 2
+	f1ControlStart f1Control = 1 << 6
+	f1ControlLock  f1Control = 1 << 7
+)
+
+// Devices with 1 KB pages, all others use 2 KB pages
+var f1SmallPages = map[uint16]bool{
+	0x410: true,
+	0x412: true,
+	0x420: true,
+	0x440: true,
+	0x444: true,
+	0x445: true,
+}
+
+type flashF1 struct {
+	swd      *swd.SWD
+	banks    int
+	pageSize uint32
+	unlocked [2]bool
+}
+
+func (f *flashF1) initialize(dev *Device, size uint32) (Geometry, error) {
+	g := Geometry{
+		Size:     size,
+		Banks:    1,
+		PageSize: 2048,
+	}
+
+	if f1SmallPages[dev.DevID] {
+		g.PageSize = 1024
+	}
+
+	if dev.DevID == f1DevIDXL && size > f1Bank2Start {
+		g.Banks = 2
+	}
+
+	f.banks = g.Banks
+	f.pageSize = g.PageSize
+	f.unlocked = [2]bool{}
+
+	for bank := 0; bank < f.banks; bank++ {
+		sr, err := f.swd.ReadRegister(f.reg(regF1SR, bank))
+		if err != nil {
+			return Geometry{}, err
+		}
+
+		if f1Status(sr)&f1StatusBusy != 0 {
+			return Geometry{}, fmt.Errorf("flash is busy")
+		}
+	}
+
+	return g, nil
+}
+
+func (f *flashF1) writeSize() uint32 {
+	return f1WriteSize
+}
+
+// reg returns the address of a register of the given bank.
+func (f *flashF1) reg(addr uint32, bank int) uint32 {
+	if bank == 1 {
+		return addr + f1Bank2Offset
+	}
+
+	return addr
+}
+
+func (f *flashF1) bank(offset uint32) int {
+	if f.banks > 1 && offset >= f1Bank2Start {
+		return 1
+	}
+
+	return 0
+}
+
+func (f *flashF1) unlock(bank int) error {
+	if f.unlocked[bank] {
+		return nil
+	}
+
+	cr, err := f.swd.ReadRegister(f.reg(regF1CR, bank))
+	if err != nil {
+		return err
+	}
+
+	if f1Control(cr)&f1ControlLock != 0 {
+		if err := f.swd.WriteRegister(f.reg(regF1KEYR, bank), flashKey1); err != nil {
+			return err
+		}
+
+		if err := f.swd.WriteRegister(f.reg(regF1KEYR, bank), flashKey2); err != nil {
+			return err
+		}
+	}
+
+	f.unlocked[bank] = true
+
+	return nil
+}
+
+func (f *flashF1) busy(bank int) (f1Status, error) {
+	sr, err := f.swd.ReadRegister(f.reg(regF1SR, bank))
+	if err != nil {
+		return 0, err
+	}
+
+	return f1Status(sr), nil
+}
+
+func (f *flashF1) waitForCompletion(bank int) error {
+	deadline := time.Now().Add(f1OperationTimeout)
+
+	for {
+		sr, err := f.busy(bank)
+		if err != nil {
+			return err
+		}
+
+		if sr&f1StatusBusy != 0 {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%w: SR 0x%08x", ErrTimeout, uint32(sr))
+			}
+
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		// Clear EOP and error flags
+		if err := f.swd.WriteRegister(f.reg(regF1SR, bank), uint32(sr)); err != nil {
+			return err
+		}
+
+		if sr&f1StatusWriteProtectionError != 0 {
+			return fmt.Errorf("write protection error")
+		}
+
+		if sr&f1StatusProgrammingError != 0 {
+			return fmt.Errorf("programming error")
+		}
+
+		return nil
+	}
+}
+
+func (f *flashF1) program(offset uint32, data []byte, tr *Tracker) error {
+	bank := f.bank(offset)
+
+	if err := f.unlock(bank); err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+
+	if err := f.swd.UpdateCSW(swd.CSWAutoIncrementOff|swd.CSWSize16bit,
+		swd.CSWAutoIncrementMask|swd.CSWSizeMask); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.UpdateCSW(swd.CSWSize32bit, swd.CSWSizeMask)
+		_ = f.swd.WriteRegister(f.reg(regF1CR, bank), 0)
+	}()
+
+	if err := f.swd.WriteRegister(f.reg(regF1CR, bank), uint32(f1ControlPg)); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(data); i += f1WriteSize {
+		addr := FlashBaseAddr + offset + uint32(i)
+
+		if f.bank(offset+uint32(i)) != bank {
+			// Continue in the other bank
+			return f.program(offset+uint32(i), data[i:], tr)
+		}
+
+		if err := f.swd.WriteTAR(addr); err != nil {
+			return err
+		}
+
+		// Half word transfers use the byte lanes of the address
+		hw := uint32(binary.LittleEndian.Uint16(data[i:]))
+
+		if err := f.swd.WriteDRW(hw << ((addr & 2) * 8)); err != nil {
+			return err
+		}
+
+		if err := f.waitForCompletion(bank); err != nil {
+			return fmt.Errorf("0x%08x: %w", addr, err)
+		}
+
+		tr.Add(f1WriteSize)
+	}
+
+	return nil
+}
+
+func (f *flashF1) erasePage(page uint32) error {
+	offset := page * f.pageSize
+	bank := f.bank(offset)
+
+	if err := f.unlock(bank); err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+
+	cr := f.reg(regF1CR, bank)
+
+	if err := f.swd.WriteRegister(cr, uint32(f1ControlPer)); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(cr, 0)
+	}()
+
+	if err := f.swd.WriteRegister(f.reg(regF1AR, bank), FlashBaseAddr+offset); err != nil {
+		return err
+	}
+
+	if err := f.swd.WriteRegister(cr, uint32(f1ControlPer|f1ControlStart)); err != nil {
+		return err
+	}
+
+	return f.waitForCompletion(bank)
+}
+
+func (f *flashF1) eraseAll(timeout time.Duration, tr *Tracker) error {
+	for bank := 0; bank < f.banks; bank++ {
+		if err := f.unlock(bank); err != nil {
+			return fmt.Errorf("unlock: %w", err)
+		}
+
+		cr := f.reg(regF1CR, bank)
+
+		if err := f.swd.WriteRegister(cr, uint32(f1ControlMer)); err != nil {
+			return err
+		}
+
+		if err := f.swd.WriteRegister(cr, uint32(f1ControlMer|f1ControlStart)); err != nil {
+			return err
+		}
+
+		err := waitIdle(func() (bool, error) {
+			sr, err := f.busy(bank)
+			return sr&f1StatusBusy != 0, err
+		}, timeout, tr)
+
+		_ = f.swd.WriteRegister(cr, 0)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package stm32
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+// Flash controller of the F2, F4 and F7 series with sectors of different size,
+// programmed in words
+
+const (
+	regF4Base uint32 = 0x40023c00
+	regF4KEYR uint32 = regF4Base + 0x04
+	regF4SR   uint32 = regF4Base + 0x0c
+	regF4CR   uint32 = regF4Base + 0x10
+
+	f4WriteSize = 4
+	// Sector number of the first sector of bank 2 in CR.SNB
+	f4Bank2SectorBase = 16
+	f4DualBankSize    = 2 * 1024 * 1024
+
+	// Erasing the largest sectors with 8-bit parallelism takes seconds
+	f4OperationTimeout = 16 * time.Second
+)
+
+type f4Status uint32
+
+const (
+	f4StatusEndOfOperation              f4Status = 1 << 0
+	f4StatusOperationError              f4Status = 1 << 1
+	f4StatusWriteProtectionError        f4Status = 1 << 4
+	f4StatusProgrammingAlignmentError   f4Status = 1 << 5
+	f4StatusProgrammingParallelismError f4Status = 1 << 6
+	f4StatusProgrammingSequenceError    f4Status = 1 << 7
+	f4StatusBusy                        f4Status = 1 << 16
+	f4StatusErrors                      f4Status = 0xf2
+)
+
+type f4Control uint32
+
+const (
+	f4ControlPg    f4Control = 1 << 0
+	f4ControlSer   f4Control = 1 << 1
+	f4ControlMer   f4Control = 1 << 2
+	f4ControlMer1  f4Control = 1 << 15
+	f4ControlStart f4Control = 1 << 16
+	f4ControlLock  f4Control = 1 << 31
+
+	f4ControlSectorShift = 3
+	// 32-bit parallelism, requires a supply voltage above 2.7 V
+	f4ControlPSize32 = 2 << 8
+)
+
+// Size of the smallest sectors. Each bank starts with four of them, followed by
+// one sector four times and further sectors eight times as large.
+var f4SmallSector = map[uint16]uint32{
+	0x449: 32 * 1024,
+	0x451: 32 * 1024,
+}
+
+// f4Sectors returns the sector sizes of a bank.
+func f4Sectors(bankSize, small uint32) []uint32 {
+	var sectors []uint32
+
+	for size := uint32(0); size < bankSize; {
+		s := small * 8
+
+		switch n := len(sectors); {
+		case n < 4:
+			s = small
+		case n == 4:
+			s = small * 4
+		}
+
+		sectors = append(sectors, s)
+		size += s
+	}
+
+	return sectors
+}
+
+type flashF4 struct {
+	swd            *swd.SWD
+	banks          int
+	sectorsPerBank uint32
+	unlocked       bool
+}
+
+func (f *flashF4) initialize(dev *Device, size uint32) (Geometry, error) {
+	small, ok := f4SmallSector[dev.DevID]
+	if !ok {
+		small = 16 * 1024
+	}
+
+	g := Geometry{
+		Size:  size,
+		Banks: 1,
+	}
+
+	// The 2 MB parts of the F42x/F43x and F469/F479 lines have two banks
+	if (dev.DevID == 0x419 || dev.DevID == 0x434) && size == f4DualBankSize {
+		g.Banks = 2
+	}
+
+	for bank := 0; bank < g.Banks; bank++ {
+		g.Sectors = append(g.Sectors, f4Sectors(size/uint32(g.Banks), small)...)
+	}
+
+	f.banks = g.Banks
+	f.sectorsPerBank = g.pagesPerBank()
+	f.unlocked = false
+
+	sr, err := f.swd.ReadRegister(regF4SR)
+	if err != nil {
+		return Geometry{}, err
+	}
+
+	if f4Status(sr)&f4StatusBusy != 0 {
+		return Geometry{}, fmt.Errorf("flash is busy")
+	}
+
+	return g, nil
+}
+
+func (f *flashF4) writeSize() uint32 {
+	return f4WriteSize
+}
+
+func (f *flashF4) unlock() error {
+	if f.unlocked {
+		return nil
+	}
+
+	cr, err := f.swd.ReadRegister(regF4CR)
+	if err != nil {
+		return err
+	}
+
+	if f4Control(cr)&f4ControlLock != 0 {
+		if err := f.swd.WriteRegister(regF4KEYR, flashKey1); err != nil {
+			return err
+		}
+
+		if err := f.swd.WriteRegister(regF4KEYR, flashKey2); err != nil {
+			return err
+		}
+	}
+
+	f.unlocked = true
+
+	return nil
+}
+
+func (f *flashF4) busy() (bool, error) {
+	sr, err := f.swd.ReadRegister(regF4SR)
+	if err != nil {
+		return false, err
+	}
+
+	return f4Status(sr)&f4StatusBusy != 0, nil
+}
+
+func (f *flashF4) waitForCompletion() error {
+	deadline := time.Now().Add(f4OperationTimeout)
+
+	for {
+		v, err := f.swd.ReadRegister(regF4SR)
+		if err != nil {
+			return err
+		}
+
+		sr := f4Status(v)
+
+		if sr&f4StatusBusy != 0 {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%w: SR 0x%08x", ErrTimeout, v)
+			}
+
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		if err := f.swd.WriteRegister(regF4SR, uint32(sr)); err != nil {
+			return err
+		}
+
+		switch {
+		case sr&f4StatusWriteProtectionError != 0:
+			return fmt.Errorf("write protection error")
+		case sr&f4StatusProgrammingAlignmentError != 0:
+			return fmt.Errorf("programming alignment error")
+		case sr&f4StatusProgrammingParallelismError != 0:
+			return fmt.Errorf("programming parallelism error")
+		case sr&f4StatusProgrammingSequenceError != 0:
+			return fmt.Errorf("programming sequence error")
+		case sr&f4StatusOperationError != 0:
+			return fmt.Errorf("operation error")
+		}
+
+		return nil
+	}
+}
+
+// prepare unlocks the controller and clears stale error flags.
+func (f *flashF4) prepare() error {
+	if err := f.unlock(); err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+
+	return f.swd.WriteRegister(regF4SR, uint32(f4StatusErrors|f4StatusEndOfOperation))
+}
+
+func (f *flashF4) program(offset uint32, data []byte, tr *Tracker) error {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	if err := f.swd.WriteRegister(regF4CR, uint32(f4ControlPg)|f4ControlPSize32); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(regF4CR, 0)
+	}()
+
+	for i := 0; i < len(data); i += f4WriteSize {
+		addr := FlashBaseAddr + offset + uint32(i)
+		word := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+
+		if err := f.swd.WriteTAR(addr); err != nil {
+			return err
+		}
+
+		if err := f.swd.WriteDRW(word); err != nil {
+			return err
+		}
+
+		if err := f.waitForCompletion(); err != nil {
+			return fmt.Errorf("0x%08x: %w", addr, err)
+		}
+
+		tr.Add(f4WriteSize)
+	}
+
+	return nil
+}
+
+func (f *flashF4) erasePage(page uint32) error {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	snb := page
+	if page >= f.sectorsPerBank {
+		snb = f4Bank2SectorBase + page - f.sectorsPerBank
+	}
+
+	cr := uint32(f4ControlSer) | f4ControlPSize32 | snb<<f4ControlSectorShift
+
+	if err := f.swd.WriteRegister(regF4CR, cr); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(regF4CR, 0)
+	}()
+
+	if err := f.swd.WriteRegister(regF4CR, cr|uint32(f4ControlStart)); err != nil {
+		return err
+	}
+
+	return f.waitForCompletion()
+}
+
+func (f *flashF4) eraseAll(timeout time.Duration, tr *Tracker) error {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	cr := uint32(f4ControlMer) | f4ControlPSize32
+	if f.banks > 1 {
+		cr |= uint32(f4ControlMer1)
+	}
+
+	if err := f.swd.WriteRegister(regF4CR, cr); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(regF4CR, 0)
+	}()
+
+	if err := f.swd.WriteRegister(regF4CR, cr|uint32(f4ControlStart)); err != nil {
+		return err
+	}
+
+	return waitIdle(f.busy, timeout, tr)
+}
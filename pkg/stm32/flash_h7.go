@@ -0,0 +1,322 @@
+package stm32
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+// Flash controller of the H7 series, programmed in flash words of 128 or 256 bits
+
+const (
+	regH7Base uint32 = 0x52002000
+	regH7KEYR uint32 = regH7Base + 0x04
+	regH7CR   uint32 = regH7Base + 0x0c
+	regH7SR   uint32 = regH7Base + 0x10
+	regH7CCR  uint32 = regH7Base + 0x14
+
+	// Offset of the bank 2 registers
+	h7Bank2Offset = 0x100
+	h7Bank2Start  = 1024 * 1024
+
+	// Erasing a 128 KB sector with 8-bit parallelism takes seconds
+	h7OperationTimeout = 8 * time.Second
+)
+
+type h7Status uint32
+
+const (
+	h7StatusBusy                   h7Status = 1 << 0
+	h7StatusWriteBufferNotEmpty    h7Status = 1 << 1
+	h7StatusQueueWait              h7Status = 1 << 2
+	h7StatusEndOfOperation         h7Status = 1 << 16
+	h7StatusWriteProtectionError   h7Status = 1 << 17
+	h7StatusProgrammingSequenceErr h7Status = 1 << 18
+	h7StatusStrobeError            h7Status = 1 << 19
+	h7StatusInconsistencyError     h7Status = 1 << 21
+	h7StatusOperationError         h7Status = 1 << 22
+	h7StatusErrors                 h7Status = 0x07ee0000
+)
+
+type h7Control uint32
+
+const (
+	h7ControlLock  h7Control = 1 << 0
+	h7ControlPg    h7Control = 1 << 1
+	h7ControlSer   h7Control = 1 << 2
+	h7ControlBer   h7Control = 1 << 3
+	h7ControlStart h7Control = 1 << 7
+
+	h7ControlSectorShift = 8
+	// 64-bit parallelism
+	h7ControlPSize64 h7Control = 3 << 4
+
+	// The H7A3/B3 has no PSIZE field, which moves START and the sector number
+	h7ABControlStart       h7Control = 1 << 5
+	h7ABControlSectorShift           = 6
+)
+
+type h7Layout struct {
+	sectorSize uint32
+	wordSize   uint32
+
+	// CR bit positions
+	start       h7Control
+	sectorShift int
+	// Program and erase parallelism, 0 if the CR has no PSIZE field
+	psize h7Control
+}
+
+var h7Layouts = map[uint16]h7Layout{
+	0x450: {sectorSize: 128 * 1024, wordSize: 32,
+		start: h7ControlStart, sectorShift: h7ControlSectorShift, psize: h7ControlPSize64},
+	0x480: {sectorSize: 8 * 1024, wordSize: 16,
+		start: h7ABControlStart, sectorShift: h7ABControlSectorShift},
+	0x483: {sectorSize: 128 * 1024, wordSize: 32,
+		start: h7ControlStart, sectorShift: h7ControlSectorShift, psize: h7ControlPSize64},
+}
+
+type flashH7 struct {
+	swd      *swd.SWD
+	layout   h7Layout
+	banks    int
+	unlocked [2]bool
+}
+
+func (f *flashH7) initialize(dev *Device, size uint32) (Geometry, error) {
+	layout, ok := h7Layouts[dev.DevID]
+	if !ok {
+		return Geometry{}, fmt.Errorf("%w: no flash layout for %s", ErrUnsupportedDevice, dev)
+	}
+
+	g := Geometry{
+		Size:     size,
+		Banks:    1,
+		PageSize: layout.sectorSize,
+	}
+
+	// Bank 2 always starts at 1 MB, so only parts with 2 MB are contiguous.
+	// Smaller dual bank parts are limited to bank 1.
+	if dev.DevID != 0x483 {
+		if size > h7Bank2Start {
+			g.Banks = 2
+		} else {
+			g.Size = size / 2
+		}
+	}
+
+	f.layout = layout
+	f.banks = g.Banks
+	f.unlocked = [2]bool{}
+
+	for bank := 0; bank < f.banks; bank++ {
+		sr, err := f.status(bank)
+		if err != nil {
+			return Geometry{}, err
+		}
+
+		if sr&(h7StatusBusy|h7StatusQueueWait) != 0 {
+			return Geometry{}, fmt.Errorf("flash is busy")
+		}
+	}
+
+	return g, nil
+}
+
+func (f *flashH7) writeSize() uint32 {
+	return f.layout.wordSize
+}
+
+func (f *flashH7) reg(addr uint32, bank int) uint32 {
+	if bank == 1 {
+		return addr + h7Bank2Offset
+	}
+
+	return addr
+}
+
+func (f *flashH7) bank(offset uint32) int {
+	if f.banks > 1 && offset >= h7Bank2Start {
+		return 1
+	}
+
+	return 0
+}
+
+func (f *flashH7) status(bank int) (h7Status, error) {
+	sr, err := f.swd.ReadRegister(f.reg(regH7SR, bank))
+	return h7Status(sr), err
+}
+
+func (f *flashH7) prepare(bank int) error {
+	if !f.unlocked[bank] {
+		cr, err := f.swd.ReadRegister(f.reg(regH7CR, bank))
+		if err != nil {
+			return err
+		}
+
+		if h7Control(cr)&h7ControlLock != 0 {
+			if err := f.swd.WriteRegister(f.reg(regH7KEYR, bank), flashKey1); err != nil {
+				return err
+			}
+
+			if err := f.swd.WriteRegister(f.reg(regH7KEYR, bank), flashKey2); err != nil {
+				return err
+			}
+		}
+
+		f.unlocked[bank] = true
+	}
+
+	return f.swd.WriteRegister(f.reg(regH7CCR, bank), uint32(h7StatusErrors|h7StatusEndOfOperation))
+}
+
+func (f *flashH7) waitForCompletion(bank int) error {
+	deadline := time.Now().Add(h7OperationTimeout)
+
+	for {
+		sr, err := f.status(bank)
+		if err != nil {
+			return err
+		}
+
+		if sr&(h7StatusBusy|h7StatusQueueWait) != 0 {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%w: SR 0x%08x", ErrTimeout, uint32(sr))
+			}
+
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		if sr&h7StatusErrors == 0 {
+			return nil
+		}
+
+		if err := f.swd.WriteRegister(f.reg(regH7CCR, bank), uint32(sr&h7StatusErrors)); err != nil {
+			return err
+		}
+
+		switch {
+		case sr&h7StatusWriteProtectionError != 0:
+			return fmt.Errorf("write protection error")
+		case sr&h7StatusProgrammingSequenceErr != 0:
+			return fmt.Errorf("programming sequence error")
+		case sr&h7StatusStrobeError != 0:
+			return fmt.Errorf("strobe error")
+		case sr&h7StatusInconsistencyError != 0:
+			return fmt.Errorf("inconsistency error")
+		case sr&h7StatusOperationError != 0:
+			return fmt.Errorf("operation error")
+		}
+
+		return fmt.Errorf("flash error, SR 0x%08x", uint32(sr))
+	}
+}
+
+func (f *flashH7) program(offset uint32, data []byte, tr *Tracker) error {
+	for i := 0; i < len(data); {
+		bank := f.bank(offset + uint32(i))
+
+		if err := f.prepare(bank); err != nil {
+			return err
+		}
+
+		cr := f.reg(regH7CR, bank)
+
+		if err := f.swd.WriteRegister(cr, uint32(h7ControlPg|f.layout.psize)); err != nil {
+			return err
+		}
+
+		for ; i < len(data) && f.bank(offset+uint32(i)) == bank; i += int(f.layout.wordSize) {
+			addr := FlashBaseAddr + offset + uint32(i)
+
+			// The flash word is committed once the write buffer is full
+			for w := 0; w < int(f.layout.wordSize); w += 4 {
+				d := data[i+w:]
+				word := uint32(d[0]) | uint32(d[1])<<8 | uint32(d[2])<<16 | uint32(d[3])<<24
+
+				if err := f.swd.WriteRegister(addr+uint32(w), word); err != nil {
+					_ = f.swd.WriteRegister(cr, 0)
+					return err
+				}
+			}
+
+			if err := f.waitForCompletion(bank); err != nil {
+				_ = f.swd.WriteRegister(cr, 0)
+				return fmt.Errorf("0x%08x: %w", addr, err)
+			}
+
+			tr.Add(f.layout.wordSize)
+		}
+
+		if err := f.swd.WriteRegister(cr, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *flashH7) erasePage(page uint32) error {
+	bank := f.bank(page * f.layout.sectorSize)
+	sector := page % (h7Bank2Start / f.layout.sectorSize)
+
+	if err := f.prepare(bank); err != nil {
+		return err
+	}
+
+	cr := f.reg(regH7CR, bank)
+	v := h7ControlSer | f.layout.psize | h7Control(sector)<<f.layout.sectorShift
+
+	if err := f.swd.WriteRegister(cr, uint32(v)); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(cr, 0)
+	}()
+
+	if err := f.swd.WriteRegister(cr, uint32(v|f.layout.start)); err != nil {
+		return err
+	}
+
+	return f.waitForCompletion(bank)
+}
+
+func (f *flashH7) eraseAll(timeout time.Duration, tr *Tracker) error {
+	for bank := 0; bank < f.banks; bank++ {
+		if err := f.eraseBank(bank, timeout, tr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *flashH7) eraseBank(bank int, timeout time.Duration, tr *Tracker) error {
+	if err := f.prepare(bank); err != nil {
+		return err
+	}
+
+	cr := f.reg(regH7CR, bank)
+	v := h7ControlBer | f.layout.psize
+
+	if err := f.swd.WriteRegister(cr, uint32(v)); err != nil {
+		return err
+	}
+
+	if err := f.swd.WriteRegister(cr, uint32(v|f.layout.start)); err != nil {
+		return err
+	}
+
+	err := waitIdle(func() (bool, error) {
+		sr, err := f.status(bank)
+		return sr&(h7StatusBusy|h7StatusQueueWait) != 0, err
+	}, timeout, tr)
+
+	_ = f.swd.WriteRegister(cr, 0)
+
+	return err
+}
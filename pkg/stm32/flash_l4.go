@@ -0,0 +1,494 @@
+package stm32
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+// Flash controller of the G0, G4, L4 and WB series, programmed in double words
+
+const (
+	regBase      uint32 = 0x40022000
+	regACR       uint32 = regBase + 0x00
+	regKEYR      uint32 = regBase + 0x08
+	regOPTKEYR   uint32 = regBase + 0x0c
+	regSR        uint32 = regBase + 0x10
+	regCR        uint32 = regBase + 0x14
+	regECCR      uint32 = regBase + 0x18
+	regOPTR      uint32 = regBase + 0x20
+	regPCROP1SR  uint32 = regBase + 0x24
+	regPCROP1ER  uint32 = regBase + 0x28
+	regWRP1AR    uint32 = regBase + 0x2c
+	regWRP1BR    uint32 = regBase + 0x30
+	regPCROP1BSR uint32 = regBase + 0x34
+	regPCROP1BER uint32 = regBase + 0x38
+	regPCROP2SR  uint32 = regBase + 0x44
+	regPCROP2ER  uint32 = regBase + 0x48
+	regWRP2AR    uint32 = regBase + 0x4c
+	regWRP2BR    uint32 = regBase + 0x50
+
+	flashKey1 = 0x45670123
+	flashKey2 = 0xcdef89ab
+
+	optionKey1 = 0x08192a3b
+	optionKey2 = 0x4c5d6e7f
+
+	l4WriteSize = 8
+
+	// Longest single program or page erase operation, with a large margin
+	l4OperationTimeout = time.Second
+)
+
+type acrRegister uint32
+
+const (
+	acrRegisterLatencyMask       acrRegister = 0x7
+	acrRegisterCPUPrefetchEnable acrRegister = 1 << 8
+	acrRegisterInstructionCache  acrRegister = 1 << 9
+	acrRegisterDataCache         acrRegister = 1 << 11
+	acrEmpty                     acrRegister = 1 << 16
+	acrDebugEnable               acrRegister = 1 << 18
+)
+
+type statusRegister uint32
+
+const (
+	statusRegisterEndOfOperation            statusRegister = 1 << 0
+	statusRegisterOperationError            statusRegister = 1 << 1
+	statusRegisterProgrammingError          statusRegister = 1 << 3
+	statusRegisterWriteProtectionError      statusRegister = 1 << 4
+	statusRegisterProgrammingAlignmentError statusRegister = 1 << 5
+	statusRegisterSizeError                 statusRegister = 1 << 6
+	statusRegisterProgrammingSequenceError  statusRegister = 1 << 7
+	statusRegisterStatusMissError           statusRegister = 1 << 8
+	statusRegisterFastProgrammingError      statusRegister = 1 << 9
+	statusRegisterBusy1                     statusRegister = 1 << 16
+	statusRegisterBusy2                     statusRegister = 1 << 17
+
+	statusRegisterErrors = statusRegisterOperationError |
+		statusRegisterProgrammingError |
+		statusRegisterWriteProtectionError |
+		statusRegisterProgrammingAlignmentError |
+		statusRegisterSizeError |
+		statusRegisterProgrammingSequenceError |
+		statusRegisterStatusMissError |
+		statusRegisterFastProgrammingError
+)
+
+type controlRegister uint32
+
+const (
+	controlRegisterPg                    controlRegister = 1 << 0
+	controlRegisterPer                   controlRegister = 1 << 1
+	controlRegisterPageShift                             = 3
+	controlRegisterBKER                  controlRegister = 1 << 11
+	controlRegisterMer1                  controlRegister = 1 << 2
+	controlRegisterMer2                  controlRegister = 1 << 15
+	controlRegisterStart                 controlRegister = 1 << 16
+	controlRegisterOptionStart           controlRegister = 1 << 17
+	controlRegisterOptionFastProgramming controlRegister = 1 << 18
+	controlRegisterEndOfOperation        controlRegister = 1 << 24
+	controlRegisterOptionLoad            controlRegister = 1 << 27
+	controlRegisterOptLock               controlRegister = 1 << 30
+	controlRegisterLock                  controlRegister = 1 << 31
+)
+
+// l4Layout holds the flash layout parameters of a device line.
+type l4Layout struct {
+	pageSize uint32
+
+	// OPTR bit enabling the dual bank mode, 0 for single bank parts
+	dualBankOption uint32
+	// Page size in dual bank mode
+	dualBankPageSize uint32
+
+	bker controlRegister
+	// Number of the first page of bank 2 as encoded in PNB, whatever the
+	// size of bank 1. 0 if the pages of each bank are numbered from 0.
+	bank2PageBase uint32
+	// Busy flag of bank 2 operations, 0 if BSY1 covers both banks
+	busy2 statusRegister
+
+	// OPTR bit booting from bank 2, 0 if bank swapping is not supported
+	bankSwapOption uint32
+	// The G0 nSWAP_BANK bit is cleared to swap the banks
+	invertBankSwap bool
+}
+
+var l4Layouts = map[uint16]l4Layout{
+	// G0
+	0x456: {pageSize: 2048},
+	0x460: {pageSize: 2048},
+	0x466: {pageSize: 2048},
+	0x467: {
+		pageSize: 2048, dualBankOption: 1 << 21, dualBankPageSize: 2048, bker: 1 << 13, bank2PageBase: 256,
+		busy2: statusRegisterBusy2, bankSwapOption: 1 << 20, invertBankSwap: true,
+	},
+	// G4
+	0x468: {pageSize: 2048},
+	0x469: {pageSize: 4096, dualBankOption: 1 << 22, dualBankPageSize: 2048, bker: controlRegisterBKER,
+		bankSwapOption: 1 << 20},
+	0x479: {pageSize: 2048},
+	// L4
+	0x415: {pageSize: 2048, dualBankOption: 1 << 21, dualBankPageSize: 2048, bker: controlRegisterBKER,
+		bankSwapOption: 1 << 20},
+	0x435: {pageSize: 2048},
+	0x461: {pageSize: 2048, dualBankOption: 1 << 21, dualBankPageSize: 2048, bker: controlRegisterBKER,
+		bankSwapOption: 1 << 20},
+	0x462: {pageSize: 2048},
+	0x464: {pageSize: 2048},
+	// L4+
+	0x470: {pageSize: 8192, dualBankOption: 1 << 22, dualBankPageSize: 4096, bker: controlRegisterBKER,
+		bankSwapOption: 1 << 20},
+	0x471: {pageSize: 8192, dualBankOption: 1 << 22, dualBankPageSize: 4096, bker: controlRegisterBKER,
+		bankSwapOption: 1 << 20},
+	// WB
+	0x494: {pageSize: 2048},
+	0x495: {pageSize: 4096},
+	0x496: {pageSize: 2048},
+}
+
+type flashL4 struct {
+	swd        *swd.SWD
+	isWritable bool
+	family     Family
+	devID      uint16
+	layout     l4Layout
+	geometry   Geometry
+	fast       bool
+}
+
+func (f *flashL4) initialize(dev *Device, size uint32) (Geometry, error) {
+	if busy, err := f.busy(); err != nil {
+		return Geometry{}, err
+	} else if busy {
+		return Geometry{}, fmt.Errorf("flash is busy")
+	}
+
+	cr, err := f.swd.ReadRegister(regCR)
+	if err != nil {
+		return Geometry{}, err
+	}
+
+	f.isWritable = (cr & uint32(controlRegisterLock)) == 0
+
+	layout, ok := l4Layouts[dev.DevID]
+	if !ok {
+		return Geometry{}, fmt.Errorf("%w: no flash layout for %s", ErrUnsupportedDevice, dev)
+	}
+
+	f.family = dev.Family
+	f.devID = dev.DevID
+	f.layout = layout
+	f.geometry = Geometry{
+		Size:     size,
+		Banks:    1,
+		PageSize: layout.pageSize,
+	}
+
+	if layout.dualBankOption != 0 {
+		optr, err := f.swd.ReadRegister(regOPTR)
+		if err != nil {
+			return Geometry{}, fmt.Errorf("read option register: %w", err)
+		}
+
+		if optr&layout.dualBankOption != 0 {
+			f.geometry.PageSize = layout.dualBankPageSize
+			f.geometry.Banks = 2
+		}
+	}
+
+	return f.geometry, nil
+}
+
+func (f *flashL4) writeSize() uint32 {
+	return l4WriteSize
+}
+
+func (f *flashL4) makeWriteable() error {
+	if !f.isWritable {
+		if err := f.swd.WriteRegister(regKEYR, flashKey1); err != nil {
+			return err
+		}
+
+		if err := f.swd.WriteRegister(regKEYR, flashKey2); err != nil {
+			return err
+		}
+
+		f.isWritable = true
+	}
+
+	return nil
+}
+
+func (f *flashL4) clearErrors() error {
+	return f.swd.WriteRegister(regSR, uint32(statusRegisterErrors))
+}
+
+// error returns an error for the first error flag set.
+func (sr statusRegister) error() error {
+	switch {
+	case sr&statusRegisterWriteProtectionError != 0:
+		return fmt.Errorf("write protection error")
+	case sr&statusRegisterProgrammingAlignmentError != 0:
+		return fmt.Errorf("programming alignment error")
+	case sr&statusRegisterSizeError != 0:
+		return fmt.Errorf("size error")
+	case sr&statusRegisterProgrammingSequenceError != 0:
+		return fmt.Errorf("programming sequence error")
+	case sr&statusRegisterProgrammingError != 0:
+		return fmt.Errorf("programming error")
+	case sr&statusRegisterOperationError != 0:
+		return fmt.Errorf("operation error")
+	case sr&statusRegisterFastProgrammingError != 0:
+		return fmt.Errorf("fast programming error")
+	case sr&statusRegisterStatusMissError != 0:
+		return fmt.Errorf("fast programming data miss")
+	}
+
+	return nil
+}
+
+func (f *flashL4) waitForCompletion() error {
+	var sr statusRegister
+
+	defer func() {
+		_ = f.swd.WriteRegister(regSR, uint32(sr))
+	}()
+
+	deadline := time.Now().Add(l4OperationTimeout)
+
+	for {
+		val, err := f.swd.ReadRegister(regSR)
+		if err != nil {
+			return err
+		}
+
+		sr = statusRegister(val)
+
+		// EOP is not set if the operation failed
+		if err := sr.error(); err != nil {
+			return err
+		}
+
+		if sr&(f.busyFlags()|statusRegisterEndOfOperation) == statusRegisterEndOfOperation {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: SR 0x%08x", ErrTimeout, uint32(sr))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitNotBusy waits for a pending operation to finish.
+func (f *flashL4) waitNotBusy() error {
+	deadline := time.Now().Add(l4OperationTimeout)
+
+	for {
+		if busy, err := f.busy(); err != nil {
+			return err
+		} else if !busy {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: flash is busy", ErrTimeout)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// prepare unlocks the controller and waits for pending operations.
+func (f *flashL4) prepare() error {
+	if err := f.makeWriteable(); err != nil {
+		return fmt.Errorf("make writable: %w", err)
+	}
+
+	if err := f.waitNotBusy(); err != nil {
+		return err
+	}
+
+	return f.clearErrors()
+}
+
+func (f *flashL4) program(offset uint32, data []byte, tr *Tracker) error {
+	if f.fast {
+		return f.programFast(offset, data, tr)
+	}
+
+	if err := f.programDoubleWords(offset, data, tr); err != nil {
+		return err
+	}
+
+	return f.clearEmpty()
+}
+
+// programDoubleWords programs data one double word at a time.
+func (f *flashL4) programDoubleWords(offset uint32, data []byte, tr *Tracker) error {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	if err := f.swd.UpdateCSW(swd.CSWAutoIncrementOff|swd.CSWSize32bit,
+		swd.CSWAutoIncrementMask|swd.CSWSizeMask); err != nil {
+		return err
+	}
+
+	if err := f.swd.WriteRegister(regCR, uint32(controlRegisterPg|controlRegisterEndOfOperation)); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(regCR, 0)
+	}()
+
+	for i := 0; i < len(data); i += l4WriteSize {
+		addr := FlashBaseAddr + offset + uint32(i)
+
+		for w := 0; w < l4WriteSize; w += 4 {
+			if err := f.swd.WriteTAR(addr + uint32(w)); err != nil {
+				return err
+			}
+
+			if err := f.swd.WriteDRW(binary.LittleEndian.Uint32(data[i+w:])); err != nil {
+				return err
+			}
+		}
+
+		if err := f.waitForCompletion(); err != nil {
+			return err
+		}
+
+		tr.Add(l4WriteSize)
+	}
+
+	return nil
+}
+
+func (f *flashL4) loaderStub() loaderStub {
+	return loaderStub{
+		code:      l4LoaderStub,
+		statusReg: regSR,
+		errorMask: uint32(statusRegisterErrors),
+	}
+}
+
+func (f *flashL4) beginLoader() error {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	return f.swd.WriteRegister(regCR, uint32(controlRegisterPg))
+}
+
+func (f *flashL4) endLoader() error {
+	if err := f.swd.WriteRegister(regCR, 0); err != nil {
+		return err
+	}
+
+	return f.clearEmpty()
+}
+
+// clearEmpty clears the EMPTY bit, so the device boots from flash again. Only
+// the G0 and WB have the bit, the rest of the ACR is left untouched.
+func (f *flashL4) clearEmpty() error {
+	if f.family != FamilyG0 && f.family != FamilyWB {
+		return nil
+	}
+
+	return f.swd.UpdateRegisterBits(regACR, uint32(acrEmpty), 0)
+}
+
+func (f *flashL4) eraseAll(timeout time.Duration, tr *Tracker) error {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	cr := controlRegisterMer1
+	if f.geometry.Banks > 1 {
+		cr |= controlRegisterMer2
+	}
+
+	if err := f.swd.WriteRegister(regCR, uint32(cr|controlRegisterStart)); err != nil {
+		return err
+	}
+
+	err := waitIdle(f.busy, timeout, tr)
+
+	_ = f.swd.WriteRegister(regCR, 0)
+
+	return err
+}
+
+func (f *flashL4) eraseBank(bank int, timeout time.Duration, tr *Tracker) error {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	cr := controlRegisterMer1
+	if bank == 1 {
+		cr = controlRegisterMer2
+	}
+
+	if err := f.swd.WriteRegister(regCR, uint32(cr|controlRegisterStart)); err != nil {
+		return err
+	}
+
+	err := waitIdle(f.busy, timeout, tr)
+
+	_ = f.swd.WriteRegister(regCR, 0)
+
+	return err
+}
+
+func (f *flashL4) erasePage(page uint32) error {
+	g := f.geometry
+	cr := controlRegisterPer
+
+	if perBank := g.pagesPerBank(); g.Banks > 1 && page >= perBank {
+		cr |= f.layout.bker
+		page = f.layout.bank2PageBase + page - perBank
+	}
+
+	cr |= controlRegister(page) << controlRegisterPageShift
+
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	if err := f.swd.WriteRegister(regCR, uint32(cr)); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(regCR, 0)
+	}()
+
+	if err := f.swd.WriteRegister(regCR, uint32(cr|controlRegisterStart|controlRegisterEndOfOperation)); err != nil {
+		return err
+	}
+
+	return f.waitForCompletion()
+}
+
+func (f *flashL4) busy() (bool, error) {
+	sr, err := f.swd.ReadRegister(regSR)
+	if err != nil {
+		return false, err
+	}
+
+	return (statusRegister(sr) & f.busyFlags()) != 0, nil
+}
+
+// busyFlags returns the busy flags of all banks. On most dual bank parts, BSY1
+// covers both banks and bit 17 has a different meaning.
+func (f *flashL4) busyFlags() statusRegister {
+	return statusRegisterBusy1 | f.layout.busy2
+}
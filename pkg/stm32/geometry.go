@@ -0,0 +1,92 @@
+package stm32
+
+import "fmt"
+
+// Geometry describes the layout of the main flash memory.
+type Geometry struct {
+	// Size in bytes
+	Size  uint32
+	Banks int
+
+	// Size of all pages for uniform layouts
+	PageSize uint32
+	// Size of each sector, in address order, for layouts with sectors of
+	// different size. Sectors take the place of pages.
+	Sectors []uint32
+}
+
+// Pages returns the number of pages in all banks.
+func (g Geometry) Pages() uint32 {
+	if g.Sectors != nil {
+		return uint32(len(g.Sectors))
+	}
+
+	if g.PageSize == 0 {
+		return 0
+	}
+
+	return g.Size / g.PageSize
+}
+
+// Page returns the page containing offset into flash, along with its start
+// offset and size.
+func (g Geometry) Page(offset uint32) (page, start, size uint32, err error) {
+	if g.Sectors == nil {
+		if g.PageSize == 0 || offset >= g.Size {
+			return 0, 0, 0, fmt.Errorf("offset 0x%x outside of flash", offset)
+		}
+
+		page = offset / g.PageSize
+
+		return page, page * g.PageSize, g.PageSize, nil
+	}
+
+	for i, s := range g.Sectors {
+		if offset < start+s {
+			return uint32(i), start, s, nil
+		}
+
+		start += s
+	}
+
+	return 0, 0, 0, fmt.Errorf("offset 0x%x outside of flash", offset)
+}
+
+// pageBounds returns the start offset and size of a page.
+func (g Geometry) pageBounds(page uint32) (start, size uint32) {
+	if g.Sectors == nil {
+		return page * g.PageSize, g.PageSize
+	}
+
+	for _, s := range g.Sectors[:page] {
+		start += s
+	}
+
+	return start, g.Sectors[page]
+}
+
+// pagesPerBank returns the number of pages in each bank.
+func (g Geometry) pagesPerBank() uint32 {
+	if g.Banks < 2 {
+		return g.Pages()
+	}
+
+	return g.Pages() / uint32(g.Banks)
+}
+
+// checkBank returns an error if bank, counted from 0, does not exist.
+func (g Geometry) checkBank(bank int) error {
+	if bank < 0 || bank >= g.Banks {
+		return fmt.Errorf("bank %d does not exist, flash has %d banks", bank+1, g.Banks)
+	}
+
+	return nil
+}
+
+func (g Geometry) String() string {
+	if g.Sectors != nil {
+		return fmt.Sprintf("%d KB, %d banks, %d sectors", g.Size/1024, g.Banks, len(g.Sectors))
+	}
+
+	return fmt.Sprintf("%d KB, %d banks of %d byte pages", g.Size/1024, g.Banks, g.PageSize)
+}
@@ -0,0 +1,280 @@
+package stm32
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+const (
+	// DBGMCU_IDCODE of Cortex-M0/M0+ parts, Cortex-M3/M4/M7 parts and the H7 series
+	regIDCodeM0 uint32 = 0x40015800
+	regIDCode   uint32 = 0xe0042000
+	regIDCodeH7 uint32 = 0x5c001000
+
+	idcodeDevIDMask  = 0xfff
+	idcodeRevIDShift = 16
+)
+
+var ErrUnknownDevice = errors.New("unknown device")
+
+type Family int
+
+const (
+	FamilyUnknown Family = iota
+	FamilyF0
+	FamilyF1
+	FamilyF2
+	FamilyF3
+	FamilyF4
+	FamilyF7
+	FamilyG0
+	FamilyG4
+	FamilyH7
+	FamilyL0
+	FamilyL1
+	FamilyL4
+	FamilyWB
+)
+
+func (f Family) String() string {
+	switch f {
+	case FamilyF0:
+		return "STM32F0"
+	case FamilyF1:
+		return "STM32F1"
+	case FamilyF2:
+		return "STM32F2"
+	case FamilyF3:
+		return "STM32F3"
+	case FamilyF4:
+		return "STM32F4"
+	case FamilyF7:
+		return "STM32F7"
+	case FamilyG0:
+		return "STM32G0"
+	case FamilyG4:
+		return "STM32G4"
+	case FamilyH7:
+		return "STM32H7"
+	case FamilyL0:
+		return "STM32L0"
+	case FamilyL1:
+		return "STM32L1"
+	case FamilyL4:
+		return "STM32L4"
+	case FamilyWB:
+		return "STM32WB"
+	default:
+		return "unknown"
+	}
+}
+
+// familyInfo holds the addresses of the identification registers of a family.
+type familyInfo struct {
+	// Flash size in KB, a 16-bit value
+	flashSizeAddr uint32
+	// 96-bit unique device ID
+	uidAddr uint32
+	// The unique ID words are at offsets 0x00, 0x04 and 0x14
+	uidSplit bool
+	// Package data register, 0 if not available
+	packageAddr uint32
+	packageMask uint32
+}
+
+var families = map[Family]familyInfo{
+	FamilyF0: {flashSizeAddr: 0x1ffff7cc, uidAddr: 0x1ffff7ac},
+	FamilyF1: {flashSizeAddr: 0x1ffff7e0, uidAddr: 0x1ffff7e8},
+	FamilyF2: {flashSizeAddr: 0x1fff7a22, uidAddr: 0x1fff7a10},
+	FamilyF3: {flashSizeAddr: 0x1ffff7cc, uidAddr: 0x1ffff7ac},
+	FamilyF4: {flashSizeAddr: 0x1fff7a22, uidAddr: 0x1fff7a10},
+	FamilyF7: {flashSizeAddr: 0x1ff0f442, uidAddr: 0x1ff0f420},
+	FamilyG0: {flashSizeAddr: 0x1fff75e0, uidAddr: 0x1fff7590, packageAddr: 0x1fff7500, packageMask: 0xf},
+	FamilyG4: {flashSizeAddr: 0x1fff75e0, uidAddr: 0x1fff7590, packageAddr: 0x1fff7500, packageMask: 0xf},
+	FamilyH7: {flashSizeAddr: 0x1ff1e880, uidAddr: 0x1ff1e800},
+	FamilyL0: {flashSizeAddr: 0x1ff8007c, uidAddr: 0x1ff80050, uidSplit: true},
+	FamilyL1: {flashSizeAddr: 0x1ff8004c, uidAddr: 0x1ff80050, uidSplit: true},
+	FamilyL4: {flashSizeAddr: 0x1fff75e0, uidAddr: 0x1fff7590, packageAddr: 0x1fff7500, packageMask: 0x1f},
+	FamilyWB: {flashSizeAddr: 0x1fff75e0, uidAddr: 0x1fff7590, packageAddr: 0x1fff7500, packageMask: 0x1f},
+}
+
+type deviceInfo struct {
+	name   string
+	family Family
+	// Override the addresses of the family if non-zero
+	flashSizeAddr uint32
+	uidAddr       uint32
+}
+
+var deviceIDs = map[uint16]deviceInfo{
+	0x440: {name: "STM32F05x/F030x8", family: FamilyF0},
+	0x442: {name: "STM32F09x/F030xC", family: FamilyF0},
+	0x444: {name: "STM32F03x", family: FamilyF0},
+	0x445: {name: "STM32F04x/F070x6", family: FamilyF0},
+	0x448: {name: "STM32F07x", family: FamilyF0},
+
+	0x410: {name: "STM32F1 medium-density", family: FamilyF1},
+	0x412: {name: "STM32F1 low-density", family: FamilyF1},
+	0x414: {name: "STM32F1 high-density", family: FamilyF1},
+	0x418: {name: "STM32F1 connectivity line", family: FamilyF1},
+	0x420: {name: "STM32F100 low/medium-density", family: FamilyF1},
+	0x428: {name: "STM32F100 high-density", family: FamilyF1},
+	0x430: {name: "STM32F1 XL-density", family: FamilyF1},
+
+	0x411: {name: "STM32F2", family: FamilyF2},
+
+	0x422: {name: "STM32F30xB/C/F358", family: FamilyF3},
+	0x432: {name: "STM32F37x", family: FamilyF3},
+	0x438: {name: "STM32F303x6/8/F334", family: FamilyF3},
+	0x439: {name: "STM32F301/F302x6/8", family: FamilyF3},
+	0x446: {name: "STM32F302/F303xD/E/F398", family: FamilyF3},
+
+	0x413: {name: "STM32F405/407/415/417", family: FamilyF4},
+	0x419: {name: "STM32F42x/F43x", family: FamilyF4},
+	0x421: {name: "STM32F446", family: FamilyF4},
+	0x423: {name: "STM32F401xB/C", family: FamilyF4},
+	0x431: {name: "STM32F411", family: FamilyF4},
+	0x433: {name: "STM32F401xD/E", family: FamilyF4},
+	0x434: {name: "STM32F469/479", family: FamilyF4},
+	0x441: {name: "STM32F412", family: FamilyF4},
+	0x458: {name: "STM32F410", family: FamilyF4},
+	0x463: {name: "STM32F413/423", family: FamilyF4},
+
+	0x449: {name: "STM32F74x/75x", family: FamilyF7},
+	0x451: {name: "STM32F76x/77x", family: FamilyF7},
+	0x452: {name: "STM32F72x/73x", family: FamilyF7, flashSizeAddr: 0x1ff07a22, uidAddr: 0x1ff07a10},
+
+	0x456: {name: "STM32G05x/G06x", family: FamilyG0},
+	0x460: {name: "STM32G07x/G08x", family: FamilyG0},
+	0x466: {name: "STM32G03x/G04x", family: FamilyG0},
+	0x467: {name: "STM32G0Bx/G0Cx", family: FamilyG0},
+
+	0x468: {name: "STM32G431/441", family: FamilyG4},
+	0x469: {name: "STM32G47x/48x", family: FamilyG4},
+	0x479: {name: "STM32G491/4A1", family: FamilyG4},
+
+	0x450: {name: "STM32H74x/75x", family: FamilyH7},
+	0x480: {name: "STM32H7Ax/7Bx", family: FamilyH7, flashSizeAddr: 0x08fff80c, uidAddr: 0x08fff800},
+	0x483: {name: "STM32H72x/73x", family: FamilyH7},
+
+	0x417: {name: "STM32L05x/L06x", family: FamilyL0},
+	0x425: {name: "STM32L03x/L04x", family: FamilyL0},
+	0x447: {name: "STM32L07x/L08x", family: FamilyL0},
+	0x457: {name: "STM32L01x/L02x", family: FamilyL0},
+
+	0x416: {name: "STM32L1 category 1", family: FamilyL1},
+	0x427: {name: "STM32L1 category 3", family: FamilyL1, flashSizeAddr: 0x1ff800cc, uidAddr: 0x1ff800d0},
+	0x429: {name: "STM32L1 category 2", family: FamilyL1},
+	0x436: {name: "STM32L1 category 4", family: FamilyL1, flashSizeAddr: 0x1ff800cc, uidAddr: 0x1ff800d0},
+	0x437: {name: "STM32L1 category 5/6", family: FamilyL1, flashSizeAddr: 0x1ff800cc, uidAddr: 0x1ff800d0},
+
+	0x415: {name: "STM32L47x/L48x", family: FamilyL4},
+	0x435: {name: "STM32L43x/L44x", family: FamilyL4},
+	0x461: {name: "STM32L49x/L4Ax", family: FamilyL4},
+	0x462: {name: "STM32L45x/L46x", family: FamilyL4},
+	0x464: {name: "STM32L41x/L42x", family: FamilyL4},
+	0x470: {name: "STM32L4Rx/L4Sx", family: FamilyL4},
+	0x471: {name: "STM32L4P5/L4Q5", family: FamilyL4},
+
+	0x494: {name: "STM32WB1x", family: FamilyWB},
+	0x495: {name: "STM32WB5x", family: FamilyWB},
+	0x496: {name: "STM32WB3x", family: FamilyWB},
+}
+
+// Device identifies an STM32 part by the content of its DBGMCU_IDCODE register.
+type Device struct {
+	DevID  uint16
+	RevID  uint16
+	Name   string
+	Family Family
+	Core   scb.Core
+
+	info deviceInfo
+}
+
+func (d *Device) String() string {
+	return fmt.Sprintf("%s (%s, DEV_ID 0x%03x, REV_ID 0x%04x)", d.Name, d.Core, d.DevID, d.RevID)
+}
+
+// identify reads DBGMCU_IDCODE from the address matching the core type and looks
+// up the device.
+func identify(s *swd.SWD) (*Device, error) {
+	cpuid, err := scb.New(s).ReadCPUID()
+	if err != nil {
+		return nil, fmt.Errorf("read CPUID: %w", err)
+	}
+
+	core := cpuid.Core()
+
+	reg := regIDCode
+	if core == scb.CoreCortexM0 || core == scb.CoreCortexM0Plus {
+		reg = regIDCodeM0
+	}
+
+	idcode, err := s.ReadRegister(reg)
+	if err != nil {
+		return nil, fmt.Errorf("read IDCODE: %w", err)
+	}
+
+	// The H7 series does not implement the DBGMCU at the Cortex-M7 location
+	if idcode&idcodeDevIDMask == 0 && core == scb.CoreCortexM7 {
+		if idcode, err = s.ReadRegister(regIDCodeH7); err != nil {
+			return nil, fmt.Errorf("read IDCODE: %w", err)
+		}
+	}
+
+	dev := &Device{
+		DevID: uint16(idcode & idcodeDevIDMask),
+		RevID: uint16(idcode >> idcodeRevIDShift),
+		Core:  core,
+	}
+
+	info, ok := deviceIDs[dev.DevID]
+	if !ok {
+		return dev, fmt.Errorf("%w: DEV_ID 0x%03x", ErrUnknownDevice, dev.DevID)
+	}
+
+	dev.Name = info.name
+	dev.Family = info.family
+	dev.info = info
+
+	return dev, nil
+}
+
+// familyInfo returns the register addresses of the device.
+func (d *Device) familyInfo() familyInfo {
+	fi := families[d.Family]
+
+	if d.info.flashSizeAddr != 0 {
+		fi.flashSizeAddr = d.info.flashSizeAddr
+	}
+
+	if d.info.uidAddr != 0 {
+		fi.uidAddr = d.info.uidAddr
+	}
+
+	return fi
+}
+
+// readHalfWord reads a 16-bit value from any half word aligned address.
+func readHalfWord(s *swd.SWD, addr uint32) (uint16, error) {
+	v, err := s.ReadRegister(addr &^ 3)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint16(v >> ((addr & 3) * 8)), nil
+}
+
+// readFlashSize returns the size of the main flash in bytes.
+func readFlashSize(s *swd.SWD, dev *Device) (uint32, error) {
+	kb, err := readHalfWord(s, dev.familyInfo().flashSizeAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(kb) * 1024, nil
+}
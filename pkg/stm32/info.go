@@ -0,0 +1,91 @@
+package stm32
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// Offsets of the unique ID words on families that do not store them contiguously
+var uidSplitOffsets = [3]uint32{0x00, 0x04, 0x14}
+
+// Info holds the identification data of a device.
+type Info struct {
+	Device *Device
+
+	// Size of the main flash in bytes
+	FlashSize uint32
+
+	// 96-bit unique device ID as stored in memory, least significant word first
+	UID [12]byte
+
+	// Package code as defined in the reference manual of the family
+	Package    uint8
+	HasPackage bool
+}
+
+// UIDString returns the unique ID in the notation of the reference manuals,
+// most significant word first.
+func (i *Info) UIDString() string {
+	var b [12]byte
+
+	for w := 0; w < 3; w++ {
+		for n := 0; n < 4; n++ {
+			b[w*4+n] = i.UID[(2-w)*4+3-n]
+		}
+	}
+
+	return hex.EncodeToString(b[:])
+}
+
+func (i *Info) String() string {
+	s := fmt.Sprintf("%s, %d KB flash, UID %s", i.Device, i.FlashSize/1024, i.UIDString())
+
+	if i.HasPackage {
+		s += fmt.Sprintf(", package 0x%02x", i.Package)
+	}
+
+	return s
+}
+
+// Info identifies the device and reads its flash size, unique ID and package.
+func (stm *STM32) Info() (*Info, error) {
+	dev, err := identify(stm.swd)
+	if err != nil {
+		return nil, err
+	}
+
+	fi := dev.familyInfo()
+	info := &Info{Device: dev}
+
+	if info.FlashSize, err = readFlashSize(stm.swd, dev); err != nil {
+		return nil, fmt.Errorf("read flash size: %w", err)
+	}
+
+	for w := uint32(0); w < 3; w++ {
+		addr := fi.uidAddr + w*4
+		if fi.uidSplit {
+			addr = fi.uidAddr + uidSplitOffsets[w]
+		}
+
+		v, err := stm.swd.ReadRegister(addr)
+		if err != nil {
+			return nil, fmt.Errorf("read unique ID: %w", err)
+		}
+
+		for n := uint32(0); n < 4; n++ {
+			info.UID[w*4+n] = byte(v >> (n * 8))
+		}
+	}
+
+	if fi.packageAddr != 0 {
+		v, err := stm.swd.ReadRegister(fi.packageAddr)
+		if err != nil {
+			return nil, fmt.Errorf("read package: %w", err)
+		}
+
+		info.Package = uint8(v & fi.packageMask)
+		info.HasPackage = true
+	}
+
+	return info, nil
+}
@@ -0,0 +1,309 @@
+package stm32
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+)
+
+//go:generate sh -c "llvm-mc -triple=thumbv6m-none-eabi -filetype=obj -o stub/l4.o stub/l4.S && llvm-objcopy -O binary -j .text stub/l4.o stub/l4.bin && rm stub/l4.o"
+//go:generate sh -c "llvm-mc -triple=thumbv6m-none-eabi -filetype=obj -o stub/crc.o stub/crc.S && llvm-objcopy -O binary -j .text stub/crc.o stub/crc.bin && rm stub/crc.o"
+
+//go:embed stub/l4.bin
+var l4LoaderStub []byte
+
+//go:embed stub/crc.bin
+var crcStub []byte
+
+const (
+	// Mailbox layout, see stub/l4.S
+	mailboxStatusReg  = 0x00
+	mailboxErrorMask  = 0x04
+	mailboxStatus     = 0x08
+	mailboxSlots      = 0x0c
+	mailboxSlotSize   = 0x10
+	mailboxSize       = mailboxSlots + 2*mailboxSlotSize
+	slotState         = 0x00
+	slotAddress       = 0x04
+	slotLength        = 0x08
+	slotBuffer        = 0x0c
+	slotStateEmpty    = 0
+	slotStateFull     = 1
+	slotStateStop     = 2
+	loaderSlotTimeout = time.Second
+
+	xpsrThumb = 1 << 24
+	// PRIMASK in the special purpose register
+	specialPrimask = 1 << 0
+)
+
+// loaderStub describes a flash loader for a controller.
+type loaderStub struct {
+	code []byte
+	// Flash status register and its error bits, polled by the stub
+	statusReg uint32
+	errorMask uint32
+}
+
+// loaderController is implemented by controllers that can program through a
+// loader stub running on the target.
+type loaderController interface {
+	loaderStub() loaderStub
+	// beginLoader unlocks the controller and enables programming
+	beginLoader() error
+	endLoader() error
+}
+
+// SetLoaderRAM enables the RAM-resident flash loader. The stub, its mailbox and
+// two data buffers are placed in size bytes of RAM at addr, which the firmware
+// must not rely on. Programming with the loader runs the core, so its registers
+// are clobbered. A size of 0 disables the loader.
+func (f *Flash) SetLoaderRAM(addr, size uint32) {
+	f.loaderAddr = addr
+	f.loaderSize = size
+}
+
+// loader returns the loader controller if the loader is enabled and supported.
+func (f *Flash) loader() (loaderController, bool) {
+	if f.loaderSize == 0 {
+		return nil, false
+	}
+
+	lc, ok := f.ctrl.(loaderController)
+
+	return lc, ok
+}
+
+// loaderLayout returns the addresses of the mailbox and the buffers, and the
+// size of each buffer.
+func (f *Flash) loaderLayout(stub loaderStub) (mailbox uint32, buffers [2]uint32, size uint32, err error) {
+	mailbox = f.loaderAddr + (uint32(len(stub.code))+3)&^3
+	start := mailbox + mailboxSize
+
+	size = (f.loaderAddr + f.loaderSize - start) / 2 &^ (f.ctrl.writeSize() - 1)
+	if f.loaderAddr+f.loaderSize < start || size < f.ctrl.writeSize() {
+		return 0, buffers, 0, fmt.Errorf("loader RAM of %d bytes too small", f.loaderSize)
+	}
+
+	return mailbox, [2]uint32{start, start + size}, size, nil
+}
+
+// programWithLoader downloads the stub and feeds it data through the mailbox.
+// While the core programs one buffer, the host fills the other.
+func (f *Flash) programWithLoader(lc loaderController, offset uint32, data []byte, tr *Tracker) error {
+	stub := lc.loaderStub()
+	core := cd.New(f.swd)
+
+	mailbox, buffers, bufSize, err := f.loaderLayout(stub)
+	if err != nil {
+		return err
+	}
+
+	if err := core.Halt(); err != nil {
+		return fmt.Errorf("halt: %w", err)
+	}
+
+	if err := f.swd.WriteMemory(f.loaderAddr, stub.code); err != nil {
+		return fmt.Errorf("download stub: %w", err)
+	}
+
+	header := make([]byte, mailboxSize)
+	binary.LittleEndian.PutUint32(header[mailboxStatusReg:], stub.statusReg)
+	binary.LittleEndian.PutUint32(header[mailboxErrorMask:], stub.errorMask)
+
+	if err := f.swd.WriteMemory(mailbox, header); err != nil {
+		return fmt.Errorf("write mailbox: %w", err)
+	}
+
+	if err := lc.beginLoader(); err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = core.Halt()
+		_ = lc.endLoader()
+	}()
+
+	if err := startStub(core, f.loaderAddr, f.loaderAddr+f.loaderSize, mailbox); err != nil {
+		return err
+	}
+
+	slot := 0
+
+	for i := uint32(0); i < uint32(len(data)); i += bufSize {
+		chunk := data[i:]
+		if uint32(len(chunk)) > bufSize {
+			chunk = chunk[:bufSize]
+		}
+
+		slotAddr := mailbox + mailboxSlots + uint32(slot)*mailboxSlotSize
+
+		if err := f.waitSlot(core, mailbox, slotAddr); err != nil {
+			return fmt.Errorf("write 0x%08x: %w", FlashBaseAddr+offset+i, err)
+		}
+
+		if err := f.swd.WriteMemory(buffers[slot], chunk); err != nil {
+			return err
+		}
+
+		desc := make([]byte, mailboxSlotSize)
+		binary.LittleEndian.PutUint32(desc[slotAddress:], FlashBaseAddr+offset+i)
+		binary.LittleEndian.PutUint32(desc[slotLength:], uint32(len(chunk)))
+		binary.LittleEndian.PutUint32(desc[slotBuffer:], buffers[slot])
+
+		if err := f.swd.WriteMemory(slotAddr, desc); err != nil {
+			return err
+		}
+
+		// The state is written last, it hands the slot over to the stub
+		if err := f.swd.WriteRegister(slotAddr+slotState, slotStateFull); err != nil {
+			return err
+		}
+
+		tr.Add(uint32(len(chunk)))
+		slot ^= 1
+	}
+
+	// The stub moves on to the other slot once the last one is done
+	for i := 0; i < 2; i++ {
+		slotAddr := mailbox + mailboxSlots + uint32(slot)*mailboxSlotSize
+
+		if err := f.waitSlot(core, mailbox, slotAddr); err != nil {
+			return err
+		}
+
+		slot ^= 1
+	}
+
+	if err := f.swd.WriteRegister(mailbox+mailboxSlots+uint32(slot)*mailboxSlotSize, slotStateStop); err != nil {
+		return err
+	}
+
+	return f.waitLoaderHalt(core, mailbox)
+}
+
+// stubRegisters are the core registers startStub and the stubs modify.
+var stubRegisters = []cd.CoreRegister{
+	cd.CoreRegisterR0, cd.CoreRegisterR1, cd.CoreRegisterR2, cd.CoreRegisterR3,
+	cd.CoreRegisterSP, cd.CoreRegisterPC, cd.CoreRegisterXPSR, cd.CoreRegisterSpecial,
+}
+
+// saveRegisters reads the registers of the halted core that a stub modifies.
+func saveRegisters(core *cd.CoreDebug) (map[cd.CoreRegister]uint32, error) {
+	saved := map[cd.CoreRegister]uint32{}
+
+	for _, reg := range stubRegisters {
+		v, err := core.ReadCoreRegister(reg)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", reg, err)
+		}
+
+		saved[reg] = v
+	}
+
+	return saved, nil
+}
+
+// restoreRegisters writes back registers read by saveRegisters.
+func restoreRegisters(core *cd.CoreDebug, saved map[cd.CoreRegister]uint32) error {
+	for _, reg := range stubRegisters {
+		if err := core.WriteCoreRegister(reg, saved[reg]); err != nil {
+			return fmt.Errorf("write %s: %w", reg, err)
+		}
+	}
+
+	return nil
+}
+
+// startStub runs the code at entry on the halted core, with args in r0 and up.
+// Interrupts are masked, so the firmware's handlers can not run while the stub
+// owns the core, its RAM and the flash controller.
+func startStub(core *cd.CoreDebug, entry, sp uint32, args ...uint32) error {
+	special, err := core.ReadCoreRegister(cd.CoreRegisterSpecial)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", cd.CoreRegisterSpecial, err)
+	}
+
+	regs := map[cd.CoreRegister]uint32{
+		cd.CoreRegisterPC:      entry,
+		cd.CoreRegisterXPSR:    xpsrThumb,
+		cd.CoreRegisterSP:      sp,
+		cd.CoreRegisterSpecial: special | specialPrimask,
+	}
+
+	for i, arg := range args {
+		regs[cd.CoreRegisterR0+cd.CoreRegister(i)] = arg
+	}
+
+	for reg, val := range regs {
+		if err := core.WriteCoreRegister(reg, val); err != nil {
+			return fmt.Errorf("write %s: %w", reg, err)
+		}
+	}
+
+	if err := core.Continue(); err != nil {
+		return fmt.Errorf("start stub: %w", err)
+	}
+
+	return nil
+}
+
+// waitSlot waits until the stub has emptied a slot.
+func (f *Flash) waitSlot(core *cd.CoreDebug, mailbox, slotAddr uint32) error {
+	start := time.Now()
+
+	for time.Since(start) < loaderSlotTimeout {
+		state, err := f.swd.ReadRegister(slotAddr + slotState)
+		if err != nil {
+			return err
+		}
+
+		if state == slotStateEmpty {
+			return nil
+		}
+
+		if dhcsr, err := core.ReadDHCSR(); err != nil {
+			return err
+		} else if dhcsr&cd.DHCSRSHalt != 0 {
+			if err := f.loaderStatus(mailbox); err != nil {
+				return err
+			}
+
+			return fmt.Errorf("loader halted unexpectedly")
+		}
+	}
+
+	return fmt.Errorf("loader: %w", ErrTimeout)
+}
+
+// waitLoaderHalt waits for the stub to halt after the stop request.
+func (f *Flash) waitLoaderHalt(core *cd.CoreDebug, mailbox uint32) error {
+	start := time.Now()
+
+	for time.Since(start) < loaderSlotTimeout {
+		if dhcsr, err := core.ReadDHCSR(); err != nil {
+			return err
+		} else if dhcsr&cd.DHCSRSHalt != 0 {
+			return f.loaderStatus(mailbox)
+		}
+	}
+
+	return fmt.Errorf("loader: %w", ErrTimeout)
+}
+
+// loaderStatus returns the error reported by a halted stub, if any.
+func (f *Flash) loaderStatus(mailbox uint32) error {
+	status, err := f.swd.ReadRegister(mailbox + mailboxStatus)
+	if err != nil {
+		return err
+	}
+
+	if status == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("loader: programming failed, SR 0x%08x", status)
+}
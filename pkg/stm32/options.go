@@ -0,0 +1,152 @@
+package stm32
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrIrreversible is returned for option byte changes that permanently lock the
+// device unless they are explicitly confirmed.
+var ErrIrreversible = errors.New("irreversible option byte change")
+
+// RDPLevel is the readout protection level as encoded in the option bytes. All
+// values other than RDPLevel0 and RDPLevel2 select level 1.
+type RDPLevel uint8
+
+const (
+	RDPLevel0 RDPLevel = 0xaa
+	RDPLevel1 RDPLevel = 0xbb
+	RDPLevel2 RDPLevel = 0xcc
+)
+
+// Level returns the protection level 0, 1 or 2.
+func (l RDPLevel) Level() int {
+	switch l {
+	case RDPLevel0:
+		return 0
+	case RDPLevel2:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (l RDPLevel) String() string {
+	return fmt.Sprintf("level %d (0x%02x)", l.Level(), uint8(l))
+}
+
+// WRPArea is a write protected range of pages. The area is disabled if Start is
+// greater than End.
+type WRPArea struct {
+	Bank int
+	// Page numbers within the bank
+	Start, End uint32
+}
+
+// Enabled reports whether the area protects any page.
+func (a WRPArea) Enabled() bool {
+	return a.Start <= a.End
+}
+
+func (a WRPArea) String() string {
+	if !a.Enabled() {
+		return fmt.Sprintf("bank %d: disabled", a.Bank+1)
+	}
+
+	return fmt.Sprintf("bank %d: pages %d-%d", a.Bank+1, a.Start, a.End)
+}
+
+// PCROPArea is a proprietary code readout protection range. Start and End are
+// the register values, their unit depends on the family.
+type PCROPArea struct {
+	Bank       int
+	Start, End uint32
+}
+
+// OptionBytes holds the user option bytes. Fields that do not exist on a family
+// are ignored when programming.
+type OptionBytes struct {
+	RDP RDPLevel
+	// Brown-out reset configuration as encoded in the option register
+	BORLevel uint8
+
+	// Reset when entering Stop or Standby mode
+	NRstStop  bool
+	NRstStdby bool
+	// Watchdog started by software instead of hardware
+	IWDGSW bool
+
+	NBoot0   bool
+	NBoot1   bool
+	NSWBoot0 bool
+
+	// Flash organized in two banks, only reported
+	DualBank bool
+	// Boot from bank 2, which is mapped at the flash base address
+	BankSwap bool
+
+	WRP   []WRPArea
+	PCROP []PCROPArea
+	// Remove the PCROP areas when regressing from RDP level 1 to 0
+	PCROPRDP bool
+
+	// Raw option register. Bits not covered by the fields above are kept when
+	// programming.
+	OPTR uint32
+}
+
+// optionBytesController is implemented by controllers that support option bytes.
+type optionBytesController interface {
+	readOptionBytes() (*OptionBytes, error)
+	readProtection() (RDPLevel, error)
+	programOptionBytes(ob *OptionBytes) error
+	// launchOptionBytes reloads the option bytes, which resets the device
+	launchOptionBytes() error
+}
+
+func (f *Flash) optionBytesController() (optionBytesController, error) {
+	ctrl, err := f.controller()
+	if err != nil {
+		return nil, err
+	}
+
+	obc, ok := ctrl.(optionBytesController)
+	if !ok {
+		return nil, fmt.Errorf("%w: option bytes not supported on %s", ErrUnsupportedDevice, f.device)
+	}
+
+	return obc, nil
+}
+
+// ReadOptionBytes returns the option bytes currently in effect.
+func (f *Flash) ReadOptionBytes() (*OptionBytes, error) {
+	obc, err := f.optionBytesController()
+	if err != nil {
+		return nil, err
+	}
+
+	return obc.readOptionBytes()
+}
+
+// ProgramOptionBytes writes the option bytes and reloads them, which resets the
+// device and usually drops the debug connection. Setting RDP level 2 disables
+// the debug port forever and is refused unless confirmIrreversible is set.
+func (f *Flash) ProgramOptionBytes(ob *OptionBytes, confirmIrreversible bool) error {
+	if ob.RDP == RDPLevel2 && !confirmIrreversible {
+		return fmt.Errorf("%w: RDP level 2 can never be removed", ErrIrreversible)
+	}
+
+	obc, err := f.optionBytesController()
+	if err != nil {
+		return err
+	}
+
+	if err := obc.programOptionBytes(ob); err != nil {
+		return err
+	}
+
+	// The device needs to be identified again after the reset
+	f.ctrl = nil
+
+	return obc.launchOptionBytes()
+}
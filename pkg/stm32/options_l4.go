@@ -0,0 +1,307 @@
+package stm32
+
+import "fmt"
+
+const (
+	optrRDPMask = 0xff
+	wrpEndShift = 16
+	pcropRDP    = 1 << 31
+)
+
+// l4OptionLayout describes the option register bits of a family.
+type l4OptionLayout struct {
+	borShift uint32
+	borMask  uint32
+
+	nRstStop  uint32
+	nRstStdby uint32
+	iwdgSW    uint32
+	nBoot0    uint32
+	nBoot1    uint32
+	nSWBoot0  uint32
+	// The G0 nBOOT_SEL bit has the opposite meaning of nSWBOOT0
+	invertSWBoot0 bool
+
+	wrpMask   uint32
+	pcropMask uint32
+	// Bank 1 has a second PCROP area instead of a PCROP area in bank 2
+	pcropAreaB bool
+}
+
+var l4OptionLayouts = map[Family]l4OptionLayout{
+	FamilyG0: {
+		borShift: 8, borMask: 0x1f,
+		nRstStop: 1 << 13, nRstStdby: 1 << 14, iwdgSW: 1 << 16,
+		nBoot0: 1 << 26, nBoot1: 1 << 25, nSWBoot0: 1 << 24, invertSWBoot0: true,
+		wrpMask: 0x7f, pcropMask: 0x1ff, pcropAreaB: true,
+	},
+	FamilyG4: {
+		borShift: 8, borMask: 0x7,
+		nRstStop: 1 << 12, nRstStdby: 1 << 13, iwdgSW: 1 << 16,
+		nBoot0: 1 << 27, nBoot1: 1 << 23, nSWBoot0: 1 << 26,
+		wrpMask: 0xff, pcropMask: 0x7fff,
+	},
+	FamilyL4: {
+		borShift: 8, borMask: 0x7,
+		nRstStop: 1 << 12, nRstStdby: 1 << 13, iwdgSW: 1 << 16,
+		nBoot0: 1 << 27, nBoot1: 1 << 23, nSWBoot0: 1 << 26,
+		wrpMask: 0xff, pcropMask: 0xffff,
+	},
+	FamilyWB: {
+		borShift: 9, borMask: 0x7,
+		nRstStop: 1 << 12, nRstStdby: 1 << 13, iwdgSW: 1 << 16,
+		nBoot0: 1 << 27, nBoot1: 1 << 23, nSWBoot0: 1 << 26,
+		wrpMask: 0xff, pcropMask: 0x1ff, pcropAreaB: true,
+	},
+}
+
+type wrpRegister struct {
+	bank int
+	addr uint32
+}
+
+type pcropRegisters struct {
+	bank       int
+	start, end uint32
+}
+
+// wrpRegisters returns the WRP area registers in the order of OptionBytes.WRP.
+// The bank 2 areas are only in effect in dual bank mode.
+func (f *flashL4) wrpRegisters() []wrpRegister {
+	regs := []wrpRegister{{0, regWRP1AR}, {0, regWRP1BR}}
+
+	if f.geometry.Banks > 1 {
+		regs = append(regs, wrpRegister{1, regWRP2AR}, wrpRegister{1, regWRP2BR})
+	}
+
+	return regs
+}
+
+// pcropRegisters returns the PCROP registers in the order of OptionBytes.PCROP.
+func (f *flashL4) pcropRegisters(layout l4OptionLayout) []pcropRegisters {
+	regs := []pcropRegisters{{0, regPCROP1SR, regPCROP1ER}}
+
+	switch {
+	case layout.pcropAreaB:
+		regs = append(regs, pcropRegisters{0, regPCROP1BSR, regPCROP1BER})
+	case f.geometry.Banks > 1:
+		regs = append(regs, pcropRegisters{1, regPCROP2SR, regPCROP2ER})
+	}
+
+	return regs
+}
+
+func (l l4OptionLayout) decode(optr uint32) *OptionBytes {
+	ob := &OptionBytes{
+		RDP:       RDPLevel(optr & optrRDPMask),
+		BORLevel:  uint8((optr >> l.borShift) & l.borMask),
+		NRstStop:  optr&l.nRstStop != 0,
+		NRstStdby: optr&l.nRstStdby != 0,
+		IWDGSW:    optr&l.iwdgSW != 0,
+		NBoot0:    optr&l.nBoot0 != 0,
+		NBoot1:    optr&l.nBoot1 != 0,
+		NSWBoot0:  (optr&l.nSWBoot0 != 0) != l.invertSWBoot0,
+		OPTR:      optr,
+	}
+
+	return ob
+}
+
+func (l l4OptionLayout) encode(ob *OptionBytes) uint32 {
+	optr := ob.OPTR&^optrRDPMask | uint32(ob.RDP)
+
+	optr &^= l.borMask << l.borShift
+	optr |= (uint32(ob.BORLevel) & l.borMask) << l.borShift
+
+	set := func(bit uint32, v bool) {
+		if v {
+			optr |= bit
+		} else {
+			optr &^= bit
+		}
+	}
+
+	set(l.nRstStop, ob.NRstStop)
+	set(l.nRstStdby, ob.NRstStdby)
+	set(l.iwdgSW, ob.IWDGSW)
+	set(l.nBoot0, ob.NBoot0)
+	set(l.nBoot1, ob.NBoot1)
+	set(l.nSWBoot0, ob.NSWBoot0 != l.invertSWBoot0)
+
+	return optr
+}
+
+func (f *flashL4) optionLayout() (l4OptionLayout, error) {
+	layout, ok := l4OptionLayouts[f.family]
+	if !ok {
+		return layout, fmt.Errorf("%w: no option byte layout for %s", ErrUnsupportedDevice, f.family)
+	}
+
+	return layout, nil
+}
+
+func (f *flashL4) readOptionBytes() (*OptionBytes, error) {
+	layout, err := f.optionLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	optr, err := f.swd.ReadRegister(regOPTR)
+	if err != nil {
+		return nil, fmt.Errorf("read OPTR: %w", err)
+	}
+
+	ob := layout.decode(optr)
+	ob.DualBank = f.geometry.Banks > 1
+
+	if opt := f.layout.bankSwapOption; opt != 0 {
+		ob.BankSwap = (optr&opt != 0) != f.layout.invertBankSwap
+	}
+
+	for _, reg := range f.wrpRegisters() {
+		v, err := f.swd.ReadRegister(reg.addr)
+		if err != nil {
+			return nil, fmt.Errorf("read WRP: %w", err)
+		}
+
+		ob.WRP = append(ob.WRP, WRPArea{
+			Bank:  reg.bank,
+			Start: v & layout.wrpMask,
+			End:   (v >> wrpEndShift) & layout.wrpMask,
+		})
+	}
+
+	for i, reg := range f.pcropRegisters(layout) {
+		start, err := f.swd.ReadRegister(reg.start)
+		if err != nil {
+			return nil, fmt.Errorf("read PCROP: %w", err)
+		}
+
+		end, err := f.swd.ReadRegister(reg.end)
+		if err != nil {
+			return nil, fmt.Errorf("read PCROP: %w", err)
+		}
+
+		if i == 0 {
+			ob.PCROPRDP = end&pcropRDP != 0
+		}
+
+		ob.PCROP = append(ob.PCROP, PCROPArea{
+			Bank:  reg.bank,
+			Start: start & layout.pcropMask,
+			End:   end & layout.pcropMask,
+		})
+	}
+
+	return ob, nil
+}
+
+func (f *flashL4) readProtection() (RDPLevel, error) {
+	optr, err := f.swd.ReadRegister(regOPTR)
+	if err != nil {
+		return 0, fmt.Errorf("read OPTR: %w", err)
+	}
+
+	return RDPLevel(optr & optrRDPMask), nil
+}
+
+// unlockOptions clears the OPTLOCK bit, which requires an unlocked controller.
+func (f *flashL4) unlockOptions() error {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+
+	cr, err := f.swd.ReadRegister(regCR)
+	if err != nil {
+		return err
+	}
+
+	if controlRegister(cr)&controlRegisterOptLock == 0 {
+		return nil
+	}
+
+	if err := f.swd.WriteRegister(regOPTKEYR, optionKey1); err != nil {
+		return err
+	}
+
+	return f.swd.WriteRegister(regOPTKEYR, optionKey2)
+}
+
+func (f *flashL4) programOptionBytes(ob *OptionBytes) error {
+	layout, err := f.optionLayout()
+	if err != nil {
+		return err
+	}
+
+	wrpRegs := f.wrpRegisters()
+	pcropRegs := f.pcropRegisters(layout)
+
+	if len(ob.WRP) != len(wrpRegs) || len(ob.PCROP) != len(pcropRegs) {
+		return fmt.Errorf("option bytes must hold %d WRP and %d PCROP areas", len(wrpRegs), len(pcropRegs))
+	}
+
+	if err := f.unlockOptions(); err != nil {
+		return fmt.Errorf("unlock option bytes: %w", err)
+	}
+
+	optr := layout.encode(ob)
+
+	if opt := f.layout.bankSwapOption; opt != 0 {
+		if ob.BankSwap != f.layout.invertBankSwap {
+			optr |= opt
+		} else {
+			optr &^= opt
+		}
+	}
+
+	if err := f.swd.WriteRegister(regOPTR, optr); err != nil {
+		return err
+	}
+
+	for i, reg := range wrpRegs {
+		area := ob.WRP[i]
+		v := area.Start&layout.wrpMask | (area.End&layout.wrpMask)<<wrpEndShift
+
+		if err := f.swd.WriteRegister(reg.addr, v); err != nil {
+			return err
+		}
+	}
+
+	for i, reg := range pcropRegs {
+		area := ob.PCROP[i]
+		end := area.End & layout.pcropMask
+
+		if i == 0 && ob.PCROPRDP {
+			end |= pcropRDP
+		}
+
+		if err := f.swd.WriteRegister(reg.start, area.Start&layout.pcropMask); err != nil {
+			return err
+		}
+
+		if err := f.swd.WriteRegister(reg.end, end); err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		_ = f.swd.WriteRegister(regCR, 0)
+	}()
+
+	if err := f.swd.WriteRegister(regCR, uint32(controlRegisterOptionStart|controlRegisterEndOfOperation)); err != nil {
+		return err
+	}
+
+	return f.waitForCompletion()
+}
+
+func (f *flashL4) launchOptionBytes() error {
+	f.isWritable = false
+
+	// The device resets immediately, so the write is usually not acknowledged.
+	// Writing 0 to the lock bits has no effect, so the option bytes stay unlocked
+	// for the launch.
+	_ = f.swd.WriteRegister(regCR, uint32(controlRegisterOptionLoad))
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package stm32
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const otpLocked = 0x00
+
+var (
+	ErrOTPProgrammed = errors.New("OTP already programmed")
+	ErrOTPLocked     = errors.New("OTP block locked")
+)
+
+// otpLayout describes the one-time programmable area of a family.
+type otpLayout struct {
+	addr uint32
+	size uint32
+	// One lock byte per block, 0 if the area can not be locked
+	lockAddr  uint32
+	blockSize uint32
+}
+
+var otpLayouts = map[Family]otpLayout{
+	FamilyF2: {addr: 0x1fff7800, size: 512, lockAddr: 0x1fff7a00, blockSize: 32},
+	FamilyF4: {addr: 0x1fff7800, size: 512, lockAddr: 0x1fff7a00, blockSize: 32},
+	FamilyF7: {addr: 0x1ff0f000, size: 1024, lockAddr: 0x1ff0f400, blockSize: 64},
+	FamilyG0: {addr: 0x1fff7000, size: 1024},
+	FamilyG4: {addr: 0x1fff7000, size: 1024},
+	FamilyL4: {addr: 0x1fff7000, size: 1024},
+	FamilyWB: {addr: 0x1fff7000, size: 1024},
+}
+
+// The STM32F72x/F73x have an F4 style OTP area at a different address
+var otpDeviceLayouts = map[uint16]otpLayout{
+	0x452: {addr: 0x1ff07800, size: 512, lockAddr: 0x1ff07a00, blockSize: 32},
+}
+
+// OTPWrite is a single programming operation in the OTP area.
+type OTPWrite struct {
+	// Absolute address
+	Addr uint32
+	Data []byte
+}
+
+func (w OTPWrite) String() string {
+	return fmt.Sprintf("0x%08x: % x", w.Addr, w.Data)
+}
+
+func (f *Flash) otpLayout() (otpLayout, controller, error) {
+	ctrl, err := f.controller()
+	if err != nil {
+		return otpLayout{}, nil, err
+	}
+
+	layout, ok := otpDeviceLayouts[f.device.DevID]
+	if !ok {
+		layout, ok = otpLayouts[f.device.Family]
+	}
+
+	if !ok {
+		return otpLayout{}, nil, fmt.Errorf("%w: no OTP area on %s", ErrUnsupportedDevice, f.device)
+	}
+
+	return layout, ctrl, nil
+}
+
+// OTPSize returns the size of the OTP area in bytes and the number of blocks
+// that can be locked, 0 if the area has no lock bytes.
+func (f *Flash) OTPSize() (size uint32, blocks int, err error) {
+	layout, _, err := f.otpLayout()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if layout.lockAddr != 0 {
+		blocks = int(layout.size / layout.blockSize)
+	}
+
+	return layout.size, blocks, nil
+}
+
+// ReadOTP reads size bytes at offset into the OTP area.
+func (f *Flash) ReadOTP(offset, size uint32) ([]byte, error) {
+	layout, _, err := f.otpLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > layout.size || size > layout.size-offset {
+		return nil, fmt.Errorf("0x%x bytes at offset 0x%x outside of the %d byte OTP area", size, offset, layout.size)
+	}
+
+	buf := make([]byte, size)
+
+	if err := f.swd.ReadMemory(layout.addr+offset, buf); err != nil {
+		return nil, fmt.Errorf("read OTP: %w", err)
+	}
+
+	return buf, nil
+}
+
+// ProgramOTP programs data at offset into the OTP area. Both must be aligned to
+// the programming granularity, double words on G0/G4/L4/WB and words on
+// F2/F4/F7. Each unit that is already programmed with different data makes
+// ProgramOTP fail before anything is written, as do locked blocks. Units that
+// already hold the data or would stay erased are skipped. The remaining writes
+// are returned; with dryRun set, they are only reported.
+func (f *Flash) ProgramOTP(offset uint32, data []byte, dryRun bool) ([]OTPWrite, error) {
+	layout, ctrl, err := f.otpLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	unit := ctrl.writeSize()
+
+	if offset%unit != 0 || uint32(len(data))%unit != 0 {
+		return nil, fmt.Errorf("OTP data must be aligned to %d bytes", unit)
+	}
+
+	current, err := f.ReadOTP(offset, uint32(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := f.otpLocks(layout)
+	if err != nil {
+		return nil, err
+	}
+
+	var writes []OTPWrite
+
+	for i := uint32(0); i < uint32(len(data)); i += unit {
+		addr := layout.addr + offset + i
+		want, cur := data[i:i+unit], current[i:i+unit]
+
+		if bytes.Equal(want, cur) {
+			continue
+		}
+
+		if !erased(cur) {
+			return nil, fmt.Errorf("%w: 0x%08x holds % x", ErrOTPProgrammed, addr, cur)
+		}
+
+		if erased(want) {
+			continue
+		}
+
+		if locked != nil {
+			if block := (offset + i) / layout.blockSize; locked[block] {
+				return nil, fmt.Errorf("%w: block %d", ErrOTPLocked, block)
+			}
+		}
+
+		// Merge adjacent units into one write
+		if n := len(writes); n > 0 && writes[n-1].Addr+uint32(len(writes[n-1].Data)) == addr {
+			writes[n-1].Data = append(writes[n-1].Data, want...)
+		} else {
+			writes = append(writes, OTPWrite{Addr: addr, Data: append([]byte{}, want...)})
+		}
+	}
+
+	if dryRun || len(writes) == 0 {
+		return writes, nil
+	}
+
+	return writes, f.programOTP(ctrl, writes)
+}
+
+// programOTP programs and verifies writes outside of the main flash.
+func (f *Flash) programOTP(ctrl controller, writes []OTPWrite) error {
+	// Fast programming only works on the main flash
+	if fp, ok := ctrl.(fastProgrammer); ok && f.fastProgramming {
+		fp.setFastProgramming(false)
+		defer fp.setFastProgramming(true)
+	}
+
+	var total uint32
+	for _, w := range writes {
+		total += uint32(len(w.Data))
+	}
+
+	tr := f.newTracker(PhaseWrite, total)
+
+	for _, w := range writes {
+		if err := ctrl.program(w.Addr-FlashBaseAddr, w.Data, tr); err != nil {
+			return fmt.Errorf("program OTP at 0x%08x: %w", w.Addr, err)
+		}
+
+		buf := make([]byte, len(w.Data))
+
+		if err := f.swd.ReadMemory(w.Addr, buf); err != nil {
+			return err
+		}
+
+		if i := mismatch(buf, w.Data); i >= 0 {
+			return fmt.Errorf("%w at 0x%08x", ErrVerify, w.Addr+uint32(i))
+		}
+	}
+
+	tr.Finish()
+
+	return nil
+}
+
+// OTPLocked returns the lock state of each OTP block.
+func (f *Flash) OTPLocked() ([]bool, error) {
+	layout, _, err := f.otpLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	if layout.lockAddr == 0 {
+		return nil, fmt.Errorf("%w: OTP area of %s has no lock bytes", ErrUnsupportedDevice, f.device)
+	}
+
+	return f.otpLocks(layout)
+}
+
+// otpLocks reads the lock bytes, it returns nil if the area has none.
+func (f *Flash) otpLocks(layout otpLayout) ([]bool, error) {
+	if layout.lockAddr == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, layout.size/layout.blockSize)
+
+	if err := f.swd.ReadMemory(layout.lockAddr, buf); err != nil {
+		return nil, fmt.Errorf("read OTP lock bytes: %w", err)
+	}
+
+	locked := make([]bool, len(buf))
+	for i, b := range buf {
+		locked[i] = b != flashErasedValue
+	}
+
+	return locked, nil
+}
+
+// LockOTP programs the lock byte of an OTP block, which prevents any further
+// programming of the block. This can not be undone.
+func (f *Flash) LockOTP(block int) error {
+	layout, ctrl, err := f.otpLayout()
+	if err != nil {
+		return err
+	}
+
+	if layout.lockAddr == 0 {
+		return fmt.Errorf("%w: OTP area of %s has no lock bytes", ErrUnsupportedDevice, f.device)
+	}
+
+	if blocks := int(layout.size / layout.blockSize); block < 0 || block >= blocks {
+		return fmt.Errorf("OTP block %d out of range, area has %d blocks", block, blocks)
+	}
+
+	// Lock bytes are programmed in units of the write size. The other lock
+	// bytes of the unit are programmed with their current value, which keeps
+	// them unchanged.
+	unit := ctrl.writeSize()
+	addr := layout.lockAddr + uint32(block)
+	start := addr &^ (unit - 1)
+
+	buf := make([]byte, unit)
+
+	if err := f.swd.ReadMemory(start, buf); err != nil {
+		return fmt.Errorf("read OTP lock bytes: %w", err)
+	}
+
+	if buf[addr-start] != flashErasedValue {
+		return nil
+	}
+
+	buf[addr-start] = otpLocked
+
+	return f.programOTP(ctrl, []OTPWrite{{Addr: start, Data: buf}})
+}
+
+func erased(data []byte) bool {
+	for _, b := range data {
+		if b != flashErasedValue {
+			return false
+		}
+	}
+
+	return true
+}
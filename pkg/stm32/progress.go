@@ -0,0 +1,181 @@
+package stm32
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bytes between two progress reports while writing or verifying
+const progressInterval = 1024
+
+type Phase int
+
+const (
+	PhaseErase Phase = iota
+	PhaseWrite
+	PhaseVerify
+	PhaseScan
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseErase:
+		return "erase"
+	case PhaseWrite:
+		return "write"
+	case PhaseVerify:
+		return "verify"
+	case PhaseScan:
+		return "scan"
+	}
+
+	return fmt.Sprintf("phase(%d)", int(p))
+}
+
+// Progress describes the state of a running flash operation. Total is 0 if the
+// amount of work is not known in advance, as for a mass erase.
+type Progress struct {
+	Phase   Phase
+	Done    uint32
+	Total   uint32
+	Elapsed time.Duration
+
+	// Set in the last report of a phase
+	Finished bool
+}
+
+// Remaining estimates the time until the phase completes, assuming a constant rate.
+func (p Progress) Remaining() time.Duration {
+	if p.Done == 0 || p.Total <= p.Done {
+		return 0
+	}
+
+	return time.Duration(float64(p.Elapsed) * float64(p.Total-p.Done) / float64(p.Done))
+}
+
+// ProgressFunc is called from the goroutine running the flash operation.
+type ProgressFunc func(Progress)
+
+// Summary collects statistics of a flash operation.
+type Summary struct {
+	Erased   uint32
+	Written  uint32
+	Verified uint32
+
+	EraseTime  time.Duration
+	WriteTime  time.Duration
+	VerifyTime time.Duration
+
+	// Transactions repeated because the target was busy
+	Retries uint64
+
+	// Pages left untouched by UpdateImage because they already matched
+	Skipped int
+}
+
+func rate(n uint32, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return float64(n) / d.Seconds()
+}
+
+// WriteRate returns the programming throughput in bytes per second.
+func (s Summary) WriteRate() float64 {
+	return rate(s.Written, s.WriteTime)
+}
+
+// VerifyRate returns the verification throughput in bytes per second.
+func (s Summary) VerifyRate() float64 {
+	return rate(s.Verified, s.VerifyTime)
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("erased %d bytes in %v, wrote %d bytes in %v (%.0f B/s), verified %d bytes in %v (%.0f B/s), %d retries",
+		s.Erased, s.EraseTime.Round(time.Millisecond),
+		s.Written, s.WriteTime.Round(time.Millisecond), s.WriteRate(),
+		s.Verified, s.VerifyTime.Round(time.Millisecond), s.VerifyRate(),
+		s.Retries) + s.skipped()
+}
+
+func (s Summary) skipped() string {
+	if s.Skipped == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(", %d pages unchanged", s.Skipped)
+}
+
+// Tracker reports the progress of a single phase to a ProgressFunc, throttled
+// to one report per progressInterval bytes. It is shared with flash drivers
+// outside of this package.
+type Tracker struct {
+	fn       ProgressFunc
+	phase    Phase
+	total    uint32
+	done     uint32
+	reported uint32
+	start    time.Time
+}
+
+// NewTracker starts a phase with total bytes of work, 0 if unknown. The start
+// is reported immediately, fn may be nil.
+func NewTracker(fn ProgressFunc, phase Phase, total uint32) *Tracker {
+	t := &Tracker{
+		fn:    fn,
+		phase: phase,
+		total: total,
+		start: time.Now(),
+	}
+
+	t.report(false)
+
+	return t
+}
+
+func (f *Flash) newTracker(phase Phase, total uint32) *Tracker {
+	return NewTracker(f.progress, phase, total)
+}
+
+func (t *Tracker) report(finished bool) {
+	t.reported = t.done
+
+	if t.fn != nil {
+		t.fn(Progress{
+			Phase:    t.phase,
+			Done:     t.done,
+			Total:    t.total,
+			Elapsed:  time.Since(t.start),
+			Finished: finished,
+		})
+	}
+}
+
+// Report reports the current state, to show that an operation of unknown
+// duration is still running.
+func (t *Tracker) Report() {
+	t.report(false)
+}
+
+// Add adds n bytes to the work done.
+func (t *Tracker) Add(n uint32) {
+	t.done += n
+
+	if t.done-t.reported >= progressInterval {
+		t.report(false)
+	}
+}
+
+// Done returns the number of bytes done so far.
+func (t *Tracker) Done() uint32 {
+	return t.done
+}
+
+// Finish reports the completion of the phase and returns its duration.
+func (t *Tracker) Finish() time.Duration {
+	t.total = t.done
+	t.report(true)
+
+	return time.Since(t.start)
+}
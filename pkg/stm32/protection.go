@@ -0,0 +1,141 @@
+package stm32
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/holoplot/go-swd/pkg/swd"
+)
+
+const (
+	// Interval between attempts to reconnect after the option bytes were reloaded
+	reconnectInterval = 100 * time.Millisecond
+)
+
+var (
+	ErrReadProtected = errors.New("flash is read protected")
+	ErrNotBlank      = errors.New("flash is not blank")
+)
+
+// ReadProtection returns the readout protection level in effect.
+func (f *Flash) ReadProtection() (RDPLevel, error) {
+	obc, err := f.optionBytesController()
+	if err != nil {
+		return 0, err
+	}
+
+	return obc.readProtection()
+}
+
+// Recover lowers the readout protection of a locked device to level 0. The
+// device erases its entire flash while doing so and resets when the option bytes
+// are reloaded. Recover reconnects within timeout, checks that the protection
+// has been removed and that the flash is blank. Devices at level 0 are left
+// untouched; level 2 can not be recovered.
+func (f *Flash) Recover(timeout time.Duration) error {
+	obc, err := f.optionBytesController()
+	if err != nil {
+		return err
+	}
+
+	ob, err := obc.readOptionBytes()
+	if err != nil {
+		return err
+	}
+
+	switch ob.RDP.Level() {
+	case 0:
+		return nil
+	case 2:
+		return fmt.Errorf("%w: RDP %s is permanent", ErrReadProtected, ob.RDP)
+	}
+
+	tr := f.newTracker(PhaseErase, 0)
+
+	ob.RDP = RDPLevel0
+
+	if err := obc.programOptionBytes(ob); err != nil {
+		return fmt.Errorf("program option bytes: %w", err)
+	}
+
+	f.ctrl = nil
+
+	if err := obc.launchOptionBytes(); err != nil {
+		return err
+	}
+
+	if err := f.reconnect(timeout, tr); err != nil {
+		return err
+	}
+
+	tr.Finish()
+
+	if level, err := f.ReadProtection(); err != nil {
+		return err
+	} else if level != RDPLevel0 {
+		return fmt.Errorf("%w: RDP still at %s after recovery", ErrReadProtected, level)
+	}
+
+	return f.checkBlank()
+}
+
+// reconnect initializes the debug port and the flash driver again after the
+// device has been reset.
+func (f *Flash) reconnect(timeout time.Duration, tr *Tracker) error {
+	var err error
+
+	for time.Since(tr.start) < timeout {
+		time.Sleep(reconnectInterval)
+		tr.report(false)
+
+		if _, err = f.swd.Initialize(); err != nil {
+			continue
+		}
+
+		if err = f.Initialize(); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("reconnect: %w (%v)", ErrTimeout, err)
+}
+
+// checkBlank reads back the entire flash and checks that it is erased.
+func (f *Flash) checkBlank() error {
+	tr := f.newTracker(PhaseVerify, f.geometry.Size)
+	buf := make([]byte, progressInterval)
+
+	for offset := uint32(0); offset < f.geometry.Size; offset += uint32(len(buf)) {
+		addr := FlashBaseAddr + offset
+
+		if err := f.swd.ReadMemory(addr, buf); err != nil {
+			return fmt.Errorf("read 0x%08x: %w", addr, err)
+		}
+
+		for i, b := range buf {
+			if b != flashErasedValue {
+				return fmt.Errorf("%w: 0x%02x at 0x%08x", ErrNotBlank, b, addr+uint32(i))
+			}
+		}
+
+		tr.Add(uint32(len(buf)))
+	}
+
+	tr.Finish()
+
+	return nil
+}
+
+// readProtected wraps a read error with ErrReadProtected if readout protection
+// is the likely cause.
+func (f *Flash) readProtected(err error) error {
+	// A faulting access leaves sticky flags that block further transactions
+	_ = f.swd.Abort(swd.AbortAllFlags())
+
+	if level, perr := f.ReadProtection(); perr == nil && level != RDPLevel0 {
+		return fmt.Errorf("%w: RDP %s: %v", ErrReadProtected, level, err)
+	}
+
+	return err
+}
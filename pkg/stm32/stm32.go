@@ -17,6 +17,11 @@ func (stm *STM32) Flash() *Flash {
 	return stm.flash
 }
 
+// Identify reads the DBGMCU_IDCODE register and returns the device description.
+func (stm *STM32) Identify() (*Device, error) {
+	return identify(stm.swd)
+}
+
 func (stm *STM32) Reset() error {
 	if err := stm.coreDebug.ResetRegisters(); err != nil {
 		return err
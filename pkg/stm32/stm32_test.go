@@ -0,0 +1,901 @@
+package stm32
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/image"
+	"github.com/holoplot/go-swd/pkg/io/sim"
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+func TestProgressRemaining(t *testing.T) {
+	for _, tc := range []struct {
+		p    Progress
+		want time.Duration
+	}{
+		{Progress{Done: 0, Total: 100, Elapsed: time.Second}, 0},
+		{Progress{Done: 25, Total: 100, Elapsed: time.Second}, 3 * time.Second},
+		{Progress{Done: 100, Total: 100, Elapsed: time.Second}, 0},
+		// Unknown total, as for a mass erase
+		{Progress{Done: 100, Total: 0, Elapsed: time.Second}, 0},
+	} {
+		if got := tc.p.Remaining(); got != tc.want {
+			t.Errorf("%+v: got %v, want %v", tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	var reports []Progress
+
+	tr := NewTracker(func(p Progress) { reports = append(reports, p) }, PhaseWrite, 2000)
+
+	// Reported once per progressInterval bytes
+	for i := 0; i < 5; i++ {
+		tr.Add(progressInterval / 4)
+	}
+
+	tr.Add(100)
+	tr.Finish()
+
+	done := uint32(progressInterval*5/4 + 100)
+
+	if tr.Done() != done {
+		t.Errorf("done: got %d", tr.Done())
+	}
+
+	want := []Progress{
+		{Phase: PhaseWrite, Total: 2000},
+		{Phase: PhaseWrite, Done: progressInterval, Total: 2000},
+		{Phase: PhaseWrite, Done: done, Total: done, Finished: true},
+	}
+
+	if len(reports) != len(want) {
+		t.Fatalf("got %d reports: %+v", len(reports), reports)
+	}
+
+	for i := range want {
+		reports[i].Elapsed = 0
+
+		if reports[i] != want[i] {
+			t.Errorf("report %d: got %+v, want %+v", i, reports[i], want[i])
+		}
+	}
+
+	// Without a callback nothing is reported
+	NewTracker(nil, PhaseErase, 0).Finish()
+}
+
+func TestSummaryString(t *testing.T) {
+	s := Summary{
+		Erased:     2048,
+		Written:    1000,
+		Verified:   1000,
+		EraseTime:  100 * time.Millisecond,
+		WriteTime:  2 * time.Second,
+		VerifyTime: 500 * time.Millisecond,
+		Retries:    3,
+	}
+
+	want := "erased 2048 bytes in 100ms, wrote 1000 bytes in 2s (500 B/s), verified 1000 bytes in 500ms (2000 B/s), 3 retries"
+	if got := s.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	s.Skipped = 2
+
+	if got := s.String(); got != want+", 2 pages unchanged" {
+		t.Errorf("skipped: got %q", got)
+	}
+
+	if rate := (Summary{Written: 1000}).WriteRate(); rate != 0 {
+		t.Errorf("rate without time: got %v", rate)
+	}
+}
+
+// newTestFlash simulates a G0/G4/L4/WB device with flashKB of flash and no
+// write protection. Tests set up the registers they need before the flash
+// driver first accesses the device.
+func newTestFlash(idcode, flashKB uint32) (*sim.Target, *Flash) {
+	target := sim.New()
+	target.WriteWord(regIDCode, idcode)
+	target.WriteWord(0x1fff75e0, flashKB)
+
+	for _, reg := range []uint32{regWRP1AR, regWRP1BR, regWRP2AR, regWRP2BR} {
+		target.WriteWord(reg, 0xff)
+	}
+
+	return target, New(swd.New(target)).Flash()
+}
+
+func TestIdentify(t *testing.T) {
+	target := sim.New()
+	target.WriteWord(regIDCode, 0x20036469)
+
+	dev, err := New(swd.New(target)).Identify()
+	if err != nil {
+		t.Fatalf("identify: %v", err)
+	}
+
+	if dev.Family != FamilyG4 || dev.DevID != 0x469 || dev.RevID != 0x2003 {
+		t.Errorf("got %s", dev)
+	}
+
+	target.WriteWord(regIDCode, 0x123)
+
+	if _, err := New(swd.New(target)).Identify(); !errors.Is(err, ErrUnknownDevice) {
+		t.Errorf("unknown device: got %v", err)
+	}
+}
+
+func TestFlashGeometry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		idcode   uint32
+		sizeAddr uint32
+		sizeWord uint32
+		optr     uint32
+		want     Geometry
+	}{
+		{
+			name:     "G4 single bank",
+			idcode:   0x469,
+			sizeAddr: 0x1fff75e0,
+			sizeWord: 512,
+			want:     Geometry{Size: 512 * 1024, Banks: 1, PageSize: 4096},
+		},
+		{
+			name:     "G4 dual bank",
+			idcode:   0x469,
+			sizeAddr: 0x1fff75e0,
+			sizeWord: 512,
+			optr:     1 << 22,
+			want:     Geometry{Size: 512 * 1024, Banks: 2, PageSize: 2048},
+		},
+		{
+			name:     "F4 sectors",
+			idcode:   0x413,
+			sizeAddr: 0x1fff7a20,
+			sizeWord: 1024 << 16,
+			want: Geometry{Size: 1024 * 1024, Banks: 1, Sectors: []uint32{
+				0x4000, 0x4000, 0x4000, 0x4000, 0x10000,
+				0x20000, 0x20000, 0x20000, 0x20000, 0x20000, 0x20000, 0x20000,
+			}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := sim.New()
+			target.WriteWord(regIDCode, tc.idcode)
+			target.WriteWord(tc.sizeAddr, tc.sizeWord)
+			target.WriteWord(regOPTR, tc.optr)
+
+			flash := New(swd.New(target)).Flash()
+
+			if err := flash.Initialize(); err != nil {
+				t.Fatalf("initialize: %v", err)
+			}
+
+			got := flash.Geometry()
+
+			if got.String() != tc.want.String() || len(got.Sectors) != len(tc.want.Sectors) {
+				t.Fatalf("got %s, want %s", got, tc.want)
+			}
+
+			for i := range got.Sectors {
+				if got.Sectors[i] != tc.want.Sectors[i] {
+					t.Errorf("sector %d: got 0x%x, want 0x%x", i, got.Sectors[i], tc.want.Sectors[i])
+				}
+			}
+
+			last := got.Size - 1
+
+			page, start, size, err := got.Page(last)
+			if err != nil || page != got.Pages()-1 || start+size != got.Size {
+				t.Errorf("last page: got %d 0x%x+0x%x, %v", page, start, size, err)
+			}
+		})
+	}
+}
+
+func TestL4StatusErrors(t *testing.T) {
+	target, flash := newTestFlash(0x469, 512)
+
+	// A rejected operation sets an error flag but never EOP
+	target.Map(regSR, func() uint32 { return uint32(statusRegisterWriteProtectionError) }, nil)
+
+	err := flash.ErasePage(3)
+	if err == nil || !strings.Contains(err.Error(), "write protection error") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestClearEmpty(t *testing.T) {
+	const acr = 2 | acrRegisterCPUPrefetchEnable | acrRegisterInstructionCache | acrEmpty
+
+	for _, tc := range []struct {
+		name    string
+		devID   uint32
+		wantACR uint32
+	}{
+		{"WB", 0x495, uint32(acr &^ acrEmpty)},
+		{"G4", 0x468, uint32(acr)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target, flash := newTestFlash(tc.devID, 128)
+			target.WriteWord(regACR, uint32(acr))
+			target.Map(regSR, func() uint32 { return uint32(statusRegisterEndOfOperation) }, nil)
+
+			if err := flash.Write(0, bytes.NewReader(make([]byte, 8))); err != nil {
+				t.Fatalf("program: %v", err)
+			}
+
+			if got := target.ReadWord(regACR); got != tc.wantACR {
+				t.Errorf("ACR: got 0x%08x, want 0x%08x", got, tc.wantACR)
+			}
+		})
+	}
+}
+
+func TestH7AEraseControl(t *testing.T) {
+	target := sim.New()
+	// Cortex-M7, which implements the DBGMCU at the H7 location
+	target.WriteWord(0xe000ed00, 0x411fc272)
+	target.WriteWord(regIDCodeH7, 0x480)
+	target.WriteWord(0x08fff80c, 2048)
+
+	var writes []uint32
+	target.Map(regH7CR+h7Bank2Offset, nil, func(v uint32) { writes = append(writes, v) })
+
+	// Sector 5 of bank 2
+	if err := New(swd.New(target)).Flash().ErasePage(128 + 5); err != nil {
+		t.Fatalf("erase: %v", err)
+	}
+
+	want := []uint32{
+		uint32(h7ControlSer | 5<<h7ABControlSectorShift),
+		uint32(h7ControlSer | 5<<h7ABControlSectorShift | h7ABControlStart),
+		0,
+	}
+
+	if fmt.Sprint(writes) != fmt.Sprint(want) {
+		t.Errorf("CR: got %x, want %x", writes, want)
+	}
+}
+
+func TestG0Bank2Pages(t *testing.T) {
+	target, flash := newTestFlash(0, 512)
+	// Cortex-M0+, which implements the DBGMCU at the M0 location
+	target.WriteWord(0xe000ed00, 0x410cc601)
+	target.WriteWord(regIDCodeM0, 0x467)
+	target.WriteWord(regOPTR, 1<<21)
+	target.Map(regSR, func() uint32 { return uint32(statusRegisterEndOfOperation) }, nil)
+
+	var writes []controlRegister
+	target.Map(regCR, nil, func(v uint32) { writes = append(writes, controlRegister(v)) })
+
+	// Page 3 of bank 2, bank 1 has 128 pages
+	if err := flash.ErasePage(128 + 3); err != nil {
+		t.Fatalf("erase: %v", err)
+	}
+
+	want := controlRegisterPer | 1<<13 | (256+3)<<controlRegisterPageShift
+	if len(writes) == 0 || writes[0] != want {
+		t.Errorf("CR: got %v, want 0x%08x", writes, want)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	target := sim.New()
+	target.WriteWord(regIDCode, 0x10006468)
+	target.WriteWord(0x1fff75e0, 128)
+	target.WriteWord(0x1fff7590, 0x33221100)
+	target.WriteWord(0x1fff7594, 0x77665544)
+	target.WriteWord(0x1fff7598, 0xbbaa9988)
+	target.WriteWord(0x1fff7500, 0xfff3)
+
+	info, err := New(swd.New(target)).Info()
+	if err != nil {
+		t.Fatalf("info: %v", err)
+	}
+
+	if info.FlashSize != 128*1024 {
+		t.Errorf("flash size: got %d", info.FlashSize)
+	}
+
+	if got := info.UIDString(); got != "bbaa99887766554433221100" {
+		t.Errorf("UID: got %s", got)
+	}
+
+	if !info.HasPackage || info.Package != 3 {
+		t.Errorf("package: got 0x%x", info.Package)
+	}
+}
+
+func TestReadOptionBytes(t *testing.T) {
+	target, flash := newTestFlash(0x469, 512)
+	target.WriteWord(regOPTR, 0xfbaff8bb)
+	target.WriteWord(regWRP1AR, 0x00030001)
+	target.WriteWord(regWRP1BR, 0x000000ff)
+	target.WriteWord(regPCROP1ER, 0x80000000)
+
+	ob, err := flash.ReadOptionBytes()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if ob.RDP.Level() != 1 || !ob.NRstStop || !ob.NBoot0 || !ob.PCROPRDP {
+		t.Errorf("got %+v", ob)
+	}
+
+	if len(ob.WRP) != 2 || !ob.WRP[0].Enabled() || ob.WRP[0].End != 3 || ob.WRP[1].Enabled() {
+		t.Errorf("WRP: got %v", ob.WRP)
+	}
+
+	if l := l4OptionLayouts[FamilyG4]; l.encode(ob) != ob.OPTR {
+		t.Errorf("encode: got 0x%08x, want 0x%08x", l.encode(ob), ob.OPTR)
+	}
+}
+
+func TestOptionBytesBootSelect(t *testing.T) {
+	l := l4OptionLayouts[FamilyG0]
+
+	// nBOOT_SEL set selects the nBOOT0 option bit, like nSWBOOT0 cleared
+	ob := l.decode(0xdfffe1aa)
+	if ob.NSWBoot0 {
+		t.Errorf("nBOOT_SEL set: got nSWBOOT0 true")
+	}
+
+	ob.NSWBoot0 = true
+	if got := l.encode(ob); got&(1<<24) != 0 {
+		t.Errorf("encode: got 0x%08x, want nBOOT_SEL cleared", got)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	const flashSize = 128 * 1024
+
+	target, flash := newTestFlash(0x468, flashSize/1024)
+	target.WriteWord(regOPTR, 0xffeff8bb)
+	target.Map(regSR, func() uint32 { return uint32(statusRegisterEndOfOperation) }, nil)
+
+	erased := false
+	launched := false
+
+	// Programming the option bytes triggers the mass erase
+	target.Map(regCR, nil, func(v uint32) {
+		if v&uint32(controlRegisterOptionStart) != 0 {
+			erased = true
+		}
+
+		if v&uint32(controlRegisterOptionLoad) != 0 {
+			launched = true
+		}
+	})
+
+	for addr := FlashBaseAddr; addr < FlashBaseAddr+flashSize; addr += 4 {
+		target.Map(addr, func() uint32 {
+			if erased {
+				return 0xffffffff
+			}
+
+			return 0x12345678
+		}, nil)
+	}
+
+	if level, err := flash.ReadProtection(); err != nil || level.Level() != 1 {
+		t.Fatalf("read protection: got %s, %v", level, err)
+	}
+
+	if err := flash.Recover(time.Second); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+
+	if !erased || !launched {
+		t.Errorf("erased %t, launched %t", erased, launched)
+	}
+
+	if optr := target.ReadWord(regOPTR); RDPLevel(optr) != RDPLevel0 {
+		t.Errorf("OPTR: got 0x%08x", optr)
+	}
+}
+
+func TestWriteProtection(t *testing.T) {
+	target, flash := newTestFlash(0x469, 512)
+	target.WriteWord(regWRP1AR, 0x00050004)
+	target.WriteWord(regWRP1BR, 0x000000ff)
+
+	touched := false
+	target.Map(regCR, nil, func(uint32) { touched = true })
+
+	areas, err := flash.WriteProtection()
+	if err != nil || len(areas) != 2 || areas[0].String() != "bank 1: pages 4-5" {
+		t.Fatalf("got %v, %v", areas, err)
+	}
+
+	err = flash.Write(0x5800, bytes.NewReader(make([]byte, 0x1000)))
+	if !errors.Is(err, ErrWriteProtected) || !strings.Contains(err.Error(), "0x08004000-0x08005fff") {
+		t.Errorf("write: got %v", err)
+	}
+
+	if err := flash.ErasePage(5); !errors.Is(err, ErrWriteProtected) {
+		t.Errorf("erase page: got %v", err)
+	}
+
+	if err := flash.EraseRange(0x2000, 0x4000); !errors.Is(err, ErrWriteProtected) {
+		t.Errorf("erase range: got %v", err)
+	}
+
+	if touched {
+		t.Errorf("flash controller modified")
+	}
+}
+
+// runLoaderStub emulates stub/l4.S: it copies full slots to flash while the core
+// is running and halts on a stop request.
+func runLoaderStub(target *sim.Target, mailbox uint32, done <-chan struct{}) {
+	slot := uint32(0)
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if target.Core().Halted() {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		base := mailbox + mailboxSlots + slot*mailboxSlotSize
+
+		switch target.ReadWord(base + slotState) {
+		case slotStateFull:
+			addr := target.ReadWord(base + slotAddress)
+			size := target.ReadWord(base + slotLength)
+			buf := target.ReadWord(base + slotBuffer)
+
+			target.Load(addr, target.Dump(buf, int(size)))
+			target.WriteWord(base+slotState, slotStateEmpty)
+			slot ^= 1
+		case slotStateStop:
+			target.Core().Break(0, scb.DFSRBkpt)
+		}
+	}
+}
+
+func TestLoader(t *testing.T) {
+	const ramAddr = 0x20000000
+
+	target, flash := newTestFlash(0x468, 128)
+	target.Map(regSR, func() uint32 { return 0 }, nil)
+	flash.SetLoaderRAM(ramAddr, 1024)
+
+	if err := flash.Initialize(); err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+
+	mailbox, _, _, err := flash.loaderLayout(flash.ctrl.(loaderController).loaderStub())
+	if err != nil {
+		t.Fatalf("layout: %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go runLoaderStub(target, mailbox, done)
+
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	if err := flash.Write(0x800, bytes.NewReader(data)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if got := target.Dump(FlashBaseAddr+0x800, len(data)); !bytes.Equal(got, data) {
+		t.Errorf("flash content differs")
+	}
+
+	if got := target.Dump(ramAddr, len(l4LoaderStub)); !bytes.Equal(got, l4LoaderStub) {
+		t.Errorf("stub not downloaded")
+	}
+
+	if !target.Core().Halted() {
+		t.Errorf("core still running")
+	}
+
+	if target.Core().Register(cd.CoreRegisterSpecial)&specialPrimask == 0 {
+		t.Errorf("stub ran with interrupts enabled")
+	}
+}
+
+func TestFastProgramming(t *testing.T) {
+	target, flash := newTestFlash(0x468, 128)
+	target.Map(regSR, func() uint32 { return uint32(statusRegisterEndOfOperation) }, nil)
+	target.Load(FlashBaseAddr, bytes.Repeat([]byte{0xff}, 0x400))
+	// The second row is not erased
+	target.WriteWord(FlashBaseAddr+0x280, 0)
+
+	var fast, standard int
+
+	target.Map(regCR, nil, func(v uint32) {
+		switch {
+		case v&uint32(controlRegisterOptionFastProgramming) != 0:
+			fast++
+		case v&uint32(controlRegisterPg) != 0:
+			standard++
+		}
+	})
+
+	flash.SetFastProgramming(true)
+
+	data := make([]byte, 0x308)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	if err := cd.New(flash.swd).Continue(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flash.Write(0x100, bytes.NewReader(data)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if !target.Core().Halted() {
+		t.Errorf("fast programming with the core running")
+	}
+
+	// Rows at 0x100 and 0x300 are fast programmed, the row at 0x200 and the
+	// trailing double word are not
+	if fast != 2 || standard != 2 {
+		t.Errorf("got %d fast and %d standard operations", fast, standard)
+	}
+
+	if got := target.Dump(FlashBaseAddr+0x100, len(data)); !bytes.Equal(got, data) {
+		t.Errorf("flash content differs")
+	}
+}
+
+func TestUpdateImage(t *testing.T) {
+	target, flash := newTestFlash(0x468, 128)
+	target.Map(regSR, func() uint32 { return uint32(statusRegisterEndOfOperation) }, nil)
+
+	data := make([]byte, 0x1000)
+	for i := range data {
+		data[i] = byte(i / 3)
+	}
+
+	// The first page is up to date, the second one holds old data
+	target.Load(FlashBaseAddr, data[:0x800])
+
+	summary, err := flash.UpdateImage(image.FromBinary(FlashBaseAddr, data))
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if summary.Skipped != 1 || summary.Erased != 0x800 || summary.Written != 0x800 {
+		t.Errorf("got %s", summary)
+	}
+
+	if got := target.Dump(FlashBaseAddr, len(data)); !bytes.Equal(got, data) {
+		t.Errorf("flash content differs")
+	}
+}
+
+func TestSTM32CRC(t *testing.T) {
+	// CRC-32/MPEG-2 of "12345678", fed as two big-endian words
+	if got := stm32CRC(crcInitial, []byte("43218765")); got != 0x49e3c2fb {
+		t.Errorf("got 0x%08x", got)
+	}
+}
+
+// runCRCStub emulates stub/crc.S.
+func runCRCStub(target *sim.Target, dr uint32, done <-chan struct{}) {
+	core := target.Core()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if core.Halted() {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		addr, words := core.Register(cd.CoreRegisterR0), core.Register(cd.CoreRegisterR1)
+
+		target.WriteWord(dr, stm32CRC(crcInitial, target.Dump(addr, int(words*4))))
+		core.SetRegister(cd.CoreRegisterR1, 0)
+		core.Break(core.Register(cd.CoreRegisterPC)+0xc, scb.DFSRBkpt)
+	}
+}
+
+func TestVerifyCRC(t *testing.T) {
+	target, flash := newTestFlash(0x468, 128)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go runCRCStub(target, crcUnits[FamilyG4].addr+crcRegDR, done)
+
+	data := make([]byte, 0x403)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+
+	target.Load(FlashBaseAddr+1, data)
+
+	ram := []byte("firmware data in SRAM, not a stub")
+	target.Load(defaultStubAddr, ram)
+
+	flash.SetVerifyMode(VerifyCRC)
+
+	// The firmware was halted here
+	core := target.Core()
+	core.SetRegister(cd.CoreRegisterPC, 0x08000124)
+	core.SetRegister(cd.CoreRegisterSP, 0x20001ff0)
+	core.SetRegister(cd.CoreRegisterR0, 0x1234)
+
+	img := image.FromBinary(FlashBaseAddr+1, data)
+
+	if summary, err := flash.VerifyImage(img); err != nil || summary.Verified != uint32(len(data)) {
+		t.Fatalf("verify: %v, %s", err, summary)
+	}
+
+	if target.ReadWord(crcUnits[FamilyG4].clockReg)&crcUnits[FamilyG4].clockBit == 0 {
+		t.Errorf("CRC clock not enabled")
+	}
+
+	if got := target.Dump(defaultStubAddr, len(ram)); !bytes.Equal(got, ram) {
+		t.Errorf("SRAM not restored: %q", got)
+	}
+
+	for reg, want := range map[cd.CoreRegister]uint32{
+		cd.CoreRegisterPC:      0x08000124,
+		cd.CoreRegisterSP:      0x20001ff0,
+		cd.CoreRegisterR0:      0x1234,
+		cd.CoreRegisterSpecial: 0,
+	} {
+		if got := core.Register(reg); got != want {
+			t.Errorf("%s: got 0x%08x, want 0x%08x", reg, got, want)
+		}
+	}
+
+	target.Load(FlashBaseAddr+0x201, []byte{0xaa})
+
+	if _, err := flash.VerifyImage(img); !errors.Is(err, ErrVerify) || !strings.Contains(err.Error(), "0x08000201") {
+		t.Errorf("mismatch: got %v", err)
+	}
+}
+
+func TestDualBank(t *testing.T) {
+	target, flash := newTestFlash(0x469, 512)
+	target.WriteWord(regOPTR, 0xffcff8aa)
+	target.Map(regSR, func() uint32 { return uint32(statusRegisterEndOfOperation) }, nil)
+
+	var writes []controlRegister
+	target.Map(regCR, nil, func(v uint32) { writes = append(writes, controlRegister(v)) })
+
+	if err := flash.EraseAll(time.Second); err != nil {
+		t.Fatalf("erase all: %v", err)
+	}
+
+	if g := flash.Geometry(); g.Banks != 2 || g.PageSize != 2048 {
+		t.Errorf("geometry: got %s", g)
+	}
+
+	if want := controlRegisterMer1 | controlRegisterMer2 | controlRegisterStart; len(writes) == 0 || writes[0] != want {
+		t.Errorf("erase all: got CR %v, want 0x%08x", writes, want)
+	}
+
+	writes = nil
+
+	if err := flash.EraseBank(1, time.Second); err != nil {
+		t.Fatalf("erase bank: %v", err)
+	}
+
+	if want := controlRegisterMer2 | controlRegisterStart; len(writes) == 0 || writes[0] != want {
+		t.Errorf("erase bank: got CR %v, want 0x%08x", writes, want)
+	}
+
+	if err := flash.EraseBank(2, time.Second); err == nil {
+		t.Errorf("erase bank 3: got no error")
+	}
+
+	if swap, err := flash.BankSwap(); err != nil || swap {
+		t.Fatalf("bank swap: got %t, %v", swap, err)
+	}
+
+	if err := flash.SetBankSwap(true); err != nil {
+		t.Fatalf("set bank swap: %v", err)
+	}
+
+	if optr := target.ReadWord(regOPTR); optr != 0xffdff8aa {
+		t.Errorf("OPTR: got 0x%08x", optr)
+	}
+
+	if swap, err := flash.BankSwap(); err != nil || !swap {
+		t.Errorf("bank swap after reload: got %t, %v", swap, err)
+	}
+}
+
+func TestProgramOTP(t *testing.T) {
+	const otp = 0x1fff7000
+
+	target, flash := newTestFlash(0x468, 128)
+	target.Map(regSR, func() uint32 { return uint32(statusRegisterEndOfOperation) }, nil)
+
+	for addr := uint32(otp); addr < otp+1024; addr += 4 {
+		target.WriteWord(addr, 0xffffffff)
+	}
+
+	target.WriteWord(otp, 0x44332211)
+	target.WriteWord(otp+4, 0x88776655)
+
+	data := []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 0}
+
+	writes, err := flash.ProgramOTP(0, data, true)
+	if err != nil || len(writes) != 1 || writes[0].String() != "0x1fff7008: de ad be ef 00 00 00 00" {
+		t.Fatalf("dry run: got %v, %v", writes, err)
+	}
+
+	if target.ReadWord(otp+8) != 0xffffffff {
+		t.Fatalf("dry run programmed OTP")
+	}
+
+	if _, err := flash.ProgramOTP(0, make([]byte, 8), false); !errors.Is(err, ErrOTPProgrammed) {
+		t.Errorf("overwrite: got %v", err)
+	}
+
+	if _, err := flash.ProgramOTP(4, make([]byte, 8), false); err == nil {
+		t.Errorf("unaligned: got no error")
+	}
+
+	if _, err := flash.ProgramOTP(0, data, false); err != nil {
+		t.Fatalf("program: %v", err)
+	}
+
+	if got := target.ReadWord(otp + 8); got != 0xefbeadde {
+		t.Errorf("OTP: got 0x%08x", got)
+	}
+
+	if err := flash.LockOTP(0); !errors.Is(err, ErrUnsupportedDevice) {
+		t.Errorf("lock: got %v", err)
+	}
+}
+
+func TestLockOTP(t *testing.T) {
+	const otp, lock = 0x1fff7800, 0x1fff7a00
+
+	target := sim.New()
+	target.WriteWord(regIDCode, 0x413)
+	target.WriteWord(0x1fff7a20, 1024<<16)
+	target.Map(regF4SR, func() uint32 { return 0 }, nil)
+
+	for addr := uint32(otp); addr < lock+16; addr += 4 {
+		target.WriteWord(addr, 0xffffffff)
+	}
+
+	flash := New(swd.New(target)).Flash()
+
+	if err := flash.LockOTP(2); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	if got := target.ReadWord(lock); got != 0xff00ffff {
+		t.Errorf("lock bytes: got 0x%08x", got)
+	}
+
+	locked, err := flash.OTPLocked()
+	if err != nil || len(locked) != 16 || !locked[2] || locked[3] {
+		t.Errorf("locked: got %v, %v", locked, err)
+	}
+
+	if _, err := flash.ProgramOTP(64, []byte{1, 2, 3, 4}, false); !errors.Is(err, ErrOTPLocked) {
+		t.Errorf("program locked block: got %v", err)
+	}
+}
+
+func TestScanECC(t *testing.T) {
+	target, flash := newTestFlash(0x469, 512)
+	target.WriteWord(regOPTR, 1<<22)
+
+	// A double-bit error in bank 2 is latched before the scan
+	eccr := uint32(eccRegisterDetection | 1<<21 | 0x100)
+	flags := uint32(eccRegisterCorrection | eccRegisterDetection)
+
+	target.Map(regECCR, func() uint32 { return eccr }, func(v uint32) {
+		if v&flags != 0 {
+			eccr &^= v & flags
+		}
+	})
+
+	// Only the first event is latched until the flags are cleared
+	latch := func(addr uint32, flag eccRegister) {
+		target.Map(FlashBaseAddr+addr, func() uint32 {
+			if eccr&flags == 0 {
+				eccr = uint32(flag) | addr
+			}
+
+			return 0x12345678
+		}, nil)
+	}
+
+	latch(0x808, eccRegisterCorrection)
+	latch(0xa00, eccRegisterCorrection)
+	latch(0x2000, eccRegisterDetection)
+
+	events, err := flash.ScanECC(0, 0x1000)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+
+	want := []string{
+		"double-bit error at 0x08040100 (bank 2)",
+		"corrected single-bit error at 0x08000808 (bank 1)",
+		"corrected single-bit error at 0x08000a00 (bank 1)",
+	}
+
+	if len(events) != len(want) {
+		t.Fatalf("got %v", events)
+	}
+
+	for i, ev := range events {
+		if ev.String() != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, ev, want[i])
+		}
+	}
+
+	if events, err := flash.ECCEvents(); err != nil || len(events) != 0 {
+		t.Errorf("after scan: got %v, %v", events, err)
+	}
+
+	var buf bytes.Buffer
+
+	if err := flash.Read(0x2000, 8, &buf); !errors.Is(err, ErrECC) {
+		t.Errorf("read: got %v", err)
+	}
+}
+
+func TestConfigureDebug(t *testing.T) {
+	target := sim.New()
+	target.WriteWord(regIDCode, 0x469)
+	target.WriteWord(regIDCode+0x04, 1<<5)
+	target.WriteWord(regIDCode+0x08, 1<<11)
+
+	stm := New(swd.New(target))
+	cfg := DebugConfig{Stop: true, Standby: true, FreezeIWDG: true, FreezeTimers: true}
+
+	if err := stm.ConfigureDebug(cfg); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+
+	for _, tc := range []struct {
+		reg, want uint32
+	}{
+		{regIDCode + 0x04, 1<<5 | 1<<1 | 1<<2},
+		{regIDCode + 0x08, 1<<12 | 0x3f},
+		{regIDCode + 0x10, 1<<11 | 1<<13 | 7<<16 | 1<<20},
+	} {
+		if got := target.ReadWord(tc.reg); got != tc.want {
+			t.Errorf("0x%08x: got 0x%08x, want 0x%08x", tc.reg, got, tc.want)
+		}
+	}
+
+	if got, err := stm.DebugConfig(); err != nil || got != cfg {
+		t.Errorf("read back: got %+v, %v", got, err)
+	}
+}
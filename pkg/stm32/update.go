@@ -0,0 +1,124 @@
+package stm32
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/holoplot/go-swd/pkg/image"
+)
+
+// UpdateImage programs the image like WriteImage, but reads back each page it
+// touches first and leaves pages alone that already hold the expected content.
+// Only the changed pages are erased and programmed; Summary.Skipped counts the
+// others.
+func (f *Flash) UpdateImage(img *image.Image) (summary Summary, err error) {
+	retries := f.swd.WaitRetries()
+
+	defer func() {
+		summary.Retries = f.swd.WaitRetries() - retries
+	}()
+
+	if _, err := f.controller(); err != nil {
+		return summary, err
+	}
+
+	changed, skipped, err := f.changedPages(img)
+	if err != nil {
+		return summary, err
+	}
+
+	summary.Skipped = skipped
+
+	if err := f.checkWriteProtection(changed); err != nil {
+		return summary, err
+	}
+
+	start := time.Now()
+
+	if summary.Erased, err = f.erasePages(changed); err != nil {
+		return summary, err
+	}
+
+	summary.EraseTime = time.Since(start)
+	start = time.Now()
+
+	if summary.Written, err = f.writeSegments(changed); err != nil {
+		return summary, err
+	}
+
+	summary.WriteTime = time.Since(start)
+
+	return summary, nil
+}
+
+// changedPages compares every page touched by the image with the content it
+// would have after WriteImage, which is the erased value where the image has no
+// data. It returns the parts of the image in pages that differ and the number of
+// matching pages.
+func (f *Flash) changedPages(img *image.Image) (*image.Image, int, error) {
+	pages, err := f.imagePages(img)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := uint32(0)
+	for _, p := range pages {
+		total += p.size
+	}
+
+	tr := f.newTracker(PhaseVerify, total)
+	changed := &image.Image{}
+	skipped := 0
+
+	for _, p := range pages {
+		pageStart := FlashBaseAddr + p.start
+		pageEnd := pageStart + p.size
+
+		want := bytes.Repeat([]byte{flashErasedValue}, int(p.size))
+		var parts []image.Segment
+
+		for _, seg := range img.Segments {
+			if seg.End() <= pageStart || seg.Address >= pageEnd {
+				continue
+			}
+
+			from, to := seg.Address, seg.End()
+			if from < pageStart {
+				from = pageStart
+			}
+
+			if to > pageEnd {
+				to = pageEnd
+			}
+
+			data := seg.Data[from-seg.Address : to-seg.Address]
+			copy(want[from-pageStart:], data)
+			parts = append(parts, image.Segment{Address: from, Data: data})
+		}
+
+		got := make([]byte, p.size)
+
+		if err := f.swd.ReadMemory(pageStart, got); err != nil {
+			return nil, 0, fmt.Errorf("read 0x%08x: %w", pageStart, err)
+		}
+
+		tr.Add(p.size)
+
+		if bytes.Equal(got, want) {
+			skipped++
+			continue
+		}
+
+		for _, part := range parts {
+			// Copy, Add appends to the data of adjacent segments
+			if err := changed.Add(part.Address, append([]byte(nil), part.Data...)); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	tr.Finish()
+
+	return changed, skipped, nil
+}
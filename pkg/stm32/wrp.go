@@ -0,0 +1,156 @@
+package stm32
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/holoplot/go-swd/pkg/image"
+)
+
+var ErrWriteProtected = errors.New("write protected")
+
+// WriteProtection returns the WRP areas of all banks. Disabled areas are
+// included, so the result can be modified and passed to SetWriteProtection.
+func (f *Flash) WriteProtection() ([]WRPArea, error) {
+	ob, err := f.ReadOptionBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return ob.WRP, nil
+}
+
+// SetWriteProtection programs the WRP areas, which must be in the order returned
+// by WriteProtection. Like ProgramOptionBytes, this resets the device.
+func (f *Flash) SetWriteProtection(areas []WRPArea) error {
+	return f.updateOptionBytes(func(ob *OptionBytes) error {
+		if len(areas) != len(ob.WRP) {
+			return fmt.Errorf("device has %d WRP areas, got %d", len(ob.WRP), len(areas))
+		}
+
+		for i, area := range areas {
+			if area.Bank != ob.WRP[i].Bank {
+				return fmt.Errorf("WRP area %d is in bank %d", i, ob.WRP[i].Bank+1)
+			}
+
+			if area.Enabled() && area.End >= f.geometry.pagesPerBank() {
+				return fmt.Errorf("WRP area %s beyond the end of the bank", area)
+			}
+		}
+
+		ob.WRP = areas
+
+		return nil
+	})
+}
+
+// PCROP returns the proprietary code readout protection areas and whether they
+// are removed when regressing from RDP level 1 to 0.
+func (f *Flash) PCROP() ([]PCROPArea, bool, error) {
+	ob, err := f.ReadOptionBytes()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return ob.PCROP, ob.PCROPRDP, nil
+}
+
+// SetPCROP programs the PCROP areas, which must be in the order returned by
+// PCROP. Like ProgramOptionBytes, this resets the device.
+func (f *Flash) SetPCROP(areas []PCROPArea, removeOnRegression bool) error {
+	return f.updateOptionBytes(func(ob *OptionBytes) error {
+		if len(areas) != len(ob.PCROP) {
+			return fmt.Errorf("device has %d PCROP areas, got %d", len(ob.PCROP), len(areas))
+		}
+
+		ob.PCROP = areas
+		ob.PCROPRDP = removeOnRegression
+
+		return nil
+	})
+}
+
+// updateOptionBytes reads the option bytes, applies fn and programs the result.
+func (f *Flash) updateOptionBytes(fn func(ob *OptionBytes) error) error {
+	ob, err := f.ReadOptionBytes()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(ob); err != nil {
+		return err
+	}
+
+	return f.ProgramOptionBytes(ob, false)
+}
+
+// wrpRange returns the offsets into flash covered by an enabled WRP area.
+func (f *Flash) wrpRange(area WRPArea) (start, end uint32) {
+	bankStart := uint32(area.Bank) * (f.geometry.Size / uint32(f.geometry.Banks))
+
+	return bankStart + area.Start*f.geometry.PageSize, bankStart + (area.End+1)*f.geometry.PageSize
+}
+
+// addrRange is a range of absolute addresses, end is exclusive.
+type addrRange struct {
+	start, end uint32
+}
+
+// checkWriteProtection fails if any segment of the image overlaps an active WRP
+// area.
+func (f *Flash) checkWriteProtection(img *image.Image) error {
+	var ranges []addrRange
+
+	for _, seg := range img.Segments {
+		ranges = append(ranges, addrRange{seg.Address, seg.End()})
+	}
+
+	return f.checkProtected(ranges)
+}
+
+// checkEraseProtection fails if size bytes at offset into flash overlap an
+// active WRP area, which would make the controller reject the erase.
+func (f *Flash) checkEraseProtection(offset, size uint32) error {
+	return f.checkProtected([]addrRange{{FlashBaseAddr + offset, FlashBaseAddr + offset + size}})
+}
+
+// checkProtected fails if any of the ranges overlaps an active WRP area and
+// names the areas in the error. Devices without option byte support are not
+// checked.
+func (f *Flash) checkProtected(ranges []addrRange) error {
+	obc, ok := f.ctrl.(optionBytesController)
+	if !ok {
+		return nil
+	}
+
+	ob, err := obc.readOptionBytes()
+	if err != nil {
+		return err
+	}
+
+	var protected []string
+
+	for _, area := range ob.WRP {
+		if !area.Enabled() {
+			continue
+		}
+
+		start, end := f.wrpRange(area)
+
+		for _, r := range ranges {
+			if r.start < FlashBaseAddr+end && r.end > FlashBaseAddr+start {
+				protected = append(protected, fmt.Sprintf("%s (0x%08x-0x%08x)",
+					area, FlashBaseAddr+start, FlashBaseAddr+end-1))
+
+				break
+			}
+		}
+	}
+
+	if len(protected) > 0 {
+		return fmt.Errorf("%w: %s", ErrWriteProtected, strings.Join(protected, ", "))
+	}
+
+	return nil
+}
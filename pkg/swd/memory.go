@@ -0,0 +1,236 @@
+package swd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holoplot/go-swd/pkg/io"
+)
+
+const (
+	// TAR auto-increment is only guaranteed to work within a 1KB range
+	autoIncrementBoundary = 0x400
+)
+
+var (
+	ErrUnaligned = errors.New("address not word aligned")
+	ErrSticky    = errors.New("sticky error flagged in CTRL/STAT")
+)
+
+func (s *SWD) checkSticky() error {
+	ctrlStat, err := s.ReadCtrlStat()
+	if err != nil {
+		return fmt.Errorf("read ctrlstat: %w", err)
+	}
+
+	if ctrlStat&CtrlStatStickyErr != 0 {
+		_ = s.Abort(AbortStickyErrClear)
+
+		return ErrSticky
+	}
+
+	return nil
+}
+
+// ReadBlock reads consecutive words starting at addr using TAR auto-increment.
+// Reads on the access port are pipelined, so each word costs a single transaction.
+func (s *SWD) ReadBlock(addr uint32, data []uint32) error {
+	if addr&3 != 0 {
+		return ErrUnaligned
+	}
+
+	if err := s.UpdateCSW(CSWAutoIncrementSingle|CSWSize32bit,
+		CSWAutoIncrementMask|CSWSizeMask); err != nil {
+		return fmt.Errorf("update CSW: %w", err)
+	}
+
+	defer func() {
+		_ = s.UpdateCSW(CSWAutoIncrementOff, CSWAutoIncrementMask)
+	}()
+
+	for i := 0; i < len(data); {
+		a := addr + uint32(i)*4
+		n := int(autoIncrementBoundary-a%autoIncrementBoundary) / 4
+
+		if n > len(data)-i {
+			n = len(data) - i
+		}
+
+		if err := s.WriteTAR(a); err != nil {
+			return fmt.Errorf("write TAR: %w", err)
+		}
+
+		if err := s.Select(0, uint8(regApDRW>>4), 0); err != nil {
+			return err
+		}
+
+		// Each AP read returns the result of the previous one
+		if _, err := s.readTx("MEMAP:DRW", io.AccessPort, regApDRW&0xf); err != nil {
+			return fmt.Errorf("read DRW: %w", err)
+		}
+
+		for j := 1; j < n; j++ {
+			v, err := s.readTx("MEMAP:DRW", io.AccessPort, regApDRW&0xf)
+			if err != nil {
+				return fmt.Errorf("read DRW: %w", err)
+			}
+
+			data[i+j-1] = v
+		}
+
+		v, err := s.ReadRdBuff()
+		if err != nil {
+			return fmt.Errorf("read rdbuff: %w", err)
+		}
+
+		data[i+n-1] = v
+		i += n
+	}
+
+	return s.checkSticky()
+}
+
+// WriteBlock writes consecutive words starting at addr using TAR auto-increment.
+func (s *SWD) WriteBlock(addr uint32, data []uint32) error {
+	if addr&3 != 0 {
+		return ErrUnaligned
+	}
+
+	if err := s.UpdateCSW(CSWAutoIncrementSingle|CSWSize32bit,
+		CSWAutoIncrementMask|CSWSizeMask); err != nil {
+		return fmt.Errorf("update CSW: %w", err)
+	}
+
+	defer func() {
+		_ = s.UpdateCSW(CSWAutoIncrementOff, CSWAutoIncrementMask)
+	}()
+
+	for i := 0; i < len(data); {
+		a := addr + uint32(i)*4
+		n := int(autoIncrementBoundary-a%autoIncrementBoundary) / 4
+
+		if n > len(data)-i {
+			n = len(data) - i
+		}
+
+		if err := s.WriteTAR(a); err != nil {
+			return fmt.Errorf("write TAR: %w", err)
+		}
+
+		for j := 0; j < n; j++ {
+			if err := s.WriteDRW(data[i+j]); err != nil {
+				return fmt.Errorf("write DRW: %w", err)
+			}
+		}
+
+		i += n
+	}
+
+	if _, err := s.ReadRdBuff(); err != nil {
+		return fmt.Errorf("read rdbuff: %w", err)
+	}
+
+	return s.checkSticky()
+}
+
+// ReadMemory reads len(buf) bytes of target memory starting at addr.
+// The word aligned part is transferred as a block, unaligned head and tail
+// bytes are extracted from full word reads.
+func (s *SWD) ReadMemory(addr uint32, buf []byte) error {
+	first := (addr + 3) &^ 3
+	last := (addr + uint32(len(buf))) &^ 3
+
+	if first >= last {
+		return s.readMemoryWords(addr, buf)
+	}
+
+	head := int(first - addr)
+	words := make([]uint32, (last-first)/4)
+
+	if err := s.readMemoryWords(addr, buf[:head]); err != nil {
+		return err
+	}
+
+	if err := s.ReadBlock(first, words); err != nil {
+		return fmt.Errorf("read block 0x%08x: %w", first, err)
+	}
+
+	for i, w := range words {
+		o := head + i*4
+		buf[o], buf[o+1], buf[o+2], buf[o+3] = byte(w), byte(w>>8), byte(w>>16), byte(w>>24)
+	}
+
+	return s.readMemoryWords(last, buf[head+len(words)*4:])
+}
+
+func (s *SWD) readMemoryWords(addr uint32, buf []byte) error {
+	for i := 0; i < len(buf); {
+		a := addr + uint32(i)
+
+		word, err := s.ReadRegister(a &^ 3)
+		if err != nil {
+			return fmt.Errorf("read 0x%08x: %w", a&^3, err)
+		}
+
+		for shift := (a & 3) * 8; shift < 32 && i < len(buf); shift += 8 {
+			buf[i] = byte(word >> shift)
+			i++
+		}
+	}
+
+	return nil
+}
+
+// WriteMemory writes data to target memory starting at addr.
+// The word aligned part is transferred as a block, partial words are written
+// with a read-modify-write cycle.
+func (s *SWD) WriteMemory(addr uint32, data []byte) error {
+	first := (addr + 3) &^ 3
+	last := (addr + uint32(len(data))) &^ 3
+
+	if first >= last {
+		return s.writeMemoryPartial(addr, data)
+	}
+
+	head := int(first - addr)
+	words := make([]uint32, (last-first)/4)
+
+	for i := range words {
+		o := head + i*4
+		words[i] = uint32(data[o]) | uint32(data[o+1])<<8 | uint32(data[o+2])<<16 | uint32(data[o+3])<<24
+	}
+
+	if err := s.writeMemoryPartial(addr, data[:head]); err != nil {
+		return err
+	}
+
+	if err := s.WriteBlock(first, words); err != nil {
+		return fmt.Errorf("write block 0x%08x: %w", first, err)
+	}
+
+	return s.writeMemoryPartial(last, data[head+len(words)*4:])
+}
+
+func (s *SWD) writeMemoryPartial(addr uint32, data []byte) error {
+	for i := 0; i < len(data); {
+		a := addr + uint32(i)
+		aligned := a &^ 3
+
+		word, err := s.ReadRegister(aligned)
+		if err != nil {
+			return fmt.Errorf("read 0x%08x: %w", aligned, err)
+		}
+
+		for shift := (a & 3) * 8; shift < 32 && i < len(data); shift += 8 {
+			word &= ^(uint32(0xff) << shift)
+			word |= uint32(data[i]) << shift
+			i++
+		}
+
+		if err := s.WriteRegister(aligned, word); err != nil {
+			return fmt.Errorf("write 0x%08x: %w", aligned, err)
+		}
+	}
+
+	return nil
+}
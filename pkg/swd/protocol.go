@@ -18,6 +18,13 @@ const (
 	regIDR  io.Address = 0xfc
 )
 
+// Access port register addresses for ReadAP
+const (
+	APRegCSW  = uint8(regApCSW)
+	APRegBase = uint8(regBase)
+	APRegIDR  = uint8(regIDR)
+)
+
 type AbortFlags uint32
 
 const (
@@ -3,6 +3,7 @@ package swd
 import (
 	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/holoplot/go-swd/pkg/debug"
@@ -18,6 +19,7 @@ type SWD struct {
 	debugger debug.Debugger
 
 	currentSelect uint32
+	waitRetries   uint64
 }
 
 func (s *SWD) writeTx(name string, portType io.PortType, addr io.Address, data uint32) error {
@@ -42,6 +44,7 @@ func (s *SWD) writeTx(name string, portType io.PortType, addr io.Address, data u
 		}
 
 		// Repeat on AckWait
+		atomic.AddUint64(&s.waitRetries, 1)
 		time.Sleep(10 * time.Millisecond)
 	}
 }
@@ -67,10 +70,17 @@ func (s *SWD) readTx(name string, portType io.PortType, addr io.Address) (uint32
 		}
 
 		// Repeat on AckWait
+		atomic.AddUint64(&s.waitRetries, 1)
 		time.Sleep(10 * time.Millisecond)
 	}
 }
 
+// WaitRetries returns the number of transactions that were repeated because the
+// target answered with WAIT.
+func (s *SWD) WaitRetries() uint64 {
+	return atomic.LoadUint64(&s.waitRetries)
+}
+
 func (s *SWD) Abort(flags AbortFlags) error {
 	return s.writeTx("ABORT", io.DebugPort, regAbort, uint32(flags))
 }
@@ -91,6 +101,18 @@ func (s *SWD) Select(accessPort uint32, bank uint8, low uint8) error {
 	return nil
 }
 
+// resetSelect writes SELECT unconditionally, as the target may have been reset
+// since the cached value was written.
+func (s *SWD) resetSelect() error {
+	if err := s.writeTx("SELECT", io.DebugPort, regSelect, 0); err != nil {
+		return fmt.Errorf("select failed: %w", err)
+	}
+
+	s.currentSelect = 0
+
+	return nil
+}
+
 func (s *SWD) WriteMemAP(name string, addr io.Address, data uint32) error {
 	if err := s.Select(0, uint8(addr>>4), 0); err != nil {
 		return err
@@ -124,6 +146,19 @@ func (s *SWD) ReadMemAP(name string, addr io.Address) (uint32, error) {
 	return v, nil
 }
 
+// ReadAP reads a register of the access port with index ap.
+func (s *SWD) ReadAP(ap uint8, addr uint8) (uint32, error) {
+	if err := s.Select(uint32(ap), addr>>4, 0); err != nil {
+		return 0, fmt.Errorf("select: %w", err)
+	}
+
+	if _, err := s.readTx(fmt.Sprintf("AP%d", ap), io.AccessPort, io.Address(addr&0xf)); err != nil {
+		return 0, err
+	}
+
+	return s.ReadRdBuff()
+}
+
 func (s *SWD) ReadCSW() (CSW, error) {
 	v, err := s.ReadMemAP("CSW", regApCSW)
 	if err != nil {
@@ -284,6 +319,10 @@ func (s *SWD) Initialize() (uint32, error) {
 
 		_ = s.Abort(AbortAllFlags())
 
+		if err == nil {
+			err = s.resetSelect()
+		}
+
 		if err == nil {
 			return id, nil
 		}
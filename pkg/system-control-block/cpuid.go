@@ -0,0 +1,283 @@
+package systemcontrolblock
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CPUID Base Register
+type CPUID uint32
+
+const (
+	CPUIDRevisionMask         CPUID = 0xf
+	CPUIDPartNoShift                = 4
+	CPUIDPartNoMask           CPUID = 0xfff << CPUIDPartNoShift
+	CPUIDArchitectureShift          = 16
+	CPUIDArchitectureMask     CPUID = 0xf << CPUIDArchitectureShift
+	CPUIDVariantShift               = 20
+	CPUIDVariantMask          CPUID = 0xf << CPUIDVariantShift
+	CPUIDImplementerShift           = 24
+	CPUIDImplementerMask      CPUID = 0xff << CPUIDImplementerShift
+	CPUIDImplementerARM             = 0x41
+	CPUIDArchitectureARMv6M         = 0xc
+	CPUIDArchitectureConstant       = 0xf
+)
+
+func (c CPUID) Implementer() uint8 {
+	return uint8((c & CPUIDImplementerMask) >> CPUIDImplementerShift)
+}
+
+func (c CPUID) Variant() uint8 {
+	return uint8((c & CPUIDVariantMask) >> CPUIDVariantShift)
+}
+
+func (c CPUID) Architecture() uint8 {
+	return uint8((c & CPUIDArchitectureMask) >> CPUIDArchitectureShift)
+}
+
+func (c CPUID) PartNo() uint16 {
+	return uint16((c & CPUIDPartNoMask) >> CPUIDPartNoShift)
+}
+
+func (c CPUID) Revision() uint8 {
+	return uint8(c & CPUIDRevisionMask)
+}
+
+// Core maps the implementer and part number to a known core type.
+func (c CPUID) Core() Core {
+	if c.Implementer() != CPUIDImplementerARM {
+		return CoreUnknown
+	}
+
+	if core, ok := partNumbers[c.PartNo()]; ok {
+		return core
+	}
+
+	return CoreUnknown
+}
+
+func (c CPUID) String() string {
+	return fmt.Sprintf("%s r%dp%d", c.Core(), c.Variant(), c.Revision())
+}
+
+type Core int
+
+const (
+	CoreUnknown Core = iota
+	CoreCortexM0
+	CoreCortexM0Plus
+	CoreCortexM1
+	CoreCortexM3
+	CoreCortexM4
+	CoreCortexM7
+	CoreCortexM23
+	CoreCortexM33
+	CoreCortexM55
+	CoreCortexM85
+)
+
+var partNumbers = map[uint16]Core{
+	0xc20: CoreCortexM0,
+	0xc60: CoreCortexM0Plus,
+	0xc21: CoreCortexM1,
+	0xc23: CoreCortexM3,
+	0xc24: CoreCortexM4,
+	0xc27: CoreCortexM7,
+	0xd20: CoreCortexM23,
+	0xd21: CoreCortexM33,
+	0xd22: CoreCortexM55,
+	0xd23: CoreCortexM85,
+}
+
+func (c Core) String() string {
+	switch c {
+	case CoreCortexM0:
+		return "Cortex-M0"
+	case CoreCortexM0Plus:
+		return "Cortex-M0+"
+	case CoreCortexM1:
+		return "Cortex-M1"
+	case CoreCortexM3:
+		return "Cortex-M3"
+	case CoreCortexM4:
+		return "Cortex-M4"
+	case CoreCortexM7:
+		return "Cortex-M7"
+	case CoreCortexM23:
+		return "Cortex-M23"
+	case CoreCortexM33:
+		return "Cortex-M33"
+	case CoreCortexM55:
+		return "Cortex-M55"
+	case CoreCortexM85:
+		return "Cortex-M85"
+	default:
+		return "unknown"
+	}
+}
+
+// Architecture returns the architecture profile implemented by the core.
+func (c Core) Architecture() Architecture {
+	switch c {
+	case CoreCortexM0, CoreCortexM0Plus, CoreCortexM1:
+		return ArchitectureARMv6M
+	case CoreCortexM3:
+		return ArchitectureARMv7M
+	case CoreCortexM4, CoreCortexM7:
+		return ArchitectureARMv7EM
+	case CoreCortexM23:
+		return ArchitectureARMv8MBaseline
+	case CoreCortexM33:
+		return ArchitectureARMv8MMainline
+	case CoreCortexM55, CoreCortexM85:
+		return ArchitectureARMv81MMainline
+	default:
+		return ArchitectureUnknown
+	}
+}
+
+type Architecture int
+
+const (
+	ArchitectureUnknown Architecture = iota
+	ArchitectureARMv6M
+	ArchitectureARMv7M
+	ArchitectureARMv7EM
+	ArchitectureARMv8MBaseline
+	ArchitectureARMv8MMainline
+	ArchitectureARMv81MMainline
+)
+
+func (a Architecture) String() string {
+	switch a {
+	case ArchitectureARMv6M:
+		return "ARMv6-M"
+	case ArchitectureARMv7M:
+		return "ARMv7-M"
+	case ArchitectureARMv7EM:
+		return "ARMv7E-M"
+	case ArchitectureARMv8MBaseline:
+		return "ARMv8-M Baseline"
+	case ArchitectureARMv8MMainline:
+		return "ARMv8-M Mainline"
+	case ArchitectureARMv81MMainline:
+		return "ARMv8.1-M Mainline"
+	default:
+		return "unknown"
+	}
+}
+
+// Baseline reports whether the architecture lacks the mainline extensions,
+// such as the fault status registers and FPU.
+func (a Architecture) Baseline() bool {
+	return a == ArchitectureARMv6M || a == ArchitectureARMv8MBaseline
+}
+
+// ARMv8M reports whether the architecture is any of the ARMv8-M profiles.
+func (a Architecture) ARMv8M() bool {
+	return a == ArchitectureARMv8MBaseline ||
+		a == ArchitectureARMv8MMainline ||
+		a == ArchitectureARMv81MMainline
+}
+
+const (
+	mvfr0SinglePrecisionMask = 0xf << 4
+	mvfr0DoublePrecisionMask = 0xf << 8
+
+	mpuTypeDRegionShift = 8
+	mpuTypeDRegionMask  = 0xff << mpuTypeDRegionShift
+
+	pfr1SecurityShift = 4
+	pfr1SecurityMask  = 0xf << pfr1SecurityShift
+)
+
+// Identity describes the core type and its optional features.
+type Identity struct {
+	CPUID        CPUID
+	Core         Core
+	Architecture Architecture
+
+	FPU                bool
+	DoublePrecisionFPU bool
+	MPU                bool
+	MPURegions         int
+	TrustZone          bool
+}
+
+func (id *Identity) String() string {
+	parts := []string{
+		fmt.Sprintf("%s (%s)", id.CPUID, id.Architecture),
+	}
+
+	if id.FPU {
+		if id.DoublePrecisionFPU {
+			parts = append(parts, "FPU (double precision)")
+		} else {
+			parts = append(parts, "FPU")
+		}
+	}
+
+	if id.MPU {
+		parts = append(parts, fmt.Sprintf("MPU (%d regions)", id.MPURegions))
+	}
+
+	if id.TrustZone {
+		parts = append(parts, "TrustZone")
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (scb *SystemControlBlock) ReadCPUID() (CPUID, error) {
+	reg, err := scb.swd.ReadRegister(regCPUID)
+	if err != nil {
+		return 0, err
+	}
+
+	return CPUID(reg), nil
+}
+
+// Identify reads CPUID and the feature registers to determine the core type and
+// which of the optional FPU, MPU and Security Extension are implemented.
+func (scb *SystemControlBlock) Identify() (*Identity, error) {
+	cpuid, err := scb.ReadCPUID()
+	if err != nil {
+		return nil, fmt.Errorf("read CPUID: %w", err)
+	}
+
+	id := &Identity{
+		CPUID:        cpuid,
+		Core:         cpuid.Core(),
+		Architecture: cpuid.Core().Architecture(),
+	}
+
+	mpuType, err := scb.swd.ReadRegister(regMPU)
+	if err != nil {
+		return nil, fmt.Errorf("read MPU_TYPE: %w", err)
+	}
+
+	id.MPURegions = int((mpuType & mpuTypeDRegionMask) >> mpuTypeDRegionShift)
+	id.MPU = id.MPURegions > 0
+
+	// The media and FP feature registers are not implemented on baseline cores
+	if !id.Architecture.Baseline() {
+		mvfr0, err := scb.swd.ReadRegister(regMVFR0)
+		if err != nil {
+			return nil, fmt.Errorf("read MVFR0: %w", err)
+		}
+
+		id.FPU = mvfr0&mvfr0SinglePrecisionMask != 0
+		id.DoublePrecisionFPU = mvfr0&mvfr0DoublePrecisionMask != 0
+	}
+
+	if id.Architecture.ARMv8M() {
+		pfr1, err := scb.swd.ReadRegister(regPFR1)
+		if err != nil {
+			return nil, fmt.Errorf("read ID_PFR1: %w", err)
+		}
+
+		id.TrustZone = (pfr1&pfr1SecurityMask)>>pfr1SecurityShift != 0
+	}
+
+	return id, nil
+}
@@ -0,0 +1,121 @@
+package systemcontrolblock_test
+
+import (
+	"testing"
+
+	"github.com/holoplot/go-swd/pkg/io/sim"
+	"github.com/holoplot/go-swd/pkg/swd"
+	scb "github.com/holoplot/go-swd/pkg/system-control-block"
+)
+
+const (
+	regCPUID = 0xe000ed00
+	regPFR1  = 0xe000ed44
+	regMPU   = 0xe000ed90
+	regMVFR0 = 0xe000ef40
+)
+
+func TestCPUID_Core(t *testing.T) {
+	tests := []struct {
+		name  string
+		cpuid scb.CPUID
+		core  scb.Core
+		arch  scb.Architecture
+		want  string
+	}{
+		{"M0", 0x410cc200, scb.CoreCortexM0, scb.ArchitectureARMv6M, "Cortex-M0 r0p0"},
+		{"M0+", 0x410cc601, scb.CoreCortexM0Plus, scb.ArchitectureARMv6M, "Cortex-M0+ r0p1"},
+		{"M3", 0x412fc231, scb.CoreCortexM3, scb.ArchitectureARMv7M, "Cortex-M3 r2p1"},
+		{"M4", 0x410fc241, scb.CoreCortexM4, scb.ArchitectureARMv7EM, "Cortex-M4 r0p1"},
+		{"M7", 0x411fc272, scb.CoreCortexM7, scb.ArchitectureARMv7EM, "Cortex-M7 r1p2"},
+		{"M23", 0x410cd200, scb.CoreCortexM23, scb.ArchitectureARMv8MBaseline, "Cortex-M23 r0p0"},
+		{"M33", 0x410fd214, scb.CoreCortexM33, scb.ArchitectureARMv8MMainline, "Cortex-M33 r0p4"},
+		{"M55", 0x410fd220, scb.CoreCortexM55, scb.ArchitectureARMv81MMainline, "Cortex-M55 r0p0"},
+		{"unknown part", 0x410fc990, scb.CoreUnknown, scb.ArchitectureUnknown, "unknown r0p0"},
+		{"other implementer", 0x510fc241, scb.CoreUnknown, scb.ArchitectureUnknown, "unknown r0p1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cpuid.Core(); got != tt.core {
+				t.Errorf("CPUID.Core() = %s, want %s", got, tt.core)
+			}
+
+			if got := tt.cpuid.Core().Architecture(); got != tt.arch {
+				t.Errorf("Core.Architecture() = %s, want %s", got, tt.arch)
+			}
+
+			if got := tt.cpuid.String(); got != tt.want {
+				t.Errorf("CPUID.String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemControlBlock_Identify(t *testing.T) {
+	tests := []struct {
+		name                     string
+		cpuid, mpu, mvfr0, pfr1  uint32
+		fpu, doublePrecision, tz bool
+		regions                  int
+		want                     string
+	}{
+		{
+			name:  "M4 with FPU",
+			cpuid: 0x410fc241, mpu: 0x800, mvfr0: 0x10110021,
+			fpu: true, regions: 8,
+			want: "Cortex-M4 r0p1 (ARMv7E-M), FPU, MPU (8 regions)",
+		},
+		{
+			name:  "M7 with double precision FPU",
+			cpuid: 0x411fc272, mpu: 0x1000, mvfr0: 0x10110221,
+			fpu: true, doublePrecision: true, regions: 16,
+			want: "Cortex-M7 r1p2 (ARMv7E-M), FPU (double precision), MPU (16 regions)",
+		},
+		{
+			// MVFR0 is not implemented on baseline cores and not read
+			name:  "M0+ without MPU",
+			cpuid: 0x410cc601, mvfr0: 0x10110021,
+			want: "Cortex-M0+ r0p1 (ARMv6-M)",
+		},
+		{
+			name:  "M33 with TrustZone",
+			cpuid: 0x410fd214, mpu: 0x800, mvfr0: 0x10110021, pfr1: 0x10,
+			fpu: true, tz: true, regions: 8,
+			want: "Cortex-M33 r0p4 (ARMv8-M Mainline), FPU, MPU (8 regions), TrustZone",
+		},
+		{
+			// ID_PFR1 is only decoded on ARMv8-M
+			name:  "M4 ignores ID_PFR1",
+			cpuid: 0x410fc241, pfr1: 0x10,
+			want: "Cortex-M4 r0p1 (ARMv7E-M)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := sim.New()
+			target.WriteWord(regCPUID, tt.cpuid)
+			target.WriteWord(regMPU, tt.mpu)
+			target.WriteWord(regMVFR0, tt.mvfr0)
+			target.WriteWord(regPFR1, tt.pfr1)
+
+			id, err := scb.New(swd.New(target)).Identify()
+			if err != nil {
+				t.Fatalf("Identify() error = %v", err)
+			}
+
+			if id.FPU != tt.fpu || id.DoublePrecisionFPU != tt.doublePrecision || id.TrustZone != tt.tz {
+				t.Errorf("FPU %t, double precision %t, TrustZone %t", id.FPU, id.DoublePrecisionFPU, id.TrustZone)
+			}
+
+			if id.MPU != (tt.regions > 0) || id.MPURegions != tt.regions {
+				t.Errorf("MPU %t with %d regions, want %d", id.MPU, id.MPURegions, tt.regions)
+			}
+
+			if got := id.String(); got != tt.want {
+				t.Errorf("Identity.String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
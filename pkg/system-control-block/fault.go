@@ -0,0 +1,408 @@
+package systemcontrolblock
+
+import (
+	"fmt"
+	"strings"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+)
+
+// Configurable Fault Status Register, combining MMFSR, BFSR and UFSR
+type CFSR uint32
+
+const (
+	// MemManage Fault Status Register
+	CFSRIAccViol  CFSR = 1 << 0
+	CFSRDAccViol  CFSR = 1 << 1
+	CFSRMUnstkErr CFSR = 1 << 3
+	CFSRMStkErr   CFSR = 1 << 4
+	CFSRMLSPErr   CFSR = 1 << 5
+	CFSRMMARValid CFSR = 1 << 7
+
+	// BusFault Status Register
+	CFSRIBusErr      CFSR = 1 << 8
+	CFSRPreciseErr   CFSR = 1 << 9
+	CFSRImpreciseErr CFSR = 1 << 10
+	CFSRUnstkErr     CFSR = 1 << 11
+	CFSRStkErr       CFSR = 1 << 12
+	CFSRLSPErr       CFSR = 1 << 13
+	CFSRBFARValid    CFSR = 1 << 15
+
+	// UsageFault Status Register
+	CFSRUndefInstr CFSR = 1 << 16
+	CFSRInvState   CFSR = 1 << 17
+	CFSRInvPC      CFSR = 1 << 18
+	CFSRNoCP       CFSR = 1 << 19
+	CFSRStkOf      CFSR = 1 << 20
+	CFSRUnaligned  CFSR = 1 << 24
+	CFSRDivByZero  CFSR = 1 << 25
+)
+
+// HardFault Status Register
+type HFSR uint32
+
+const (
+	HFSRVectTbl  HFSR = 1 << 1
+	HFSRForced   HFSR = 1 << 30
+	HFSRDebugEvt HFSR = 1 << 31
+)
+
+// Debug Fault Status Register
+type DFSR uint32
+
+const (
+	DFSRHalted   DFSR = 1 << 0
+	DFSRBkpt     DFSR = 1 << 1
+	DFSRDWTTrap  DFSR = 1 << 2
+	DFSRVCatch   DFSR = 1 << 3
+	DFSRExternal DFSR = 1 << 4
+)
+
+const (
+	excReturnMask         = 0xff000000
+	excReturnProcessStack = 1 << 2
+	excReturnBasicFrame   = 1 << 4
+
+	xpsrStackAligned = 1 << 9
+
+	basicFrameSize    = 8 * 4
+	extendedFrameSize = 26 * 4
+)
+
+// ExceptionFrame is the register context the core pushed to the stack on exception entry.
+type ExceptionFrame struct {
+	// Address of the frame on the stack
+	Address uint32
+
+	// EXC_RETURN value found in LR
+	ExcReturn uint32
+
+	// Frame was pushed to the process stack (PSP) rather than the main stack (MSP)
+	ProcessStack bool
+
+	// Frame includes the floating point context
+	Extended bool
+
+	R0, R1, R2, R3, R12, LR, PC, XPSR uint32
+}
+
+// CallerSP returns the value of the stack pointer before the exception was taken.
+func (ef *ExceptionFrame) CallerSP() uint32 {
+	sp := ef.Address + basicFrameSize
+
+	if ef.Extended {
+		sp = ef.Address + extendedFrameSize
+	}
+
+	if ef.XPSR&xpsrStackAligned != 0 {
+		sp += 4
+	}
+
+	return sp
+}
+
+func (ef *ExceptionFrame) String() string {
+	stack := "MSP"
+	if ef.ProcessStack {
+		stack = "PSP"
+	}
+
+	return fmt.Sprintf("frame on %s at 0x%08x: r0=0x%08x r1=0x%08x r2=0x%08x r3=0x%08x r12=0x%08x lr=0x%08x pc=0x%08x xpsr=0x%08x",
+		stack, ef.Address, ef.R0, ef.R1, ef.R2, ef.R3, ef.R12, ef.LR, ef.PC, ef.XPSR)
+}
+
+// Fault is a snapshot of the fault status registers, and the stacked exception
+// frame if it could be located.
+type Fault struct {
+	CFSR  CFSR
+	HFSR  HFSR
+	DFSR  DFSR
+	MMFAR uint32
+	BFAR  uint32
+	AFSR  uint32
+
+	Frame *ExceptionFrame
+}
+
+// Causes returns a human readable description for every fault condition flagged in the status registers.
+func (f *Fault) Causes() []string {
+	var causes []string
+
+	add := func(format string, args ...any) {
+		causes = append(causes, fmt.Sprintf(format, args...))
+	}
+
+	if f.HFSR&HFSRVectTbl != 0 {
+		add("bus fault on vector table read (VECTTBL)")
+	}
+
+	if f.HFSR&HFSRForced != 0 {
+		add("configurable fault escalated to hard fault (FORCED)")
+	}
+
+	if f.HFSR&HFSRDebugEvt != 0 {
+		add("debug event while debugging was disabled (DEBUGEVT)")
+	}
+
+	if f.CFSR&CFSRIAccViol != 0 {
+		add("instruction access violation (IACCVIOL)")
+	}
+
+	if f.CFSR&CFSRDAccViol != 0 {
+		if f.CFSR&CFSRMMARValid != 0 {
+			add("data access violation at 0x%08x (DACCVIOL)", f.MMFAR)
+		} else {
+			add("data access violation, MMARVALID not set (DACCVIOL)")
+		}
+	}
+
+	if f.CFSR&CFSRMUnstkErr != 0 {
+		add("memory management fault on unstacking for exception return (MUNSTKERR)")
+	}
+
+	if f.CFSR&CFSRMStkErr != 0 {
+		add("memory management fault on stacking for exception entry (MSTKERR)")
+	}
+
+	if f.CFSR&CFSRMLSPErr != 0 {
+		add("memory management fault during lazy floating point state preservation (MLSPERR)")
+	}
+
+	if f.CFSR&CFSRIBusErr != 0 {
+		add("instruction bus error (IBUSERR)")
+	}
+
+	if f.CFSR&CFSRPreciseErr != 0 {
+		imprecise := "IMPRECISERR not set"
+		if f.CFSR&CFSRImpreciseErr != 0 {
+			imprecise = "IMPRECISERR also set"
+		}
+
+		if f.CFSR&CFSRBFARValid != 0 {
+			add("precise bus fault at 0x%08x, %s (PRECISERR)", f.BFAR, imprecise)
+		} else {
+			add("precise bus fault, BFARVALID not set, %s (PRECISERR)", imprecise)
+		}
+	} else if f.CFSR&CFSRImpreciseErr != 0 {
+		add("imprecise bus fault, faulting address unknown (IMPRECISERR)")
+	}
+
+	if f.CFSR&CFSRUnstkErr != 0 {
+		add("bus fault on unstacking for exception return (UNSTKERR)")
+	}
+
+	if f.CFSR&CFSRStkErr != 0 {
+		add("bus fault on stacking for exception entry (STKERR)")
+	}
+
+	if f.CFSR&CFSRLSPErr != 0 {
+		add("bus fault during lazy floating point state preservation (LSPERR)")
+	}
+
+	if f.CFSR&CFSRUndefInstr != 0 {
+		add("undefined instruction (UNDEFINSTR)")
+	}
+
+	if f.CFSR&CFSRInvState != 0 {
+		add("invalid execution state, EPSR.T not set (INVSTATE)")
+	}
+
+	if f.CFSR&CFSRInvPC != 0 {
+		add("invalid PC load on exception return (INVPC)")
+	}
+
+	if f.CFSR&CFSRNoCP != 0 {
+		add("coprocessor access while disabled or not present (NOCP)")
+	}
+
+	if f.CFSR&CFSRStkOf != 0 {
+		add("stack overflow (STKOF)")
+	}
+
+	if f.CFSR&CFSRUnaligned != 0 {
+		add("unaligned memory access (UNALIGNED)")
+	}
+
+	if f.CFSR&CFSRDivByZero != 0 {
+		add("division by zero (DIVBYZERO)")
+	}
+
+	if f.DFSR&DFSRHalted != 0 {
+		add("halted by debugger request or step (HALTED)")
+	}
+
+	if f.DFSR&DFSRBkpt != 0 {
+		add("breakpoint (BKPT)")
+	}
+
+	if f.DFSR&DFSRDWTTrap != 0 {
+		add("watchpoint (DWTTRAP)")
+	}
+
+	if f.DFSR&DFSRVCatch != 0 {
+		add("vector catch (VCATCH)")
+	}
+
+	if f.DFSR&DFSRExternal != 0 {
+		add("external debug request (EXTERNAL)")
+	}
+
+	return causes
+}
+
+func (f *Fault) String() string {
+	lines := f.Causes()
+
+	if len(lines) == 0 {
+		lines = append(lines, "no fault flagged")
+	}
+
+	lines = append(lines, fmt.Sprintf("CFSR=0x%08x HFSR=0x%08x DFSR=0x%08x MMFAR=0x%08x BFAR=0x%08x AFSR=0x%08x",
+		uint32(f.CFSR), uint32(f.HFSR), uint32(f.DFSR), f.MMFAR, f.BFAR, f.AFSR))
+
+	if f.Frame != nil {
+		lines = append(lines, f.Frame.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (scb *SystemControlBlock) ReadCFSR() (CFSR, error) {
+	reg, err := scb.swd.ReadRegister(regCFSR)
+	if err != nil {
+		return 0, err
+	}
+
+	return CFSR(reg), nil
+}
+
+func (scb *SystemControlBlock) ReadHFSR() (HFSR, error) {
+	reg, err := scb.swd.ReadRegister(regHFSR)
+	if err != nil {
+		return 0, err
+	}
+
+	return HFSR(reg), nil
+}
+
+func (scb *SystemControlBlock) ReadDFSR() (DFSR, error) {
+	reg, err := scb.swd.ReadRegister(regDFSR)
+	if err != nil {
+		return 0, err
+	}
+
+	return DFSR(reg), nil
+}
+
+// ReadFaultStatus reads all fault status and address registers.
+func (scb *SystemControlBlock) ReadFaultStatus() (*Fault, error) {
+	f := &Fault{}
+
+	regs := []struct {
+		addr uint32
+		val  *uint32
+	}{
+		{regCFSR, (*uint32)(&f.CFSR)},
+		{regHFSR, (*uint32)(&f.HFSR)},
+		{regDFSR, (*uint32)(&f.DFSR)},
+		{regMMFAR, &f.MMFAR},
+		{regBFAR, &f.BFAR},
+		{regAFSR, &f.AFSR},
+	}
+
+	for _, r := range regs {
+		v, err := scb.swd.ReadRegister(r.addr)
+		if err != nil {
+			return nil, fmt.Errorf("read 0x%08x: %w", r.addr, err)
+		}
+
+		*r.val = v
+	}
+
+	return f, nil
+}
+
+// ClearDFSR clears the sticky debug event flags in DFSR.
+func (scb *SystemControlBlock) ClearDFSR() error {
+	return scb.swd.WriteRegister(regDFSR, uint32(DFSRHalted|DFSRBkpt|DFSRDWTTrap|DFSRVCatch|DFSRExternal))
+}
+
+// ClearFaultStatus clears all sticky bits in CFSR, HFSR and DFSR.
+func (scb *SystemControlBlock) ClearFaultStatus() error {
+	for _, addr := range []uint32{regCFSR, regHFSR, regDFSR} {
+		if err := scb.swd.WriteRegister(addr, 0xffffffff); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsExcReturn reports whether the value is an EXC_RETURN magic value as found in LR
+// in an exception handler.
+func IsExcReturn(v uint32) bool {
+	return v&excReturnMask == excReturnMask
+}
+
+// ReadStackedFrame reads the exception frame at addr, interpreting its layout with the
+// given EXC_RETURN value.
+func (scb *SystemControlBlock) ReadStackedFrame(addr, excReturn uint32) (*ExceptionFrame, error) {
+	ef := &ExceptionFrame{
+		Address:      addr,
+		ExcReturn:    excReturn,
+		ProcessStack: excReturn&excReturnProcessStack != 0,
+		Extended:     excReturn&excReturnBasicFrame == 0,
+	}
+
+	for i, v := range []*uint32{&ef.R0, &ef.R1, &ef.R2, &ef.R3, &ef.R12, &ef.LR, &ef.PC, &ef.XPSR} {
+		var err error
+
+		if *v, err = scb.swd.ReadRegister(addr + uint32(i)*4); err != nil {
+			return nil, fmt.Errorf("read stacked frame: %w", err)
+		}
+	}
+
+	return ef, nil
+}
+
+// ReadExceptionFrame locates and reads the stacked exception frame.
+// The core must be halted in an exception handler before it modified LR, which is the
+// case when it was stopped by a vector catch. If LR does not hold an EXC_RETURN value,
+// nil is returned.
+func (scb *SystemControlBlock) ReadExceptionFrame(core *cd.CoreDebug) (*ExceptionFrame, error) {
+	lr, err := core.ReadCoreRegister(cd.CoreRegisterLR)
+	if err != nil {
+		return nil, err
+	}
+
+	if !IsExcReturn(lr) {
+		return nil, nil
+	}
+
+	sp := cd.CoreRegisterMSP
+	if lr&excReturnProcessStack != 0 {
+		sp = cd.CoreRegisterPSP
+	}
+
+	addr, err := core.ReadCoreRegister(sp)
+	if err != nil {
+		return nil, err
+	}
+
+	return scb.ReadStackedFrame(addr, lr)
+}
+
+// AnalyzeFault reads the fault status registers and the stacked exception frame
+// of a halted core.
+func (scb *SystemControlBlock) AnalyzeFault(core *cd.CoreDebug) (*Fault, error) {
+	f, err := scb.ReadFaultStatus()
+	if err != nil {
+		return nil, fmt.Errorf("read fault status: %w", err)
+	}
+
+	if f.Frame, err = scb.ReadExceptionFrame(core); err != nil {
+		return nil, fmt.Errorf("read exception frame: %w", err)
+	}
+
+	return f, nil
+}
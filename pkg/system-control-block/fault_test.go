@@ -0,0 +1,82 @@
+package systemcontrolblock
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFault_Causes(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault Fault
+		want  []string
+	}{
+		{
+			name:  "none",
+			fault: Fault{},
+			want:  nil,
+		},
+		{
+			name: "precise bus fault",
+			fault: Fault{
+				CFSR: CFSRPreciseErr | CFSRBFARValid,
+				HFSR: HFSRForced,
+				BFAR: 0x40023c14,
+			},
+			want: []string{
+				"configurable fault escalated to hard fault (FORCED)",
+				"precise bus fault at 0x40023c14, IMPRECISERR not set (PRECISERR)",
+			},
+		},
+		{
+			name: "data access violation without address",
+			fault: Fault{
+				CFSR: CFSRDAccViol | CFSRDivByZero,
+			},
+			want: []string{
+				"data access violation, MMARVALID not set (DACCVIOL)",
+				"division by zero (DIVBYZERO)",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fault.Causes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Fault.Causes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExceptionFrame_CallerSP(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame ExceptionFrame
+		want  uint32
+	}{
+		{
+			name:  "basic",
+			frame: ExceptionFrame{Address: 0x20001000},
+			want:  0x20001020,
+		},
+		{
+			name:  "basic aligned",
+			frame: ExceptionFrame{Address: 0x20001000, XPSR: 1 << 9},
+			want:  0x20001024,
+		},
+		{
+			name:  "extended",
+			frame: ExceptionFrame{Address: 0x20001000, Extended: true},
+			want:  0x20001068,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.frame.CallerSP(); got != tt.want {
+				t.Errorf("ExceptionFrame.CallerSP() = 0x%08x, want 0x%08x", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,15 +1,98 @@
 package systemcontrolblock
 
-import "github.com/holoplot/go-swd/pkg/swd"
+import (
+	"time"
+
+	cd "github.com/holoplot/go-swd/pkg/core-debug"
+	"github.com/holoplot/go-swd/pkg/swd"
+)
 
 type SystemControlBlock struct {
 	swd *swd.SWD
 }
 
 const (
+	resetTimeout = time.Second
+
 	baseAddress = 0xe000ed00
 
+	regCPUID = baseAddress + 0x0
+	regICSR  = baseAddress + 0x4
+	regVTOR  = baseAddress + 0x8
 	regAIRCR = baseAddress + 0xc
+	regCCR   = baseAddress + 0x14
+	regSHCSR = baseAddress + 0x24
+	regCFSR  = baseAddress + 0x28
+	regHFSR  = baseAddress + 0x2c
+	regDFSR  = baseAddress + 0x30
+	regMMFAR = baseAddress + 0x34
+	regBFAR  = baseAddress + 0x38
+	regAFSR  = baseAddress + 0x3c
+	regPFR1  = baseAddress + 0x44
+	regMPU   = baseAddress + 0x90
+	regMVFR0 = baseAddress + 0x240
+)
+
+// Interrupt Control and State Register
+type ICSR uint32
+
+const (
+	ICSRVectActiveMask   ICSR = 0x1ff
+	ICSRRetToBase        ICSR = 1 << 11
+	ICSRVectPendingShift      = 12
+	ICSRVectPendingMask  ICSR = 0x1ff << ICSRVectPendingShift
+	ICSRIsrPending       ICSR = 1 << 22
+	ICSRIsrPreempt       ICSR = 1 << 23
+	ICSRPendSysTickClear ICSR = 1 << 25
+	ICSRPendSysTickSet   ICSR = 1 << 26
+	ICSRPendSVClear      ICSR = 1 << 27
+	ICSRPendSVSet        ICSR = 1 << 28
+	ICSRNMIPendSet       ICSR = 1 << 31
+)
+
+// VectActive returns the exception number of the currently active exception, or 0 in thread mode.
+func (icsr ICSR) VectActive() uint16 {
+	return uint16(icsr & ICSRVectActiveMask)
+}
+
+// VectPending returns the exception number of the highest priority pending exception.
+func (icsr ICSR) VectPending() uint16 {
+	return uint16((icsr & ICSRVectPendingMask) >> ICSRVectPendingShift)
+}
+
+// Configuration and Control Register
+type CCR uint32
+
+const (
+	CCRNonBaseThreadEnable CCR = 1 << 0
+	CCRUserSetMPend        CCR = 1 << 1
+	CCRUnalignTrap         CCR = 1 << 3
+	CCRDiv0Trap            CCR = 1 << 4
+	CCRBFHFNMIgnore        CCR = 1 << 8
+	CCRStackAlign          CCR = 1 << 9
+	CCRDataCache           CCR = 1 << 16
+	CCRInstructionCache    CCR = 1 << 17
+	CCRBranchPrediction    CCR = 1 << 18
+)
+
+// System Handler Control and State Register
+type SHCSR uint32
+
+const (
+	SHCSRMemFaultAct    SHCSR = 1 << 0
+	SHCSRBusFaultAct    SHCSR = 1 << 1
+	SHCSRUsgFaultAct    SHCSR = 1 << 3
+	SHCSRSVCallAct      SHCSR = 1 << 7
+	SHCSRMonitorAct     SHCSR = 1 << 8
+	SHCSRPendSVAct      SHCSR = 1 << 10
+	SHCSRSysTickAct     SHCSR = 1 << 11
+	SHCSRUsgFaultPended SHCSR = 1 << 12
+	SHCSRMemFaultPended SHCSR = 1 << 13
+	SHCSRBusFaultPended SHCSR = 1 << 14
+	SHCSRSVCallPended   SHCSR = 1 << 15
+	SHCSRMemFaultEnable SHCSR = 1 << 16
+	SHCSRBusFaultEnable SHCSR = 1 << 17
+	SHCSRUsgFaultEnable SHCSR = 1 << 18
 )
 
 type AIRCR uint32
@@ -39,10 +122,102 @@ func (cd *SystemControlBlock) WriteAIRCR(aircr AIRCR) error {
 	return cd.swd.WriteRegister(regAIRCR, uint32(aircr))
 }
 
+func (scb *SystemControlBlock) ReadICSR() (ICSR, error) {
+	reg, err := scb.swd.ReadRegister(regICSR)
+	if err != nil {
+		return 0, err
+	}
+
+	return ICSR(reg), nil
+}
+
+func (scb *SystemControlBlock) WriteICSR(icsr ICSR) error {
+	return scb.swd.WriteRegister(regICSR, uint32(icsr))
+}
+
+// ReadVTOR returns the vector table offset.
+func (scb *SystemControlBlock) ReadVTOR() (uint32, error) {
+	return scb.swd.ReadRegister(regVTOR)
+}
+
+func (scb *SystemControlBlock) WriteVTOR(vtor uint32) error {
+	return scb.swd.WriteRegister(regVTOR, vtor)
+}
+
+func (scb *SystemControlBlock) ReadCCR() (CCR, error) {
+	reg, err := scb.swd.ReadRegister(regCCR)
+	if err != nil {
+		return 0, err
+	}
+
+	return CCR(reg), nil
+}
+
+func (scb *SystemControlBlock) WriteCCR(ccr CCR) error {
+	return scb.swd.WriteRegister(regCCR, uint32(ccr))
+}
+
+func (scb *SystemControlBlock) ReadSHCSR() (SHCSR, error) {
+	reg, err := scb.swd.ReadRegister(regSHCSR)
+	if err != nil {
+		return 0, err
+	}
+
+	return SHCSR(reg), nil
+}
+
+func (scb *SystemControlBlock) WriteSHCSR(shcsr SHCSR) error {
+	return scb.swd.WriteRegister(regSHCSR, uint32(shcsr))
+}
+
 func (scb *SystemControlBlock) ResetSystem() error {
 	return scb.WriteAIRCR(AIRCRVectKeyStat | AIRCRSysResetReq)
 }
 
+// ResetAndHalt resets the system with the core reset vector catch enabled, so the
+// core halts before executing the first instruction.
+func (scb *SystemControlBlock) ResetAndHalt(core *cd.CoreDebug) error {
+	if err := core.WriteDHCSR(cd.DHCSRDebugKey | cd.DHCSRCDebugEn); err != nil {
+		return err
+	}
+
+	demcr, err := core.ReadDEMCR()
+	if err != nil {
+		return err
+	}
+
+	if err := core.WriteDEMCR(demcr | cd.DEMCRVcCoreReset); err != nil {
+		return err
+	}
+
+	if err := scb.ResetSystem(); err != nil {
+		return err
+	}
+
+	for start := time.Now(); ; {
+		dhcsr, err := core.ReadDHCSR()
+		if err != nil {
+			return err
+		}
+
+		if dhcsr&cd.DHCSRSHalt != 0 {
+			break
+		}
+
+		if time.Since(start) > resetTimeout {
+			return cd.ErrTimeout
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := core.WriteDEMCR(demcr); err != nil {
+		return err
+	}
+
+	return scb.ClearDFSR()
+}
+
 func New(swd *swd.SWD) *SystemControlBlock {
 	return &SystemControlBlock{
 		swd: swd,